@@ -0,0 +1,209 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+const (
+	// apiKeyPrefix starts every API key, which tells them apart from JWTs
+	apiKeyPrefix      = "tx_"
+	maxAPIKeysPerUser = 25
+	maxAPIKeyDays     = 3650
+	// apiKeyUseInterval throttles the last_used_at writes of busy keys
+	apiKeyUseInterval = time.Minute
+)
+
+// apiKeyScopes are what a key can be limited to. A key never gets more than its
+// owner's role allows.
+var apiKeyScopes = map[string]Permission{
+	"read_clips": PermViewClips,
+	"telemetry":  PermViewLocation,
+	"export":     PermExport,
+}
+
+var errInvalidAPIKey = errors.New("invalid API key")
+
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// authenticateAPIKey finds the key and its owner, recording when it was used
+func authenticateAPIKey(token string) (*models.APIKey, *models.User, error) {
+	if database.DB == nil {
+		return nil, nil, errInvalidAPIKey
+	}
+	var key models.APIKey
+	if err := database.DB.Where("key_hash = ?", hashSecret(token)).First(&key).Error; err != nil {
+		return nil, nil, errInvalidAPIKey
+	}
+	now := time.Now()
+	if key.ExpiresAt != nil && now.After(*key.ExpiresAt) {
+		return nil, nil, errInvalidAPIKey
+	}
+	var user models.User
+	if err := database.DB.First(&user, key.UserID).Error; err != nil {
+		return nil, nil, errInvalidAPIKey
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyUseInterval {
+		database.DB.Model(&key).UpdateColumn("last_used_at", &now)
+	}
+	return &key, &user, nil
+}
+
+// apiKeyAllows reports whether one of key's scopes grants perm
+func apiKeyAllows(key *models.APIKey, perm Permission) bool {
+	for _, scope := range strings.Split(key.Scopes, ",") {
+		if apiKeyScopes[scope] == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func currentAPIKey(c *gin.Context) *models.APIKey {
+	v, _ := c.Get("api_key")
+	key, _ := v.(*models.APIKey)
+	return key
+}
+
+// RequireSession keeps API keys away from account routes: changing passwords,
+// sessions and keys needs a login
+func RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if currentAPIKey(c) != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API keys can't be used for this"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// --- Handlers ---
+
+// listAPIKeys returns the caller's keys, without the keys themselves
+func listAPIKeys(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authentication is disabled"})
+		return
+	}
+	var keys []models.APIKey
+	if err := database.DB.Where("user_id = ?", user.ID).Order("created_at desc").Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// createAPIKey issues a key for the caller. The key is only ever returned here.
+func createAPIKey(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authentication is disabled"})
+		return
+	}
+	var req struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"` // 0 = never
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name must be 1-64 characters"})
+		return
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxAPIKeyDays {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expires_in_days must be between 0 and %d", maxAPIKeyDays)})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scopes is required (read_clips, telemetry, export)"})
+		return
+	}
+	seen := map[string]bool{}
+	var scopes []string
+	for _, scope := range req.Scopes {
+		perm, ok := apiKeyScopes[scope]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown scope %q", scope)})
+			return
+		}
+		if !roleHas(user.Role, perm) {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Your account can't grant the %s scope", scope)})
+			return
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+
+	var count int
+	database.DB.Model(&models.APIKey{}).Where("user_id = ?", user.ID).Count(&count)
+	if count >= maxAPIKeysPerUser {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("You already have %d API keys; revoke one first", maxAPIKeysPerUser)})
+		return
+	}
+
+	secret, err := randomBytes(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	token := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	key := models.APIKey{
+		UserID:  user.ID,
+		Name:    req.Name,
+		Prefix:  token[:len(apiKeyPrefix)+8],
+		KeyHash: hashSecret(token),
+		Scopes:  strings.Join(scopes, ","),
+	}
+	if req.ExpiresInDays > 0 {
+		expires := time.Now().Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour)
+		key.ExpiresAt = &expires
+	}
+	if err := database.DB.Create(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	audit(c, models.AuditEvent{Action: AuditAPIKeyCreate, Detail: fmt.Sprintf("%q (%s), scopes %s", key.Name, key.Prefix, key.Scopes)})
+	c.JSON(http.StatusCreated, struct {
+		models.APIKey
+		Key string `json:"key"`
+	}{key, token})
+}
+
+// deleteAPIKey revokes one of the caller's keys
+func deleteAPIKey(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authentication is disabled"})
+		return
+	}
+	var key models.APIKey
+	if err := database.DB.Where("id = ? AND user_id = ?", c.Param("id"), user.ID).First(&key).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if err := database.DB.Delete(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	audit(c, models.AuditEvent{Action: AuditAPIKeyRevoke, Detail: fmt.Sprintf("%q (%s)", key.Name, key.Prefix)})
+	c.Status(http.StatusNoContent)
+}
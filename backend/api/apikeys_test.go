@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+type createdKey struct {
+	ID         uint       `json:"id"`
+	Key        string     `json:"key"`
+	Prefix     string     `json:"prefix"`
+	Scopes     string     `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func createKey(t *testing.T, r *gin.Engine, token string, body map[string]interface{}) createdKey {
+	w := sendJSON(r, "POST", "/api/keys", token, body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Creating API key failed: %d %s", w.Code, w.Body.String())
+	}
+	var key createdKey
+	json.Unmarshal(w.Body.Bytes(), &key)
+	return key
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	r, _ := setupShareTest(t)
+	token := tokenFor(t, "eve", RoleExporter)
+	key := createKey(t, r, token, map[string]interface{}{"name": "Home Assistant", "scopes": []string{"read_clips", "read_clips"}})
+	assert.True(t, strings.HasPrefix(key.Key, "tx_"))
+	assert.True(t, strings.HasPrefix(key.Key, key.Prefix))
+	assert.Equal(t, "read_clips", key.Scopes)
+	assert.Nil(t, key.ExpiresAt)
+
+	// The key works as a Bearer token, within its scopes
+	assert.Equal(t, http.StatusOK, sendJSON(r, "GET", "/api/clips", key.Key, nil).Code)
+	assert.Equal(t, http.StatusForbidden, sendJSON(r, "GET", "/api/exports", key.Key, nil).Code)
+	w := sendJSON(r, "GET", "/api/me", key.Key, nil)
+	assert.Contains(t, w.Body.String(), `"permissions":["view_clips"]`)
+
+	// Listing shows when it was used but never the key or its hash
+	w = sendJSON(r, "GET", "/api/keys", token, nil)
+	assert.NotContains(t, w.Body.String(), key.Key)
+	assert.NotContains(t, w.Body.String(), hashSecret(key.Key))
+	var keys []createdKey
+	json.Unmarshal(w.Body.Bytes(), &keys)
+	if len(keys) != 1 || keys[0].LastUsedAt == nil {
+		t.Fatalf("Expected one used key, got %s", w.Body.String())
+	}
+
+	// Keys of other users can't be revoked
+	other := tokenFor(t, "vic", RoleViewer)
+	url := fmt.Sprintf("/api/keys/%d", key.ID)
+	assert.Equal(t, http.StatusNotFound, sendJSON(r, "DELETE", url, other, nil).Code)
+	assert.Equal(t, http.StatusNoContent, sendJSON(r, "DELETE", url, token, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(r, "GET", "/api/clips", key.Key, nil).Code)
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	r, _ := setupShareTest(t)
+	admin, _ := generateToken("admin", RoleAdmin, adminSession)
+	viewer := tokenFor(t, "vic", RoleViewer)
+
+	for _, tt := range []struct {
+		token string
+		body  map[string]interface{}
+		code  int
+	}{
+		{viewer, map[string]interface{}{"name": "cron", "scopes": []string{"export"}}, http.StatusForbidden},
+		{viewer, map[string]interface{}{"name": "cron", "scopes": []string{"manage_users"}}, http.StatusBadRequest},
+		{viewer, map[string]interface{}{"name": "cron", "scopes": []string{}}, http.StatusBadRequest},
+		{viewer, map[string]interface{}{"name": "", "scopes": []string{"read_clips"}}, http.StatusBadRequest},
+		{viewer, map[string]interface{}{"name": "cron", "scopes": []string{"read_clips"}, "expires_in_days": -1}, http.StatusBadRequest},
+	} {
+		assert.Equal(t, tt.code, sendJSON(r, "POST", "/api/keys", tt.token, tt.body).Code, tt.body)
+	}
+
+	// Even an admin's key can't manage users, rescan or touch accounts
+	key := createKey(t, r, admin, map[string]interface{}{"name": "all", "scopes": []string{"read_clips", "telemetry", "export"}})
+	assert.Equal(t, http.StatusOK, sendJSON(r, "GET", "/api/exports", key.Key, nil).Code)
+	for _, route := range []struct{ method, url string }{
+		{"GET", "/api/users"},
+		{"POST", "/api/rescan"},
+		{"POST", "/api/keys"},
+		{"GET", "/api/keys"},
+		{"GET", "/api/sessions"},
+		{"PUT", "/api/me/password"},
+		{"POST", "/api/logout/all"},
+		{"POST", "/api/media/sign"},
+	} {
+		if code := sendJSON(r, route.method, route.url, key.Key, nil).Code; code != http.StatusForbidden {
+			t.Errorf("%s %s with an API key = %d, want 403", route.method, route.url, code)
+		}
+	}
+
+	// A key never has more than its owner's current role
+	eve := tokenFor(t, "eve", RoleExporter)
+	exportKey := createKey(t, r, eve, map[string]interface{}{"name": "backup", "scopes": []string{"export"}})
+	assert.Equal(t, http.StatusOK, sendJSON(r, "GET", "/api/exports", exportKey.Key, nil).Code)
+	database.DB.Model(&models.User{}).Where("username = ?", "eve").Update("role", RoleViewer)
+	assert.Equal(t, http.StatusForbidden, sendJSON(r, "GET", "/api/exports", exportKey.Key, nil).Code)
+}
+
+func TestAPIKeyExpiry(t *testing.T) {
+	r, _ := setupShareTest(t)
+	token := tokenFor(t, "vic", RoleViewer)
+	key := createKey(t, r, token, map[string]interface{}{"name": "cron", "scopes": []string{"read_clips"}, "expires_in_days": 7})
+	if key.ExpiresAt == nil || key.ExpiresAt.Sub(time.Now()) > 7*24*time.Hour {
+		t.Fatalf("Expected the key to expire in a week, got %v", key.ExpiresAt)
+	}
+	assert.Equal(t, http.StatusOK, sendJSON(r, "GET", "/api/clips", key.Key, nil).Code)
+
+	database.DB.Model(&models.APIKey{}).Where("id = ?", key.ID).Update("expires_at", time.Now().Add(-time.Minute))
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(r, "GET", "/api/clips", key.Key, nil).Code)
+
+	// Made-up keys and keys of deleted users are rejected too
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(r, "GET", "/api/clips", "tx_not-a-key", nil).Code)
+	other := createKey(t, r, token, map[string]interface{}{"name": "ha", "scopes": []string{"read_clips"}})
+	var vic models.User
+	database.DB.Where("username = ?", "vic").First(&vic)
+	admin, _ := generateToken("admin", RoleAdmin, adminSession)
+	assert.Equal(t, http.StatusNoContent, sendJSON(r, "DELETE", fmt.Sprintf("/api/users/%d", vic.ID), admin, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(r, "GET", "/api/clips", other.Key, nil).Code)
+}
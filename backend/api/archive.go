@@ -0,0 +1,68 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"teslaxy/database"
+	"teslaxy/models"
+	"teslaxy/services"
+)
+
+// downloadArchive streams an original-footage bundle (chain-of-custody package) for a clip.
+//
+// Query params:
+//   - format: "zip" (default) or "tar"
+//   - from, to: optional RFC3339 window; only files overlapping it are included
+func downloadArchive(c *gin.Context) {
+	opts := services.ArchiveOptions{Format: c.DefaultQuery("format", services.ArchiveFormatZip)}
+	if opts.Format != services.ArchiveFormatZip && opts.Format != services.ArchiveFormatTar {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format"})
+		return
+	}
+
+	for param, dst := range map[string]**time.Time{"from": &opts.From, "to": &opts.To} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param + " parameter"})
+				return
+			}
+			*dst = &t
+		}
+	}
+	if opts.From != nil && opts.To != nil && !opts.To.After(*opts.From) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be after from"})
+		return
+	}
+
+	var clip models.Clip
+	if err := database.DB.Preload("VideoFiles").First(&clip, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Clip not found"})
+		return
+	}
+
+	if len(services.ArchiveFiles(clip, opts)) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No video files in the selected window"})
+		return
+	}
+	audit(c, models.AuditEvent{Action: AuditDownloadArchive, ClipID: clip.ID, Detail: opts.Format})
+
+	filename := fmt.Sprintf("teslaxy_%s_%d.%s", clip.Timestamp.Format("20060102_150405"), clip.ID, opts.Format)
+	contentType := "application/zip"
+	if opts.Format == services.ArchiveFormatTar {
+		contentType = "application/x-tar"
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Status(http.StatusOK)
+
+	// Headers are already sent; a failure here can only truncate the stream
+	if err := services.WriteClipArchive(c.Writer, clip, opts); err != nil {
+		log.Printf("Archive stream for clip %d failed: %v", clip.ID, err)
+	}
+}
@@ -0,0 +1,291 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+// Audit actions, stored in models.AuditEvent.Action
+const (
+	AuditLogin           = "login"
+	AuditLoginFailed     = "login_failed"
+	AuditLoginChallenge  = "login_challenge" // Password accepted, second factor pending
+	AuditLogout          = "logout"
+	AuditViewVideo       = "view_video"
+	AuditViewReport      = "view_report"
+	AuditViewFrame       = "view_frame"
+	AuditViewPreview     = "view_preview"
+	AuditViewStoryboard  = "view_storyboard"
+	AuditDownloadArchive = "download_archive"
+	AuditExportCreate    = "export_create"
+	AuditExportDownload  = "export_download"
+	AuditExportDelete    = "export_delete"
+	AuditShareCreate     = "share_create"
+	AuditShareRevoke     = "share_revoke"
+	AuditShareView       = "share_view"
+	AuditShareVideo      = "share_video"
+	AuditShareDownload   = "share_download"
+	AuditUserCreate      = "user_create"
+	AuditUserUpdate      = "user_update" // By an admin
+	AuditUserDelete      = "user_delete"
+	AuditPasswordChange  = "password_change"
+	AuditTOTPEnable      = "totp_enable"
+	AuditTOTPDisable     = "totp_disable"
+	AuditAPIKeyCreate    = "api_key_create"
+	AuditAPIKeyRevoke    = "api_key_revoke"
+	AuditOIDCLink        = "oidc_link"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+	// auditViewInterval keeps one view per viewer and video: players fetch a file in
+	// many range requests and reload playlists
+	auditViewInterval = 30 * time.Minute
+	auditPruneEvery   = 6 * time.Hour
+)
+
+var (
+	auditViewsLock sync.Mutex
+	auditViews     = map[string]time.Time{}
+
+	// auditCSVBatch is how many events a CSV download reads at a time
+	auditCSVBatch = 500
+)
+
+// auditRetention is how long audit events are kept (AUDIT_RETENTION_DAYS, default
+// 365, 0 keeps them forever)
+func auditRetention() time.Duration {
+	days := 365
+	if v, err := strconv.Atoi(os.Getenv("AUDIT_RETENTION_DAYS")); err == nil && v >= 0 {
+		days = v
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// audit records event for the request, filling in the caller and their address.
+// Without a database, or if the write fails, the event goes to the log instead.
+func audit(c *gin.Context, event models.AuditEvent) {
+	event.IP = c.ClientIP()
+	if event.Username == "" {
+		event.Username = currentUsername(c)
+	}
+	// Failed logins store whatever username was typed
+	if len(event.Username) > 128 {
+		event.Username = event.Username[:128]
+	}
+	if key := currentAPIKey(c); key != nil {
+		event.Detail = strings.TrimPrefix(event.Detail+"; API key "+key.Prefix, "; ")
+	}
+	if database.DB != nil {
+		// Fill in the clip of footage and exports, so it can be searched for
+		if event.ClipID == 0 && event.VideoFile != "" {
+			var vf models.VideoFile
+			if database.DB.Select("clip_id").Where("file_path = ?", event.VideoFile).First(&vf).Error == nil {
+				event.ClipID = vf.ClipID
+			}
+		}
+		if event.ClipID == 0 && event.ExportJobID != "" {
+			var job models.ExportJob
+			if database.DB.Select("clip_id").Where("job_id = ?", event.ExportJobID).First(&job).Error == nil {
+				event.ClipID = job.ClipID
+			}
+		}
+		err := database.DB.Create(&event).Error
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to record audit event: %v", err)
+	}
+	log.Printf("AUDIT: %s by %q from IP %s (clip %d, file %q, export %q, share %q) %s",
+		event.Action, event.Username, event.IP, event.ClipID, event.VideoFile, event.ExportJobID, event.ShareLinkID, event.Detail)
+}
+
+// auditView records that footage was watched, once per auditViewInterval for the
+// same viewer, address and video
+func auditView(c *gin.Context, event models.AuditEvent) {
+	now := time.Now()
+	key := strings.Join([]string{currentUsername(c), c.ClientIP(), event.Action, strconv.Itoa(int(event.ClipID)), event.VideoFile, event.ShareLinkID, event.Detail}, "|")
+
+	auditViewsLock.Lock()
+	if last, ok := auditViews[key]; ok && now.Sub(last) < auditViewInterval {
+		auditViewsLock.Unlock()
+		return
+	}
+	auditViews[key] = now
+	if len(auditViews) > 10000 {
+		for k, last := range auditViews {
+			if now.Sub(last) >= auditViewInterval {
+				delete(auditViews, k)
+			}
+		}
+	}
+	auditViewsLock.Unlock()
+
+	audit(c, event)
+}
+
+// pruneAuditEvents deletes events older than the retention period
+func pruneAuditEvents(now time.Time) {
+	retention := auditRetention()
+	if database.DB == nil || retention == 0 {
+		return
+	}
+	result := database.DB.Where("created_at < ?", now.Add(-retention)).Delete(&models.AuditEvent{})
+	if result.Error != nil {
+		log.Printf("Audit log pruning failed: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Pruned %d audit events older than %s", result.RowsAffected, retention)
+	}
+}
+
+// StartAuditPruner drops expired audit events in the background
+func StartAuditPruner() {
+	go func() {
+		for {
+			pruneAuditEvents(time.Now())
+			time.Sleep(auditPruneEvery)
+		}
+	}()
+}
+
+// listAuditEvents returns audit events, newest first, filtered by user, clip,
+// action and time range. With format=csv every match is downloaded as CSV.
+func listAuditEvents(c *gin.Context) {
+	query := database.DB.Model(&models.AuditEvent{})
+	if v := c.Query("user"); v != "" {
+		query = query.Where("username = ?", v)
+	}
+	if v := c.Query("action"); v != "" {
+		query = query.Where("action = ?", v)
+	}
+	if v := c.Query("clip_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid clip_id parameter"})
+			return
+		}
+		query = query.Where("clip_id = ?", id)
+	}
+	for param, cond := range map[string]string{"from": "created_at >= ?", "to": "created_at < ?"} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param + " parameter"})
+				return
+			}
+			// Timestamps are stored in local time and compared as text
+			query = query.Where(cond, t.Local())
+		}
+	}
+	query = query.Order("created_at desc, id desc")
+
+	if c.Query("format") == "csv" {
+		writeAuditCSV(c, query)
+		return
+	}
+
+	limit, offset := defaultAuditLimit, 0
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxAuditLimit)})
+			return
+		}
+		limit = n
+	}
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset parameter"})
+			return
+		}
+		offset = n
+	}
+
+	var total int
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	events := []models.AuditEvent{}
+	if err := query.Limit(limit).Offset(offset).Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events, "total": total})
+}
+
+// writeAuditCSV streams every event of query as CSV. Events are read in batches,
+// each continuing after the last event written, so a long log is neither held in
+// memory nor keeps the database locked while a slow client downloads it.
+func writeAuditCSV(c *gin.Context, query *gorm.DB) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="teslaxy_audit_%s.csv"`, time.Now().Format("20060102_150405")))
+	c.Status(http.StatusOK)
+
+	cw := csv.NewWriter(c.Writer)
+	cw.Write([]string{"time", "user", "ip", "action", "clip_id", "video_file", "export_job_id", "share_link_id", "detail"})
+	var last *models.AuditEvent
+	for {
+		batch := query
+		if last != nil {
+			batch = batch.Where("created_at < ? OR (created_at = ? AND id < ?)", last.CreatedAt, last.CreatedAt, last.ID)
+		}
+		rows, err := batch.Limit(auditCSVBatch).Rows()
+		if err != nil {
+			log.Printf("Audit CSV export failed: %v", err)
+			break
+		}
+		n := 0
+		for rows.Next() {
+			var e models.AuditEvent
+			if err := database.DB.ScanRows(rows, &e); err != nil {
+				log.Printf("Audit CSV export failed: %v", err)
+				break
+			}
+			writeAuditRow(cw, e)
+			last = &e
+			n++
+		}
+		rows.Close()
+		cw.Flush()
+		if n < auditCSVBatch || cw.Error() != nil {
+			break
+		}
+	}
+	cw.Flush()
+}
+
+func writeAuditRow(cw *csv.Writer, e models.AuditEvent) {
+	clipID := ""
+	if e.ClipID != 0 {
+		clipID = strconv.FormatUint(uint64(e.ClipID), 10)
+	}
+	cw.Write([]string{
+		e.CreatedAt.UTC().Format(time.RFC3339),
+		csvCell(e.Username), e.IP, e.Action, clipID,
+		csvCell(e.VideoFile), e.ExportJobID, e.ShareLinkID, csvCell(e.Detail),
+	})
+}
+
+// csvCell keeps spreadsheets from running text as a formula. Usernames of failed
+// logins are whatever was typed.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+type auditPage struct {
+	Events []models.AuditEvent `json:"events"`
+	Total  int                 `json:"total"`
+}
+
+func queryAudit(t *testing.T, r *gin.Engine, query string) auditPage {
+	admin, _ := generateToken("admin", RoleAdmin, adminSession)
+	w := sendJSON(r, "GET", "/api/audit"+query, admin, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Audit query %q failed: %d %s", query, w.Code, w.Body.String())
+	}
+	var page auditPage
+	json.Unmarshal(w.Body.Bytes(), &page)
+	return page
+}
+
+func actions(events []models.AuditEvent) []string {
+	var out []string
+	for _, e := range events {
+		out = append(out, e.Action)
+	}
+	return out
+}
+
+func TestAuditLogins(t *testing.T) {
+	r := setupSessionTest(t)
+	resetRateLimit()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/login", strings.NewReader(`{"username":"sam","password":"wrong"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = "203.0.113.7:50000"
+	r.ServeHTTP(w, req)
+	token := loginPair(t, r).Token
+	sendJSON(r, "POST", "/api/logout", token, nil)
+
+	page := queryAudit(t, r, "?user=sam")
+	assert.Equal(t, []string{AuditLogout, AuditLogin, AuditLoginFailed}, actions(page.Events))
+	assert.Equal(t, "203.0.113.7", page.Events[2].IP)
+	assert.Equal(t, "invalid password", page.Events[2].Detail)
+	assert.Equal(t, "password", page.Events[1].Detail)
+
+	// Only admins read the log, and API keys never do
+	assert.Equal(t, http.StatusForbidden, sendJSON(r, "GET", "/api/audit", tokenFor(t, "eve", RoleExporter), nil).Code)
+	admin, _ := generateToken("admin", RoleAdmin, adminSession)
+	key := createKey(t, r, admin, map[string]interface{}{"name": "all", "scopes": []string{"read_clips", "telemetry", "export"}})
+	assert.Equal(t, http.StatusForbidden, sendJSON(r, "GET", "/api/audit", key.Key, nil).Code)
+}
+
+func TestAuditFootageAndShares(t *testing.T) {
+	r, clip := setupShareTest(t)
+	auditViewsLock.Lock()
+	auditViews = map[string]time.Time{}
+	auditViewsLock.Unlock()
+
+	var front models.VideoFile
+	database.DB.Where("clip_id = ? AND camera = ?", clip.ID, "Front").First(&front)
+	t.Setenv("FOOTAGE_PATH", filepath.Dir(front.FilePath))
+
+	// A player's range requests are one view
+	viewer := tokenFor(t, "vic", RoleViewer)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, sendJSON(r, "GET", "/api/video"+front.FilePath, viewer, nil).Code)
+	}
+	page := queryAudit(t, r, "?user=vic&action="+AuditViewVideo)
+	if assert.Equal(t, 1, page.Total) {
+		assert.Equal(t, clip.ID, page.Events[0].ClipID)
+		assert.Equal(t, front.FilePath, page.Events[0].VideoFile)
+	}
+
+	share := createTestShare(t, r, map[string]interface{}{"kind": "clip", "clip_id": clip.ID, "cameras": []string{"Front"}})
+	assert.Equal(t, http.StatusOK, get(r, share["url"].(string), nil).Code)
+	assert.Equal(t, http.StatusOK, get(r, share["url"].(string)+"/video/0", nil).Code)
+	admin, _ := generateToken("admin", RoleAdmin, adminSession)
+	assert.Equal(t, http.StatusNoContent, sendJSON(r, "DELETE", "/api/shares/"+share["id"].(string), admin, nil).Code)
+
+	page = queryAudit(t, r, fmt.Sprintf("?clip_id=%d", clip.ID))
+	assert.Equal(t, []string{AuditShareRevoke, AuditShareVideo, AuditShareView, AuditShareCreate, AuditViewVideo}, actions(page.Events))
+	for _, e := range page.Events[:4] {
+		assert.Equal(t, share["id"], e.ShareLinkID, e.Action)
+	}
+	// Visitors of a link are anonymous, and the token itself is never stored
+	assert.Empty(t, page.Events[1].Username)
+	assert.Equal(t, "admin", page.Events[3].Username)
+	assert.NotContains(t, fmt.Sprint(page.Events), share["token"])
+}
+
+func TestAuditAccountChanges(t *testing.T) {
+	r := setupSessionTest(t)
+	admin, _ := generateToken("admin", RoleAdmin, adminSession)
+	w := sendJSON(r, "POST", "/api/users", admin, map[string]interface{}{"username": "bob", "password": "bobs password", "role": RoleViewer})
+	var bob models.User
+	json.Unmarshal(w.Body.Bytes(), &bob)
+	path := fmt.Sprintf("/api/users/%d", bob.ID)
+	sendJSON(r, "PUT", path, admin, map[string]interface{}{"role": RoleExporter, "reset_totp": true})
+	key := createKey(t, r, admin, map[string]interface{}{"name": "ha", "scopes": []string{"read_clips"}})
+	sendJSON(r, "DELETE", fmt.Sprintf("/api/keys/%d", key.ID), admin, nil)
+	sendJSON(r, "DELETE", path, admin, nil)
+
+	page := queryAudit(t, r, "?user=admin")
+	assert.Equal(t, []string{AuditUserDelete, AuditAPIKeyRevoke, AuditAPIKeyCreate, AuditUserUpdate, AuditUserCreate}, actions(page.Events))
+	assert.Equal(t, `user "bob", role exporter, two-factor reset`, page.Events[3].Detail)
+	assert.Contains(t, page.Events[2].Detail, key.Prefix)
+	assert.NotContains(t, fmt.Sprint(page.Events), key.Key)
+}
+
+func TestAuditQuery(t *testing.T) {
+	r, _ := setupShareTest(t)
+	base := time.Date(2024, 7, 1, 12, 0, 0, 0, time.Local)
+	for i, e := range []models.AuditEvent{
+		{Username: "ann", Action: AuditLogin, IP: "10.0.0.1"},
+		{Username: "=HYPERLINK(\"http://evil\")", Action: AuditLoginFailed, IP: "10.0.0.2"},
+		{Username: "ann", Action: AuditExportCreate, ClipID: 7, ExportJobID: "job-1"},
+	} {
+		e.CreatedAt = base.Add(time.Duration(i) * time.Hour)
+		database.DB.Create(&e)
+	}
+
+	from, to := base.Add(30*time.Minute).Format(time.RFC3339), base.Add(2*time.Hour).Format(time.RFC3339)
+	page := queryAudit(t, r, "?from="+url.QueryEscape(from)+"&to="+url.QueryEscape(to))
+	assert.Equal(t, []string{AuditLoginFailed}, actions(page.Events))
+	page = queryAudit(t, r, "?user=ann&limit=1&offset=1")
+	assert.Equal(t, 2, page.Total)
+	assert.Equal(t, []string{AuditLogin}, actions(page.Events))
+	assert.Equal(t, 1, queryAudit(t, r, "?clip_id=7").Total)
+
+	admin, _ := generateToken("admin", RoleAdmin, adminSession)
+	for _, query := range []string{"?from=yesterday", "?clip_id=x", "?limit=0", "?limit=5000", "?offset=-1"} {
+		assert.Equal(t, http.StatusBadRequest, sendJSON(r, "GET", "/api/audit"+query, admin, nil).Code, query)
+	}
+
+	// The CSV holds every match and doesn't let a spreadsheet run a username
+	w := sendJSON(r, "GET", "/api/audit?format=csv", admin, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "teslaxy_audit_")
+	rows, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+	assert.NoError(t, err)
+	if assert.Len(t, rows, 4) {
+		assert.Equal(t, "action", rows[0][3])
+		assert.Equal(t, []string{"ann", "", AuditExportCreate, "7", "", "job-1"}, rows[1][1:7])
+		assert.Equal(t, "'=HYPERLINK(\"http://evil\")", rows[2][1])
+	}
+}
+
+func TestPruneAuditEvents(t *testing.T) {
+	setupUserDB(t)
+	now := time.Now()
+	for _, age := range []time.Duration{time.Hour, 40 * 24 * time.Hour} {
+		database.DB.Create(&models.AuditEvent{CreatedAt: now.Add(-age), Action: AuditLogin})
+	}
+	count := func() (n int) {
+		database.DB.Model(&models.AuditEvent{}).Count(&n)
+		return
+	}
+
+	t.Setenv("AUDIT_RETENTION_DAYS", "0")
+	pruneAuditEvents(now)
+	assert.Equal(t, 2, count())
+
+	t.Setenv("AUDIT_RETENTION_DAYS", "30")
+	pruneAuditEvents(now)
+	assert.Equal(t, 1, count())
+}
+
+func TestAuditCSVBatches(t *testing.T) {
+	r, _ := setupShareTest(t)
+	original := auditCSVBatch
+	auditCSVBatch = 2
+	t.Cleanup(func() { auditCSVBatch = original })
+
+	base := time.Date(2024, 7, 1, 12, 0, 0, 0, time.Local)
+	for i := 0; i < 5; i++ {
+		// Batches must continue correctly past events logged at the same instant
+		database.DB.Create(&models.AuditEvent{CreatedAt: base.Add(time.Duration(i/2) * time.Minute), Action: AuditLogin, Detail: fmt.Sprint(i)})
+	}
+
+	admin, _ := generateToken("admin", RoleAdmin, adminSession)
+	w := sendJSON(r, "GET", "/api/audit?format=csv", admin, nil)
+	rows, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+	assert.NoError(t, err)
+	var details []string
+	for _, row := range rows[1:] {
+		details = append(details, row[8])
+	}
+	assert.Equal(t, []string{"4", "3", "2", "1", "0"}, details)
+}
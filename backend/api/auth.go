@@ -2,8 +2,6 @@ package api
 
 import (
 	"crypto/rand"
-	"crypto/subtle"
-	"encoding/hex"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,6 +12,8 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"teslaxy/database"
+	"teslaxy/models"
 )
 
 var (
@@ -30,7 +30,8 @@ type loginAttempt struct {
 }
 
 func init() {
-	// Initialize JWT Secret
+	// Initialize JWT Secret. Without JWT_SECRET this random key is only a placeholder
+	// until InitKeys loads the keys persisted in CONFIG_PATH.
 	secretKey = []byte(os.Getenv("JWT_SECRET"))
 	if len(secretKey) == 0 {
 		// Generate random 32-byte key
@@ -39,7 +40,6 @@ func init() {
 			panic(fmt.Sprintf("CRITICAL: Failed to generate random JWT secret: %v", err))
 		}
 		secretKey = key
-		log.Println("SECURITY WARNING: JWT_SECRET not set. Using randomly generated secret key. All existing sessions will be invalidated on restart.")
 	}
 
 	// Initialize Admin Credentials
@@ -62,21 +62,17 @@ func cleanupRateLimits() {
 	}
 }
 
+// loadAdminCreds reads the legacy ADMIN_USER/ADMIN_PASS pair. It only matters until
+// the first account exists: with a database it is migrated into an admin user.
 func loadAdminCreds() {
 	adminUser = os.Getenv("ADMIN_USER")
 	if adminUser == "" {
 		adminUser = "admin"
 	}
-
 	adminPass = os.Getenv("ADMIN_PASS")
-	if adminPass == "" {
-		// Generate secure random password
-		bytes := make([]byte, 16)
-		if _, err := rand.Read(bytes); err != nil {
-			panic(fmt.Sprintf("CRITICAL: Failed to generate random admin password: %v", err))
-		}
-		adminPass = hex.EncodeToString(bytes)
-		log.Printf("SECURITY NOTICE: ADMIN_PASS not set. Auto-generated admin password: %s", adminPass)
+
+	if database.DB != nil {
+		migrateAdminCreds()
 	}
 }
 
@@ -89,18 +85,26 @@ func AuthMiddleware() gin.HandlerFunc {
 		}
 
 		// Public Routes
-		if c.Request.URL.Path == "/api/login" {
+		if c.Request.URL.Path == "/api/login" || c.Request.URL.Path == "/api/refresh" {
 			c.Next()
 			return
 		}
 
-		tokenString := ""
-		authHeader := c.GetHeader("Authorization")
-		if authHeader != "" {
-			tokenString = strings.TrimPrefix(authHeader, "Bearer ")
-		} else {
-			// Fallback to query parameter for <img> and <video> tags
-			tokenString = c.Query("token")
+		tokenString := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+		// <img>, <video> and download links can't send the header; they use media
+		// URLs signed for their path instead (see media.go). Tokens are never
+		// accepted in the query string, where they would end up in logs and history.
+		if tokenString == "" && c.Query("sig") != "" && c.Request.Method == http.MethodGet {
+			claims, user, err := verifyMediaURL(c)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired media link"})
+				return
+			}
+			c.Set("claims", claims)
+			c.Set("user", user)
+			c.Next()
+			return
 		}
 
 		if tokenString == "" {
@@ -108,11 +112,40 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		if valid, _ := validateToken(tokenString); !valid {
+		// Personal API keys act as their owner, limited to the key's scopes
+		if isAPIKey(tokenString) {
+			key, user, err := authenticateAPIKey(tokenString)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired API key"})
+				return
+			}
+			c.Set("claims", &Claims{Username: user.Username, Role: user.Role})
+			c.Set("user", user)
+			c.Set("api_key", key)
+			c.Next()
+			return
+		}
+
+		claims, err := parseToken(tokenString)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+
+		// The account must still exist with the role the token was issued for, and
+		// its session must not have been logged out
+		user, err := findUser(claims.Username)
+		if err != nil || claims.Role != user.Role {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			return
 		}
+		if session, err := activeSession(claims.SessionID); err != nil || session.UserID != user.ID {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Session has ended"})
+			return
+		}
 
+		c.Set("claims", claims)
+		c.Set("user", user)
 		c.Next()
 	}
 }
@@ -158,33 +191,65 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	// Verify using constant time compare to prevent timing attacks
-	userMatch := subtle.ConstantTimeCompare([]byte(creds.Username), []byte(adminUser)) == 1
-	passMatch := subtle.ConstantTimeCompare([]byte(creds.Password), []byte(adminPass)) == 1
-
-	if userMatch && passMatch {
-		token, _ := generateToken(creds.Username)
-		log.Printf("AUTH: Successful login for user %q from IP %s", creds.Username, c.ClientIP())
-		c.JSON(200, gin.H{"token": token})
-	} else {
-		log.Printf("AUTH: Failed login attempt for user %q from IP %s", creds.Username, c.ClientIP())
+	user, ok := authenticate(creds.Username, creds.Password)
+	if !ok {
+		audit(c, models.AuditEvent{Action: AuditLoginFailed, Username: creds.Username, Detail: "invalid password"})
 		c.JSON(401, gin.H{"error": "Invalid credentials"})
+		return
 	}
+
+	// With two-factor authentication the password only earns a challenge for the
+	// second step (see totp.go)
+	if user.TOTPEnabled || user.TOTPRequired {
+		audit(c, models.AuditEvent{Action: AuditLoginChallenge, Username: user.Username, Detail: "password accepted, waiting for the second factor"})
+		c.JSON(200, gin.H{
+			"mfa_required":            true,
+			"mfa_enrollment_required": !user.TOTPEnabled,
+			"mfa_token":               mfaChallenge(user, time.Now()),
+		})
+		return
+	}
+	finishLogin(c, user, "password", nil)
+}
+
+// finishLogin starts a session for an authenticated user and responds with its
+// tokens, plus any extra fields. method is recorded in the audit log.
+func finishLogin(c *gin.Context, user *models.User, method string, extra gin.H) {
+	tokens, err := startSession(c, user)
+	if err != nil {
+		log.Printf("AUTH: Failed to start a session for user %q: %v", user.Username, err)
+		c.JSON(500, gin.H{"error": "Failed to log in"})
+		return
+	}
+	now := time.Now()
+	database.DB.Model(user).UpdateColumn("last_login_at", &now)
+	audit(c, models.AuditEvent{Action: AuditLogin, Username: user.Username, Detail: method})
+	for k, v := range extra {
+		tokens[k] = v
+	}
+	c.JSON(200, tokens)
 }
 
 // Claims represents the JWT claims used by Teslaxy.
 // We use RegisteredClaims for proper exp, iat, nbf, iss, sub handling.
+// Username is the models.User the token was issued to and Role decides which
+// routes it may use (see RequirePermission).
 type Claims struct {
-	Username string `json:"username"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid"`
 	jwt.RegisteredClaims
 }
 
-// generateToken creates a signed JWT using the official golang-jwt/jwt/v5 library.
-func generateToken(user string) (string, error) {
+// generateToken creates a short-lived access token for a session, signed with the
+// current key (named in the kid header), using the official golang-jwt/jwt/v5 library.
+func generateToken(user, role, sessionID string) (string, error) {
 	claims := Claims{
-		Username: user,
+		Username:  user,
+		Role:      role,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 			Issuer:    "teslaxy",
@@ -192,13 +257,23 @@ func generateToken(user string) (string, error) {
 		},
 	}
 
+	key := currentSigningKey()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(secretKey)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Secret)
 }
 
 // validateToken parses and validates a JWT using the official library.
 // It performs algorithm verification, signature check, and expiration validation.
 func validateToken(tokenString string) (bool, error) {
+	if _, err := parseToken(tokenString); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// parseToken validates a JWT and returns its claims
+func parseToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
@@ -206,16 +281,31 @@ func validateToken(tokenString string) (bool, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return secretKey, nil
+		kid, _ := token.Header["kid"].(string)
+		key, ok := lookupSigningKey(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
 	})
 
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	if !token.Valid {
-		return false, fmt.Errorf("invalid token")
+		return nil, fmt.Errorf("invalid token")
 	}
 
-	return true, nil
+	return claims, nil
+}
+
+// currentUsername returns the authenticated user for the request, or "" when auth is disabled
+func currentUsername(c *gin.Context) string {
+	if v, ok := c.Get("claims"); ok {
+		if claims, ok := v.(*Claims); ok {
+			return claims.Username
+		}
+	}
+	return ""
 }
@@ -13,6 +13,7 @@ import (
 
 func TestLogin_Security(t *testing.T) {
 	gin.SetMode(gin.TestMode)
+	setupUserDB(t)
 
 	t.Run("Default Insecure Password Disabled", func(t *testing.T) {
 		// Ensure environment is clean (simulating first run without env vars)
@@ -45,7 +46,8 @@ func TestLogin_Security(t *testing.T) {
 		os.Setenv("ADMIN_PASS", expectedPass)
 		defer os.Unsetenv("ADMIN_PASS")
 
-		// Reload credentials to pick up the env var
+		// Reload credentials to pick up the env var; with no accounts yet they are
+		// migrated into an admin user
 		// Note: loadAdminCreds is available because we are in package api
 		loadAdminCreds()
 
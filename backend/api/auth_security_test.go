@@ -15,7 +15,7 @@ func TestGenerateToken_Injection(t *testing.T) {
 
 	maliciousUser := `admin","role":"admin`
 
-	token, err := generateToken(maliciousUser)
+	token, err := generateToken(maliciousUser, RoleViewer, "")
 	if err != nil {
 		t.Fatalf("generateToken failed: %v", err)
 	}
@@ -13,7 +13,7 @@ func TestTokenValidation(t *testing.T) {
 	secretKey = []byte("test-secret")
 
 	// 1. Test Valid Token
-	token, err := generateToken("testuser")
+	token, err := generateToken("testuser", RoleViewer, "")
 	if err != nil {
 		t.Fatalf("Failed to generate token: %v", err)
 	}
@@ -3,6 +3,7 @@ package api
 import (
 	"testing"
 	"teslaxy/services"
+	"time"
 )
 
 func TestExportRequestValidation(t *testing.T) {
@@ -91,6 +92,56 @@ func TestExportRequestValidation(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "Valid Timelapse Clip",
+			req: services.ExportRequest{
+				ClipID:  1,
+				Cameras: []string{"front"},
+				Mode:    services.ExportModeTimelapse,
+				SpeedUp: 60,
+			},
+			wantErr: false,
+		},
+		{
+			name: "Timelapse Speed-Up Too Low",
+			req: services.ExportRequest{
+				ClipID:  1,
+				Cameras: []string{"front"},
+				Mode:    services.ExportModeTimelapse,
+				SpeedUp: 1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Timelapse Range Without Bounds",
+			req: services.ExportRequest{
+				Cameras: []string{"front"},
+				Mode:    services.ExportModeTimelapse,
+				SpeedUp: 10,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Timelapse Range Too Long",
+			req: services.ExportRequest{
+				Cameras: []string{"front"},
+				Mode:    services.ExportModeTimelapse,
+				SpeedUp: 10,
+				From:    timePtr(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)),
+				To:      timePtr(time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)),
+			},
+			wantErr: true,
+		},
+		{
+			name: "Unknown Mode",
+			req: services.ExportRequest{
+				ClipID:   1,
+				Cameras:  []string{"front"},
+				Duration: 10,
+				Mode:     "slowmo",
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -102,3 +153,7 @@ func TestExportRequestValidation(t *testing.T) {
 		})
 	}
 }
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
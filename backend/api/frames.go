@@ -0,0 +1,98 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"teslaxy/models"
+	"teslaxy/services"
+)
+
+// getFrame returns an exact, full-resolution PNG still for evidence. GPS is left out
+// for roles that may not see locations.
+//
+// Query params:
+//   - camera: camera name, or "all" for a ZIP with the same instant from every camera
+//   - time: RFC3339 timestamp with optional fractional seconds, or
+//   - frame: frame number counted from the camera's first frame in the clip (single camera only)
+func getFrame(c *gin.Context) {
+	camera := c.Query("camera")
+	timeParam, frameParam := c.Query("time"), c.Query("frame")
+	if camera == "" || (timeParam == "") == (frameParam == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "camera and exactly one of time or frame are required"})
+		return
+	}
+
+	var instant time.Time
+	frame := -1
+	if timeParam != "" {
+		t, err := time.Parse(time.RFC3339Nano, timeParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time parameter"})
+			return
+		}
+		instant = t
+	} else {
+		n, err := strconv.Atoi(frameParam)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid frame parameter"})
+			return
+		}
+		if camera == "all" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Grabbing every camera requires a time"})
+			return
+		}
+		frame = n
+	}
+
+	clip, ok := loadStreamClip(c)
+	if !ok {
+		return
+	}
+
+	if camera == "all" {
+		grabs, err := services.GrabAllCameras(c.Request.Context(), clip, instant, hasPermission(c, PermViewLocation))
+		if !frameGrabOK(c, err) {
+			return
+		}
+		audit(c, models.AuditEvent{Action: AuditViewFrame, ClipID: clip.ID, Detail: "all cameras at " + instant.UTC().Format(time.RFC3339Nano)})
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="teslaxy_%d_%s.zip"`, clip.ID, instant.UTC().Format("20060102_150405.000")))
+		c.Status(http.StatusOK)
+		if err := services.WriteFrameZip(c.Writer, grabs); err != nil {
+			log.Printf("Frame ZIP for clip %d failed: %v", clip.ID, err)
+		}
+		return
+	}
+
+	grab, err := services.GrabFrame(c.Request.Context(), clip, camera, instant, frame, hasPermission(c, PermViewLocation))
+	if !frameGrabOK(c, err) {
+		return
+	}
+	audit(c, models.AuditEvent{Action: AuditViewFrame, ClipID: clip.ID, VideoFile: grab.File.FilePath, Detail: grab.FileName()})
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="teslaxy_%d_%s"`, clip.ID, grab.FileName()))
+	c.Header("X-Source-SHA256", grab.SHA256)
+	c.Data(http.StatusOK, "image/png", grab.PNG)
+}
+
+func frameGrabOK(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, services.ErrNoCameraFootage), errors.Is(err, services.ErrFrameOutOfRange):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrFrameCount):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrTranscoderBusy):
+		transcoderBusy(c)
+	default:
+		log.Printf("Frame grab failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to extract frame"})
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"teslaxy/database"
+	"teslaxy/models"
+	"teslaxy/services"
+)
+
+var hlsSegmentName = regexp.MustCompile(`^(\d{1,5})\.ts$`)
+
+// hlsSource resolves the :fileID param to the path of a VideoFile on disk.
+// Files are addressed by ID, so no client-supplied path ever reaches ffmpeg.
+func hlsSource(c *gin.Context) (string, bool) {
+	id, err := strconv.ParseUint(c.Param("fileID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return "", false
+	}
+	var vf models.VideoFile
+	if err := database.DB.Select("id, file_path").First(&vf, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Video file not found"})
+		return "", false
+	}
+	if _, err := os.Stat(vf.FilePath); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Video file not found"})
+		return "", false
+	}
+	return vf.FilePath, true
+}
+
+// hlsURISuffix carries a media URL signature and the transcode hints along to the
+// URIs inside a playlist, since native HLS players can't add headers or parameters
+// to follow-up requests. Playlists are signed for their whole directory, so the
+// signature also covers the segments.
+func hlsURISuffix(c *gin.Context) string {
+	query := url.Values{}
+	for _, key := range append([]string{"session", "focus"}, mediaParams...) {
+		if v := c.Query(key); v != "" {
+			query.Set(key, v)
+		}
+	}
+	if len(query) == 0 {
+		return ""
+	}
+	return "?" + query.Encode()
+}
+
+// transcodeOptions reads the optional ?session= (a client-chosen ID per player, up to
+// 64 characters) and ?focus=1 (the camera being watched) transcode hints
+func transcodeOptions(c *gin.Context) services.TranscodeOptions {
+	opts := services.TranscodeOptions{Focused: c.Query("focus") == "1" || c.Query("focus") == "true"}
+	if session := c.Query("session"); len(session) <= 64 {
+		opts.Session = session
+	}
+	return opts
+}
+
+// transcoderBusy asks the client to come back once a transcode slot may be free
+func transcoderBusy(c *gin.Context) {
+	c.Header("Retry-After", strconv.Itoa(services.TranscodeRetryAfter))
+	c.JSON(http.StatusServiceUnavailable, gin.H{"error": services.ErrTranscoderBusy.Error()})
+}
+
+func writePlaylist(c *gin.Context, playlist string, err error) {
+	if errors.Is(err, services.ErrUnknownRendition) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("HLS playlist error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read video"})
+		return
+	}
+	c.Header("Cache-Control", "private, max-age=60")
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(playlist))
+}
+
+// getHLSMaster lists the renditions available for a video file
+func getHLSMaster(c *gin.Context) {
+	path, ok := hlsSource(c)
+	if !ok {
+		return
+	}
+	playlist, err := services.HLSMasterPlaylist(path, hlsURISuffix(c))
+	if err == nil {
+		auditView(c, models.AuditEvent{Action: AuditViewVideo, VideoFile: path})
+	}
+	writePlaylist(c, playlist, err)
+}
+
+// getHLSMedia lists the segments of one rendition
+func getHLSMedia(c *gin.Context) {
+	path, ok := hlsSource(c)
+	if !ok {
+		return
+	}
+	playlist, err := services.HLSMediaPlaylist(path, c.Param("rendition"), hlsURISuffix(c))
+	writePlaylist(c, playlist, err)
+}
+
+// getHLSSegment serves a segment from the cache, transcoding it on first request
+func getHLSSegment(c *gin.Context) {
+	m := hlsSegmentName.FindStringSubmatch(c.Param("segment"))
+	if m == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+		return
+	}
+	index, _ := strconv.Atoi(m[1])
+
+	path, ok := hlsSource(c)
+	if !ok {
+		return
+	}
+
+	segment, err := services.HLSSegment(c.Request.Context(), path, c.Param("rendition"), index, transcodeOptions(c))
+	switch {
+	case errors.Is(err, services.ErrTranscoderBusy):
+		transcoderBusy(c)
+		return
+	case errors.Is(err, services.ErrUnknownRendition), errors.Is(err, services.ErrSegmentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, context.Canceled):
+		return // Viewer went away; the segment is still cached for the next one
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Transcoding failed"})
+		return
+	}
+
+	// Segments of a given file and rendition never change
+	c.Header("Cache-Control", "private, max-age=86400, immutable")
+	c.Header("Content-Type", "video/mp2t")
+	c.File(segment)
+}
+
+// loadStreamClip loads the clip of a continuous camera stream with its files
+func loadStreamClip(c *gin.Context) (models.Clip, bool) {
+	var clip models.Clip
+	if err := database.DB.Preload("VideoFiles").First(&clip, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Clip not found"})
+		return clip, false
+	}
+	return clip, true
+}
+
+// getClipStream returns one HLS playlist covering every file of a camera in a clip
+func getClipStream(c *gin.Context) {
+	clip, ok := loadStreamClip(c)
+	if !ok {
+		return
+	}
+	playlist, err := services.ClipStreamPlaylist(clip, c.Param("camera"), hlsURISuffix(c))
+	if errors.Is(err, services.ErrNoCameraFootage) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err == nil {
+		auditView(c, models.AuditEvent{Action: AuditViewVideo, ClipID: clip.ID, Detail: c.Param("camera") + " stream"})
+	}
+	writePlaylist(c, playlist, err)
+}
+
+// getClipStreamSegment serves one file of a clip camera stream, remuxed to MPEG-TS
+func getClipStreamSegment(c *gin.Context) {
+	m := hlsSegmentName.FindStringSubmatch(c.Param("segment"))
+	if m == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+		return
+	}
+	index, _ := strconv.Atoi(m[1])
+
+	clip, ok := loadStreamClip(c)
+	if !ok {
+		return
+	}
+
+	segment, err := services.ClipStreamSegment(c.Request.Context(), clip, c.Param("camera"), index)
+	switch {
+	case errors.Is(err, services.ErrNoCameraFootage), errors.Is(err, services.ErrSegmentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, context.Canceled):
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Remuxing failed"})
+		return
+	}
+
+	c.Header("Cache-Control", "private, max-age=86400, immutable")
+	c.Header("Content-Type", "video/mp2t")
+	c.File(segment)
+}
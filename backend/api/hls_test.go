@@ -0,0 +1,119 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"teslaxy/database"
+	"teslaxy/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHLSRoutes_Validation(t *testing.T) {
+	r, _ := setupShareTest(t)
+	token, _ := generateToken("admin", RoleAdmin, adminSession)
+	auth := map[string]string{"Authorization": "Bearer " + token}
+
+	tests := []struct {
+		name string
+		url  string
+		code int
+	}{
+		{"Non-numeric file ID", "/api/hls/abc/master.m3u8", http.StatusBadRequest},
+		{"Unknown file", "/api/hls/999/master.m3u8", http.StatusNotFound},
+		{"Bad segment name", "/api/hls/1/480p/..%2F..%2Fetc%2Fpasswd", http.StatusNotFound},
+		{"Segment without index", "/api/hls/1/480p/segment.ts", http.StatusNotFound},
+		{"Unknown clip stream", "/api/clips/999/stream/front/index.m3u8", http.StatusNotFound},
+		{"Camera without footage", "/api/clips/1/stream/cabin/index.m3u8", http.StatusNotFound},
+		{"Bad stream segment name", "/api/clips/1/stream/front/00000.mp4", http.StatusNotFound},
+		{"Unknown clip storyboard", "/api/clips/999/storyboard", http.StatusNotFound},
+		{"Storyboard camera without footage", "/api/clips/1/storyboard?camera=cabin", http.StatusNotFound},
+		{"Bad sprite name", "/api/clips/1/storyboard/1.png", http.StatusNotFound},
+		{"Sprite of another clip", "/api/clips/2/storyboard/1.jpg", http.StatusNotFound},
+		{"Unknown clip preview", "/api/clips/999/preview", http.StatusNotFound},
+		{"Unsupported preview format", "/api/clips/1/preview?format=gif", http.StatusBadRequest},
+		{"Frame without camera", "/api/clips/1/frame?frame=1", http.StatusBadRequest},
+		{"Frame with time and number", "/api/clips/1/frame?camera=front&frame=1&time=2024-01-01T00:00:00Z", http.StatusBadRequest},
+		{"Bad frame time", "/api/clips/1/frame?camera=front&time=yesterday", http.StatusBadRequest},
+		{"Negative frame number", "/api/clips/1/frame?camera=front&frame=-1", http.StatusBadRequest},
+		{"Every camera by frame number", "/api/clips/1/frame?camera=all&frame=1", http.StatusBadRequest},
+		{"Unknown clip frame", "/api/clips/999/frame?camera=front&frame=1", http.StatusNotFound},
+		{"Frame camera without footage", "/api/clips/1/frame?camera=cabin&frame=1", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := get(r, tt.url, auth); w.Code != tt.code {
+				t.Errorf("GET %s = %d, want %d", tt.url, w.Code, tt.code)
+			}
+		})
+	}
+
+	if w := get(r, "/api/hls/1/master.m3u8", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected playlists to require auth, got %d", w.Code)
+	}
+}
+
+func TestHLSURISuffix(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/api/hls/1/master.m3u8?token=a+b&x=1&focus=1&session=tab1&exp=9&user=sam&sid=s1&sig=x-y&scope=/api/hls/1/", nil)
+	if got := hlsURISuffix(c); got != "?exp=9&focus=1&scope=%2Fapi%2Fhls%2F1%2F&session=tab1&sid=s1&sig=x-y&user=sam" {
+		t.Errorf("Unexpected suffix %q", got)
+	}
+
+	c, _ = gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/api/hls/1/master.m3u8", nil)
+	if got := hlsURISuffix(c); got != "" {
+		t.Errorf("Expected no suffix without a signature, got %q", got)
+	}
+}
+
+func TestServeVideo_Proxy(t *testing.T) {
+	r, _ := setupShareTest(t)
+	token, _ := generateToken("admin", RoleAdmin, adminSession)
+	auth := map[string]string{"Authorization": "Bearer " + token}
+
+	var front models.VideoFile
+	database.DB.First(&front, 1)
+	os.Setenv("FOOTAGE_PATH", filepath.Dir(front.FilePath))
+	t.Cleanup(func() { os.Unsetenv("FOOTAGE_PATH") })
+
+	proxy := filepath.Join(t.TempDir(), "1.mp4")
+	os.WriteFile(proxy, []byte("front proxy"), 0644)
+	database.DB.Model(&front).Updates(map[string]interface{}{"proxy_path": proxy, "proxy_size": 11})
+
+	w := get(r, "/api/video/front.mp4?quality=480p", auth)
+	if w.Code != http.StatusOK || w.Body.String() != "front proxy" {
+		t.Errorf("Expected the proxy for 480p, got %d %q", w.Code, w.Body.String())
+	}
+	w = get(r, "/api/video/front.mp4", auth)
+	if w.Body.String() != "Front footage" {
+		t.Errorf("Expected the original without a quality, got %q", w.Body.String())
+	}
+	// Transcoded qualities are played as HLS
+	w = get(r, "/api/video/front.mp4?quality=720p&session=p1", auth)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/api/hls/1/master.m3u8?session=p1" {
+		t.Errorf("Expected a redirect to the HLS playlist, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestGetStoryboard(t *testing.T) {
+	r, _ := setupShareTest(t)
+	token, _ := generateToken("admin", RoleAdmin, adminSession)
+
+	w := get(r, "/api/clips/1/storyboard?camera=back", map[string]string{"Authorization": "Bearer " + token})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/vtt; charset=utf-8" {
+		t.Fatalf("Expected a WebVTT track, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.HasPrefix(w.Body.String(), "WEBVTT") {
+		t.Errorf("Unexpected body %q", w.Body.String())
+	}
+	if w := get(r, "/api/clips/1/storyboard", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected storyboards to require auth, got %d", w.Code)
+	}
+}
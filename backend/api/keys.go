@@ -0,0 +1,200 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"teslaxy/services"
+)
+
+// envKeyID names the single signing key derived from JWT_SECRET
+const envKeyID = "env"
+
+// signingKey is one JWT signing key; tokens name theirs in the kid header
+type signingKey struct {
+	ID      string    `json:"kid"`
+	Secret  []byte    `json:"secret"`
+	Created time.Time `json:"created_at"`
+}
+
+// keyFile is persisted in CONFIG_PATH when JWT_SECRET is unset, so restarts keep
+// everyone signed in
+type keyFile struct {
+	// Secret signs share links and other HMAC tokens; it is never rotated since
+	// those can outlive any signing key
+	Secret []byte       `json:"secret"`
+	Keys   []signingKey `json:"signing_keys"` // Newest first
+}
+
+var (
+	keysMu sync.RWMutex
+	// signingKeys is empty when JWT_SECRET is set; secretKey then signs tokens
+	signingKeys []signingKey
+	keysPath    string
+)
+
+func keysFilePath() string {
+	return filepath.Join(services.ConfigPath(), "keys.json")
+}
+
+// keyRotation is how long a persisted signing key signs new tokens
+// (JWT_KEY_ROTATION_DAYS, default 30, 0 disables rotation)
+func keyRotation() time.Duration {
+	days := 30
+	if v, err := strconv.Atoi(os.Getenv("JWT_KEY_ROTATION_DAYS")); err == nil && v >= 0 {
+		days = v
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// InitKeys loads the persisted signing keys, creating them on first start, unless
+// JWT_SECRET is set. Call it before serving requests; without keys no token can be
+// signed or checked, so an error should stop the server.
+func InitKeys() error {
+	if os.Getenv("JWT_SECRET") != "" {
+		return nil
+	}
+	if err := loadKeys(keysFilePath()); err != nil {
+		return err
+	}
+	if _, err := rotateSigningKeys(time.Now()); err != nil {
+		log.Printf("Signing key rotation failed: %v", err)
+	}
+
+	go func() {
+		for range time.Tick(time.Hour) {
+			if _, err := rotateSigningKeys(time.Now()); err != nil {
+				log.Printf("Signing key rotation failed: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func newSigningKey(now time.Time) (signingKey, error) {
+	secret, err := randomBytes(32)
+	if err != nil {
+		return signingKey{}, err
+	}
+	id, err := randomBytes(8)
+	if err != nil {
+		return signingKey{}, err
+	}
+	return signingKey{ID: hex.EncodeToString(id), Secret: secret, Created: now}, nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// loadKeys reads path, creating it with fresh keys if it does not exist
+func loadKeys(path string) error {
+	var kf keyFile
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		if kf.Secret, err = randomBytes(32); err != nil {
+			return err
+		}
+		key, err := newSigningKey(time.Now())
+		if err != nil {
+			return err
+		}
+		kf.Keys = []signingKey{key}
+		if err := writeKeys(path, kf); err != nil {
+			return err
+		}
+		log.Printf("Created signing keys in %s", path)
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &kf); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if len(kf.Secret) == 0 || len(kf.Keys) == 0 {
+			return fmt.Errorf("%s has no keys", path)
+		}
+	}
+
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	keysPath = path
+	secretKey = kf.Secret
+	signingKeys = kf.Keys
+	return nil
+}
+
+func writeKeys(path string, kf keyFile) error {
+	data, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// rotateSigningKeys starts signing with a new key once the current one is older
+// than keyRotation. The previous key is kept to verify tokens it already signed,
+// which expire long before the next rotation.
+func rotateSigningKeys(now time.Time) (bool, error) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+
+	interval := keyRotation()
+	if len(signingKeys) == 0 || interval == 0 || now.Sub(signingKeys[0].Created) < interval {
+		return false, nil
+	}
+	key, err := newSigningKey(now)
+	if err != nil {
+		return false, err
+	}
+	keys := []signingKey{key, signingKeys[0]}
+	if err := writeKeys(keysPath, keyFile{Secret: secretKey, Keys: keys}); err != nil {
+		return false, err
+	}
+	signingKeys = keys
+	log.Printf("Rotated the token signing key to %s", key.ID)
+	return true, nil
+}
+
+// currentSigningKey is the key new tokens are signed with
+func currentSigningKey() signingKey {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	if len(signingKeys) > 0 {
+		return signingKeys[0]
+	}
+	sum := sha256.Sum256(secretKey)
+	return signingKey{ID: envKeyID + "-" + hex.EncodeToString(sum[:4]), Secret: secretKey}
+}
+
+// lookupSigningKey finds the key a token names in its kid header
+func lookupSigningKey(kid string) ([]byte, bool) {
+	keysMu.RLock()
+	for _, key := range signingKeys {
+		if key.ID == kid {
+			keysMu.RUnlock()
+			return key.Secret, true
+		}
+	}
+	keysMu.RUnlock()
+
+	if current := currentSigningKey(); current.ID == kid {
+		return current.Secret, true
+	}
+	return nil, false
+}
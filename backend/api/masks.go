@@ -0,0 +1,103 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"teslaxy/database"
+	"teslaxy/models"
+	"teslaxy/services"
+)
+
+// maskRequest is the body of POST/PUT /api/masks
+type maskRequest struct {
+	Name    string  `json:"name"`
+	Camera  string  `json:"camera"`
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Width   float64 `json:"width"`
+	Height  float64 `json:"height"`
+	Mode    string  `json:"mode"`
+	Enabled *bool   `json:"enabled"` // Defaults to true
+}
+
+// apply validates the request and copies it onto mask
+func (r *maskRequest) apply(mask *models.CameraMask) error {
+	region := services.MaskRegion{Camera: r.Camera, X: r.X, Y: r.Y, Width: r.Width, Height: r.Height, Mode: r.Mode}
+	if err := region.Validate(); err != nil {
+		return err
+	}
+
+	mask.Name = r.Name
+	mask.Camera = services.NormalizeCameraName(strings.TrimSpace(r.Camera))
+	mask.X, mask.Y, mask.Width, mask.Height = r.X, r.Y, r.Width, r.Height
+	mask.Mode = r.Mode
+	if mask.Mode == "" {
+		mask.Mode = services.MaskModeBlur
+	}
+	mask.Enabled = r.Enabled == nil || *r.Enabled
+	return nil
+}
+
+func listMasks(c *gin.Context) {
+	var masks []models.CameraMask
+	if err := database.DB.Order("camera asc, id asc").Find(&masks).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, masks)
+}
+
+func createMask(c *gin.Context) {
+	var req maskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var mask models.CameraMask
+	if err := req.apply(&mask); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := database.DB.Create(&mask).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, mask)
+}
+
+func updateMask(c *gin.Context) {
+	var mask models.CameraMask
+	if err := database.DB.First(&mask, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Mask not found"})
+		return
+	}
+
+	var req maskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.apply(&mask); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Save (not Updates) so disabling a mask persists the false value
+	if err := database.DB.Save(&mask).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, mask)
+}
+
+func deleteMask(c *gin.Context) {
+	var mask models.CameraMask
+	if err := database.DB.First(&mask, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Mask not found"})
+		return
+	}
+	database.DB.Unscoped().Delete(&mask)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+func maskRequestJSON(r *gin.Engine, method, url string, body interface{}) *httptest.ResponseRecorder {
+	token, _ := generateToken("admin", RoleAdmin, adminSession)
+	payload, _ := json.Marshal(body)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestCameraMaskCRUD(t *testing.T) {
+	r, _ := setupShareTest(t)
+	database.DB.AutoMigrate(&models.CameraMask{})
+
+	w := maskRequestJSON(r, "POST", "/api/masks", map[string]interface{}{
+		"name": "Number plate", "camera": "Back", "x": 0.4, "y": 0.8, "width": 0.2, "height": 0.1,
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created models.CameraMask
+	json.Unmarshal(w.Body.Bytes(), &created)
+	assert.Equal(t, "Back", created.Camera)
+	assert.Equal(t, "blur", created.Mode)
+	assert.True(t, created.Enabled)
+
+	// Out-of-frame rectangles never reach the filter graph
+	w = maskRequestJSON(r, "POST", "/api/masks", map[string]interface{}{"camera": "back", "x": 0.9, "y": 0.8, "width": 0.2, "height": 0.1})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Disabling persists the false value
+	w = maskRequestJSON(r, "PUT", "/api/masks/1", map[string]interface{}{
+		"name": "Number plate", "camera": "back", "x": 0.4, "y": 0.8, "width": 0.2, "height": 0.1, "mode": "pixelate", "enabled": false,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var stored models.CameraMask
+	database.DB.First(&stored, created.ID)
+	assert.False(t, stored.Enabled)
+	assert.Equal(t, "pixelate", stored.Mode)
+
+	w = get(r, "/api/masks", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = maskRequestJSON(r, "DELETE", "/api/masks/1", nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = maskRequestJSON(r, "DELETE", "/api/masks/1", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
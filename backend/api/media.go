@@ -0,0 +1,179 @@
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	pathpkg "path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"teslaxy/models"
+)
+
+// Media URLs let <video>, <img>, download links and native HLS players fetch files
+// without an Authorization header. Each is signed for one path (or a playlist's
+// directory), one user session and a short expiry, so a leaked URL opens nothing else.
+
+const (
+	mediaURLTTL   = 2 * time.Hour
+	maxMediaPaths = 200
+)
+
+// Query parameters of a signed media URL
+var mediaParams = []string{"scope", "exp", "user", "sid", "sig"}
+
+var errInvalidMediaURL = errors.New("invalid media signature")
+
+// mediaRoute is a path that can be signed. scope maps the path to what the signature
+// covers: the path itself, or a prefix ending in "/" for playlists whose segments
+// and sprites sit below it.
+type mediaRoute struct {
+	pattern *regexp.Regexp
+	scope   func(p string) string
+	perms   []Permission
+}
+
+func exactScope(p string) string { return p }
+
+func dirScope(p string) string { return p[:strings.LastIndex(p, "/")+1] }
+
+func treeScope(p string) string { return p + "/" }
+
+var mediaRoutes = []mediaRoute{
+	{regexp.MustCompile(`^/api/video/.+$`), exactScope, []Permission{PermViewClips}},
+	{regexp.MustCompile(`^/api/thumbnail/.+$`), exactScope, []Permission{PermViewClips}},
+	{regexp.MustCompile(`^/api/hls/\d+/master\.m3u8$`), dirScope, []Permission{PermViewClips}},
+	{regexp.MustCompile(`^/api/clips/\d+/stream/[^/]+/index\.m3u8$`), dirScope, []Permission{PermViewClips}},
+	{regexp.MustCompile(`^/api/clips/\d+/storyboard$`), treeScope, []Permission{PermViewClips}},
+	{regexp.MustCompile(`^/api/clips/\d+/(preview|frame)$`), exactScope, []Permission{PermViewClips}},
+	{regexp.MustCompile(`^/api/clips/\d+/report$`), exactScope, []Permission{PermViewClips, PermViewLocation}},
+	{regexp.MustCompile(`^/api/clips/\d+/archive$`), exactScope, []Permission{PermExport}},
+	{regexp.MustCompile(`^/api/exports/[^/]+/download$`), exactScope, []Permission{PermExport}},
+}
+
+func findMediaRoute(p string) *mediaRoute {
+	if pathpkg.Clean(p) != p {
+		return nil
+	}
+	for i := range mediaRoutes {
+		if mediaRoutes[i].pattern.MatchString(p) {
+			return &mediaRoutes[i]
+		}
+	}
+	return nil
+}
+
+// inMediaScope reports whether a request for p is covered by scope
+func inMediaScope(scope, p string) bool {
+	if pathpkg.Clean(p) != p {
+		return false
+	}
+	if p == scope || p+"/" == scope {
+		return true
+	}
+	return strings.HasSuffix(scope, "/") && strings.HasPrefix(p, scope)
+}
+
+func mediaSignature(scope, username, sessionID string, expires int64) string {
+	// Usernames and session IDs can't contain "|", so the message is unambiguous
+	return signShare("media", fmt.Sprintf("%s|%s|%s", scope, username, sessionID), expires)
+}
+
+// signMediaURL appends a signature for user's session to target, keeping its
+// query string
+func signMediaURL(target *url.URL, scope, username, sessionID string, expires time.Time) string {
+	query := target.Query()
+	for _, key := range mediaParams {
+		query.Del(key)
+	}
+	exp := expires.Unix()
+	if scope != target.Path {
+		query.Set("scope", scope)
+	}
+	query.Set("exp", strconv.FormatInt(exp, 10))
+	query.Set("user", username)
+	query.Set("sid", sessionID)
+	query.Set("sig", mediaSignature(scope, username, sessionID, exp))
+	return (&url.URL{Path: target.Path, RawQuery: query.Encode()}).String()
+}
+
+// verifyMediaURL checks the signature of a media request and loads the user and
+// session it was issued to
+func verifyMediaURL(c *gin.Context) (*Claims, *models.User, error) {
+	scope := c.Query("scope")
+	if scope == "" {
+		scope = c.Request.URL.Path
+	}
+	exp, err := strconv.ParseInt(c.Query("exp"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return nil, nil, errInvalidMediaURL
+	}
+	username, sessionID := c.Query("user"), c.Query("sid")
+	expected := mediaSignature(scope, username, sessionID, exp)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(c.Query("sig"))) != 1 {
+		return nil, nil, errInvalidMediaURL
+	}
+	if !inMediaScope(scope, c.Request.URL.Path) {
+		return nil, nil, errInvalidMediaURL
+	}
+
+	user, err := findUser(username)
+	if err != nil {
+		return nil, nil, errInvalidMediaURL
+	}
+	if session, err := activeSession(sessionID); err != nil || session.UserID != user.ID {
+		return nil, nil, errInvalidMediaURL
+	}
+	return &Claims{Username: user.Username, Role: user.Role, SessionID: sessionID}, user, nil
+}
+
+// signMediaURLs returns short-lived URLs for media paths (optionally with a query
+// string), for players and links that can't send the Authorization header
+func signMediaURLs(c *gin.Context) {
+	var req struct {
+		Paths []string `json:"paths"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Paths) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "paths is required"})
+		return
+	}
+	if len(req.Paths) > maxMediaPaths {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d paths can be signed at once", maxMediaPaths)})
+		return
+	}
+
+	expires := time.Now().Add(mediaURLTTL)
+	user := currentUser(c)
+	urls := make([]string, 0, len(req.Paths))
+	for _, raw := range req.Paths {
+		target, err := url.Parse(raw)
+		var route *mediaRoute
+		if err == nil && target.Scheme == "" && target.Host == "" {
+			route = findMediaRoute(target.Path)
+		}
+		if route == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Can't sign %q", raw)})
+			return
+		}
+		for _, perm := range route.perms {
+			if !hasPermission(c, perm) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Your account is not allowed to do this"})
+				return
+			}
+		}
+
+		// Without authentication every URL works as is
+		if user == nil {
+			urls = append(urls, target.String())
+			continue
+		}
+		urls = append(urls, signMediaURL(target, route.scope(target.Path), user.Username, currentSessionID(c), expires))
+	}
+	c.JSON(http.StatusOK, gin.H{"urls": urls, "expires_at": expires})
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+// signPaths asks the API for media URLs as the given user
+func signPaths(t *testing.T, r *gin.Engine, token string, paths ...string) []string {
+	w := sendJSON(r, "POST", "/api/media/sign", token, map[string]interface{}{"paths": paths})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Signing %v failed: %d %s", paths, w.Code, w.Body.String())
+	}
+	var resp struct {
+		URLs []string `json:"urls"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.URLs
+}
+
+// withQuery moves the signature of signed onto another path
+func withQuery(path, signed string) string {
+	return path + signed[strings.Index(signed, "?"):]
+}
+
+func TestMediaURLScope(t *testing.T) {
+	r, _ := setupShareTest(t)
+	token := tokenFor(t, "vic", RoleViewer)
+	urls := signPaths(t, r, token, "/api/clips/1/preview?format=gif", "/api/clips/1/stream/front/index.m3u8", "/api/clips/1/storyboard")
+	preview, stream, storyboard := urls[0], urls[1], urls[2]
+	assert.Contains(t, preview, "format=gif")
+	assert.Contains(t, scrubLogPath(preview), "sig=***")
+
+	// The signed path itself gets through authentication (and fails validation)
+	assert.Equal(t, http.StatusBadRequest, get(r, preview, nil).Code)
+	assert.Equal(t, http.StatusNotFound, get(r, withQuery("/api/clips/1/stream/front/00000.mp4", stream), nil).Code)
+	assert.Equal(t, http.StatusNotFound, get(r, withQuery("/api/clips/1/storyboard/1.png", storyboard), nil).Code)
+
+	// ...but not another file or API route
+	for _, other := range []string{
+		withQuery("/api/clips/2/preview", preview),
+		withQuery("/api/clips/1/frame", preview),
+		withQuery("/api/clips/1", preview),
+		withQuery("/api/clips", preview),
+		withQuery("/api/me", preview),
+		withQuery("/api/video/front.mp4", preview),
+		withQuery("/api/clips/1/stream/back/index.m3u8", stream),
+		withQuery("/api/clips/1/storyboard", stream),
+		withQuery("/api/clips/1/archive", storyboard),
+	} {
+		if code := get(r, other, nil).Code; code != http.StatusUnauthorized {
+			t.Errorf("GET %s = %d, want 401", other, code)
+		}
+	}
+	assert.False(t, inMediaScope("/api/clips/1/stream/front/", "/api/clips/1/stream/front/../../archive"))
+
+	// Nor does rewriting the scope help
+	scoped := withQuery("/api/clips/1/archive", preview) + "&scope=" + url.QueryEscape("/api/clips/1/")
+	assert.Equal(t, http.StatusUnauthorized, get(r, scoped, nil).Code)
+}
+
+func TestMediaURLTampering(t *testing.T) {
+	r, _ := setupShareTest(t)
+	token := tokenFor(t, "vic", RoleViewer)
+	tokenFor(t, "eve", RoleExporter)
+	signed := signPaths(t, r, token, "/api/clips/1/preview?format=gif")[0]
+
+	u, _ := url.Parse(signed)
+	for key, value := range map[string]string{
+		"user": "eve",
+		"sid":  "eve-session",
+		"exp":  "99999999999",
+		"sig":  "AAAA",
+	} {
+		q := u.Query()
+		q.Set(key, value)
+		if code := get(r, u.Path+"?"+q.Encode(), nil).Code; code != http.StatusUnauthorized {
+			t.Errorf("Changing %s: got %d, want 401", key, code)
+		}
+	}
+
+	// Expired signatures and logged out sessions are rejected
+	expired := signMediaURL(u, u.Path, "vic", "vic-session", time.Now().Add(-time.Second))
+	assert.Equal(t, http.StatusUnauthorized, get(r, expired, nil).Code)
+	assert.Equal(t, http.StatusNoContent, sendJSON(r, "POST", "/api/logout", token, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, get(r, signed, nil).Code)
+}
+
+func TestMediaURLPermissions(t *testing.T) {
+	r, _ := setupShareTest(t)
+	viewer := tokenFor(t, "vic", RoleViewer)
+	restricted := tokenFor(t, "nol", RoleViewerNoLocation)
+
+	// Tokens are no longer accepted in the query string
+	assert.Equal(t, http.StatusUnauthorized, get(r, "/api/clips/1/preview?format=gif&token="+url.QueryEscape(viewer), nil).Code)
+
+	tests := []struct {
+		token, path string
+		code        int
+	}{
+		{viewer, "/api/clips/1/archive", http.StatusForbidden},
+		{restricted, "/api/clips/1/report", http.StatusForbidden},
+		{viewer, "/api/users", http.StatusBadRequest},
+		{viewer, "/api/clips/1", http.StatusBadRequest},
+		{viewer, "https://example.com/api/video/front.mp4", http.StatusBadRequest},
+		{viewer, "/api/video/../../etc/passwd", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := sendJSON(r, "POST", "/api/media/sign", tt.token, map[string]interface{}{"paths": []string{tt.path}})
+		assert.Equal(t, tt.code, w.Code, tt.path)
+	}
+
+	// Downloads work for roles allowed to export
+	exporter := tokenFor(t, "eve", RoleExporter)
+	archive := signPaths(t, r, exporter, "/api/clips/1/archive")[0]
+	assert.NotEqual(t, http.StatusUnauthorized, get(r, archive, nil).Code)
+	assert.NotEqual(t, http.StatusForbidden, get(r, archive, nil).Code)
+}
+
+func TestMediaURLQualityRedirect(t *testing.T) {
+	r, _ := setupShareTest(t)
+	token := tokenFor(t, "vic", RoleViewer)
+	var front models.VideoFile
+	database.DB.First(&front, 1)
+	t.Setenv("FOOTAGE_PATH", filepath.Dir(front.FilePath))
+
+	signed := signPaths(t, r, token, "/api/video/front.mp4?quality=720p")[0]
+	w := get(r, signed, nil)
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	// The playlist is signed for the same session, so the player can follow it
+	location, _ := url.Parse(w.Header().Get("Location"))
+	assert.Equal(t, "/api/hls/1/master.m3u8", location.Path)
+	assert.Equal(t, "/api/hls/1/", location.Query().Get("scope"))
+	assert.Equal(t, "vic", location.Query().Get("user"))
+	assert.NotEqual(t, http.StatusUnauthorized, get(r, location.String(), nil).Code)
+}
@@ -10,11 +10,12 @@ import (
 )
 
 // Include ? or & before token to avoid matching part of a path or another param name suffix
-var tokenRegex = regexp.MustCompile(`([?&]token=)[^&]*`)
+var tokenRegex = regexp.MustCompile(`([?&](?:token|sig)=)[^&]*`)
 
-// scrubLogPath removes sensitive query parameters from the log path
+// scrubLogPath removes sensitive query parameters (old style tokens and media URL
+// signatures) from the log path
 func scrubLogPath(path string) string {
-	if !strings.Contains(path, "token=") {
+	if !strings.Contains(path, "token=") && !strings.Contains(path, "sig=") {
 		return path
 	}
 	// Use regex to replace value of token parameter until next & or end of string
@@ -0,0 +1,710 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+// Single sign-on with an OpenID Connect provider (authorization code flow with
+// PKCE). The provider proves who the user is; Teslaxy still issues its own
+// sessions, and password login keeps working as a fallback.
+
+const (
+	oidcStateCookie  = "teslaxy_oidc_state"
+	oidcStateTTL     = 10 * time.Minute
+	oidcLoginCodeTTL = time.Minute
+	maxOIDCPending   = 1000
+	// oidcKeysRefresh limits how often an unknown kid refetches the provider's keys
+	oidcKeysRefresh = time.Minute
+)
+
+var (
+	errOIDCNoRole   = errors.New("no Teslaxy role for this account")
+	errOIDCConflict = errors.New("username belongs to another account")
+
+	oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// oidcSettings is read from the environment:
+//
+//	OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET, OIDC_REDIRECT_URL (.../api/oidc/callback)
+//	OIDC_SCOPES (default "openid profile email")
+//	OIDC_USERNAME_CLAIM (default "preferred_username", falling back to "email")
+//	OIDC_LINK_CLAIMS, claims the provider guarantees, trusted to link an existing
+//	account without a password (a verified "email" always is)
+//	OIDC_ROLE_CLAIM (default "groups") and OIDC_ROLE_MAP ("family=viewer,admins=admin")
+//	OIDC_DEFAULT_ROLE for accounts no mapping matches (unset: they can't log in)
+type oidcSettings struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string
+	Scopes        string
+	UsernameClaim string
+	LinkClaims    []string
+	RoleClaim     string
+	RoleMap       map[string]string // Claim value -> role
+	DefaultRole   string
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// oidcConfig returns nil when single sign-on is not configured
+func oidcConfig() (*oidcSettings, error) {
+	issuer := strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return nil, nil
+	}
+	cfg := &oidcSettings{
+		Issuer:        issuer,
+		ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:        envOr("OIDC_SCOPES", "openid profile email"),
+		UsernameClaim: envOr("OIDC_USERNAME_CLAIM", "preferred_username"),
+		LinkClaims:    strings.FieldsFunc(os.Getenv("OIDC_LINK_CLAIMS"), func(r rune) bool { return r == ',' || r == ' ' }),
+		RoleClaim:     envOr("OIDC_ROLE_CLAIM", "groups"),
+		RoleMap:       map[string]string{},
+		DefaultRole:   os.Getenv("OIDC_DEFAULT_ROLE"),
+	}
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required")
+	}
+	if cfg.DefaultRole != "" && !validRole(cfg.DefaultRole) {
+		return nil, fmt.Errorf("OIDC_DEFAULT_ROLE %q is not a role", cfg.DefaultRole)
+	}
+	for _, pair := range strings.Split(os.Getenv("OIDC_ROLE_MAP"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		value, role, ok := strings.Cut(pair, "=")
+		role = strings.TrimSpace(role)
+		if !ok || !validRole(role) {
+			return nil, fmt.Errorf("OIDC_ROLE_MAP entry %q must be <claim value>=<role>", pair)
+		}
+		cfg.RoleMap[strings.TrimSpace(value)] = role
+	}
+	return cfg, nil
+}
+
+// roleFor maps the role claim (a string or a list, such as groups) to the most
+// privileged matching role, or "" when nothing matches
+func (cfg *oidcSettings) roleFor(claims jwt.MapClaims) string {
+	var values []string
+	switch v := claims[cfg.RoleClaim].(type) {
+	case string:
+		values = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	best := ""
+	for _, value := range values {
+		role, ok := cfg.RoleMap[value]
+		if ok && (best == "" || roleRank(role) < roleRank(best)) {
+			best = role
+		}
+	}
+	return best
+}
+
+// roleRank orders roles from most to least privileged
+func roleRank(role string) int {
+	for i, r := range []string{RoleAdmin, RoleExporter, RoleViewer, RoleViewerNoLocation} {
+		if r == role {
+			return i
+		}
+	}
+	return len(rolePermissions)
+}
+
+// username picks the local username for a new account from the ID token, and
+// the claim it came from
+func (cfg *oidcSettings) username(claims jwt.MapClaims) (string, string) {
+	for _, claim := range []string{cfg.UsernameClaim, "email"} {
+		if name, _ := claims[claim].(string); usernamePattern.MatchString(name) {
+			return name, claim
+		}
+	}
+	return "", ""
+}
+
+// trustedForLinking reports whether claim is one the provider vouches for, so
+// that matching it to a local username may link the two accounts. Users can edit
+// most profile claims at the provider, often including an unverified email.
+func (cfg *oidcSettings) trustedForLinking(claims jwt.MapClaims, claim string) bool {
+	if claim == "email" && claims["email_verified"] == true {
+		return true
+	}
+	for _, trusted := range cfg.LinkClaims {
+		if trusted == claim {
+			return true
+		}
+	}
+	return false
+}
+
+// --- Provider discovery and keys ---
+
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	mu        sync.Mutex
+	keys      map[string]interface{}
+	keysFetch time.Time
+}
+
+var (
+	oidcProviderMu sync.Mutex
+	oidcProviders  = map[string]*oidcProvider{}
+)
+
+func fetchJSON(target string, v interface{}) error {
+	resp, err := oidcHTTPClient.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", target, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discoverOIDC reads the provider's metadata once per issuer
+func discoverOIDC(issuer string) (*oidcProvider, error) {
+	oidcProviderMu.Lock()
+	defer oidcProviderMu.Unlock()
+	if p, ok := oidcProviders[issuer]; ok {
+		return p, nil
+	}
+
+	p := &oidcProvider{}
+	if err := fetchJSON(issuer+"/.well-known/openid-configuration", p); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("provider reports issuer %q, expected %q", p.Issuer, issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, errors.New("provider metadata is missing endpoints")
+	}
+	oidcProviders[issuer] = p
+	return p, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// publicKey converts an RSA or EC signing key; other keys are skipped
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	if k.Use != "" && k.Use != "sig" {
+		return nil, nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, nil
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+// key returns the provider's signing key kid, refetching the key set when the
+// provider has rotated to a key we haven't seen
+func (p *oidcProvider) key(kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key := p.lookupKey(kid); key != nil {
+		return key, nil
+	}
+	if time.Since(p.keysFetch) < oidcKeysRefresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	p.keysFetch = time.Now()
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := fetchJSON(p.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys = map[string]interface{}{}
+	for _, k := range set.Keys {
+		if key, err := k.publicKey(); err == nil && key != nil {
+			p.keys[k.Kid] = key
+		}
+	}
+	if key := p.lookupKey(kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (p *oidcProvider) lookupKey(kid string) interface{} {
+	if key, ok := p.keys[kid]; ok {
+		return key
+	}
+	// Tokens may omit the kid when the provider has a single key
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return nil
+}
+
+// verifyIDToken checks the ID token's signature, issuer, audience, expiry and nonce
+func (p *oidcProvider) verifyIDToken(cfg *oidcSettings, raw, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if got, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+		return nil, errors.New("nonce mismatch")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("missing sub claim")
+	}
+	return claims, nil
+}
+
+// exchangeCode redeems an authorization code with its PKCE verifier for an ID token
+func (p *oidcProvider) exchangeCode(cfg *oidcSettings, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {cfg.RedirectURL},
+		"client_id":     {cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	}
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("token endpoint: %s %s %s", resp.Status, body.Error, body.Description)
+	}
+	return body.IDToken, nil
+}
+
+// --- Pending logins ---
+
+// oidcPending is a login that went off to the provider, keyed by its state.
+// linkUser is set when a signed-in user links their provider account instead.
+type oidcPending struct {
+	verifier string
+	nonce    string
+	linkUser uint
+	created  time.Time
+}
+
+// oidcLogin holds the tokens of a finished login until the app collects them with
+// the one-time code it was redirected with
+type oidcLogin struct {
+	tokens  gin.H
+	created time.Time
+}
+
+var (
+	oidcStoreMu sync.Mutex
+	oidcStates  = map[string]oidcPending{}
+	oidcLogins  = map[string]oidcLogin{}
+)
+
+func randomToken() (string, error) {
+	b, err := randomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func pruneOIDCStore(now time.Time) {
+	for state, p := range oidcStates {
+		if now.Sub(p.created) > oidcStateTTL {
+			delete(oidcStates, state)
+		}
+	}
+	for code, l := range oidcLogins {
+		if now.Sub(l.created) > oidcLoginCodeTTL {
+			delete(oidcLogins, code)
+		}
+	}
+}
+
+// oidcUser finds the account linked to the ID token's subject. On first login it
+// creates one, or links the local account of the same username if that has no
+// password or second factor to protect it and a trusted claim names it. Other
+// accounts are linked by their user while signed in (see startOIDCLink).
+func oidcUser(cfg *oidcSettings, claims jwt.MapClaims) (*models.User, error) {
+	sub, _ := claims["sub"].(string)
+	role := cfg.roleFor(claims)
+
+	var user models.User
+	if err := database.DB.Where("oidc_subject = ?", sub).First(&user).Error; err != nil {
+		username, claim := cfg.username(claims)
+		if username == "" {
+			return nil, errors.New("the ID token has no usable username")
+		}
+		existing, err := findUser(username)
+		switch {
+		case err == nil && (existing.OIDCSubject != "" || existing.PasswordHash != "" || existing.TOTPEnabled ||
+			existing.Role == RoleAdmin || !cfg.trustedForLinking(claims, claim)):
+			return nil, errOIDCConflict
+		case err == nil:
+			user = *existing
+			if err := database.DB.Model(&user).UpdateColumn("oidc_subject", sub).Error; err != nil {
+				return nil, err
+			}
+			log.Printf("AUTH: Linked user %q to single sign-on", username)
+		default:
+			if role == "" {
+				role = cfg.DefaultRole
+			}
+			if role == "" {
+				return nil, errOIDCNoRole
+			}
+			// No password: the account can only sign in through the provider
+			user = models.User{Username: username, Role: role, OIDCSubject: sub, PasswordChangedAt: time.Now()}
+			if err := database.DB.Create(&user).Error; err != nil {
+				return nil, err
+			}
+			log.Printf("AUTH: Created user %q (%s) from single sign-on", username, role)
+		}
+	}
+
+	// The provider's groups stay authoritative for mapped roles, except that they
+	// can't demote the last admin (see updateUser)
+	if role != "" && role != user.Role && isLastAdmin(&user) {
+		log.Printf("AUTH: Single sign-on would demote %q to %s, but they are the last admin", user.Username, role)
+	} else if role != "" && role != user.Role {
+		if err := database.DB.Model(&user).UpdateColumn("role", role).Error; err != nil {
+			return nil, err
+		}
+		log.Printf("AUTH: Role of user %q changed to %s by single sign-on", user.Username, role)
+		user.Role = role
+	}
+	return &user, nil
+}
+
+// --- Handlers (public) ---
+
+// getOIDCStatus tells the login page whether to offer single sign-on
+func getOIDCStatus(c *gin.Context) {
+	cfg, err := oidcConfig()
+	c.JSON(http.StatusOK, gin.H{"enabled": cfg != nil && err == nil})
+}
+
+// oidcLoginRedirect sends the browser to the provider with a fresh state, nonce and
+// PKCE challenge
+func oidcLoginRedirect(c *gin.Context) {
+	if target, ok := startOIDC(c, 0); ok {
+		c.Redirect(http.StatusFound, target)
+	}
+}
+
+// startOIDCLink begins linking the caller's account to their provider account.
+// The app sends the browser to the returned URL; the callback then links the
+// subject to this user instead of logging in.
+func startOIDCLink(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authentication is disabled"})
+		return
+	}
+	if target, ok := startOIDC(c, user.ID); ok {
+		c.JSON(http.StatusOK, gin.H{"redirect": target})
+	}
+}
+
+// startOIDC records a pending login (or link, for linkUser) and returns the
+// provider's authorization URL, setting the state cookie. On failure it has
+// already responded.
+func startOIDC(c *gin.Context, linkUser uint) (string, bool) {
+	cfg, err := oidcConfig()
+	if cfg == nil {
+		if err != nil {
+			log.Printf("AUTH: Single sign-on is misconfigured: %v", err)
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return "", false
+	}
+	provider, err := discoverOIDC(cfg.Issuer)
+	if err != nil {
+		log.Printf("AUTH: OIDC discovery for %s failed: %v", cfg.Issuer, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "The identity provider is unavailable"})
+		return "", false
+	}
+
+	var state, nonce, verifier string
+	for _, v := range []*string{&state, &nonce, &verifier} {
+		if *v, err = randomToken(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+			return "", false
+		}
+	}
+	oidcStoreMu.Lock()
+	pruneOIDCStore(time.Now())
+	if len(oidcStates) >= maxOIDCPending {
+		oidcStoreMu.Unlock()
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many pending logins. Please try again later."})
+		return "", false
+	}
+	oidcStates[state] = oidcPending{verifier: verifier, nonce: nonce, linkUser: linkUser, created: time.Now()}
+	oidcStoreMu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {cfg.ClientID},
+		"redirect_uri":          {cfg.RedirectURL},
+		"scope":                 {cfg.Scopes},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	target, err := url.Parse(provider.AuthorizationEndpoint)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "The identity provider is unavailable"})
+		return "", false
+	}
+	for key, values := range target.Query() {
+		query[key] = values
+	}
+	target.RawQuery = query.Encode()
+
+	// Ties the callback to this browser, so nobody can log a victim into their account
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, int(oidcStateTTL.Seconds()), "/api/oidc", "", c.Request.TLS != nil, true)
+	return target.String(), true
+}
+
+// oidcCallback finishes the login the provider redirected back, then sends the
+// browser to the app with a one-time code for its tokens
+func oidcCallback(c *gin.Context) {
+	cfg, err := oidcConfig()
+	if cfg == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "The identity provider refused the login: " + e})
+		return
+	}
+
+	state := c.Query("state")
+	cookie, _ := c.Cookie(oidcStateCookie)
+	c.SetCookie(oidcStateCookie, "", -1, "/api/oidc", "", c.Request.TLS != nil, true)
+	oidcStoreMu.Lock()
+	pending, ok := oidcStates[state]
+	delete(oidcStates, state)
+	oidcStoreMu.Unlock()
+	if !ok || state == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) != 1 || time.Since(pending.created) > oidcStateTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Login request expired, please try again"})
+		return
+	}
+
+	provider, err := discoverOIDC(cfg.Issuer)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "The identity provider is unavailable"})
+		return
+	}
+	rawIDToken, err := provider.exchangeCode(cfg, c.Query("code"), pending.verifier)
+	if err != nil {
+		log.Printf("AUTH: OIDC code exchange failed from IP %s: %v", c.ClientIP(), err)
+		audit(c, models.AuditEvent{Action: AuditLoginFailed, Detail: "single sign-on code exchange failed"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Single sign-on failed"})
+		return
+	}
+	claims, err := provider.verifyIDToken(cfg, rawIDToken, pending.nonce)
+	if err != nil {
+		log.Printf("AUTH: Rejected OIDC ID token from IP %s: %v", c.ClientIP(), err)
+		audit(c, models.AuditEvent{Action: AuditLoginFailed, Detail: "single sign-on ID token rejected"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Single sign-on failed"})
+		return
+	}
+
+	if pending.linkUser != 0 {
+		linkOIDCSubject(c, pending.linkUser, claims)
+		return
+	}
+
+	user, err := oidcUser(cfg, claims)
+	switch {
+	case err == errOIDCNoRole:
+		audit(c, models.AuditEvent{Action: AuditLoginFailed, Detail: fmt.Sprintf("single sign-on for %v refused: no role mapping matches", claims["sub"])})
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your account has not been given access to Teslaxy"})
+		return
+	case err == errOIDCConflict:
+		c.JSON(http.StatusConflict, gin.H{"error": "This username is already linked to another account"})
+		return
+	case err != nil:
+		log.Printf("AUTH: Single sign-on failed: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Single sign-on failed"})
+		return
+	}
+
+	tokens, err := startSession(c, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+	now := time.Now()
+	database.DB.Model(user).UpdateColumn("last_login_at", &now)
+	audit(c, models.AuditEvent{Action: AuditLogin, Username: user.Username, Detail: "single sign-on"})
+
+	code, err := randomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+	oidcStoreMu.Lock()
+	oidcLogins[code] = oidcLogin{tokens: tokens, created: now}
+	oidcStoreMu.Unlock()
+	// Tokens never appear in a URL; the app trades the code for them
+	c.Redirect(http.StatusFound, "/?oidc_code="+url.QueryEscape(code))
+}
+
+// linkOIDCSubject finishes a link started by a signed-in user with startOIDCLink
+func linkOIDCSubject(c *gin.Context, userID uint, claims jwt.MapClaims) {
+	sub, _ := claims["sub"].(string)
+	var user models.User
+	if err := database.DB.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	var linked int
+	database.DB.Model(&models.User{}).Where("oidc_subject = ? AND id <> ?", sub, user.ID).Count(&linked)
+	if sub == "" || linked > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "This provider account is already linked to another user"})
+		return
+	}
+	if err := database.DB.Model(&user).UpdateColumn("oidc_subject", sub).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link the account"})
+		return
+	}
+	// The callback carries no session, so name the user
+	audit(c, models.AuditEvent{Action: AuditOIDCLink, Username: user.Username})
+	c.Redirect(http.StatusFound, "/?oidc_linked=1")
+}
+
+// oidcExchange hands out the tokens of a finished single sign-on, once
+func oidcExchange(c *gin.Context) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+		return
+	}
+	oidcStoreMu.Lock()
+	login, ok := oidcLogins[req.Code]
+	delete(oidcLogins, req.Code)
+	oidcStoreMu.Unlock()
+	if !ok || time.Since(login.created) > oidcLoginCodeTTL {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login code expired, please log in again"})
+		return
+	}
+	c.JSON(http.StatusOK, login.tokens)
+}
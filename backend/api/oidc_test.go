@@ -0,0 +1,364 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+const oidcRedirect = "http://teslaxy.test/api/oidc/callback"
+
+// mockOIDC is an in-process identity provider. claims are added to the next ID
+// tokens it issues; audience and nonce can be overridden to test rejections.
+type mockOIDC struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu       sync.Mutex
+	claims   jwt.MapClaims
+	audience string
+	nonce    string
+	grants   map[string]url.Values // Authorization code -> the authorize request
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockOIDC{key: key, grants: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != "teslaxy" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			http.Error(w, "bad authorize request", http.StatusBadRequest)
+			return
+		}
+		code, _ := randomToken()
+		m.mu.Lock()
+		m.grants[code] = q
+		m.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", m.token)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+func (m *mockOIDC) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	grant, ok := m.grants[r.PostForm.Get("code")]
+	delete(m.grants, r.PostForm.Get("code"))
+
+	id, secret, _ := r.BasicAuth()
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || id != "teslaxy" || secret != "s3cret" ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != grant.Get("code_challenge") ||
+		r.PostForm.Get("redirect_uri") != grant.Get("redirect_uri") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":   m.server.URL,
+		"aud":   "teslaxy",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": grant.Get("nonce"),
+	}
+	if m.audience != "" {
+		claims["aud"] = m.audience
+	}
+	if m.nonce != "" {
+		claims["nonce"] = m.nonce
+	}
+	for k, v := range m.claims {
+		claims[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "k1"
+	signed, _ := token.SignedString(m.key)
+	json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+}
+
+func (m *mockOIDC) setClaims(claims jwt.MapClaims) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.claims = claims
+}
+
+func setupOIDCTest(t *testing.T) (*gin.Engine, *mockOIDC) {
+	r := setupSessionTest(t)
+	m := newMockOIDC(t)
+	for key, value := range map[string]string{
+		"OIDC_ISSUER":        m.server.URL,
+		"OIDC_CLIENT_ID":     "teslaxy",
+		"OIDC_CLIENT_SECRET": "s3cret",
+		"OIDC_REDIRECT_URL":  oidcRedirect,
+		"OIDC_ROLE_MAP":      "family=viewer, admins=admin",
+	} {
+		os.Setenv(key, value)
+		t.Cleanup(func() { os.Unsetenv(key) })
+	}
+	t.Cleanup(func() {
+		oidcProviderMu.Lock()
+		oidcProviders = map[string]*oidcProvider{}
+		oidcProviderMu.Unlock()
+	})
+	return r, m
+}
+
+// startOIDCLogin follows the redirect to the provider and returns the callback URL
+// it sends the browser back to, plus the state cookie
+func startOIDCLogin(t *testing.T, r *gin.Engine) (*url.URL, *http.Cookie) {
+	w := get(r, "/api/oidc/login", nil)
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect to the provider, got %d %s", w.Code, w.Body.String())
+	}
+	return authorizeOIDC(t, w, w.Header().Get("Location"))
+}
+
+// authorizeOIDC visits the provider's authorization URL target, which response w
+// sent along with the state cookie
+func authorizeOIDC(t *testing.T, w *httptest.ResponseRecorder, target string) (*url.URL, *http.Cookie) {
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("Expected an HttpOnly state cookie, got %v", cookies)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(callback.String(), oidcRedirect) {
+		t.Fatalf("Expected a redirect to the callback, got %d %q", resp.StatusCode, callback)
+	}
+	return callback, cookies[0]
+}
+
+func finishOIDCLogin(r *gin.Engine, callback *url.URL, cookie *http.Cookie) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", callback.RequestURI(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// oidcRoundTrip runs a login through the provider and returns the callback response
+func oidcRoundTrip(t *testing.T, r *gin.Engine) *httptest.ResponseRecorder {
+	callback, cookie := startOIDCLogin(t, r)
+	return finishOIDCLogin(r, callback, cookie)
+}
+
+// oidcLoginAs signs in through the provider and returns the app's access token
+func oidcLoginAs(t *testing.T, r *gin.Engine, m *mockOIDC, claims jwt.MapClaims) string {
+	m.setClaims(claims)
+	w := oidcRoundTrip(t, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected the callback to redirect to the app, got %d %s", w.Code, w.Body.String())
+	}
+	location, _ := url.Parse(w.Header().Get("Location"))
+	code := location.Query().Get("oidc_code")
+	assert.Equal(t, "/", location.Path)
+
+	w = sendJSON(r, "POST", "/api/oidc/exchange", "", map[string]string{"code": code})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Code exchange failed: %d %s", w.Code, w.Body.String())
+	}
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(r, "POST", "/api/oidc/exchange", "", map[string]string{"code": code}).Code,
+		"login codes are single use")
+	var pair tokenPair
+	json.Unmarshal(w.Body.Bytes(), &pair)
+	return pair.Token
+}
+
+func me(t *testing.T, r *gin.Engine, token string) models.User {
+	w := sendJSON(r, "GET", "/api/me", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/me = %d %s", w.Code, w.Body.String())
+	}
+	var user models.User
+	json.Unmarshal(w.Body.Bytes(), &user)
+	return user
+}
+
+func TestOIDCCreatesUser(t *testing.T) {
+	r, m := setupOIDCTest(t)
+	w := get(r, "/api/oidc", nil)
+	assert.JSONEq(t, `{"enabled":true}`, w.Body.String())
+
+	token := oidcLoginAs(t, r, m, jwt.MapClaims{"sub": "u-1", "preferred_username": "alex", "groups": []string{"family", "other"}})
+	user := me(t, r, token)
+	assert.Equal(t, "alex", user.Username)
+	assert.Equal(t, RoleViewer, user.Role)
+	assert.Equal(t, "u-1", user.OIDCSubject)
+
+	// The next login finds the same account, and the provider's groups decide its role
+	token = oidcLoginAs(t, r, m, jwt.MapClaims{"sub": "u-1", "preferred_username": "renamed", "groups": []string{"family", "admins"}})
+	user = me(t, r, token)
+	assert.Equal(t, "alex", user.Username)
+	assert.Equal(t, RoleAdmin, user.Role)
+
+	// Losing the group at the provider can't demote the last admin
+	database.DB.Where("role = ? AND username <> ?", RoleAdmin, "alex").Delete(&models.User{})
+	token = oidcLoginAs(t, r, m, jwt.MapClaims{"sub": "u-1", "groups": []string{"family"}})
+	assert.Equal(t, RoleAdmin, me(t, r, token).Role)
+	createUserRecord("root", "roots password", RoleAdmin)
+	token = oidcLoginAs(t, r, m, jwt.MapClaims{"sub": "u-1", "groups": []string{"family"}})
+	assert.Equal(t, RoleViewer, me(t, r, token).Role)
+
+	// The account has no password to log in with
+	resetRateLimit()
+	w = sendJSON(r, "POST", "/api/login", "", map[string]string{"username": "alex", "password": ""})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestOIDCLinksLocalUser(t *testing.T) {
+	r, m := setupOIDCTest(t)
+
+	// sam has a password, so only sam can link the provider account
+	m.setClaims(jwt.MapClaims{"sub": "s-1", "preferred_username": "sam", "email": "sam", "email_verified": true})
+	assert.Equal(t, http.StatusConflict, oidcRoundTrip(t, r).Code)
+
+	w := sendJSON(r, "POST", "/api/me/oidc", loginPair(t, r).Token, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var started struct{ Redirect string }
+	json.Unmarshal(w.Body.Bytes(), &started)
+	callback, cookie := authorizeOIDC(t, w, started.Redirect)
+	w = finishOIDCLogin(r, callback, cookie)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/?oidc_linked=1", w.Header().Get("Location"))
+
+	user := me(t, r, oidcLoginAs(t, r, m, jwt.MapClaims{"sub": "s-1", "preferred_username": "sam"}))
+	assert.Equal(t, "sam", user.Username)
+	assert.Equal(t, RoleViewer, user.Role, "an unmapped account keeps its role")
+
+	var count int
+	database.DB.Model(&models.User{}).Count(&count)
+	assert.Equal(t, 2, count)
+
+	// Password login still works as a fallback
+	loginPair(t, r)
+
+	// Another provider account can't take over the username
+	m.setClaims(jwt.MapClaims{"sub": "s-2", "preferred_username": "sam", "groups": "admins"})
+	assert.Equal(t, http.StatusConflict, oidcRoundTrip(t, r).Code)
+}
+
+func TestOIDCLinkNeedsTrustedClaim(t *testing.T) {
+	r, m := setupOIDCTest(t)
+	createUserRecord("root", "roots password", RoleAdmin)
+
+	// Profile claims a provider user can edit never reach an existing account
+	for _, claims := range []jwt.MapClaims{
+		{"sub": "x-1", "preferred_username": "root", "groups": "admins"},
+		{"sub": "x-1", "email": "root", "email_verified": false},
+		{"sub": "x-1", "email": "root", "email_verified": true},
+		{"sub": "x-1", "preferred_username": "kim"},
+		{"sub": "x-1", "email": "kim"},
+	} {
+		if claims["preferred_username"] == "kim" {
+			// An account without a password is still only linked on a trusted claim
+			database.DB.Create(&models.User{Username: "kim", Role: RoleViewer})
+		}
+		m.setClaims(claims)
+		assert.Equal(t, http.StatusConflict, oidcRoundTrip(t, r).Code, claims)
+	}
+	var root models.User
+	database.DB.Where("username = ?", "root").First(&root)
+	assert.Empty(t, root.OIDCSubject)
+	assert.Equal(t, RoleAdmin, root.Role)
+
+	user := me(t, r, oidcLoginAs(t, r, m, jwt.MapClaims{"sub": "x-1", "email": "kim", "email_verified": true}))
+	assert.Equal(t, "kim", user.Username)
+
+	// OIDC_LINK_CLAIMS vouches for other claims
+	database.DB.Create(&models.User{Username: "lee", Role: RoleViewer})
+	os.Setenv("OIDC_LINK_CLAIMS", "preferred_username")
+	t.Cleanup(func() { os.Unsetenv("OIDC_LINK_CLAIMS") })
+	user = me(t, r, oidcLoginAs(t, r, m, jwt.MapClaims{"sub": "x-2", "preferred_username": "lee"}))
+	assert.Equal(t, "lee", user.Username)
+}
+
+func TestOIDCRejections(t *testing.T) {
+	r, m := setupOIDCTest(t)
+
+	// Unmapped new accounts need OIDC_DEFAULT_ROLE
+	m.setClaims(jwt.MapClaims{"sub": "u-2", "preferred_username": "guest", "groups": []string{"neighbours"}})
+	assert.Equal(t, http.StatusForbidden, oidcRoundTrip(t, r).Code)
+	os.Setenv("OIDC_DEFAULT_ROLE", RoleViewerNoLocation)
+	t.Cleanup(func() { os.Unsetenv("OIDC_DEFAULT_ROLE") })
+	user := me(t, r, oidcLoginAs(t, r, m, jwt.MapClaims{"sub": "u-2", "preferred_username": "guest"}))
+	assert.Equal(t, RoleViewerNoLocation, user.Role)
+
+	// The callback must come back to the browser that started the login, once
+	callback, cookie := startOIDCLogin(t, r)
+	assert.Equal(t, http.StatusBadRequest, finishOIDCLogin(r, callback, nil).Code)
+	callback, cookie = startOIDCLogin(t, r)
+	assert.Equal(t, http.StatusFound, finishOIDCLogin(r, callback, cookie).Code)
+	assert.Equal(t, http.StatusBadRequest, finishOIDCLogin(r, callback, cookie).Code)
+
+	// A code from another login fails PKCE: this login's verifier doesn't match it
+	stolen, _ := startOIDCLogin(t, r)
+	callback, cookie = startOIDCLogin(t, r)
+	q := callback.Query()
+	q.Set("code", stolen.Query().Get("code"))
+	callback.RawQuery = q.Encode()
+	assert.Equal(t, http.StatusUnauthorized, finishOIDCLogin(r, callback, cookie).Code)
+
+	// ID tokens for another client or login are rejected
+	m.audience = "someone-else"
+	assert.Equal(t, http.StatusUnauthorized, oidcRoundTrip(t, r).Code)
+	m.audience, m.nonce = "", "replayed"
+	assert.Equal(t, http.StatusUnauthorized, oidcRoundTrip(t, r).Code)
+	m.nonce = ""
+
+	assert.Equal(t, http.StatusBadRequest, finishOIDCLogin(r, &url.URL{Path: "/api/oidc/callback", RawQuery: "code=x&state=forged"}, cookie).Code)
+}
+
+func TestOIDCDisabled(t *testing.T) {
+	r := setupSessionTest(t)
+	assert.JSONEq(t, `{"enabled":false}`, get(r, "/api/oidc", nil).Body.String())
+	assert.Equal(t, http.StatusNotFound, get(r, "/api/oidc/login", nil).Code)
+}
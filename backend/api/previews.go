@@ -0,0 +1,48 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"teslaxy/models"
+	"teslaxy/services"
+)
+
+// getClipPreview serves a short silent animated preview of a clip for hovering the
+// clip list: ?format=mp4 (default) or webp
+func getClipPreview(c *gin.Context) {
+	format, ok := services.PreviewFormatByName(c.Query("format"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported preview format"})
+		return
+	}
+	clip, ok := loadStreamClip(c)
+	if !ok {
+		return
+	}
+
+	preview, err := services.ClipPreview(c.Request.Context(), clip, format, false)
+	switch {
+	case errors.Is(err, services.ErrNoCameraFootage), errors.Is(err, services.ErrNoPreview):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, services.ErrTranscoderBusy):
+		transcoderBusy(c)
+		return
+	case errors.Is(err, context.Canceled):
+		return
+	case err != nil:
+		log.Printf("Preview error for clip %d: %v", clip.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate preview"})
+		return
+	}
+
+	auditView(c, models.AuditEvent{Action: AuditViewPreview, ClipID: clip.ID})
+	// The URL stays the same when the clip gains footage, so revalidate
+	c.Header("Cache-Control", "private, no-cache")
+	c.Header("Content-Type", format.ContentType)
+	c.File(preview)
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"teslaxy/database"
+	"teslaxy/models"
+	"teslaxy/services"
+)
+
+// getClipReport renders an incident report for a clip.
+//
+// Query params:
+//   - format: "html" (default) or "pdf"
+//   - window: seconds of telemetry either side of the incident (default 30, max 300)
+func getClipReport(c *gin.Context) {
+	format := c.DefaultQuery("format", "html")
+	if format != "html" && format != "pdf" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format"})
+		return
+	}
+
+	opts := services.ReportOptions{Window: services.DefaultReportWindow}
+	if v := c.Query("window"); v != "" {
+		window, err := strconv.ParseFloat(v, 64)
+		if err != nil || window <= 0 || window > services.MaxReportWindow {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid window parameter"})
+			return
+		}
+		opts.Window = window
+	}
+
+	// Absolute links so the downloaded report still points back at this server
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	opts.BaseURL = scheme + "://" + c.Request.Host
+
+	var clip models.Clip
+	if err := database.DB.Preload("VideoFiles").Preload("Telemetry").First(&clip, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Clip not found"})
+		return
+	}
+
+	report, err := services.BuildIncidentReport(clip, opts)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	audit(c, models.AuditEvent{Action: AuditViewReport, ClipID: clip.ID, Detail: format})
+
+	filename := fmt.Sprintf("teslaxy_report_%s_%d.%s", report.IncidentTime.Format("20060102_150405"), clip.ID, format)
+	if format == "pdf" {
+		c.Header("Content-Type", "application/pdf")
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		c.Status(http.StatusOK)
+		if err := services.WriteReportPDF(c.Writer, report); err != nil {
+			log.Printf("PDF report for clip %d failed: %v", clip.ID, err)
+		}
+		return
+	}
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, filename))
+	c.Status(http.StatusOK)
+	if err := services.WriteReportHTML(c.Writer, report); err != nil {
+		log.Printf("HTML report for clip %d failed: %v", clip.ID, err)
+	}
+}
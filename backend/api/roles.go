@@ -0,0 +1,88 @@
+package api
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"teslaxy/models"
+)
+
+// Permission is one thing a role may do; routes declare what they need with
+// RequirePermission
+type Permission string
+
+const (
+	PermViewClips    Permission = "view_clips"    // Browse clips and play footage
+	PermViewLocation Permission = "view_location" // GPS, city, telemetry and reports
+	PermExport       Permission = "export"        // Exports, archives and masks
+	PermShare        Permission = "share"         // Public share links
+	PermManageUsers  Permission = "manage_users"
+	PermRescan       Permission = "rescan" // Rescan the library and see server status
+	PermAudit        Permission = "audit"  // Read the audit log
+)
+
+const (
+	RoleAdmin            = "admin"
+	RoleExporter         = "exporter"
+	RoleViewer           = "viewer"
+	RoleViewerNoLocation = "viewer_no_location"
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleAdmin:            {PermViewClips, PermViewLocation, PermExport, PermShare, PermManageUsers, PermRescan, PermAudit},
+	RoleExporter:         {PermViewClips, PermViewLocation, PermExport, PermShare},
+	RoleViewer:           {PermViewClips, PermViewLocation},
+	RoleViewerNoLocation: {PermViewClips},
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func roleHas(role string, perm Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPermission checks the role carried in the request's token, and the scopes of
+// its API key if it used one. Everything is allowed when AUTH_ENABLED is not set.
+func hasPermission(c *gin.Context, perm Permission) bool {
+	v, ok := c.Get("claims")
+	if !ok {
+		return os.Getenv("AUTH_ENABLED") != "true"
+	}
+	claims, ok := v.(*Claims)
+	if !ok || !roleHas(claims.Role, perm) {
+		return false
+	}
+	if key := currentAPIKey(c); key != nil {
+		return apiKeyAllows(key, perm)
+	}
+	return true
+}
+
+// RequirePermission rejects requests whose role lacks any of perms
+func RequirePermission(perms ...Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, perm := range perms {
+			if !hasPermission(c, perm) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Your account is not allowed to do this"})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// stripLocation removes everything that reveals where a clip was recorded, and
+// the rest of its telemetry (speed, gear, steering, Autopilot)
+func stripLocation(clip *models.Clip) {
+	clip.City = ""
+	clip.Telemetry = models.Telemetry{}
+}
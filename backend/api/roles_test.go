@@ -0,0 +1,138 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+// tokenFor creates an account with role and returns a token for a session of it
+func tokenFor(t *testing.T, username, role string) string {
+	createTestSession(t, username, role, username+"-session")
+	token, _ := generateToken(username, role, username+"-session")
+	return token
+}
+
+func TestRoutePermissions(t *testing.T) {
+	r, _ := setupShareTest(t)
+	tokens := map[string]string{
+		RoleAdmin:            tokenFor(t, "ann", RoleAdmin),
+		RoleExporter:         tokenFor(t, "eve", RoleExporter),
+		RoleViewer:           tokenFor(t, "vic", RoleViewer),
+		RoleViewerNoLocation: tokenFor(t, "nol", RoleViewerNoLocation),
+	}
+
+	// Roles allowed through, in order: admin, exporter, viewer, viewer without location
+	tests := []struct {
+		method, url string
+		allowed     [4]bool
+	}{
+		{"GET", "/api/clips", [4]bool{true, true, true, true}},
+		{"GET", "/api/clips/1/preview?format=gif", [4]bool{true, true, true, true}},
+		{"GET", "/api/clips/1/report", [4]bool{true, true, true, false}},
+		{"GET", "/api/clips/1/archive", [4]bool{true, true, false, false}},
+		{"GET", "/api/exports", [4]bool{true, true, false, false}},
+		{"POST", "/api/export", [4]bool{true, true, false, false}},
+		{"GET", "/api/masks", [4]bool{true, true, false, false}},
+		{"GET", "/api/shares", [4]bool{true, true, false, false}},
+		{"GET", "/api/users", [4]bool{true, false, false, false}},
+		{"GET", "/api/thumbnails/stats", [4]bool{true, false, false, false}},
+		{"GET", "/api/transcode/status", [4]bool{true, true, true, true}},
+		{"POST", "/api/rescan", [4]bool{true, false, false, false}},
+		{"GET", "/api/me", [4]bool{true, true, true, true}},
+	}
+	for _, tt := range tests {
+		for i, role := range []string{RoleAdmin, RoleExporter, RoleViewer, RoleViewerNoLocation} {
+			code := sendJSON(r, tt.method, tt.url, tokens[role], nil).Code
+			if tt.allowed[i] && code == http.StatusForbidden {
+				t.Errorf("%s %s: expected %s to be allowed", tt.method, tt.url, role)
+			}
+			if !tt.allowed[i] && code != http.StatusForbidden {
+				t.Errorf("%s %s: expected 403 for %s, got %d", tt.method, tt.url, role, code)
+			}
+		}
+	}
+}
+
+func TestViewerWithoutLocation(t *testing.T) {
+	r, clip := setupShareTest(t)
+	telemetry := models.Telemetry{ClipID: clip.ID, Latitude: -34.9, Longitude: 138.6, Speed: 87.5, Gear: "D", AutopilotState: "FSD", FullDataJson: `{"latitude_deg":-34.9}`}
+	database.DB.Create(&telemetry)
+	database.DB.Model(&clip).Updates(map[string]interface{}{"city": "Adelaide", "telemetry_id": telemetry.ID})
+
+	viewer := tokenFor(t, "vic", RoleViewer)
+	restricted := tokenFor(t, "nol", RoleViewerNoLocation)
+
+	for _, url := range []string{"/api/clips", "/api/clips/1"} {
+		w := sendJSON(r, "GET", url, viewer, nil)
+		assert.Contains(t, w.Body.String(), "Adelaide", url)
+		assert.Contains(t, w.Body.String(), "-34.9", url)
+
+		w = sendJSON(r, "GET", url, restricted, nil)
+		assert.Equal(t, http.StatusOK, w.Code, url)
+		assert.NotContains(t, w.Body.String(), "Adelaide", url)
+		assert.NotContains(t, w.Body.String(), "-34.9", url)
+		assert.NotContains(t, w.Body.String(), "138.6", url)
+		assert.NotContains(t, w.Body.String(), "87.5", url)
+		assert.NotContains(t, w.Body.String(), "FSD", url)
+	}
+
+	w := sendJSON(r, "GET", "/api/me", restricted, nil)
+	assert.Contains(t, w.Body.String(), `"permissions":["view_clips"]`)
+}
+
+func TestRoleChangeSignsOut(t *testing.T) {
+	r, _ := setupShareTest(t)
+	admin, _ := generateToken("admin", RoleAdmin, adminSession)
+	token := tokenFor(t, "eve", RoleExporter)
+
+	var eve models.User
+	database.DB.Where("username = ?", "eve").First(&eve)
+	w := sendJSON(r, "PUT", fmt.Sprintf("/api/users/%d", eve.ID), admin, map[string]string{"role": RoleViewer})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The token still claims exporter, so it is no longer accepted
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(r, "GET", "/api/exports", token, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(r, "GET", "/api/clips", token, nil).Code)
+
+	// Nor is a role claim that does not match the account
+	tokenFor(t, "vic", RoleViewer)
+	mismatched, _ := generateToken("vic", RoleAdmin, "vic-session")
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(r, "GET", "/api/users", mismatched, nil).Code)
+}
+
+func TestRescanLibrary(t *testing.T) {
+	r, _ := setupShareTest(t)
+	admin, _ := generateToken("admin", RoleAdmin, adminSession)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	Rescanner = func() {
+		close(started)
+		<-release
+	}
+	t.Cleanup(func() { Rescanner = nil })
+
+	assert.Equal(t, http.StatusAccepted, sendJSON(r, "POST", "/api/rescan", admin, nil).Code)
+	<-started
+	assert.Equal(t, http.StatusConflict, sendJSON(r, "POST", "/api/rescan", admin, nil).Code)
+	close(release)
+}
+
+func TestTranscodeStatusHidesQueuesFromViewers(t *testing.T) {
+	r, _ := setupShareTest(t)
+
+	w := sendJSON(r, "GET", "/api/transcode/status", tokenFor(t, "ann", RoleAdmin), nil)
+	assert.Contains(t, w.Body.String(), `"scheduler"`)
+	assert.Contains(t, w.Body.String(), `"proxies"`)
+
+	w = sendJSON(r, "GET", "/api/transcode/status", tokenFor(t, "vic", RoleViewer), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"encoder"`)
+	assert.NotContains(t, w.Body.String(), `"scheduler"`)
+	assert.NotContains(t, w.Body.String(), `"proxies"`)
+}
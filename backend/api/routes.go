@@ -3,10 +3,14 @@ package api
 import (
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"io"
+	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
@@ -26,25 +30,114 @@ func SetupRoutes(r *gin.Engine) {
 
 	// Login endpoint (public)
 	api.POST("/login", Login)
+	api.POST("/login/totp", loginTOTP)
+	api.POST("/login/totp/enroll", loginTOTPEnroll)
+	api.POST("/refresh", refreshSession)
 	api.GET("/version", GetVersion)
+	// First-run setup: creates the first admin while no accounts exist
+	api.GET("/setup", getSetup)
+	api.POST("/setup", completeSetup)
+	// OpenID Connect single sign-on (see oidc.go)
+	api.GET("/oidc", getOIDCStatus)
+	api.GET("/oidc/login", oidcLoginRedirect)
+	api.GET("/oidc/callback", oidcCallback)
+	api.POST("/oidc/exchange", oidcExchange)
+
+	// Public share links (outside AuthMiddleware; scoped to a single ShareLink)
+	api.POST("/share/:token/unlock", ShareMiddleware(false), unlockShare)
+	share := api.Group("/share/:token", ShareMiddleware(true))
+	{
+		share.GET("", getShare)
+		share.GET("/video/:index", RequireShareVisit(), serveSharedVideo)
+		share.GET("/download", RequireShareVisit(), downloadSharedExport)
+	}
 
 	// Apply Auth Middleware
 	api.Use(AuthMiddleware())
 
+	// Every route below declares the permissions its role needs (see roles.go)
+	view := RequirePermission(PermViewClips)
+	location := RequirePermission(PermViewClips, PermViewLocation)
+	export := RequirePermission(PermExport)
+	shares := RequirePermission(PermShare)
+	users := RequirePermission(PermManageUsers)
+	maintenance := RequirePermission(PermRescan)
+	auditLog := RequirePermission(PermAudit)
+	// Account routes need a login; API keys are turned away
+	session := RequireSession()
+
 	{
-		api.GET("/clips", getClips)
-		api.GET("/clips/:id", getClipDetails)
+		api.GET("/clips", view, getClips)
+		api.GET("/clips/:id", view, getClipDetails)
+		api.GET("/clips/:id/archive", export, downloadArchive)
+		api.GET("/clips/:id/report", location, getClipReport)
+		// Continuous HLS stream of one camera across every file of a clip
+		api.GET("/clips/:id/stream/:camera/index.m3u8", CORSMiddleware(), view, getClipStream)
+		api.GET("/clips/:id/stream/:camera/:segment", CORSMiddleware(), view, getClipStreamSegment)
+		// Scrubber thumbnails: WebVTT track plus one sprite sheet per file
+		api.GET("/clips/:id/storyboard", CORSMiddleware(), view, getStoryboard)
+		api.GET("/clips/:id/storyboard/:sprite", CORSMiddleware(), view, getStoryboardSprite)
+		api.GET("/clips/:id/preview", view, getClipPreview)
+		api.GET("/clips/:id/frame", view, getFrame)
 		// Apply CORS only to video serving to support 3D textures (crossOrigin)
-		api.GET("/video/*path", CORSMiddleware(), serveVideo)
-		api.GET("/thumbnail/*path", getThumbnail)
+		api.GET("/video/*path", CORSMiddleware(), view, serveVideo)
+		// HLS renditions of a single file, transcoded per segment and cached on disk
+		api.GET("/hls/:fileID/master.m3u8", CORSMiddleware(), view, getHLSMaster)
+		api.GET("/hls/:fileID/:rendition/index.m3u8", CORSMiddleware(), view, getHLSMedia)
+		api.GET("/hls/:fileID/:rendition/:segment", CORSMiddleware(), view, getHLSSegment)
+		api.GET("/thumbnail/*path", view, getThumbnail)
+		api.GET("/thumbnails/stats", maintenance, getThumbnailStats)
+		// Short-lived URLs for players and links that can't send the Authorization header
+		api.POST("/media/sign", session, signMediaURLs)
 
 		// Transcoding Status
-		api.GET("/transcode/status", getTranscodeStatus)
+		api.GET("/transcode/status", view, getTranscodeStatus)
+		api.POST("/rescan", maintenance, rescanLibrary)
 
 		// Export Routes
-		api.POST("/export", createExportJob)
-		api.GET("/export/:jobID", getExportStatus)
-		api.GET("/downloads/:filename", downloadExport)
+		api.POST("/export", export, createExportJob)
+		api.POST("/export/batch", export, createBatchExportJob)
+		api.POST("/export/highlights", export, createHighlightReel)
+		api.GET("/export/:jobID", export, getExportStatus)
+		api.GET("/exports", export, listExports)
+		api.DELETE("/exports/:jobID", export, deleteExport)
+		api.GET("/exports/:jobID/download", export, downloadExport)
+		api.GET("/destinations", export, listDestinations)
+
+		// Saved privacy masks, applied to every export of their camera
+		api.GET("/masks", export, listMasks)
+		api.POST("/masks", export, createMask)
+		api.PUT("/masks/:id", export, updateMask)
+		api.DELETE("/masks/:id", export, deleteMask)
+
+		// Share Link Management
+		api.POST("/shares", shares, createShare)
+		api.GET("/shares", shares, listShares)
+		api.DELETE("/shares/:id", shares, revokeShare)
+
+		// Accounts
+		api.GET("/me", getMe)
+		api.PUT("/me/password", session, changePassword)
+		api.POST("/me/totp", session, enrollTOTP)
+		api.POST("/me/totp/confirm", session, confirmTOTP)
+		api.POST("/me/totp/recovery-codes", session, regenerateRecoveryCodes)
+		api.DELETE("/me/totp", session, disableTOTP)
+		api.POST("/me/oidc", session, startOIDCLink)
+		api.POST("/logout", session, logout)
+		api.POST("/logout/all", session, logoutAll)
+		api.GET("/sessions", session, listSessions)
+		api.DELETE("/sessions/:id", session, revokeSession)
+		// Personal API keys for scripts (sent as a Bearer token)
+		api.GET("/keys", session, listAPIKeys)
+		api.POST("/keys", session, createAPIKey)
+		api.DELETE("/keys/:id", session, deleteAPIKey)
+		api.GET("/users", users, listUsers)
+		api.POST("/users", users, createUser)
+		api.PUT("/users/:id", users, updateUser)
+		api.DELETE("/users/:id", users, deleteUser)
+
+		// Who logged in, watched, exported and shared what (see audit.go)
+		api.GET("/audit", auditLog, listAuditEvents)
 	}
 }
 
@@ -76,6 +169,11 @@ func getClips(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if !hasPermission(c, PermViewLocation) {
+		for i := range clips {
+			stripLocation(&clips[i])
+		}
+	}
 	c.JSON(http.StatusOK, clips)
 }
 
@@ -86,14 +184,47 @@ func getClipDetails(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Clip not found"})
 		return
 	}
+	if !hasPermission(c, PermViewLocation) {
+		stripLocation(&clip)
+	}
 	c.JSON(http.StatusOK, clip)
 }
 
+// getTranscodeStatus shows every role the encoder; the queues and proxies are
+// server status, for admins only
 func getTranscodeStatus(c *gin.Context) {
 	status := services.GetTranscoderStatus()
+	if !hasPermission(c, PermRescan) {
+		delete(status, "scheduler")
+		delete(status, "proxies")
+	}
 	c.JSON(http.StatusOK, status)
 }
 
+var (
+	// Rescanner runs a full library scan for POST /api/rescan; set by main
+	Rescanner  func()
+	rescanning int32
+)
+
+// rescanLibrary starts a full scan in the background, one at a time
+func rescanLibrary(c *gin.Context) {
+	if Rescanner == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Scanner is not running"})
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&rescanning, 0, 1) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A scan is already running"})
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&rescanning, 0)
+		Rescanner()
+	}()
+	log.Printf("Library rescan requested by %q", currentUsername(c))
+	c.JSON(http.StatusAccepted, gin.H{"status": "scanning"})
+}
+
 func serveVideo(c *gin.Context) {
 	videoPath := c.Param("path")
 	quality := c.Query("quality")
@@ -125,25 +256,41 @@ func serveVideo(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Video file not found"})
 		return
 	}
+	auditView(c, models.AuditEvent{Action: AuditViewVideo, VideoFile: fullPath})
 
-	// If quality is requested and not original, transcode
-	if quality != "" && quality != "original" {
-		cmd, stdout, err := services.GetTranscodeStream(c.Request.Context(), fullPath, quality)
-		if err != nil {
-			log.Printf("Transcode error: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transcoding failed"})
+	// A pre-generated proxy is seekable and costs nothing to serve
+	if quality == services.ProxyQuality {
+		if proxy, ok := services.ProxyFor(fullPath); ok {
+			c.File(proxy)
 			return
 		}
+	}
 
-		c.Header("Content-Type", "video/mp4")
-		c.Status(http.StatusOK)
-
-		if _, err := io.Copy(c.Writer, stdout); err != nil {
-			log.Printf("Stream error: %v", err)
+	// Other qualities are HLS renditions, transcoded per segment and cached, so
+	// the player can seek and viewers of the same file share the work
+	if quality != "" && quality != "original" {
+		var vf models.VideoFile
+		if err := database.DB.Select("id").Where("file_path = ?", fullPath).First(&vf).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Video file not found"})
+			return
 		}
-
-		// Ensure process is cleaned up
-		cmd.Wait()
+		query := url.Values{}
+		for _, key := range []string{"session", "focus"} {
+			if v := c.Query(key); v != "" {
+				query.Set(key, v)
+			}
+		}
+		target := &url.URL{Path: fmt.Sprintf("/api/hls/%d/master.m3u8", vf.ID), RawQuery: query.Encode()}
+		// A signed URL only covers its own path; sign the playlist for the same
+		// session and expiry
+		if c.Query("sig") != "" {
+			if user := currentUser(c); user != nil {
+				exp, _ := strconv.ParseInt(c.Query("exp"), 10, 64)
+				c.Redirect(http.StatusFound, signMediaURL(target, dirScope(target.Path), user.Username, currentSessionID(c), time.Unix(exp, 0)))
+				return
+			}
+		}
+		c.Redirect(http.StatusFound, target.String())
 		return
 	}
 
@@ -164,10 +311,69 @@ func createExportJob(c *gin.Context) {
 	}
 
 	jobID, err := services.QueueExport(req)
+	if err == services.ErrUnknownDestination {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	audit(c, models.AuditEvent{Action: AuditExportCreate, ClipID: req.ClipID, ExportJobID: jobID})
+
+	c.JSON(http.StatusAccepted, gin.H{"job_id": jobID, "status": "pending"})
+}
+
+// createBatchExportJob queues several clips (by ID or filter) as a single export job
+func createBatchExportJob(c *gin.Context) {
+	var req services.BatchExportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := req.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	jobID, err := services.QueueBatchExport(req)
+	if err == services.ErrUnknownDestination {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit(c, models.AuditEvent{Action: AuditExportCreate, ExportJobID: jobID, Detail: "batch"})
+
+	c.JSON(http.StatusAccepted, gin.H{"job_id": jobID, "status": "pending"})
+}
+
+// createHighlightReel compiles the Sentry events of a day (or filter) into one video
+func createHighlightReel(c *gin.Context) {
+	var req services.HighlightRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := req.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	jobID, err := services.QueueHighlightReel(req)
+	if err == services.ErrUnknownDestination {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit(c, models.AuditEvent{Action: AuditExportCreate, ExportJobID: jobID, Detail: "highlight reel"})
 
 	c.JSON(http.StatusAccepted, gin.H{"job_id": jobID, "status": "pending"})
 }
@@ -182,15 +388,46 @@ func getExportStatus(c *gin.Context) {
 	c.JSON(http.StatusOK, status)
 }
 
-func downloadExport(c *gin.Context) {
-	filename := c.Param("filename")
+func listDestinations(c *gin.Context) {
+	c.JSON(http.StatusOK, services.ListDestinations())
+}
+
+func listExports(c *gin.Context) {
+	jobs, err := services.ListExports()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, jobs)
+}
 
-	// Security check
-	if strings.Contains(filename, "..") || strings.Contains(filename, "/") {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filename"})
+func deleteExport(c *gin.Context) {
+	switch err := services.DeleteExport(c.Param("jobID")); err {
+	case nil:
+		audit(c, models.AuditEvent{Action: AuditExportDelete, ExportJobID: c.Param("jobID")})
+		c.Status(http.StatusNoContent)
+	case services.ErrExportNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+	case services.ErrExportRunning:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// downloadExport serves the output of a completed job.
+// The file is looked up from the job record, never from a client-supplied filename.
+func downloadExport(c *gin.Context) {
+	filePath, err := services.ExportFilePath(c.Param("jobID"))
+	if err != nil {
+		status := http.StatusNotFound
+		if err == services.ErrExportNotReady {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	}
 
-	filePath := filepath.Join("/config/exports", filename)
-	c.File(filePath)
+	audit(c, models.AuditEvent{Action: AuditExportDownload, ExportJobID: c.Param("jobID")})
+	c.FileAttachment(filePath, filepath.Base(filePath))
 }
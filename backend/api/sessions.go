@@ -0,0 +1,262 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var errInvalidRefresh = errors.New("invalid refresh token")
+
+// Refresh tokens look like "<session id>.<secret>"; only a hash of the secret is stored
+
+// hashSecret is how refresh tokens and API keys are stored. They are random, so a
+// plain SHA-256 suffices.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRefreshSecret() (string, error) {
+	b, err := randomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// sessionTokens signs an access token for the session and returns the response
+// handed to the client
+func sessionTokens(user *models.User, session *models.Session, refreshSecret string) (gin.H, error) {
+	token, err := generateToken(user.Username, user.Role, session.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"token":         token,
+		"refresh_token": session.SessionID + "." + refreshSecret,
+		"expires_in":    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// startSession records a new signed-in device for user and returns its tokens
+func startSession(c *gin.Context, user *models.User) (gin.H, error) {
+	id, err := randomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := newRefreshSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &models.Session{
+		SessionID:   hex.EncodeToString(id),
+		UserID:      user.ID,
+		RefreshHash: hashSecret(secret),
+		UserAgent:   truncate(c.Request.UserAgent(), 255),
+		IP:          c.ClientIP(),
+		LastUsedAt:  now,
+		ExpiresAt:   now.Add(refreshTokenTTL),
+	}
+	if err := database.DB.Create(session).Error; err != nil {
+		return nil, err
+	}
+
+	// Forget sessions nobody can use any more
+	database.DB.Where("expires_at < ? OR revoked_at < ?", now, now.Add(-24*time.Hour)).Delete(&models.Session{})
+	return sessionTokens(user, session, secret)
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// activeSession loads a session that has been neither revoked nor expired
+func activeSession(sessionID string) (*models.Session, error) {
+	var session models.Session
+	if err := database.DB.Where("session_id = ? AND revoked_at IS NULL AND expires_at > ?", sessionID, time.Now()).First(&session).Error; err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// rotateRefreshToken exchanges a refresh token for a new one and a fresh access
+// token. Presenting a refresh token that was already exchanged means it leaked, so
+// the whole session is revoked.
+func rotateRefreshToken(c *gin.Context, refreshToken string) (gin.H, error) {
+	parts := strings.SplitN(refreshToken, ".", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidRefresh
+	}
+	session, err := activeSession(parts[0])
+	if err != nil {
+		return nil, errInvalidRefresh
+	}
+
+	hash := hashSecret(parts[1])
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(session.RefreshHash)) != 1 {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(session.PreviousHash)) == 1 {
+			log.Printf("AUTH: Refresh token reuse for session %s from IP %s; revoking it", session.SessionID, c.ClientIP())
+			revokeSessions(database.DB.Where("id = ?", session.ID))
+		}
+		return nil, errInvalidRefresh
+	}
+
+	var user models.User
+	if err := database.DB.First(&user, session.UserID).Error; err != nil {
+		return nil, errInvalidRefresh
+	}
+
+	secret, err := newRefreshSecret()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	// Only the request still holding the current hash may rotate it
+	result := database.DB.Model(&models.Session{}).
+		Where("id = ? AND refresh_hash = ?", session.ID, session.RefreshHash).
+		Updates(map[string]interface{}{
+			"refresh_hash":  hashSecret(secret),
+			"previous_hash": session.RefreshHash,
+			"ip":            c.ClientIP(),
+			"last_used_at":  now,
+			"expires_at":    now.Add(refreshTokenTTL),
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errInvalidRefresh
+	}
+	return sessionTokens(&user, session, secret)
+}
+
+// revokeSessions ends every session matched by query
+func revokeSessions(query *gorm.DB) error {
+	return query.Model(&models.Session{}).Where("revoked_at IS NULL").Update("revoked_at", time.Now()).Error
+}
+
+// currentSessionID is the session of the request's access token
+func currentSessionID(c *gin.Context) string {
+	if v, ok := c.Get("claims"); ok {
+		if claims, ok := v.(*Claims); ok {
+			return claims.SessionID
+		}
+	}
+	return ""
+}
+
+// --- Handlers ---
+
+// refreshSession trades a refresh token for new tokens (public: the access token
+// may already have expired)
+func refreshSession(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "refresh_token is required"})
+		return
+	}
+	resp, err := rotateRefreshToken(c, req.RefreshToken)
+	if err == errInvalidRefresh {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has expired, please log in again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh session"})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// logout ends the caller's session
+func logout(c *gin.Context) {
+	if err := revokeSessions(database.DB.Where("session_id = ?", currentSessionID(c))); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+	audit(c, models.AuditEvent{Action: AuditLogout})
+	c.Status(http.StatusNoContent)
+}
+
+// logoutAll ends every session of the caller, including this one
+func logoutAll(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authentication is disabled"})
+		return
+	}
+	if err := revokeSessions(database.DB.Where("user_id = ?", user.ID)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+	audit(c, models.AuditEvent{Action: AuditLogout, Detail: "all sessions"})
+	c.Status(http.StatusNoContent)
+}
+
+// listSessions returns the caller's signed-in devices, most recently used first
+func listSessions(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authentication is disabled"})
+		return
+	}
+	var sessions []models.Session
+	if err := database.DB.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", user.ID, time.Now()).
+		Order("last_used_at desc").Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	type sessionInfo struct {
+		models.Session
+		Current bool `json:"current"`
+	}
+	current := currentSessionID(c)
+	items := make([]sessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		items = append(items, sessionInfo{s, s.SessionID == current})
+	}
+	c.JSON(http.StatusOK, items)
+}
+
+// revokeSession signs out one of the caller's devices
+func revokeSession(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authentication is disabled"})
+		return
+	}
+	var session models.Session
+	if err := database.DB.Where("session_id = ? AND user_id = ? AND revoked_at IS NULL", c.Param("id"), user.ID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if err := revokeSessions(database.DB.Where("id = ?", session.ID)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+type tokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+func loginPair(t *testing.T, r *gin.Engine) tokenPair {
+	resetRateLimit()
+	w := sendJSON(r, "POST", "/api/login", "", map[string]string{"username": "sam", "password": "sams password"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Login failed: %d %s", w.Code, w.Body.String())
+	}
+	var pair tokenPair
+	json.Unmarshal(w.Body.Bytes(), &pair)
+	return pair
+}
+
+func refresh(r *gin.Engine, refreshToken string) (tokenPair, int) {
+	w := sendJSON(r, "POST", "/api/refresh", "", map[string]string{"refresh_token": refreshToken})
+	var pair tokenPair
+	json.Unmarshal(w.Body.Bytes(), &pair)
+	return pair, w.Code
+}
+
+func setupSessionTest(t *testing.T) *gin.Engine {
+	r, _ := setupShareTest(t)
+	createUserRecord("sam", "sams password", RoleViewer)
+	return r
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	r := setupSessionTest(t)
+	first := loginPair(t, r)
+	assert.Equal(t, int(accessTokenTTL.Seconds()), first.ExpiresIn)
+
+	claims, err := parseToken(first.Token)
+	if err != nil || claims.ExpiresAt.Sub(time.Now()) > accessTokenTTL {
+		t.Fatalf("Expected a short-lived access token, got %v (%v)", claims, err)
+	}
+
+	second, code := refresh(r, first.RefreshToken)
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	assert.Equal(t, http.StatusOK, sendJSON(r, "GET", "/api/me", second.Token, nil).Code)
+
+	// Replaying the exchanged refresh token means it leaked: the session is revoked
+	_, code = refresh(r, first.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	_, code = refresh(r, second.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(r, "GET", "/api/me", second.Token, nil).Code)
+
+	for _, bad := range []string{"", "garbage", first.RefreshToken[:40] + ".x"} {
+		if _, code := refresh(r, bad); code == http.StatusOK {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestLogout(t *testing.T) {
+	r := setupSessionTest(t)
+	laptop := loginPair(t, r)
+	phone := loginPair(t, r)
+
+	assert.Equal(t, http.StatusNoContent, sendJSON(r, "POST", "/api/logout", laptop.Token, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(r, "GET", "/api/me", laptop.Token, nil).Code)
+	_, code := refresh(r, laptop.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// Other sessions are unaffected until "log out all sessions"
+	assert.Equal(t, http.StatusOK, sendJSON(r, "GET", "/api/me", phone.Token, nil).Code)
+	tablet := loginPair(t, r)
+	assert.Equal(t, http.StatusNoContent, sendJSON(r, "POST", "/api/logout/all", phone.Token, nil).Code)
+	for _, pair := range []tokenPair{phone, tablet} {
+		assert.Equal(t, http.StatusUnauthorized, sendJSON(r, "GET", "/api/me", pair.Token, nil).Code)
+		_, code := refresh(r, pair.RefreshToken)
+		assert.Equal(t, http.StatusUnauthorized, code)
+	}
+}
+
+func TestListAndRevokeSessions(t *testing.T) {
+	r := setupSessionTest(t)
+	laptop := loginPair(t, r)
+	phone := loginPair(t, r)
+
+	w := sendJSON(r, "GET", "/api/sessions", laptop.Token, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var sessions []struct {
+		ID      string `json:"id"`
+		IP      string `json:"ip"`
+		Current bool   `json:"current"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("Expected two sessions, got %s", w.Body.String())
+	}
+	assert.NotContains(t, w.Body.String(), "refresh_hash")
+
+	var other string
+	for _, s := range sessions {
+		if !s.Current {
+			other = s.ID
+		}
+	}
+	claims, _ := parseToken(phone.Token)
+	assert.Equal(t, claims.SessionID, other)
+
+	// Sessions of other users cannot be revoked
+	admin, _ := generateToken("admin", RoleAdmin, adminSession)
+	assert.Equal(t, http.StatusNotFound, sendJSON(r, "DELETE", "/api/sessions/"+other, admin, nil).Code)
+
+	assert.Equal(t, http.StatusNoContent, sendJSON(r, "DELETE", "/api/sessions/"+other, laptop.Token, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(r, "GET", "/api/me", phone.Token, nil).Code)
+	assert.Equal(t, http.StatusOK, sendJSON(r, "GET", "/api/me", laptop.Token, nil).Code)
+}
+
+func TestPasswordChangeEndsSessions(t *testing.T) {
+	r := setupSessionTest(t)
+	other := loginPair(t, r)
+	current := loginPair(t, r)
+
+	body := map[string]string{"current_password": "sams password", "new_password": "new password"}
+	assert.Equal(t, http.StatusOK, sendJSON(r, "PUT", "/api/me/password", current.Token, body).Code)
+	_, code := refresh(r, other.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	var active int
+	database.DB.Model(&models.Session{}).Where("revoked_at IS NULL").Count(&active)
+	assert.Equal(t, 2, active, "Expected only the admin session and the new one")
+}
+
+// useKeyFile loads signing keys from a temp dir and restores the package state after
+func useKeyFile(t *testing.T) string {
+	oldSecret, oldKeys, oldPath := secretKey, signingKeys, keysPath
+	t.Cleanup(func() { secretKey, signingKeys, keysPath = oldSecret, oldKeys, oldPath })
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := loadKeys(path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSigningKeysPersisted(t *testing.T) {
+	path := useKeyFile(t)
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected a private key file, got %v (%v)", info, err)
+	}
+	token, _ := generateToken("sam", RoleViewer, "s1")
+	shareSig := signShare("share", "abc", 1)
+
+	// A restart reads the same keys back
+	signingKeys, secretKey = nil, []byte("placeholder")
+	if err := loadKeys(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseToken(token); err != nil {
+		t.Errorf("Expected tokens to survive a restart: %v", err)
+	}
+	assert.Equal(t, shareSig, signShare("share", "abc", 1))
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	useKeyFile(t)
+	old, _ := generateToken("sam", RoleViewer, "s1")
+	oldKid := currentSigningKey().ID
+
+	if rotated, _ := rotateSigningKeys(time.Now()); rotated {
+		t.Fatal("Expected no rotation for a new key")
+	}
+	shareSig := signShare("share", "abc", 1)
+	os.Setenv("JWT_KEY_ROTATION_DAYS", "1")
+	t.Cleanup(func() { os.Unsetenv("JWT_KEY_ROTATION_DAYS") })
+	if rotated, err := rotateSigningKeys(time.Now().Add(25 * time.Hour)); !rotated || err != nil {
+		t.Fatalf("Expected a rotation after a day (%v)", err)
+	}
+
+	// New tokens use the new key; the previous key still verifies its tokens
+	fresh, _ := generateToken("sam", RoleViewer, "s1")
+	claims, _ := parseToken(fresh)
+	assert.NotNil(t, claims)
+	assert.NotEqual(t, oldKid, currentSigningKey().ID)
+	if _, err := parseToken(old); err != nil {
+		t.Errorf("Expected the previous key to verify old tokens: %v", err)
+	}
+	// Share links are signed with the unrotated secret
+	assert.Equal(t, shareSig, signShare("share", "abc", 1))
+
+	// Two rotations later the old key is gone
+	rotateSigningKeys(time.Now().Add(50 * time.Hour))
+	if _, err := parseToken(old); err == nil {
+		t.Error("Expected tokens of retired keys to be rejected")
+	}
+}
+
+func TestInitKeysReportsUnwritableConfig(t *testing.T) {
+	oldSecret, oldKeys, oldPath := secretKey, signingKeys, keysPath
+	t.Cleanup(func() { secretKey, signingKeys, keysPath = oldSecret, oldKeys, oldPath })
+	t.Setenv("JWT_SECRET", "")
+
+	// CONFIG_PATH below a regular file can never hold keys.json
+	file := filepath.Join(t.TempDir(), "config")
+	os.WriteFile(file, nil, 0644)
+	t.Setenv("CONFIG_PATH", filepath.Join(file, "teslaxy"))
+
+	if err := InitKeys(); err == nil {
+		t.Fatal("Expected an error when the key file can't be written")
+	}
+	assert.Equal(t, oldKeys, signingKeys, "Expected the keys to stay as they were")
+}
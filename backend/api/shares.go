@@ -0,0 +1,429 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+	"teslaxy/database"
+	"teslaxy/models"
+	"teslaxy/services"
+)
+
+const (
+	defaultShareTTL = 72 * time.Hour
+	maxShareTTL     = 30 * 24 * time.Hour
+	// shareAccessTTL bounds how long an unlocked password-protected share stays unlocked
+	shareAccessTTL = 6 * time.Hour
+)
+
+// Share tokens look like "<token id>.<expiry unix>.<signature>".
+// They are signed with a "share" domain prefix so they can never be mistaken for
+// (or converted into) a session JWT, and they only ever resolve to a single ShareLink.
+
+func signShare(domain, tokenID string, expires int64) string {
+	mac := hmac.New(sha256.New, secretKey)
+	fmt.Fprintf(mac, "%s|%s|%d", domain, tokenID, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func shareToken(link *models.ShareLink) string {
+	exp := link.ExpiresAt.Unix()
+	return fmt.Sprintf("%s.%d.%s", link.TokenID, exp, signShare("share", link.TokenID, exp))
+}
+
+// shareAccessGrant is handed out after a correct password and must accompany later
+// requests. domain is "share-access" for an unlocked password or "share-visit" for
+// a counted visit of the share page (see RequireShareVisit).
+func shareAccessGrant(link *models.ShareLink, domain string) string {
+	exp := time.Now().Add(shareAccessTTL)
+	if exp.After(link.ExpiresAt) {
+		exp = link.ExpiresAt
+	}
+	return fmt.Sprintf("%d.%s", exp.Unix(), signShare(domain, link.TokenID, exp.Unix()))
+}
+
+func validShareAccessGrant(link *models.ShareLink, grant, domain string) bool {
+	parts := strings.SplitN(grant, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	return hmac.Equal([]byte(parts[1]), []byte(signShare(domain, link.TokenID, exp)))
+}
+
+// shareGrant is the access grant sent with a request, as a header or, for <video>
+// and download links, in the query string
+func shareGrant(c *gin.Context) string {
+	if grant := c.GetHeader("X-Share-Access"); grant != "" {
+		return grant
+	}
+	return c.Query("access")
+}
+
+// resolveShare verifies a public token and loads its link.
+// Returns the HTTP status to use when the link is unusable.
+func resolveShare(token string) (*models.ShareLink, int) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, http.StatusNotFound
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, http.StatusNotFound
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(signShare("share", parts[0], exp))) {
+		return nil, http.StatusNotFound
+	}
+	if time.Now().Unix() > exp {
+		return nil, http.StatusGone
+	}
+
+	var link models.ShareLink
+	if err := database.DB.Where("token_id = ?", parts[0]).First(&link).Error; err != nil {
+		return nil, http.StatusNotFound
+	}
+	if link.ExpiresAt.Unix() != exp {
+		return nil, http.StatusNotFound
+	}
+	if link.RevokedAt != nil {
+		return nil, http.StatusGone
+	}
+	return &link, http.StatusOK
+}
+
+// ShareMiddleware authorises the public share routes. It replaces AuthMiddleware for
+// them: the only thing a share token unlocks is the ShareLink it names.
+func ShareMiddleware(requirePassword bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		link, status := resolveShare(c.Param("token"))
+		if link == nil {
+			c.AbortWithStatusJSON(status, gin.H{"error": "Share link is invalid or has expired"})
+			return
+		}
+
+		if requirePassword && link.HasPassword {
+			// A visit grant is only handed to those who already unlocked the link
+			grant := shareGrant(c)
+			if !validShareAccessGrant(link, grant, "share-access") && !validShareAccessGrant(link, grant, "share-visit") {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Password required", "password_required": true})
+				return
+			}
+		}
+
+		c.Set("share", link)
+		c.Next()
+	}
+}
+
+// RequireShareVisit guards the file routes of links with a view limit. Playing a
+// clip takes many range requests, so the view is counted once by the share page,
+// whose visit grant then opens the files without counting them again.
+func RequireShareVisit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		link := sharedLink(c)
+		if link.MaxViews > 0 && !validShareAccessGrant(link, shareGrant(c), "share-visit") {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Open the share link first", "visit_required": true})
+			return
+		}
+		c.Next()
+	}
+}
+
+func sharedLink(c *gin.Context) *models.ShareLink {
+	v, _ := c.Get("share")
+	link, _ := v.(*models.ShareLink)
+	return link
+}
+
+// countShareView counts a visit of the share page, unless the link's view limit is
+// used up. The check and the increment are one statement, so parallel
+// requests can't exceed the limit.
+func countShareView(c *gin.Context, link *models.ShareLink) bool {
+	result := database.DB.Model(&models.ShareLink{}).
+		Where("id = ? AND (max_views = 0 OR views < max_views)", link.ID).
+		UpdateColumn("views", gorm.Expr("views + ?", 1))
+	if result.Error != nil || result.RowsAffected == 0 {
+		c.JSON(http.StatusGone, gin.H{"error": "Share link view limit reached"})
+		return false
+	}
+	return true
+}
+
+// sharedFiles returns the video files a clip share exposes, in playback order.
+// Indexes into this slice are the only file references handed to the public.
+func sharedFiles(link *models.ShareLink) (models.Clip, []models.VideoFile, error) {
+	var clip models.Clip
+	if err := database.DB.Preload("VideoFiles").First(&clip, link.ClipID).Error; err != nil {
+		return clip, nil, err
+	}
+
+	opts := services.ArchiveOptions{}
+	from := clip.Timestamp.Add(time.Duration(link.StartTime * float64(time.Second)))
+	opts.From = &from
+	if link.Duration > 0 {
+		to := from.Add(time.Duration(link.Duration * float64(time.Second)))
+		opts.To = &to
+	}
+
+	allowed := make(map[string]bool)
+	for _, cam := range strings.Split(link.Cameras, ",") {
+		allowed[services.NormalizeCameraName(strings.TrimSpace(cam))] = true
+	}
+
+	var files []models.VideoFile
+	for _, vf := range services.ArchiveFiles(clip, opts) {
+		if allowed[services.NormalizeCameraName(vf.Camera)] {
+			files = append(files, vf)
+		}
+	}
+	return clip, files, nil
+}
+
+// --- Public routes ---
+
+// getShare returns what the link exposes and counts a view. The access grant it
+// returns opens the link's files for the rest of the visit.
+func getShare(c *gin.Context) {
+	link := sharedLink(c)
+	if !countShareView(c, link) {
+		return
+	}
+	audit(c, models.AuditEvent{Action: AuditShareView, ClipID: link.ClipID, ExportJobID: link.ExportJobID, ShareLinkID: link.TokenID})
+
+	resp := gin.H{
+		"kind":       link.Kind,
+		"expires_at": link.ExpiresAt,
+		"access":     shareAccessGrant(link, "share-visit"),
+	}
+
+	switch link.Kind {
+	case "clip":
+		clip, files, err := sharedFiles(link)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Clip not found"})
+			return
+		}
+		var items []gin.H
+		for i, vf := range files {
+			items = append(items, gin.H{"index": i, "camera": vf.Camera, "timestamp": vf.Timestamp})
+		}
+		resp["event"] = clip.Event
+		resp["timestamp"] = clip.Timestamp
+		resp["start_time"] = link.StartTime
+		resp["duration"] = link.Duration
+		resp["cameras"] = strings.Split(link.Cameras, ",")
+		resp["files"] = items
+	case "export":
+		resp["download"] = true
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// unlockShare exchanges the link password for a short-lived access grant
+func unlockShare(c *gin.Context) {
+	if !checkRateLimit("share|" + c.ClientIP()) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts. Please try again later."})
+		return
+	}
+
+	link := sharedLink(c)
+	var body struct {
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request"})
+		return
+	}
+
+	if link.HasPassword && bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(body.Password)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"access": shareAccessGrant(link, "share-access")})
+}
+
+func serveSharedVideo(c *gin.Context) {
+	link := sharedLink(c)
+	if link.Kind != "clip" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not Found"})
+		return
+	}
+
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid index"})
+		return
+	}
+
+	_, files, err := sharedFiles(link)
+	if err != nil || index < 0 || index >= len(files) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Video file not found"})
+		return
+	}
+	auditView(c, models.AuditEvent{Action: AuditShareVideo, ClipID: link.ClipID, VideoFile: files[index].FilePath, ShareLinkID: link.TokenID})
+	c.File(files[index].FilePath)
+}
+
+func downloadSharedExport(c *gin.Context) {
+	link := sharedLink(c)
+	if link.Kind != "export" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not Found"})
+		return
+	}
+
+	filePath, err := services.ExportFilePath(link.ExportJobID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export no longer available"})
+		return
+	}
+	audit(c, models.AuditEvent{Action: AuditShareDownload, ExportJobID: link.ExportJobID, ShareLinkID: link.TokenID})
+	c.FileAttachment(filePath, filepath.Base(filePath))
+}
+
+// --- Authenticated management routes ---
+
+type createShareRequest struct {
+	Kind           string   `json:"kind"` // "clip" or "export"
+	ClipID         uint     `json:"clip_id"`
+	Cameras        []string `json:"cameras"`
+	StartTime      float64  `json:"start_time"`
+	Duration       float64  `json:"duration"`
+	ExportJobID    string   `json:"export_job_id"`
+	ExpiresInHours float64  `json:"expires_in_hours"`
+	Password       string   `json:"password"`
+	MaxViews       int      `json:"max_views"`
+}
+
+func createShare(c *gin.Context) {
+	var req createShareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ttl := defaultShareTTL
+	if req.ExpiresInHours > 0 {
+		ttl = time.Duration(req.ExpiresInHours * float64(time.Hour))
+	}
+	if ttl > maxShareTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Share links cannot last longer than 30 days"})
+		return
+	}
+	if req.MaxViews < 0 || req.StartTime < 0 || req.Duration < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid share parameters"})
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+		return
+	}
+
+	link := models.ShareLink{
+		TokenID: hex.EncodeToString(idBytes),
+		Kind:    req.Kind,
+		// Second precision: the expiry is part of the signed token
+		ExpiresAt: time.Now().Add(ttl).Truncate(time.Second),
+		MaxViews:  req.MaxViews,
+		CreatedBy: currentUsername(c),
+	}
+
+	switch req.Kind {
+	case "clip":
+		if err := services.ValidateCameras(req.Cameras); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var clip models.Clip
+		if err := database.DB.First(&clip, req.ClipID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Clip not found"})
+			return
+		}
+		link.ClipID = clip.ID
+		link.Cameras = strings.Join(req.Cameras, ",")
+		link.StartTime = req.StartTime
+		link.Duration = req.Duration
+	case "export":
+		if _, err := services.ExportFilePath(req.ExportJobID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Completed export not found"})
+			return
+		}
+		link.ExportJobID = req.ExportJobID
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be 'clip' or 'export'"})
+		return
+	}
+
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid password"})
+			return
+		}
+		link.PasswordHash = string(hash)
+		link.HasPassword = true
+	}
+
+	if err := database.DB.Create(&link).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	audit(c, models.AuditEvent{Action: AuditShareCreate, ClipID: link.ClipID, ExportJobID: link.ExportJobID, ShareLinkID: link.TokenID})
+	token := shareToken(&link)
+	c.JSON(http.StatusCreated, gin.H{
+		"id":         link.TokenID,
+		"token":      token,
+		"url":        "/api/share/" + token,
+		"expires_at": link.ExpiresAt,
+	})
+}
+
+// ownShares limits a query to the caller's links; admins manage everyone's
+func ownShares(c *gin.Context) *gorm.DB {
+	if hasPermission(c, PermManageUsers) {
+		return database.DB
+	}
+	return database.DB.Where("created_by = ?", currentUsername(c))
+}
+
+func listShares(c *gin.Context) {
+	var links []models.ShareLink
+	if err := ownShares(c).Order("created_at desc").Find(&links).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, links)
+}
+
+func revokeShare(c *gin.Context) {
+	var link models.ShareLink
+	if err := ownShares(c).Where("token_id = ?", c.Param("id")).First(&link).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		return
+	}
+	if link.RevokedAt == nil {
+		now := time.Now()
+		database.DB.Model(&link).Update("revoked_at", &now)
+		audit(c, models.AuditEvent{Action: AuditShareRevoke, ClipID: link.ClipID, ExportJobID: link.ExportJobID, ShareLinkID: link.TokenID})
+	}
+	c.Status(http.StatusNoContent)
+}
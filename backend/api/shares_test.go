@@ -0,0 +1,228 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/stretchr/testify/assert"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+func setupShareTest(t *testing.T) (*gin.Engine, models.Clip) {
+	gin.SetMode(gin.TestMode)
+	secretKey = []byte("share-test-secret")
+
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	db.AutoMigrate(&models.Clip{}, &models.VideoFile{}, &models.Telemetry{}, &models.ExportJob{}, &models.ShareLink{}, &models.User{}, &models.Session{}, &models.APIKey{}, &models.AuditEvent{})
+	database.DB = db
+	t.Cleanup(func() { db.Close() })
+	createTestSession(t, "admin", RoleAdmin, adminSession)
+
+	dir := t.TempDir()
+	base := time.Date(2024, 7, 1, 3, 0, 0, 0, time.UTC)
+	clip := models.Clip{Event: "Sentry", Timestamp: base}
+	db.Create(&clip)
+	for _, vf := range []models.VideoFile{
+		{ClipID: clip.ID, Camera: "Front", FilePath: filepath.Join(dir, "front.mp4"), Timestamp: base},
+		{ClipID: clip.ID, Camera: "Back", FilePath: filepath.Join(dir, "back.mp4"), Timestamp: base},
+	} {
+		os.WriteFile(vf.FilePath, []byte(vf.Camera+" footage"), 0644)
+		db.Create(&vf)
+	}
+
+	os.Setenv("AUTH_ENABLED", "true")
+	t.Cleanup(func() { os.Unsetenv("AUTH_ENABLED") })
+
+	r := gin.New()
+	SetupRoutes(r)
+	return r, clip
+}
+
+func createTestShare(t *testing.T, r *gin.Engine, body map[string]interface{}) map[string]interface{} {
+	token, _ := generateToken("admin", RoleAdmin, adminSession)
+	payload, _ := json.Marshal(body)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/shares", bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 creating share, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp
+}
+
+func get(r *gin.Engine, url string, headers map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", url, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestShareLink_ClipScope(t *testing.T) {
+	r, clip := setupShareTest(t)
+	share := createTestShare(t, r, map[string]interface{}{"kind": "clip", "clip_id": clip.ID, "cameras": []string{"back"}})
+	url := share["url"].(string)
+
+	t.Run("Metadata lists only shared cameras", func(t *testing.T) {
+		w := get(r, url, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var meta struct {
+			Files []map[string]interface{} `json:"files"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &meta)
+		assert.Len(t, meta.Files, 1)
+		assert.Equal(t, "Back", meta.Files[0]["camera"])
+	})
+
+	t.Run("Shared video is served by index", func(t *testing.T) {
+		w := get(r, url+"/video/0", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "Back footage", w.Body.String())
+
+		w = get(r, url+"/video/1", nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Share token cannot reach the API", func(t *testing.T) {
+		w := get(r, "/api/clips", map[string]string{"Authorization": "Bearer " + share["token"].(string)})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Tampered token is rejected", func(t *testing.T) {
+		w := get(r, url+"x", nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Views are counted", func(t *testing.T) {
+		var link models.ShareLink
+		database.DB.Where("token_id = ?", share["id"]).First(&link)
+		assert.Equal(t, 1, link.Views, "only the share page counts")
+	})
+
+	t.Run("Revoked link stops working", func(t *testing.T) {
+		token, _ := generateToken("admin", RoleAdmin, adminSession)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/api/shares/"+share["id"].(string), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+
+		w = get(r, url+"/video/0", nil)
+		assert.Equal(t, http.StatusGone, w.Code)
+	})
+}
+
+func TestShareLink_Password(t *testing.T) {
+	r, clip := setupShareTest(t)
+	share := createTestShare(t, r, map[string]interface{}{"kind": "clip", "clip_id": clip.ID, "cameras": []string{"front"}, "password": "neighbour"})
+	url := share["url"].(string)
+
+	w := get(r, url, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	unlock := func(password string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"password": password})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", url+"/unlock", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, unlock("wrong").Code)
+
+	w = unlock("neighbour")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var grant map[string]string
+	json.Unmarshal(w.Body.Bytes(), &grant)
+
+	w = get(r, url+"/video/0?access="+grant["access"], nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Front footage", w.Body.String())
+}
+
+func TestShareLink_Expired(t *testing.T) {
+	r, clip := setupShareTest(t)
+	link := models.ShareLink{TokenID: "expired", Kind: "clip", ClipID: clip.ID, Cameras: "front", ExpiresAt: time.Now().Add(-time.Minute).Truncate(time.Second)}
+	database.DB.Create(&link)
+
+	w := get(r, "/api/share/"+shareToken(&link), nil)
+	assert.Equal(t, http.StatusGone, w.Code)
+}
+
+func TestShareLink_MaxViews(t *testing.T) {
+	r, clip := setupShareTest(t)
+	clipShare := createTestShare(t, r, map[string]interface{}{"kind": "clip", "clip_id": clip.ID, "cameras": []string{"front"}, "max_views": 1})
+	url := clipShare["url"].(string)
+
+	// Skipping the share page doesn't get around the limit
+	assert.Equal(t, http.StatusUnauthorized, get(r, url+"/video/0", nil).Code)
+
+	w := get(r, url, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var visit map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &visit)
+	access := visit["access"].(string)
+
+	// A player fetches the clip in many range requests, all part of one view
+	for _, rng := range []string{"bytes=0-", "bytes=0-4", "bytes=6-"} {
+		w := get(r, url+"/video/0?access="+access, map[string]string{"Range": rng})
+		assert.Equal(t, http.StatusPartialContent, w.Code, rng)
+	}
+	var link models.ShareLink
+	database.DB.Where("token_id = ?", clipShare["id"]).First(&link)
+	assert.Equal(t, 1, link.Views)
+	assert.Equal(t, http.StatusGone, get(r, url, nil).Code)
+
+	config := t.TempDir()
+	t.Setenv("CONFIG_PATH", config)
+	os.MkdirAll(filepath.Join(config, "exports"), 0755)
+	os.WriteFile(filepath.Join(config, "exports", "export.mp4"), []byte("exported"), 0644)
+	database.DB.Create(&models.ExportJob{JobID: "job-1", Kind: "clip", Status: "completed", FileName: "export.mp4"})
+	exportShare := createTestShare(t, r, map[string]interface{}{"kind": "export", "export_job_id": "job-1", "max_views": 1})
+	exportURL := exportShare["url"].(string)
+	assert.Equal(t, http.StatusUnauthorized, get(r, exportURL+"/download", nil).Code)
+	w = get(r, exportURL, nil)
+	json.Unmarshal(w.Body.Bytes(), &visit)
+	assert.Equal(t, http.StatusOK, get(r, exportURL+"/download?access="+visit["access"].(string), nil).Code)
+	assert.Equal(t, http.StatusGone, get(r, exportURL, nil).Code)
+}
+
+func TestShareLink_Ownership(t *testing.T) {
+	r, clip := setupShareTest(t)
+	eve := tokenFor(t, "eve", RoleExporter)
+	other := tokenFor(t, "ed", RoleExporter)
+	admin, _ := generateToken("admin", RoleAdmin, adminSession)
+
+	w := sendJSON(r, "POST", "/api/shares", eve, map[string]interface{}{"kind": "clip", "clip_id": clip.ID, "cameras": []string{"front"}})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var share map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &share)
+	id := share["id"].(string)
+
+	assert.Contains(t, sendJSON(r, "GET", "/api/shares", eve, nil).Body.String(), id)
+	assert.NotContains(t, sendJSON(r, "GET", "/api/shares", other, nil).Body.String(), id)
+	assert.Contains(t, sendJSON(r, "GET", "/api/shares", admin, nil).Body.String(), id)
+
+	assert.Equal(t, http.StatusNotFound, sendJSON(r, "DELETE", "/api/shares/"+id, other, nil).Code)
+	assert.Equal(t, http.StatusNoContent, sendJSON(r, "DELETE", "/api/shares/"+id, admin, nil).Code)
+}
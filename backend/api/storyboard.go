@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"teslaxy/database"
+	"teslaxy/models"
+	"teslaxy/services"
+)
+
+var storyboardSpriteName = regexp.MustCompile(`^(\d{1,10})\.jpg$`)
+
+// getStoryboard returns a WebVTT thumbnails track for the scrubber, covering one
+// camera (?camera=, default front) over the whole clip timeline
+func getStoryboard(c *gin.Context) {
+	clip, ok := loadStreamClip(c)
+	if !ok {
+		return
+	}
+	vtt, err := services.StoryboardVTT(clip, c.DefaultQuery("camera", "front"), hlsURISuffix(c))
+	if errors.Is(err, services.ErrNoCameraFootage) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Storyboard error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read video"})
+		return
+	}
+	c.Header("Cache-Control", "private, max-age=60")
+	c.Data(http.StatusOK, "text/vtt; charset=utf-8", []byte(vtt))
+}
+
+// getStoryboardSprite serves the sprite sheet of one file of the clip
+func getStoryboardSprite(c *gin.Context) {
+	m := storyboardSpriteName.FindStringSubmatch(c.Param("sprite"))
+	if m == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sprite not found"})
+		return
+	}
+	var vf models.VideoFile
+	if err := database.DB.Where("id = ? AND clip_id = ?", m[1], c.Param("id")).First(&vf).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Video file not found"})
+		return
+	}
+
+	sprite, err := services.StoryboardSprite(c.Request.Context(), vf, false)
+	switch {
+	case errors.Is(err, services.ErrTranscoderBusy):
+		transcoderBusy(c)
+		return
+	case errors.Is(err, context.Canceled):
+		return
+	case err != nil:
+		log.Printf("Storyboard sprite error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate storyboard"})
+		return
+	}
+
+	auditView(c, models.AuditEvent{Action: AuditViewStoryboard, VideoFile: vf.FilePath})
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Header("Content-Type", "image/jpeg")
+	c.File(sprite)
+}
@@ -1,18 +1,18 @@
 package api
 
 import (
-	"crypto/md5"
-	"encoding/hex"
-	"fmt"
+	"context"
+	"errors"
 	"log"
+	"math"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"teslaxy/services"
 )
 
 func getThumbnail(c *gin.Context) {
@@ -21,9 +21,9 @@ func getThumbnail(c *gin.Context) {
 	widthStr := c.DefaultQuery("w", "480")
 
 	// Validate seekTime
-	if _, err := strconv.ParseFloat(seekTime, 64); err != nil {
-		// Attempt to parse as duration if it's not a float?
-		// For now, strict check on float to avoid injection
+	seek, err := strconv.ParseFloat(seekTime, 64)
+	if err != nil || math.IsNaN(seek) || seek < 0 || seek > 24*3600 {
+		// Strict check on a plain number to avoid injection
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time parameter"})
 		return
 	}
@@ -65,49 +65,29 @@ func getThumbnail(c *gin.Context) {
 		return
 	}
 
-	// 2. Cache Setup
-	configPath := os.Getenv("CONFIG_PATH")
-	if configPath == "" {
-		configPath = "/config"
-	}
-	thumbDir := filepath.Join(configPath, "thumbnails")
-	if err := os.MkdirAll(thumbDir, 0755); err != nil {
-		log.Printf("Failed to create thumbnail dir: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+	// 2. Generate (or serve from cache) in the best format the client accepts
+	format := services.NegotiateThumbnailFormat(c.GetHeader("Accept"))
+	thumbPath, err := services.Thumbnail(c.Request.Context(), fullPath, seek, width, format)
+	c.Header("Vary", "Accept")
+	switch {
+	case errors.Is(err, context.Canceled):
 		return
-	}
-
-	// 3. Generate Cache Filename
-	// Hash the full path, seekTime AND width to ensure uniqueness
-	cacheKey := fmt.Sprintf("%s|%s|%d", fullPath, seekTime, width)
-	hash := md5.Sum([]byte(cacheKey))
-	hashStr := hex.EncodeToString(hash[:])
-	thumbPath := filepath.Join(thumbDir, hashStr+".jpg")
-
-	// 4. Check Cache
-	if info, err := os.Stat(thumbPath); err == nil {
-		if info.Size() > 0 {
-			c.File(thumbPath)
-			return
-		}
-		// If 0 bytes (corrupted), delete it so we regenerate
-		os.Remove(thumbPath)
-	}
-
-	// 5. Generate Thumbnail using FFmpeg
-	// -ss seekTime: seek to specific time
-	// -i input: input file
-	// -vframes 1: output 1 frame
-	// -vf scale=width:-1: resize to requested width (keep aspect ratio)
-	// -q:v 5: quality (1-31, lower is better)
-	vf := fmt.Sprintf("scale=%d:-1", width)
-	cmd := exec.Command("ffmpeg", "-y", "-ss", seekTime, "-i", fullPath, "-vframes", "1", "-vf", vf, "-q:v", "5", thumbPath)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		log.Printf("FFmpeg error: %v, Output: %s", err, string(out))
+	case errors.Is(err, context.DeadlineExceeded):
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Thumbnail generation timed out"})
+		return
+	case err != nil:
+		log.Printf("Thumbnail error for %s: %v", fullPath, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate thumbnail"})
 		return
 	}
 
-	// 6. Serve
+	// 3. Serve
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Header("Content-Type", format.ContentType)
 	c.File(thumbPath)
 }
+
+// getThumbnailStats reports thumbnail cache usage
+func getThumbnailStats(c *gin.Context) {
+	c.JSON(http.StatusOK, services.ThumbnailCacheStats())
+}
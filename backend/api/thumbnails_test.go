@@ -48,6 +48,14 @@ func TestGetThumbnail(t *testing.T) {
 		assert.Equal(t, http.StatusBadRequest, w.Code)
 	})
 
+	t.Run("Negative Time Parameter", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/thumbnail/test_thumb.mp4?time=-5", nil)
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
 	t.Run("Invalid Width Parameter Defaults", func(t *testing.T) {
 		w := httptest.NewRecorder()
 		// Should not fail validation, but fallback to 480.
@@ -64,3 +72,16 @@ func TestGetThumbnail(t *testing.T) {
 	// unless we mock exec.Command which is hard in Go without dependency injection.
 	// But we verified the input validation.
 }
+
+func TestGetThumbnailStats(t *testing.T) {
+	r, _ := setupShareTest(t)
+	token, _ := generateToken("admin", RoleAdmin, adminSession)
+
+	w := get(r, "/api/thumbnails/stats", map[string]string{"Authorization": "Bearer " + token})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"hits"`)
+	assert.Contains(t, w.Body.String(), `"limit_mb"`)
+
+	w = get(r, "/api/thumbnails/stats", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,433 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+// Two-factor authentication with time-based one-time passwords (RFC 6238: SHA-1,
+// six digits, 30 second steps), as used by every authenticator app. Single sign-on
+// logins leave the second factor to the identity provider.
+
+const (
+	totpIssuer = "Teslaxy"
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew accepts codes one step either side, for clocks that drift
+	totpSkew          = 1
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+var (
+	totpEncoding        = base32.StdEncoding.WithPadding(base32.NoPadding)
+	errInvalidChallenge = errors.New("invalid or expired login challenge")
+)
+
+func newTOTPSecret() (string, error) {
+	b, err := randomBytes(20)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode is the code of secret for a time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
+
+// totpURI is the otpauth:// provisioning URI authenticator apps read from a QR code
+func totpURI(username, secret string) string {
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(totpPeriod)},
+	}
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// verifyTOTP checks code against user's secret. Each time step can only be used
+// once, so an observed code can't be replayed.
+func verifyTOTP(user *models.User, code string, now time.Time) bool {
+	code = strings.ReplaceAll(code, " ", "")
+	if user.TOTPSecret == "" || len(code) != totpDigits {
+		return false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(user.TOTPSecret, step)
+		if err != nil || subtle.ConstantTimeCompare([]byte(expected), []byte(code)) != 1 {
+			continue
+		}
+		result := database.DB.Model(&models.User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			UpdateColumn("totp_last_step", step)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return false
+		}
+		user.TOTPLastStep = step
+		return true
+	}
+	return false
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// newRecoveryCodes returns codes to show the user once, and the hashes to store
+func newRecoveryCodes() ([]string, string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b, err := randomBytes(8)
+		if err != nil {
+			return nil, "", err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashSecret(code))
+	}
+	return codes, strings.Join(hashes, ","), nil
+}
+
+// useRecoveryCode spends one of user's recovery codes
+func useRecoveryCode(user *models.User, code string) bool {
+	hash := hashSecret(normalizeRecoveryCode(code))
+	var remaining []string
+	found := false
+	for _, h := range strings.Split(user.RecoveryCodes, ",") {
+		if h != "" && !found && subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			found = true
+			continue
+		}
+		if h != "" {
+			remaining = append(remaining, h)
+		}
+	}
+	if !found {
+		return false
+	}
+	// Only one request can spend the code
+	result := database.DB.Model(&models.User{}).
+		Where("id = ? AND recovery_codes = ?", user.ID, user.RecoveryCodes).
+		UpdateColumn("recovery_codes", strings.Join(remaining, ","))
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false
+	}
+	user.RecoveryCodes = strings.Join(remaining, ",")
+	log.Printf("AUTH: User %q used a recovery code, %d left", user.Username, len(remaining))
+	return true
+}
+
+// enableTOTP turns on the second factor for user's confirmed secret and returns
+// fresh recovery codes
+func enableTOTP(user *models.User) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := database.DB.Model(user).Updates(map[string]interface{}{
+		"totp_enabled":   true,
+		"recovery_codes": hashes,
+	}).Error; err != nil {
+		return nil, err
+	}
+	log.Printf("AUTH: User %q enabled two-factor authentication", user.Username)
+	return codes, nil
+}
+
+// --- Login challenge ---
+
+// mfaChallenge proves a correct password for the second login step:
+// "<user id>.<expiry>.<signature>". Changing the password invalidates it.
+func mfaChallenge(user *models.User, now time.Time) string {
+	exp := now.Add(mfaChallengeTTL).Unix()
+	return fmt.Sprintf("%d.%d.%s", user.ID, exp, signMFA(user, exp))
+}
+
+func signMFA(user *models.User, exp int64) string {
+	return signShare("mfa", fmt.Sprintf("%d|%d", user.ID, user.PasswordChangedAt.Unix()), exp)
+}
+
+func parseMFAChallenge(token string) (*models.User, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidChallenge
+	}
+	id, err1 := strconv.ParseUint(parts[0], 10, 64)
+	exp, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil || time.Now().Unix() > exp {
+		return nil, errInvalidChallenge
+	}
+	var user models.User
+	if err := database.DB.First(&user, id).Error; err != nil {
+		return nil, errInvalidChallenge
+	}
+	if subtle.ConstantTimeCompare([]byte(signMFA(&user, exp)), []byte(parts[2])) != 1 {
+		return nil, errInvalidChallenge
+	}
+	return &user, nil
+}
+
+// secondFactorAllowed applies the login rate limit per IP and per account, so the
+// six digits can't be guessed from many addresses either
+func secondFactorAllowed(c *gin.Context, user *models.User) bool {
+	ipOK := checkRateLimit(c.ClientIP())
+	return ipOK && checkRateLimit(fmt.Sprintf("totp:%d", user.ID))
+}
+
+// --- Handlers: second login step (public) ---
+
+// loginTOTP completes a login with a code from the authenticator app or a recovery
+// code. Users that must enrol confirm their new secret here and get recovery codes.
+func loginTOTP(c *gin.Context) {
+	var req struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request"})
+		return
+	}
+	if !checkRateLimit(c.ClientIP()) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many login attempts. Please try again later."})
+		return
+	}
+	user, err := parseMFAChallenge(req.MFAToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login has expired, please enter your password again"})
+		return
+	}
+	if !checkRateLimit(fmt.Sprintf("totp:%d", user.ID)) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many login attempts. Please try again later."})
+		return
+	}
+
+	if !user.TOTPEnabled {
+		// Enrolment enforced by an admin: the first code confirms the secret
+		if !user.TOTPRequired || !verifyTOTP(user, req.Code, time.Now()) {
+			audit(c, models.AuditEvent{Action: AuditLoginFailed, Username: user.Username, Detail: "invalid two-factor code during enrolment"})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+			return
+		}
+		codes, err := enableTOTP(user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+			return
+		}
+		finishLogin(c, user, "password and new authenticator", gin.H{"recovery_codes": codes})
+		return
+	}
+
+	ok, method := false, "password and authenticator"
+	if req.RecoveryCode != "" {
+		ok, method = useRecoveryCode(user, req.RecoveryCode), "password and recovery code"
+	} else {
+		ok = verifyTOTP(user, req.Code, time.Now())
+	}
+	if !ok {
+		audit(c, models.AuditEvent{Action: AuditLoginFailed, Username: user.Username, Detail: "invalid " + strings.TrimPrefix(method, "password and ")})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+	finishLogin(c, user, method, nil)
+}
+
+// loginTOTPEnroll starts the enrolment an admin requires, before the first login
+func loginTOTPEnroll(c *gin.Context) {
+	var req struct {
+		MFAToken string `json:"mfa_token"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request"})
+		return
+	}
+	user, err := parseMFAChallenge(req.MFAToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login has expired, please enter your password again"})
+		return
+	}
+	if user.TOTPEnabled || !user.TOTPRequired {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor enrolment is not pending"})
+		return
+	}
+	startTOTPEnrolment(c, user)
+}
+
+// --- Handlers: the caller's own second factor ---
+
+// startTOTPEnrolment stores a new secret and returns it with its provisioning URI.
+// It is only used for logins once a code confirms it.
+func startTOTPEnrolment(c *gin.Context, user *models.User) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start enrolment"})
+		return
+	}
+	if err := database.DB.Model(user).UpdateColumn("totp_secret", secret).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start enrolment"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"secret": secret, "uri": totpURI(user.Username, secret)})
+}
+
+func enrollTOTP(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authentication is disabled"})
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	startTOTPEnrolment(c, user)
+}
+
+// confirmTOTP enables the second factor with a code of the enrolled secret
+func confirmTOTP(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authentication is disabled"})
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request"})
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if !secondFactorAllowed(c, user) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts. Please try again later."})
+		return
+	}
+	if !verifyTOTP(user, req.Code, time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+	codes, err := enableTOTP(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+	audit(c, models.AuditEvent{Action: AuditTOTPEnable})
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// regenerateRecoveryCodes replaces the caller's recovery codes, given a current code
+func regenerateRecoveryCodes(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authentication is disabled"})
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request"})
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	if !secondFactorAllowed(c, user) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts. Please try again later."})
+		return
+	}
+	if !verifyTOTP(user, req.Code, time.Now()) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid code"})
+		return
+	}
+	codes, err := enableTOTP(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recovery codes"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// disableTOTP turns off the caller's second factor, given their password. It stays
+// on when an admin requires it.
+func disableTOTP(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authentication is disabled"})
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request"})
+		return
+	}
+	if user.TOTPRequired {
+		c.JSON(http.StatusForbidden, gin.H{"error": "An admin requires two-factor authentication for your account"})
+		return
+	}
+	if !checkRateLimit(c.ClientIP()) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts. Please try again later."})
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Password is incorrect"})
+		return
+	}
+	if err := resetTOTP(user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+	audit(c, models.AuditEvent{Action: AuditTOTPDisable})
+	c.Status(http.StatusNoContent)
+}
+
+// resetTOTP removes user's second factor and recovery codes
+func resetTOTP(user *models.User) error {
+	user.TOTPEnabled, user.TOTPSecret, user.RecoveryCodes = false, "", ""
+	return database.DB.Model(user).Updates(map[string]interface{}{
+		"totp_enabled":   false,
+		"totp_secret":    "",
+		"recovery_codes": "",
+	}).Error
+}
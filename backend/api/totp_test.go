@@ -0,0 +1,182 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 SHA-1 test vectors, truncated to six digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, want := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 20000000000: "353130"} {
+		got, err := totpCode(secret, unix/totpPeriod)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, unix)
+	}
+}
+
+// passwordStep logs in as sam and returns the response of the first step
+func passwordStep(t *testing.T, r *gin.Engine) map[string]interface{} {
+	resetRateLimit()
+	w := sendJSON(r, "POST", "/api/login", "", map[string]string{"username": "sam", "password": "sams password"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Login failed: %d %s", w.Code, w.Body.String())
+	}
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp
+}
+
+// codeAt is the code of sam's secret steps periods from now
+func codeAt(t *testing.T, steps int64) string {
+	var user models.User
+	database.DB.Where("username = ?", "sam").First(&user)
+	code, err := totpCode(user.TOTPSecret, time.Now().Unix()/totpPeriod+steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func secondStep(r *gin.Engine, body map[string]interface{}) (int, map[string]interface{}) {
+	w := sendJSON(r, "POST", "/api/login/totp", "", body)
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+func TestTOTPEnrolmentAndLogin(t *testing.T) {
+	r := setupSessionTest(t)
+	token := loginPair(t, r).Token
+
+	w := sendJSON(r, "POST", "/api/me/totp", token, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var enrolment struct{ Secret, URI string }
+	json.Unmarshal(w.Body.Bytes(), &enrolment)
+	assert.True(t, strings.HasPrefix(enrolment.URI, "otpauth://totp/Teslaxy:sam?"), enrolment.URI)
+	assert.Contains(t, enrolment.URI, "secret="+enrolment.Secret)
+
+	// Until a code confirms the secret, the password is enough
+	assert.NotNil(t, passwordStep(t, r)["token"])
+	assert.Equal(t, http.StatusBadRequest, sendJSON(r, "POST", "/api/me/totp/confirm", token, map[string]string{"code": "000000"}).Code)
+	used := codeAt(t, 0)
+	w = sendJSON(r, "POST", "/api/me/totp/confirm", token, map[string]string{"code": used})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &confirmed)
+	assert.Len(t, confirmed.RecoveryCodes, recoveryCodeCount)
+
+	// Now the password only earns a challenge
+	first := passwordStep(t, r)
+	assert.Nil(t, first["token"])
+	assert.Equal(t, true, first["mfa_required"])
+	challenge := first["mfa_token"]
+
+	// The code that confirmed enrolment can't be replayed; the next one works
+	code, _ := secondStep(r, map[string]interface{}{"mfa_token": challenge, "code": used})
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, resp := secondStep(r, map[string]interface{}{"mfa_token": challenge, "code": codeAt(t, 1)})
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEmpty(t, resp["refresh_token"])
+	assert.Equal(t, http.StatusOK, sendJSON(r, "GET", "/api/me", resp["token"].(string), nil).Code)
+
+	// Recovery codes work once each, with or without the dash
+	resetRateLimit()
+	recovery := strings.ToUpper(strings.ReplaceAll(confirmed.RecoveryCodes[0], "-", ""))
+	code, _ = secondStep(r, map[string]interface{}{"mfa_token": challenge, "recovery_code": recovery})
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = secondStep(r, map[string]interface{}{"mfa_token": challenge, "recovery_code": recovery})
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// Forged or tampered challenges are rejected
+	var sam models.User
+	database.DB.Where("username = ?", "sam").First(&sam)
+	for _, forged := range []string{"", "garbage", fmt.Sprintf("%d.%d.AAAA", sam.ID, time.Now().Add(time.Minute).Unix()), mfaChallenge(&sam, time.Now().Add(-time.Hour))} {
+		resetRateLimit()
+		code, _ = secondStep(r, map[string]interface{}{"mfa_token": forged, "code": codeAt(t, -1)})
+		assert.Equal(t, http.StatusUnauthorized, code, forged)
+	}
+}
+
+func TestTOTPRateLimit(t *testing.T) {
+	r := setupSessionTest(t)
+	token := loginPair(t, r).Token
+	sendJSON(r, "POST", "/api/me/totp", token, nil)
+	sendJSON(r, "POST", "/api/me/totp/confirm", token, map[string]string{"code": codeAt(t, 0)})
+	challenge := passwordStep(t, r)["mfa_token"]
+
+	// The password step already used one of the five attempts per minute
+	for i := 0; i < 4; i++ {
+		code, _ := secondStep(r, map[string]interface{}{"mfa_token": challenge, "code": "000000"})
+		assert.Equal(t, http.StatusUnauthorized, code)
+	}
+	code, _ := secondStep(r, map[string]interface{}{"mfa_token": challenge, "code": codeAt(t, 1)})
+	assert.Equal(t, http.StatusTooManyRequests, code)
+
+	// From a new address the account still only gets five guesses
+	loginLock.Lock()
+	delete(loginAttempts, "")
+	loginLock.Unlock()
+	code, _ = secondStep(r, map[string]interface{}{"mfa_token": challenge, "code": "000000"})
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = secondStep(r, map[string]interface{}{"mfa_token": challenge, "code": codeAt(t, 1)})
+	assert.Equal(t, http.StatusTooManyRequests, code)
+}
+
+func TestTOTPRequiredByAdmin(t *testing.T) {
+	r := setupSessionTest(t)
+	admin, _ := generateToken("admin", RoleAdmin, adminSession)
+	var sam models.User
+	database.DB.Where("username = ?", "sam").First(&sam)
+	url := fmt.Sprintf("/api/users/%d", sam.ID)
+	assert.Equal(t, http.StatusOK, sendJSON(r, "PUT", url, admin, map[string]bool{"totp_required": true}).Code)
+
+	first := passwordStep(t, r)
+	assert.Nil(t, first["token"])
+	assert.Equal(t, true, first["mfa_enrollment_required"])
+
+	// No code works before enrolling
+	code, _ := secondStep(r, map[string]interface{}{"mfa_token": first["mfa_token"], "code": "123456"})
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	w := sendJSON(r, "POST", "/api/login/totp/enroll", "", map[string]interface{}{"mfa_token": first["mfa_token"]})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "otpauth://totp/")
+	code, resp := secondStep(r, map[string]interface{}{"mfa_token": first["mfa_token"], "code": codeAt(t, 0)})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, resp["recovery_codes"], recoveryCodeCount)
+	token := resp["token"].(string)
+	assert.Contains(t, sendJSON(r, "GET", "/api/me", token, nil).Body.String(), `"totp_enabled":true`)
+
+	// The user can't turn it off, and enrolling again is refused
+	assert.Equal(t, http.StatusForbidden, sendJSON(r, "DELETE", "/api/me/totp", token, map[string]string{"password": "sams password"}).Code)
+	w = sendJSON(r, "POST", "/api/login/totp/enroll", "", map[string]interface{}{"mfa_token": passwordStep(t, r)["mfa_token"]})
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// An admin reset for a lost phone goes back to enrolment
+	assert.Equal(t, http.StatusOK, sendJSON(r, "PUT", url, admin, map[string]bool{"reset_totp": true}).Code)
+	assert.Equal(t, true, passwordStep(t, r)["mfa_enrollment_required"])
+}
+
+func TestDisableTOTP(t *testing.T) {
+	r := setupSessionTest(t)
+	token := loginPair(t, r).Token
+	sendJSON(r, "POST", "/api/me/totp", token, nil)
+	sendJSON(r, "POST", "/api/me/totp/confirm", token, map[string]string{"code": codeAt(t, 0)})
+
+	resetRateLimit()
+	assert.Equal(t, http.StatusForbidden, sendJSON(r, "DELETE", "/api/me/totp", token, map[string]string{"password": "wrong"}).Code)
+	assert.Equal(t, http.StatusNoContent, sendJSON(r, "DELETE", "/api/me/totp", token, map[string]string{"password": "sams password"}).Code)
+	assert.NotNil(t, passwordStep(t, r)["token"])
+}
@@ -0,0 +1,432 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+const minPasswordLength = 8
+
+var (
+	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+	// setupCode must accompany the first-run setup request. It is only printed to the
+	// log, so whoever creates the first admin has access to the server.
+	setupCode string
+	setupLock sync.Mutex
+
+	// dummyHash is compared against when a username does not exist, so failed logins
+	// take the same time either way
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// InitUsers migrates the legacy env credentials into the users table, or prints a
+// setup code when there are no accounts yet. Call it once the database is open.
+func InitUsers() {
+	loadAdminCreds()
+	if userCount() > 0 {
+		return
+	}
+
+	code := make([]byte, 8)
+	if _, err := rand.Read(code); err != nil {
+		panic(fmt.Sprintf("CRITICAL: Failed to generate setup code: %v", err))
+	}
+	setupLock.Lock()
+	setupCode = hex.EncodeToString(code)
+	setupLock.Unlock()
+	log.Printf("SECURITY NOTICE: No user accounts exist. Open Teslaxy and create the first admin with setup code: %s", setupCode)
+}
+
+// migrateAdminCreds turns ADMIN_USER/ADMIN_PASS into the first admin account. Once
+// any account exists the env vars are ignored, so passwords changed in the app stick.
+func migrateAdminCreds() {
+	if adminPass == "" || userCount() > 0 {
+		return
+	}
+	if _, err := createUserRecord(adminUser, adminPass, RoleAdmin); err != nil {
+		log.Printf("Failed to migrate ADMIN_USER into the users table: %v", err)
+		return
+	}
+	log.Printf("AUTH: Created admin account %q from ADMIN_USER/ADMIN_PASS; manage users in the app from now on", adminUser)
+}
+
+func userCount() int {
+	if database.DB == nil {
+		return 0
+	}
+	var n int
+	database.DB.Model(&models.User{}).Count(&n)
+	return n
+}
+
+func findUser(username string) (*models.User, error) {
+	if database.DB == nil {
+		return nil, errors.New("user store not initialised")
+	}
+	var user models.User
+	if err := database.DB.Where("username = ?", username).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// authenticate checks a username and password against the users table
+func authenticate(username, password string) (*models.User, bool) {
+	user, err := findUser(username)
+	if err != nil {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("teslaxy"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, false
+	}
+	return user, true
+}
+
+func validateCredentials(username, password string) error {
+	if !usernamePattern.MatchString(username) {
+		return errors.New("Username must be 1-64 letters, digits or . _ @ -")
+	}
+	return validatePassword(password)
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("Password must be at least %d characters", minPasswordLength)
+	}
+	if len(password) > 72 {
+		return errors.New("Password must be at most 72 bytes") // bcrypt limit
+	}
+	return nil
+}
+
+// setUserPassword hashes password onto user
+func setUserPassword(user *models.User, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = string(hash)
+	user.PasswordChangedAt = time.Now()
+	return nil
+}
+
+func createUserRecord(username, password, role string) (*models.User, error) {
+	user := &models.User{Username: username, Role: role}
+	if err := setUserPassword(user, password); err != nil {
+		return nil, err
+	}
+	if err := database.DB.Create(user).Error; err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// currentUser returns the authenticated account, or nil when auth is disabled
+func currentUser(c *gin.Context) *models.User {
+	v, _ := c.Get("user")
+	user, _ := v.(*models.User)
+	return user
+}
+
+// --- First-run setup (public) ---
+
+func getSetup(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"setup_required": userCount() == 0})
+}
+
+// completeSetup creates the first admin account while no accounts exist
+func completeSetup(c *gin.Context) {
+	if !checkRateLimit(c.ClientIP()) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts. Please try again later."})
+		return
+	}
+
+	var req struct {
+		SetupCode string `json:"setup_code"`
+		Username  string `json:"username"`
+		Password  string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request"})
+		return
+	}
+
+	setupLock.Lock()
+	defer setupLock.Unlock()
+
+	if userCount() > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Setup has already been completed"})
+		return
+	}
+	if setupCode == "" || subtle.ConstantTimeCompare([]byte(req.SetupCode), []byte(setupCode)) != 1 {
+		log.Printf("AUTH: Rejected first-run setup with a wrong setup code from IP %s", c.ClientIP())
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid setup code"})
+		return
+	}
+	if err := validateCredentials(req.Username, req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := createUserRecord(req.Username, req.Password, RoleAdmin)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create account"})
+		return
+	}
+	setupCode = ""
+	log.Printf("AUTH: First-run setup created admin %q from IP %s", user.Username, c.ClientIP())
+
+	tokens, err := startSession(c, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Account created, but signing in failed"})
+		return
+	}
+	tokens["user"] = user
+	c.JSON(http.StatusCreated, tokens)
+}
+
+// --- Own account ---
+
+// getMe returns the caller's account and what their role allows, so the UI can hide
+// what they cannot use
+func getMe(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authentication is disabled"})
+		return
+	}
+	// An API key only has the permissions of its scopes
+	perms := []Permission{}
+	for _, perm := range rolePermissions[user.Role] {
+		if hasPermission(c, perm) {
+			perms = append(perms, perm)
+		}
+	}
+	c.JSON(http.StatusOK, struct {
+		*models.User
+		Permissions []Permission `json:"permissions"`
+	}{user, perms})
+}
+
+// changePassword replaces the caller's password, ends all of their sessions and
+// returns the tokens of a new one
+func changePassword(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authentication is disabled"})
+		return
+	}
+	if !checkRateLimit(c.ClientIP()) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts. Please try again later."})
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request"})
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.CurrentPassword)) != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := setUserPassword(user, req.NewPassword); err != nil || database.DB.Save(user).Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+	revokeSessions(database.DB.Where("user_id = ?", user.ID))
+	audit(c, models.AuditEvent{Action: AuditPasswordChange})
+
+	tokens, err := startSession(c, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password changed, but signing in again failed"})
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+// --- User management (admin) ---
+
+func listUsers(c *gin.Context) {
+	var users []models.User
+	if err := database.DB.Order("username asc").Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+func createUser(c *gin.Context) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Role == "" {
+		req.Role = RoleViewer
+	}
+	if !validRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role"})
+		return
+	}
+	if err := validateCredentials(req.Username, req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := findUser(req.Username); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username is already taken"})
+		return
+	}
+
+	user, err := createUserRecord(req.Username, req.Password, req.Role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+	audit(c, models.AuditEvent{Action: AuditUserCreate, Detail: fmt.Sprintf("user %q, role %s", user.Username, user.Role)})
+	c.JSON(http.StatusCreated, user)
+}
+
+// loadUser resolves the :id route parameter
+func loadUser(c *gin.Context) (*models.User, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return nil, false
+	}
+	var user models.User
+	if err := database.DB.First(&user, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return nil, false
+	}
+	return &user, true
+}
+
+// isLastAdmin reports whether removing user's admin role would leave no admin
+func isLastAdmin(user *models.User) bool {
+	if user.Role != RoleAdmin {
+		return false
+	}
+	var admins int
+	database.DB.Model(&models.User{}).Where("role = ?", RoleAdmin).Count(&admins)
+	return admins <= 1
+}
+
+// updateUser changes a user's role, resets their password, requires two-factor
+// authentication or resets it for a lost device. Any change ends all of the user's
+// sessions.
+func updateUser(c *gin.Context) {
+	user, ok := loadUser(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Password     *string `json:"password"`
+		Role         *string `json:"role"`
+		TOTPRequired *bool   `json:"totp_required"`
+		ResetTOTP    bool    `json:"reset_totp"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var changes []string
+	if req.Role != nil && *req.Role != user.Role {
+		if !validRole(*req.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role"})
+			return
+		}
+		if isLastAdmin(user) {
+			c.JSON(http.StatusConflict, gin.H{"error": "At least one admin is required"})
+			return
+		}
+		user.Role = *req.Role
+		changes = append(changes, "role "+user.Role)
+	}
+	if req.Password != nil {
+		if err := validatePassword(*req.Password); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := setUserPassword(user, *req.Password); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+			return
+		}
+		changes = append(changes, "password")
+	}
+
+	if req.TOTPRequired != nil {
+		user.TOTPRequired = *req.TOTPRequired
+		changes = append(changes, fmt.Sprintf("two-factor required %t", user.TOTPRequired))
+	}
+	if req.ResetTOTP {
+		user.TOTPEnabled, user.TOTPSecret, user.RecoveryCodes = false, "", ""
+		changes = append(changes, "two-factor reset")
+	}
+
+	if err := database.DB.Save(user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+	revokeSessions(database.DB.Where("user_id = ?", user.ID))
+	audit(c, models.AuditEvent{Action: AuditUserUpdate, Detail: strings.Join(append([]string{fmt.Sprintf("user %q", user.Username)}, changes...), ", ")})
+	c.JSON(http.StatusOK, user)
+}
+
+func deleteUser(c *gin.Context) {
+	user, ok := loadUser(c)
+	if !ok {
+		return
+	}
+	if user.Username == currentUsername(c) {
+		c.JSON(http.StatusConflict, gin.H{"error": "You cannot delete your own account"})
+		return
+	}
+	if isLastAdmin(user) {
+		c.JSON(http.StatusConflict, gin.H{"error": "At least one admin is required"})
+		return
+	}
+
+	if err := database.DB.Delete(user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
+		return
+	}
+	database.DB.Where("user_id = ?", user.ID).Delete(&models.Session{})
+	database.DB.Where("user_id = ?", user.ID).Delete(&models.APIKey{})
+	audit(c, models.AuditEvent{Action: AuditUserDelete, Detail: fmt.Sprintf("user %q", user.Username)})
+	c.Status(http.StatusNoContent)
+}
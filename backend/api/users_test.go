@@ -0,0 +1,207 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+// setupUserDB gives the test empty users and sessions tables
+func setupUserDB(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	db.AutoMigrate(&models.User{}, &models.Session{}, &models.APIKey{}, &models.AuditEvent{})
+	database.DB = db
+	t.Cleanup(func() { db.Close() })
+}
+
+const adminSession = "admin-session"
+
+// createTestSession creates an account with role and an active session for it
+func createTestSession(t *testing.T, username, role, sessionID string) {
+	user := models.User{Username: username, Role: role, PasswordChangedAt: time.Now()}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	session := models.Session{SessionID: sessionID, UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := database.DB.Create(&session).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sendJSON(r *gin.Engine, method, url, token string, body interface{}) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// resetRateLimit forgets earlier attempts, as every test request has the same client IP
+func resetRateLimit() {
+	loginLock.Lock()
+	loginAttempts = make(map[string]*loginAttempt)
+	loginLock.Unlock()
+}
+
+func loginAs(t *testing.T, r *gin.Engine, username, password string) string {
+	resetRateLimit()
+	w := sendJSON(r, "POST", "/api/login", "", map[string]string{"username": username, "password": password})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Login as %s failed: %d %s", username, w.Code, w.Body.String())
+	}
+	var resp struct{ Token string }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.Token
+}
+
+func TestFirstRunSetup(t *testing.T) {
+	r, _ := setupShareTest(t)
+	database.DB.Delete(&models.User{})
+	setupCode = "0123456789abcdef"
+	t.Cleanup(func() { setupCode = "" })
+	resetRateLimit()
+
+	w := get(r, "/api/setup", nil)
+	assert.JSONEq(t, `{"setup_required":true}`, w.Body.String())
+
+	body := map[string]string{"setup_code": "wrong", "username": "alice", "password": "correct horse"}
+	assert.Equal(t, http.StatusForbidden, sendJSON(r, "POST", "/api/setup", "", body).Code)
+
+	body["setup_code"] = setupCode
+	body["password"] = "short"
+	assert.Equal(t, http.StatusBadRequest, sendJSON(r, "POST", "/api/setup", "", body).Code)
+
+	body["password"] = "correct horse"
+	w = sendJSON(r, "POST", "/api/setup", "", body)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Body.String(), `"role":"admin"`)
+	assert.NotContains(t, w.Body.String(), "password_hash")
+
+	// Setup is single-use, even with the old code
+	body["setup_code"] = "0123456789abcdef"
+	assert.Equal(t, http.StatusConflict, sendJSON(r, "POST", "/api/setup", "", body).Code)
+	assert.JSONEq(t, `{"setup_required":false}`, get(r, "/api/setup", nil).Body.String())
+
+	loginAs(t, r, "alice", "correct horse")
+}
+
+func TestMigrateAdminCreds(t *testing.T) {
+	setupUserDB(t)
+	os.Setenv("ADMIN_USER", "owner")
+	os.Setenv("ADMIN_PASS", "from-the-env")
+	t.Cleanup(func() {
+		os.Unsetenv("ADMIN_USER")
+		os.Unsetenv("ADMIN_PASS")
+		loadAdminCreds()
+	})
+
+	InitUsers()
+	user, err := findUser("owner")
+	if err != nil || user.Role != RoleAdmin {
+		t.Fatalf("Expected an admin migrated from the env, got %+v (%v)", user, err)
+	}
+	if setupCode != "" {
+		t.Error("Expected no setup code once an account exists")
+	}
+
+	// Once accounts exist the env no longer overrides them
+	database.DB.Model(user).Update("password_hash", "changed in the app")
+	os.Setenv("ADMIN_PASS", "edited-env")
+	InitUsers()
+	if _, ok := authenticate("owner", "edited-env"); ok {
+		t.Error("Expected the env password to be ignored after migration")
+	}
+	if userCount() != 1 {
+		t.Errorf("Expected one account, got %d", userCount())
+	}
+}
+
+func TestUserManagement(t *testing.T) {
+	r, _ := setupShareTest(t)
+	admin, _ := generateToken("admin", RoleAdmin, adminSession)
+
+	w := sendJSON(r, "POST", "/api/users", admin, map[string]string{"username": "bob", "password": "bobs password"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var bob models.User
+	json.Unmarshal(w.Body.Bytes(), &bob)
+	assert.Equal(t, RoleViewer, bob.Role)
+
+	for name, body := range map[string]map[string]string{
+		"Duplicate username": {"username": "bob", "password": "another password"},
+		"Bad username":       {"username": "bob smith", "password": "another password"},
+		"Unknown role":       {"username": "carol", "password": "another password", "role": "root"},
+	} {
+		if w := sendJSON(r, "POST", "/api/users", admin, body); w.Code < 400 {
+			t.Errorf("%s: expected an error, got %d", name, w.Code)
+		}
+	}
+
+	// Viewers can use the app but not manage accounts
+	bobToken := loginAs(t, r, "bob", "bobs password")
+	assert.Equal(t, http.StatusOK, get(r, "/api/clips", map[string]string{"Authorization": "Bearer " + bobToken}).Code)
+	assert.Equal(t, http.StatusForbidden, sendJSON(r, "GET", "/api/users", bobToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, sendJSON(r, "DELETE", "/api/users/1", bobToken, nil).Code)
+
+	w = sendJSON(r, "GET", "/api/users", admin, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"username":"bob"`)
+
+	// The last admin cannot be demoted or deleted, nor can you delete yourself
+	assert.Equal(t, http.StatusConflict, sendJSON(r, "PUT", "/api/users/1", admin, map[string]string{"role": RoleViewer}).Code)
+	assert.Equal(t, http.StatusConflict, sendJSON(r, "DELETE", "/api/users/1", admin, nil).Code)
+
+	// An admin password reset signs bob out
+	url := fmt.Sprintf("/api/users/%d", bob.ID)
+	assert.Equal(t, http.StatusOK, sendJSON(r, "PUT", url, admin, map[string]string{"password": "reset by admin"}).Code)
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(r, "GET", "/api/me", bobToken, nil).Code)
+
+	// Deleted accounts' tokens stop working
+	bobToken = loginAs(t, r, "bob", "reset by admin")
+	assert.Equal(t, http.StatusNoContent, sendJSON(r, "DELETE", url, admin, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(r, "GET", "/api/me", bobToken, nil).Code)
+	assert.Equal(t, http.StatusNotFound, sendJSON(r, "DELETE", url, admin, nil).Code)
+}
+
+func TestChangePassword(t *testing.T) {
+	r, _ := setupShareTest(t)
+	database.DB.Delete(&models.User{})
+	createUserRecord("admin", "old password", RoleAdmin)
+	old := loginAs(t, r, "admin", "old password")
+
+	w := sendJSON(r, "GET", "/api/me", old, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"username":"admin"`)
+	assert.Contains(t, w.Body.String(), `"last_login_at":"`)
+
+	wrong := map[string]string{"current_password": "guess", "new_password": "new password"}
+	assert.Equal(t, http.StatusForbidden, sendJSON(r, "PUT", "/api/me/password", old, wrong).Code)
+
+	body := map[string]string{"current_password": "old password", "new_password": "new password"}
+	w = sendJSON(r, "PUT", "/api/me/password", old, body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp struct{ Token string }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+
+	// The returned token replaces every older one
+	assert.Equal(t, http.StatusOK, sendJSON(r, "GET", "/api/me", resp.Token, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(r, "GET", "/api/me", old, nil).Code)
+	loginAs(t, r, "admin", "new password")
+}
@@ -57,7 +57,7 @@ func InitDB() {
 	// gorm.io/gorm + separate migration files for full control.
 	// ============================================================
 
-	DB.AutoMigrate(&models.Clip{}, &models.VideoFile{}, &models.Telemetry{})
+	DB.AutoMigrate(&models.Clip{}, &models.VideoFile{}, &models.Telemetry{}, &models.ExportJob{}, &models.ExportJobItem{}, &models.CameraMask{}, &models.ShareLink{}, &models.User{}, &models.Session{}, &models.APIKey{}, &models.AuditEvent{})
 	fmt.Println("Database connection established and migrated (AutoMigrate complete)")
 }
 
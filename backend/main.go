@@ -36,9 +36,42 @@ func main() {
 	database.InitDB()
 	defer database.CloseDB()
 
+	// Accounts: migrate ADMIN_USER/ADMIN_PASS, or print the first-run setup code
+	api.InitUsers()
+	// Token signing keys persisted in CONFIG_PATH unless JWT_SECRET is set
+	if err := api.InitKeys(); err != nil {
+		log.Fatalf("Failed to load token signing keys: %v (make CONFIG_PATH writable or set JWT_SECRET)", err)
+	}
+
+	// Audit events older than AUDIT_RETENTION_DAYS
+	api.StartAuditPruner()
+
+	// Exports that were running when we last stopped can never finish
+	services.RecoverInterruptedExports()
+
+	// Nightly highlight reel (HIGHLIGHT_SCHEDULE)
+	services.StartHighlightScheduler()
+
+	// Drop transcoded HLS segments and thumbnails that haven't been viewed in a while
+	services.StartCacheJanitor()
+
 	// Init Scanner
 	scanner := services.NewScannerService(footagePath, database.DB)
+	// Background work for newly scanned clips: the clip list thumbnail and hover
+	// preview, scrubber storyboards and, with PROXY_ENABLED, low-resolution proxies
+	// for remote viewing
+	services.StartThumbnailWorker()
+	services.StartPreviewWorker()
+	services.StartStoryboardWorker()
+	services.StartProxyWorker()
+	scanner.ClipScanned = func(clipID uint) {
+		services.QueueThumbnails(clipID)
+		services.QueuePreview(clipID)
+		services.QueueStoryboards(clipID)
+		services.QueueProxies(clipID)
+	}
 	scanner.Start()
+	api.Rescanner = scanner.ScanAll
 
 	// Setup Server
 	r := gin.New()
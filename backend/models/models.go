@@ -36,6 +36,10 @@ type VideoFile struct {
 	Camera    string    `json:"camera"` // "Front", "Left Repeater", etc.
 	FilePath  string    `json:"file_path"`
 	Timestamp time.Time `json:"timestamp" gorm:"index"`
+
+	// Low-bitrate copy generated in the background, served for quality=480p
+	ProxyPath string `json:"-"`
+	ProxySize int64  `json:"-"`
 }
 
 type Telemetry struct {
@@ -53,3 +57,161 @@ type Telemetry struct {
 	AutopilotState string  `json:"autopilot_state"`
 	FullDataJson   string  `json:"full_data_json"` // Store full protobuf dump if needed
 }
+
+// ExportJob is the persisted record of an export. It outlives the in-memory
+// progress tracking so finished files can be listed, downloaded and expired.
+type ExportJob struct {
+	ID        uint       `gorm:"primary_key" json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"-"`
+	DeletedAt *time.Time `sql:"index" json:"-"`
+
+	JobID       string     `json:"job_id" gorm:"unique_index"`
+	Kind        string     `json:"kind"` // "clip", "timelapse", "batch"
+	ClipID      uint       `json:"clip_id" gorm:"index"`
+	Status      string     `json:"status"` // "pending", "processing", "completed", "failed"
+	Progress    float64    `json:"progress"`
+	FileName    string     `json:"file_name"` // Relative to the export directory
+	SizeBytes   int64      `json:"size_bytes"`
+	Error       string     `json:"error,omitempty"`
+	CompletedAt *time.Time `json:"completed_at"`
+
+	// Upload to a configured export destination
+	Destination    string  `json:"destination,omitempty"`
+	UploadStatus   string  `json:"upload_status,omitempty"` // "pending", "uploading", "uploaded", "failed"
+	UploadProgress float64 `json:"upload_progress,omitempty"`
+	UploadAttempts int     `json:"upload_attempts,omitempty"`
+	UploadError    string  `json:"upload_error,omitempty"`
+}
+
+// ExportJobItem is one clip of a batch export, tracked individually so a
+// single unreadable event doesn't hide the state of the others.
+type ExportJobItem struct {
+	ID        uint       `gorm:"primary_key" json:"-"`
+	CreatedAt time.Time  `json:"-"`
+	UpdatedAt time.Time  `json:"-"`
+	DeletedAt *time.Time `sql:"index" json:"-"`
+
+	JobID    string `json:"-" gorm:"index"`
+	Position int    `json:"position"`
+	ClipID   uint   `json:"clip_id"`
+	Status   string `json:"status"`              // "pending", "processing", "completed", "failed"
+	FileName string `json:"file_name,omitempty"` // Entry name inside the ZIP (zip output only)
+	Error    string `json:"error,omitempty"`
+}
+
+// CameraMask is a reusable privacy mask (e.g. the bonnet reflection or a number plate
+// always in view) applied to every export of its camera while enabled.
+// Coordinates are fractions (0-1) of the camera frame.
+type CameraMask struct {
+	ID        uint       `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"-"`
+	DeletedAt *time.Time `sql:"index" json:"-"`
+
+	Name    string  `json:"name"`
+	Camera  string  `json:"camera" gorm:"index"`
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Width   float64 `json:"width"`
+	Height  float64 `json:"height"`
+	Mode    string  `json:"mode"` // "blur" or "pixelate"
+	Enabled bool    `json:"enabled"`
+}
+
+// ShareLink grants unauthenticated, time-limited access to a single clip window or export.
+// The public token embeds TokenID and is HMAC-signed; this record allows revocation and view counting.
+type ShareLink struct {
+	ID        uint       `gorm:"primary_key" json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"-"`
+	DeletedAt *time.Time `sql:"index" json:"-"`
+
+	TokenID      string     `json:"id" gorm:"unique_index"`
+	Kind         string     `json:"kind"` // "clip" or "export"
+	ClipID       uint       `json:"clip_id,omitempty" gorm:"index"`
+	Cameras      string     `json:"cameras,omitempty"` // Comma-separated camera names
+	StartTime    float64    `json:"start_time"`        // Seconds from clip start
+	Duration     float64    `json:"duration"`          // 0 = until the end of the clip
+	ExportJobID  string     `json:"export_job_id,omitempty"`
+	PasswordHash string     `json:"-"`
+	HasPassword  bool       `json:"has_password"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	RevokedAt    *time.Time `json:"revoked_at"`
+	Views        int        `json:"views"`
+	MaxViews     int        `json:"max_views"` // 0 = unlimited
+	CreatedBy    string     `json:"created_by,omitempty"`
+}
+
+// User is an account that can sign in. Usernames are what JWT claims refer to.
+type User struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+
+	Username          string     `json:"username" gorm:"unique_index"`
+	PasswordHash      string     `json:"-"`    // bcrypt
+	Role              string     `json:"role"` // "admin", "exporter", "viewer" or "viewer_no_location"
+	PasswordChangedAt time.Time  `json:"password_changed_at"`
+	LastLoginAt       *time.Time `json:"last_login_at"`
+	OIDCSubject       string     `json:"oidc_subject,omitempty" gorm:"column:oidc_subject;index"` // Linked single sign-on account
+
+	// Two-factor authentication. TOTPSecret is set while enrolling and only used
+	// for logins once TOTPEnabled; TOTPRequired is set by an admin.
+	TOTPSecret    string `json:"-" gorm:"column:totp_secret"` // Base32
+	TOTPEnabled   bool   `json:"totp_enabled" gorm:"column:totp_enabled"`
+	TOTPRequired  bool   `json:"totp_required" gorm:"column:totp_required"`
+	TOTPLastStep  int64  `json:"-" gorm:"column:totp_last_step"` // Rejects a code used twice
+	RecoveryCodes string `json:"-"`                              // Comma-separated hashes of unused codes
+}
+
+// Session is one signed-in device. Access tokens name it in their sid claim and stop
+// working once it is revoked; its refresh token is stored hashed and replaced on
+// every use.
+type Session struct {
+	ID        uint      `gorm:"primary_key" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+
+	SessionID    string     `json:"id" gorm:"unique_index"`
+	UserID       uint       `json:"-" gorm:"index"`
+	RefreshHash  string     `json:"-"`
+	PreviousHash string     `json:"-"` // The refresh token it replaced, to detect reuse
+	UserAgent    string     `json:"user_agent"`
+	IP           string     `json:"ip"`
+	LastUsedAt   time.Time  `json:"last_used_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	RevokedAt    *time.Time `json:"-"`
+}
+
+// APIKey is a personal key for scripts, sent as "Authorization: Bearer tx_...". Only
+// a hash is stored; requests get the owner's role, limited to the key's scopes.
+type APIKey struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+
+	UserID     uint       `json:"-" gorm:"index"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // Start of the key, to tell keys apart
+	KeyHash    string     `json:"-" gorm:"unique_index"`
+	Scopes     string     `json:"scopes"` // Comma-separated, see api.apiKeyScopes
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// AuditEvent records who did what from where: logins, footage views, exports and
+// share links. Username is empty for visitors of a share link.
+type AuditEvent struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+
+	Username    string `json:"username" gorm:"index"`
+	IP          string `json:"ip"`
+	Action      string `json:"action" gorm:"index"` // See the Audit* constants in api/audit.go
+	ClipID      uint   `json:"clip_id,omitempty" gorm:"index"`
+	VideoFile   string `json:"video_file,omitempty"`
+	ExportJobID string `json:"export_job_id,omitempty"`
+	ShareLinkID string `json:"share_link_id,omitempty"` // ShareLink.TokenID, never the token
+	Detail      string `json:"detail,omitempty"`
+}
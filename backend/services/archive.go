@@ -0,0 +1,307 @@
+package services
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"teslaxy/models"
+)
+
+// Archive formats
+const (
+	ArchiveFormatZip = "zip"
+	ArchiveFormatTar = "tar"
+)
+
+// ArchiveOptions selects what goes into an original-footage bundle
+type ArchiveOptions struct {
+	Format string     // "zip" (default) or "tar"
+	From   *time.Time // Optional window; files overlapping it are included
+	To     *time.Time
+}
+
+// ArchiveManifestEntry describes one file in the bundle
+type ArchiveManifestEntry struct {
+	Name      string     `json:"name"`
+	Source    string     `json:"source,omitempty"` // Original path on disk
+	Camera    string     `json:"camera,omitempty"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Size      int64      `json:"size"`
+	SHA256    string     `json:"sha256"`
+}
+
+// ArchiveManifest is written last as manifest.json, once every checksum is known
+type ArchiveManifest struct {
+	ClipID         uint                   `json:"clip_id"`
+	Event          string                 `json:"event"`
+	Reason         string                 `json:"reason,omitempty"`
+	City           string                 `json:"city,omitempty"`
+	Timestamp      time.Time              `json:"timestamp"`
+	EventTimestamp *time.Time             `json:"event_timestamp,omitempty"`
+	SourceDir      string                 `json:"source_dir,omitempty"`
+	WindowFrom     *time.Time             `json:"window_from,omitempty"`
+	WindowTo       *time.Time             `json:"window_to,omitempty"`
+	GeneratedAt    time.Time              `json:"generated_at"`
+	Files          []ArchiveManifestEntry `json:"files"`
+}
+
+// archiveWriter hides the differences between zip and tar streaming
+type archiveWriter interface {
+	add(name string, size int64, modTime time.Time, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct{ zw *zip.Writer }
+
+func (a *zipArchive) add(name string, size int64, modTime time.Time, r io.Reader) error {
+	// Store, don't deflate: footage is already compressed and originals must be byte-identical
+	w, err := a.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (a *zipArchive) Close() error { return a.zw.Close() }
+
+type tarArchive struct{ tw *tar.Writer }
+
+func (a *tarArchive) add(name string, size int64, modTime time.Time, r io.Reader) error {
+	if err := a.tw.WriteHeader(&tar.Header{Name: name, Size: size, Mode: 0644, ModTime: modTime, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err := io.CopyN(a.tw, r, size)
+	return err
+}
+
+func (a *tarArchive) Close() error { return a.tw.Close() }
+
+// ArchiveFiles returns the clip's video files inside the optional window, ordered by time then camera
+func ArchiveFiles(clip models.Clip, opts ArchiveOptions) []models.VideoFile {
+	var files []models.VideoFile
+	for _, vf := range clip.VideoFiles {
+		// Each file covers roughly one minute starting at its timestamp
+		end := vf.Timestamp.Add(time.Duration(defaultSegmentDuration) * time.Second)
+		if opts.From != nil && !end.After(*opts.From) {
+			continue
+		}
+		if opts.To != nil && !vf.Timestamp.Before(*opts.To) {
+			continue
+		}
+		files = append(files, vf)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].Timestamp.Equal(files[j].Timestamp) {
+			return files[i].Timestamp.Before(files[j].Timestamp)
+		}
+		return files[i].Camera < files[j].Camera
+	})
+	return files
+}
+
+// WriteClipArchive streams the untouched original footage of a clip, its event.json,
+// extracted telemetry (JSON + CSV), SHA256SUMS and a manifest to w.
+// Nothing is staged on disk; checksums are computed while the bytes are streamed.
+func WriteClipArchive(w io.Writer, clip models.Clip, opts ArchiveOptions) error {
+	var aw archiveWriter
+	switch opts.Format {
+	case "", ArchiveFormatZip:
+		aw = &zipArchive{zw: zip.NewWriter(w)}
+	case ArchiveFormatTar:
+		aw = &tarArchive{tw: tar.NewWriter(w)}
+	default:
+		return fmt.Errorf("unsupported archive format: %s", opts.Format)
+	}
+
+	files := ArchiveFiles(clip, opts)
+	if len(files) == 0 {
+		return fmt.Errorf("no video files in the selected window")
+	}
+
+	manifest := ArchiveManifest{
+		ClipID:         clip.ID,
+		Event:          clip.Event,
+		Reason:         clip.Reason,
+		City:           clip.City,
+		Timestamp:      clip.Timestamp,
+		EventTimestamp: clip.EventTimestamp,
+		SourceDir:      clip.SourceDir,
+		WindowFrom:     opts.From,
+		WindowTo:       opts.To,
+		GeneratedAt:    time.Now().UTC(),
+	}
+
+	// addHashed streams r into the archive and records its checksum
+	addHashed := func(entry ArchiveManifestEntry, modTime time.Time, r io.Reader) error {
+		h := sha256.New()
+		if err := aw.add(entry.Name, entry.Size, modTime, io.TeeReader(r, h)); err != nil {
+			return err
+		}
+		entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+		manifest.Files = append(manifest.Files, entry)
+		return nil
+	}
+
+	addBytes := func(name string, data []byte) error {
+		return addHashed(ArchiveManifestEntry{Name: name, Size: int64(len(data))}, manifest.GeneratedAt, bytes.NewReader(data))
+	}
+
+	// 1. Original videos
+	for _, vf := range files {
+		if err := addOriginal(vf, addHashed); err != nil {
+			return err
+		}
+	}
+
+	// 2. event.json as written by the car
+	if clip.SourceDir != "" {
+		if data, err := os.ReadFile(filepath.Join(clip.SourceDir, "event.json")); err == nil {
+			if err := addBytes("event.json", data); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 3. Telemetry, re-extracted from the Front files in the window
+	telemetryJSON, telemetryCSV := archiveTelemetry(files)
+	if telemetryJSON != nil {
+		if err := addBytes("telemetry.json", telemetryJSON); err != nil {
+			return err
+		}
+		if err := addBytes("telemetry.csv", telemetryCSV); err != nil {
+			return err
+		}
+	}
+
+	// 4. Checksums (sha256sum -c compatible) and manifest
+	var sums bytes.Buffer
+	for _, entry := range manifest.Files {
+		fmt.Fprintf(&sums, "%s  %s\n", entry.SHA256, entry.Name)
+	}
+	if err := aw.add("SHA256SUMS", int64(sums.Len()), manifest.GeneratedAt, bytes.NewReader(sums.Bytes())); err != nil {
+		return err
+	}
+
+	manifestJSON, _ := json.MarshalIndent(manifest, "", "  ")
+	if err := aw.add("manifest.json", int64(len(manifestJSON)), manifest.GeneratedAt, bytes.NewReader(manifestJSON)); err != nil {
+		return err
+	}
+
+	return aw.Close()
+}
+
+func addOriginal(vf models.VideoFile, addHashed func(ArchiveManifestEntry, time.Time, io.Reader) error) error {
+	f, err := os.Open(vf.FilePath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", filepath.Base(vf.FilePath), err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	ts := vf.Timestamp
+	entry := ArchiveManifestEntry{
+		Name:      path.Join("videos", NormalizeCameraName(vf.Camera), filepath.Base(vf.FilePath)),
+		Source:    vf.FilePath,
+		Camera:    NormalizeCameraName(vf.Camera),
+		Timestamp: &ts,
+		Size:      info.Size(),
+	}
+	return addHashed(entry, info.ModTime(), f)
+}
+
+// archiveTelemetry extracts SEI samples from the Front files and renders them as JSON and CSV.
+// Returns nil when no telemetry is available.
+func archiveTelemetry(files []models.VideoFile) ([]byte, []byte) {
+	type sample struct {
+		File      string  `json:"file"`
+		FrameSeq  uint64  `json:"frame_seq_no"`
+		SpeedMps  float32 `json:"vehicle_speed_mps"`
+		Gear      string  `json:"gear"`
+		Steering  float32 `json:"steering_wheel_angle"`
+		Throttle  float32 `json:"accelerator_pedal_position"`
+		Brake     bool    `json:"brake_applied"`
+		BlinkL    bool    `json:"blinker_on_left"`
+		BlinkR    bool    `json:"blinker_on_right"`
+		Autopilot string  `json:"autopilot_state"`
+		Latitude  float64 `json:"latitude_deg"`
+		Longitude float64 `json:"longitude_deg"`
+		Heading   float64 `json:"heading_deg"`
+	}
+
+	var samples []sample
+	for _, vf := range files {
+		if NormalizeCameraName(vf.Camera) != "Front" {
+			continue
+		}
+		meta, err := seiExtractor(vf.FilePath)
+		if err != nil {
+			continue
+		}
+		for _, m := range meta {
+			samples = append(samples, sample{
+				File:      filepath.Base(vf.FilePath),
+				FrameSeq:  m.FrameSeqNo,
+				SpeedMps:  m.VehicleSpeedMps,
+				Gear:      m.GearState.String(),
+				Steering:  m.SteeringWheelAngle,
+				Throttle:  m.AcceleratorPedalPosition,
+				Brake:     m.BrakeApplied,
+				BlinkL:    m.BlinkerOnLeft,
+				BlinkR:    m.BlinkerOnRight,
+				Autopilot: m.AutopilotState.String(),
+				Latitude:  m.LatitudeDeg,
+				Longitude: m.LongitudeDeg,
+				Heading:   m.HeadingDeg,
+			})
+		}
+	}
+
+	if len(samples) == 0 {
+		return nil, nil
+	}
+
+	jsonData, _ := json.MarshalIndent(samples, "", "  ")
+
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write([]string{"file", "frame_seq_no", "vehicle_speed_mps", "gear", "steering_wheel_angle", "accelerator_pedal_position",
+		"brake_applied", "blinker_on_left", "blinker_on_right", "autopilot_state", "latitude_deg", "longitude_deg", "heading_deg"})
+	for _, s := range samples {
+		cw.Write([]string{
+			s.File,
+			strconv.FormatUint(s.FrameSeq, 10),
+			strconv.FormatFloat(float64(s.SpeedMps), 'f', -1, 32),
+			s.Gear,
+			strconv.FormatFloat(float64(s.Steering), 'f', -1, 32),
+			strconv.FormatFloat(float64(s.Throttle), 'f', -1, 32),
+			strconv.FormatBool(s.Brake),
+			strconv.FormatBool(s.BlinkL),
+			strconv.FormatBool(s.BlinkR),
+			s.Autopilot,
+			strconv.FormatFloat(s.Latitude, 'f', -1, 64),
+			strconv.FormatFloat(s.Longitude, 'f', -1, 64),
+			strconv.FormatFloat(s.Heading, 'f', -1, 64),
+		})
+	}
+	cw.Flush()
+
+	return jsonData, buf.Bytes()
+}
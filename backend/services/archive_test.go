@@ -0,0 +1,139 @@
+package services
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"teslaxy/models"
+	pb "teslaxy/proto"
+)
+
+func archiveFixture(t *testing.T) models.Clip {
+	dir := t.TempDir()
+	base := time.Date(2024, 6, 1, 21, 0, 0, 0, time.UTC)
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	write("event.json", `{"timestamp":"2024-06-01T21:00:30","reason":"sentry_aware_object_detection"}`)
+
+	return models.Clip{
+		ID:        7,
+		Event:     "Sentry",
+		Timestamp: base,
+		SourceDir: dir,
+		VideoFiles: []models.VideoFile{
+			{Camera: "Front", FilePath: write("2024-06-01_21-00-00-front.mp4", "front minute one"), Timestamp: base},
+			{Camera: "Back", FilePath: write("2024-06-01_21-00-00-back.mp4", "back minute one"), Timestamp: base},
+			{Camera: "Front", FilePath: write("2024-06-01_21-01-00-front.mp4", "front minute two"), Timestamp: base.Add(time.Minute)},
+		},
+	}
+}
+
+func stubSEI(t *testing.T) {
+	original := seiExtractor
+	seiExtractor = func(path string) ([]*pb.SeiMetadata, error) {
+		return []*pb.SeiMetadata{{FrameSeqNo: 1, VehicleSpeedMps: 12.5, LatitudeDeg: -34.9}}, nil
+	}
+	t.Cleanup(func() { seiExtractor = original })
+}
+
+func TestWriteClipArchive_Zip(t *testing.T) {
+	stubSEI(t)
+	clip := archiveFixture(t)
+
+	var buf bytes.Buffer
+	if err := WriteClipArchive(&buf, clip, ArchiveOptions{}); err != nil {
+		t.Fatalf("WriteClipArchive failed: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Invalid zip: %v", err)
+	}
+
+	contents := make(map[string][]byte)
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		contents[f.Name] = data
+	}
+
+	for _, name := range []string{"videos/Front/2024-06-01_21-00-00-front.mp4", "videos/Back/2024-06-01_21-00-00-back.mp4", "event.json", "telemetry.json", "telemetry.csv", "SHA256SUMS", "manifest.json"} {
+		if _, ok := contents[name]; !ok {
+			t.Errorf("Missing %s in archive", name)
+		}
+	}
+
+	// Originals must be byte-identical
+	if string(contents["videos/Front/2024-06-01_21-00-00-front.mp4"]) != "front minute one" {
+		t.Error("Original footage was modified")
+	}
+
+	// Every checksum line must match the archived bytes
+	for _, line := range strings.Split(strings.TrimSpace(string(contents["SHA256SUMS"])), "\n") {
+		parts := strings.SplitN(line, "  ", 2)
+		sum := sha256.Sum256(contents[parts[1]])
+		if hex.EncodeToString(sum[:]) != parts[0] {
+			t.Errorf("Checksum mismatch for %s", parts[1])
+		}
+	}
+
+	var manifest ArchiveManifest
+	if err := json.Unmarshal(contents["manifest.json"], &manifest); err != nil {
+		t.Fatalf("Invalid manifest: %v", err)
+	}
+	if manifest.ClipID != 7 || len(manifest.Files) != 6 {
+		t.Errorf("Unexpected manifest: clip %d, %d files", manifest.ClipID, len(manifest.Files))
+	}
+
+	if !strings.Contains(string(contents["telemetry.csv"]), "vehicle_speed_mps") {
+		t.Error("Expected CSV header in telemetry.csv")
+	}
+}
+
+func TestWriteClipArchive_TarWindow(t *testing.T) {
+	stubSEI(t)
+	clip := archiveFixture(t)
+
+	from := clip.Timestamp.Add(70 * time.Second)
+	var buf bytes.Buffer
+	if err := WriteClipArchive(&buf, clip, ArchiveOptions{Format: ArchiveFormatTar, From: &from}); err != nil {
+		t.Fatalf("WriteClipArchive failed: %v", err)
+	}
+
+	tr := tar.NewReader(&buf)
+	var videos []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Invalid tar: %v", err)
+		}
+		if strings.HasPrefix(hdr.Name, "videos/") {
+			videos = append(videos, hdr.Name)
+		}
+	}
+
+	if len(videos) != 1 || videos[0] != "videos/Front/2024-06-01_21-01-00-front.mp4" {
+		t.Errorf("Expected only the second minute, got %v", videos)
+	}
+}
@@ -0,0 +1,431 @@
+package services
+
+import (
+	"archive/zip"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+// ExportKindBatch is the ExportJob kind of a multi-clip export
+const ExportKindBatch = "batch"
+
+// Batch output formats
+const (
+	BatchOutputConcat = "concat" // One video, events back to back (default)
+	BatchOutputZip    = "zip"    // One video per event, bundled in a ZIP
+)
+
+const (
+	// MaxBatchClips bounds the work a single request can queue
+	MaxBatchClips = 50
+
+	// titleCardDuration is how long each event's title card is shown (seconds)
+	titleCardDuration = 3
+)
+
+// BatchExportFilter selects clips by metadata instead of explicit IDs.
+// Empty fields are ignored; at least one must be set.
+type BatchExportFilter struct {
+	From   *time.Time `json:"from,omitempty"`
+	To     *time.Time `json:"to,omitempty"`
+	Event  string     `json:"event,omitempty"`  // "Sentry", "Saved", "Recent"
+	Reason string     `json:"reason,omitempty"` // e.g. "sentry_aware_object_detection"
+	City   string     `json:"city,omitempty"`   // Substring match
+}
+
+// BatchExportRequest exports several clips as a single job
+type BatchExportRequest struct {
+	ClipIDs []uint             `json:"clip_ids,omitempty"` // Exported in the given order
+	Filter  *BatchExportFilter `json:"filter,omitempty"`   // Exported oldest first
+	Cameras []string           `json:"cameras"`
+
+	Output     string `json:"output,omitempty"`      // "concat" (default) or "zip"
+	TitleCards *bool  `json:"title_cards,omitempty"` // concat only; defaults to true
+
+	// Destination optionally names a configured destination (destinations.json) to upload the result to
+	Destination string `json:"destination,omitempty"`
+
+	// Saved camera masks are applied unless this is set
+	IgnoreSavedMasks bool `json:"ignore_saved_masks,omitempty"`
+}
+
+// Validate enforces security constraints on the batch request
+func (r *BatchExportRequest) Validate() error {
+	switch r.Output {
+	case "", BatchOutputConcat, BatchOutputZip:
+	default:
+		return fmt.Errorf("invalid output: %s", r.Output)
+	}
+
+	if (len(r.ClipIDs) == 0) == (r.Filter == nil) {
+		return fmt.Errorf("exactly one of clip_ids or filter is required")
+	}
+	if len(r.ClipIDs) > MaxBatchClips {
+		return fmt.Errorf("a batch cannot contain more than %d clips", MaxBatchClips)
+	}
+
+	if f := r.Filter; f != nil {
+		if f.From == nil && f.To == nil && f.Event == "" && f.Reason == "" && f.City == "" {
+			return fmt.Errorf("filter must not be empty")
+		}
+		if f.From != nil && f.To != nil && !f.To.After(*f.From) {
+			return fmt.Errorf("to must be after from")
+		}
+	}
+
+	return ValidateCameras(r.Cameras)
+}
+
+func (r *BatchExportRequest) titleCards() bool {
+	return r.TitleCards == nil || *r.TitleCards
+}
+
+// loadBatchClips resolves the clips of a batch request
+func loadBatchClips(req BatchExportRequest) ([]models.Clip, error) {
+	query := database.DB.Preload("VideoFiles", func(db *gorm.DB) *gorm.DB {
+		return db.Order("timestamp asc")
+	})
+
+	var clips []models.Clip
+	if len(req.ClipIDs) > 0 {
+		seen := make(map[uint]bool)
+		for _, id := range req.ClipIDs {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			var clip models.Clip
+			if err := query.First(&clip, id).Error; err != nil {
+				return nil, fmt.Errorf("clip %d not found", id)
+			}
+			clips = append(clips, clip)
+		}
+		return clips, nil
+	}
+
+	f := req.Filter
+	if f.From != nil {
+		query = query.Where("timestamp >= ?", *f.From)
+	}
+	if f.To != nil {
+		query = query.Where("timestamp < ?", *f.To)
+	}
+	if f.Event != "" {
+		query = query.Where("event = ?", f.Event)
+	}
+	if f.Reason != "" {
+		query = query.Where("reason = ?", f.Reason)
+	}
+	if f.City != "" {
+		query = query.Where("city LIKE ?", "%"+f.City+"%")
+	}
+
+	// Fetch one extra row to tell "exactly the limit" from "too many"
+	if err := query.Order("timestamp asc").Limit(MaxBatchClips + 1).Find(&clips).Error; err != nil {
+		return nil, err
+	}
+	if len(clips) == 0 {
+		return nil, fmt.Errorf("no clips match the filter")
+	}
+	if len(clips) > MaxBatchClips {
+		return nil, fmt.Errorf("filter matches more than %d clips; narrow it down", MaxBatchClips)
+	}
+	return clips, nil
+}
+
+// QueueBatchExport adds a multi-clip export to the queue. The whole batch
+// counts as one job against MaxConcurrentExports.
+func QueueBatchExport(req BatchExportRequest) (string, error) {
+	if req.Destination != "" {
+		if _, err := GetDestination(req.Destination); err != nil {
+			return "", err
+		}
+	}
+
+	clips, err := loadBatchClips(req)
+	if err != nil {
+		return "", err
+	}
+
+	items := make([]models.ExportJobItem, len(clips))
+	for i, clip := range clips {
+		items[i] = models.ExportJobItem{Position: i, ClipID: clip.ID, Status: "pending"}
+	}
+
+	return startExportJob("batch", ExportKindBatch, 0, req.Destination, items, func(jobID string) {
+		processBatchExport(jobID, req, clips)
+	})
+}
+
+// updateItemStatus records the state of one batch item in memory and in the database
+func updateItemStatus(jobID string, position int, state, fileName, errMsg string) {
+	exportQueueLock.Lock()
+	if status, ok := exportQueue[jobID]; ok && position < len(status.Items) {
+		status.Items[position].Status = state
+		status.Items[position].FileName = fileName
+		status.Items[position].Error = errMsg
+	}
+	exportQueueLock.Unlock()
+
+	if database.DB == nil {
+		return
+	}
+	if err := database.DB.Model(&models.ExportJobItem{}).Where("job_id = ? AND position = ?", jobID, position).
+		Updates(map[string]interface{}{"status": state, "file_name": fileName, "error": errMsg}).Error; err != nil {
+		log.Printf("Failed to update item %d of export job %s: %v", position, jobID, err)
+	}
+}
+
+// gridSize returns the frame size produced by layoutFilter for n tiles
+func gridSize(n int) (int, int) {
+	switch {
+	case n <= 1:
+		return timelapseTileWidth, timelapseTileHeight
+	case n <= 3:
+		return n * timelapseTileWidth, timelapseTileHeight
+	case n == 4:
+		return 2 * timelapseTileWidth, 2 * timelapseTileHeight
+	default:
+		return 3 * timelapseTileWidth, 2 * timelapseTileHeight
+	}
+}
+
+// titleCardText describes a clip on its title card
+func titleCardText(clip models.Clip) string {
+	ts := clip.Timestamp
+	if clip.EventTimestamp != nil {
+		ts = *clip.EventTimestamp
+	}
+
+	event := clip.Event
+	if event == "" {
+		event = "Clip"
+	}
+	lines := []string{event + "  " + ts.Format("2006-01-02 15:04:05")}
+	if clip.Reason != "" {
+		lines = append(lines, strings.ReplaceAll(clip.Reason, "_", " "))
+	}
+	if clip.City != "" {
+		lines = append(lines, clip.City)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// titleCardArgs renders textFile centred on a black frame matching the batch grid.
+// The text is read from a file (relative to the ffmpeg working directory) so event
+// metadata never has to be escaped into the filter graph.
+func titleCardArgs(textFile string, width, height int, videoCodec []string, output string) []string {
+	args := []string{"-hide_banner", "-loglevel", "error",
+		"-f", "lavfi", "-i", fmt.Sprintf("color=c=black:s=%dx%d:r=%d:d=%d", width, height, timelapseFPS, titleCardDuration),
+		"-vf", fmt.Sprintf("drawtext=textfile=%s:expansion=none:fontcolor=white:fontsize=%d:line_spacing=%d:x=(w-text_w)/2:y=(h-text_h)/2",
+			textFile, height/15, height/60),
+		"-an"}
+	args = append(args, videoCodec...)
+	return append(args, "-y", output)
+}
+
+// batchItemName is the file name of one event inside a ZIP batch
+func batchItemName(position int, clip models.Clip) string {
+	event := strings.ToLower(clip.Event)
+	if event == "" {
+		event = "clip"
+	}
+	return fmt.Sprintf("%02d_%s_%s.mp4", position+1, event, clip.Timestamp.Format("20060102_150405"))
+}
+
+// batchItem is one clip of a multi-clip render
+type batchItem struct {
+	Clip    models.Clip
+	Cameras []string // Normalized; every item of a concatenated render needs the same count
+	Start   float64  // Seconds from the clip's first segment for these cameras
+	Length  float64  // 0 = until the end of the clip
+	Caption string   // Title card text; defaults to titleCardText
+}
+
+// batchRender controls how the items of a multi-clip job are assembled
+type batchRender struct {
+	Zip        bool
+	TitleCards bool
+	NamePrefix string // Output file name prefix, e.g. "batch" or "highlights"
+	Masks      map[string][]MaskRegion
+}
+
+// processBatchExport renders every clip with the full camera set so the results can be joined
+func processBatchExport(jobID string, req BatchExportRequest, clips []models.Clip) {
+	// Every item uses the full camera set (black tiles where missing) so frame sizes match
+	var cameras []string
+	seen := make(map[string]bool)
+	for _, cam := range req.Cameras {
+		name := NormalizeCameraName(cam)
+		if !seen[name] {
+			seen[name] = true
+			cameras = append(cameras, name)
+		}
+	}
+
+	items := make([]batchItem, len(clips))
+	for i, clip := range clips {
+		items[i] = batchItem{Clip: clip, Cameras: cameras}
+	}
+
+	opts := batchRender{Zip: req.Output == BatchOutputZip, TitleCards: req.titleCards(), NamePrefix: "batch", Masks: map[string][]MaskRegion{}}
+	if !req.IgnoreSavedMasks {
+		opts.Masks = savedMasks()
+	}
+	renderBatch(jobID, items, opts)
+}
+
+// renderBatch renders each item with a common tile layout so the results can be
+// joined without re-encoding, then concatenates (with title cards) or zips them.
+func renderBatch(jobID string, items []batchItem, opts batchRender) {
+	updateStatus(jobID, "processing", 0, "")
+
+	exportDir := ExportDir()
+	workDir := filepath.Join(exportDir, jobID+"_work")
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		updateStatus(jobID, "failed", 0, "Failed to create export directory: "+err.Error())
+		return
+	}
+	defer os.RemoveAll(workDir)
+
+	videoCodec := tiledVideoCodec()
+
+	var parts []string     // concat: title cards and chunks of every event, in order
+	var itemFiles []string // zip: one file per event
+	var itemNames []string
+
+	for i, item := range items {
+		clip := item.Clip
+		// Reserve the last 5% for joining
+		updateStatus(jobID, "processing", float64(i)/float64(len(items))*95, "")
+		updateItemStatus(jobID, i, "processing", "", "")
+
+		plan := ExportRequest{ClipID: clip.ID, Cameras: item.Cameras, StartTime: item.Start, Duration: item.Length}
+		segments := planTimelapse(plan, []models.Clip{clip})
+		if len(segments) == 0 {
+			updateItemStatus(jobID, i, "failed", "", "No valid camera files found for selection")
+			continue
+		}
+
+		var chunks []string
+		for j, seg := range segments {
+			for k, w := range seg.Windows {
+				chunk := filepath.Join(workDir, fmt.Sprintf("item_%03d_%04d_%02d.mp4", i, j, k))
+				args := timelapseChunkArgs(seg, w, item.Cameras, opts.Masks, 1, videoCodec, chunk)
+				if out, err := exec.Command("ffmpeg", args...).CombinedOutput(); err != nil {
+					log.Printf("Batch %s item %d chunk %d failed: %v, Output: %s", jobID, i, j, err, string(out))
+					continue
+				}
+				chunks = append(chunks, chunk)
+			}
+		}
+		if len(chunks) == 0 {
+			updateItemStatus(jobID, i, "failed", "", "Encoding failed for all segments")
+			continue
+		}
+
+		if opts.Zip {
+			name := batchItemName(i, clip)
+			itemFile := filepath.Join(workDir, name)
+			if err := concatChunks(filepath.Join(workDir, fmt.Sprintf("item_%03d.txt", i)), chunks, itemFile); err != nil {
+				log.Printf("Batch %s item %d concat failed: %v", jobID, i, err)
+				updateItemStatus(jobID, i, "failed", "", "Concatenation failed: "+err.Error())
+				continue
+			}
+			itemFiles = append(itemFiles, itemFile)
+			itemNames = append(itemNames, name)
+			updateItemStatus(jobID, i, "completed", name, "")
+		} else {
+			if opts.TitleCards {
+				caption := item.Caption
+				if caption == "" {
+					caption = titleCardText(clip)
+				}
+				width, height := gridSize(len(item.Cameras))
+				textFile := fmt.Sprintf("card_%03d.txt", i)
+				card := filepath.Join(workDir, fmt.Sprintf("card_%03d.mp4", i))
+				cmd := exec.Command("ffmpeg", titleCardArgs(textFile, width, height, videoCodec, card)...)
+				cmd.Dir = workDir
+				if err := os.WriteFile(filepath.Join(workDir, textFile), []byte(caption), 0644); err != nil {
+					log.Printf("Batch %s item %d title card skipped: %v", jobID, i, err)
+				} else if out, err := cmd.CombinedOutput(); err != nil {
+					// A missing font shouldn't fail the export; the event footage still follows
+					log.Printf("Batch %s item %d title card failed: %v, Output: %s", jobID, i, err, string(out))
+				} else {
+					parts = append(parts, card)
+				}
+			}
+			parts = append(parts, chunks...)
+			updateItemStatus(jobID, i, "completed", "", "")
+		}
+	}
+
+	if len(itemFiles) == 0 && len(parts) == 0 {
+		updateStatus(jobID, "failed", 0, "All clips in the batch failed")
+		return
+	}
+
+	base := fmt.Sprintf("%s_%s_%s", opts.NamePrefix, items[0].Clip.Timestamp.Format("20060102_150405"), jobID)
+	var outputFilename string
+	var err error
+	if opts.Zip {
+		outputFilename = base + ".zip"
+		err = writeBatchZip(filepath.Join(exportDir, outputFilename), itemFiles, itemNames)
+	} else {
+		outputFilename = base + ".mp4"
+		err = concatChunks(filepath.Join(workDir, "parts.txt"), parts, filepath.Join(exportDir, outputFilename))
+	}
+	if err != nil {
+		log.Printf("Batch %s failed to assemble output: %v", jobID, err)
+		updateStatus(jobID, "failed", 0, "Failed to assemble batch: "+err.Error())
+		return
+	}
+
+	completeExport(jobID, outputFilename)
+}
+
+// writeBatchZip stores the rendered event videos uncompressed (they are already H.264)
+func writeBatchZip(output string, files, names []string) error {
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	aw := &zipArchive{zw: zip.NewWriter(f)}
+
+	for i, file := range files {
+		if err := addFileToArchive(aw, names[i], file); err != nil {
+			f.Close()
+			os.Remove(output)
+			return err
+		}
+	}
+	if err := aw.Close(); err != nil {
+		f.Close()
+		os.Remove(output)
+		return err
+	}
+	return f.Close()
+}
+
+func addFileToArchive(aw *zipArchive, name, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	return aw.add(name, info.Size(), info.ModTime(), in)
+}
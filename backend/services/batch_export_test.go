@@ -0,0 +1,208 @@
+package services
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+func TestBatchExportRequestValidation(t *testing.T) {
+	from := time.Date(2024, 5, 1, 22, 0, 0, 0, time.UTC)
+	to := from.Add(8 * time.Hour)
+	tooMany := make([]uint, MaxBatchClips+1)
+
+	tests := []struct {
+		name    string
+		req     BatchExportRequest
+		wantErr bool
+	}{
+		{"Clip IDs", BatchExportRequest{ClipIDs: []uint{1, 2}, Cameras: []string{"front"}}, false},
+		{"Filter", BatchExportRequest{Filter: &BatchExportFilter{From: &from, To: &to, Event: "Sentry"}, Cameras: []string{"front"}, Output: BatchOutputZip}, false},
+		{"Neither", BatchExportRequest{Cameras: []string{"front"}}, true},
+		{"Both", BatchExportRequest{ClipIDs: []uint{1}, Filter: &BatchExportFilter{Event: "Sentry"}, Cameras: []string{"front"}}, true},
+		{"Empty filter", BatchExportRequest{Filter: &BatchExportFilter{}, Cameras: []string{"front"}}, true},
+		{"Reversed range", BatchExportRequest{Filter: &BatchExportFilter{From: &to, To: &from}, Cameras: []string{"front"}}, true},
+		{"Too many clips", BatchExportRequest{ClipIDs: tooMany, Cameras: []string{"front"}}, true},
+		{"Invalid output", BatchExportRequest{ClipIDs: []uint{1}, Cameras: []string{"front"}, Output: "gif"}, true},
+		{"Invalid camera", BatchExportRequest{ClipIDs: []uint{1}, Cameras: []string{"front;rm -rf"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.req.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func createBatchClip(t *testing.T, event, reason, city string, ts time.Time) models.Clip {
+	clip := models.Clip{Timestamp: ts, Event: event, Reason: reason, City: city,
+		VideoFiles: []models.VideoFile{{Camera: "Front", FilePath: filepath.Join(t.TempDir(), "front.mp4"), Timestamp: ts}}}
+	if err := database.DB.Create(&clip).Error; err != nil {
+		t.Fatal(err)
+	}
+	return clip
+}
+
+func TestLoadBatchClips_Filter(t *testing.T) {
+	setupExportDB(t)
+	night := time.Date(2024, 5, 1, 22, 0, 0, 0, time.UTC)
+	late := createBatchClip(t, "Sentry", "sentry_aware_object_detection", "Springfield", night.Add(3*time.Hour))
+	early := createBatchClip(t, "Sentry", "sentry_aware_object_detection", "Springfield", night.Add(time.Hour))
+	createBatchClip(t, "Saved", "user_interaction_honk", "Springfield", night.Add(2*time.Hour))
+	createBatchClip(t, "Sentry", "sentry_aware_object_detection", "Shelbyville", night.Add(2*time.Hour))
+	createBatchClip(t, "Sentry", "sentry_aware_object_detection", "Springfield", night.Add(-time.Hour))
+
+	to := night.Add(8 * time.Hour)
+	clips, err := loadBatchClips(BatchExportRequest{Filter: &BatchExportFilter{From: &night, To: &to, Event: "Sentry", City: "spring"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clips) != 2 || clips[0].ID != early.ID || clips[1].ID != late.ID {
+		t.Fatalf("Expected the two Springfield Sentry clips oldest first, got %+v", clips)
+	}
+	if len(clips[0].VideoFiles) != 1 {
+		t.Error("Expected video files to be preloaded")
+	}
+
+	if _, err := loadBatchClips(BatchExportRequest{Filter: &BatchExportFilter{Reason: "nothing_like_this"}}); err == nil {
+		t.Error("Expected an error when no clips match")
+	}
+}
+
+func TestLoadBatchClips_IDsKeepOrder(t *testing.T) {
+	setupExportDB(t)
+	now := time.Now()
+	a := createBatchClip(t, "Sentry", "", "", now)
+	b := createBatchClip(t, "Sentry", "", "", now.Add(time.Minute))
+
+	clips, err := loadBatchClips(BatchExportRequest{ClipIDs: []uint{b.ID, a.ID, b.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clips) != 2 || clips[0].ID != b.ID || clips[1].ID != a.ID {
+		t.Errorf("Expected requested order without duplicates, got %+v", clips)
+	}
+
+	if _, err := loadBatchClips(BatchExportRequest{ClipIDs: []uint{a.ID, 9999}}); err == nil {
+		t.Error("Expected an error for a missing clip")
+	}
+}
+
+func TestLoadBatchClips_FilterLimit(t *testing.T) {
+	setupExportDB(t)
+	start := time.Now()
+	for i := 0; i <= MaxBatchClips; i++ {
+		database.DB.Create(&models.Clip{Timestamp: start.Add(time.Duration(i) * time.Minute), Event: "Sentry"})
+	}
+
+	if _, err := loadBatchClips(BatchExportRequest{Filter: &BatchExportFilter{Event: "Sentry"}}); err == nil {
+		t.Error("Expected a filter matching too many clips to be rejected")
+	}
+}
+
+func TestGridSizeMatchesLayout(t *testing.T) {
+	cases := map[int][2]int{1: {960, 720}, 2: {1920, 720}, 3: {2880, 720}, 4: {1920, 1440}, 6: {2880, 1440}}
+	for n, want := range cases {
+		if w, h := gridSize(n); w != want[0] || h != want[1] {
+			t.Errorf("gridSize(%d) = %dx%d, want %dx%d", n, w, h, want[0], want[1])
+		}
+	}
+}
+
+func TestTitleCard(t *testing.T) {
+	eventTime := time.Date(2024, 5, 2, 1, 23, 45, 0, time.UTC)
+	clip := models.Clip{Timestamp: eventTime.Add(-time.Minute), EventTimestamp: &eventTime, Event: "Sentry",
+		Reason: "sentry_aware_object_detection", City: "O'Fallon: Main St"}
+
+	text := titleCardText(clip)
+	want := "Sentry  2024-05-02 01:23:45\nsentry aware object detection\nO'Fallon: Main St"
+	if text != want {
+		t.Errorf("titleCardText() = %q, want %q", text, want)
+	}
+
+	args := strings.Join(titleCardArgs("card_000.txt", 1920, 1440, []string{"-c:v", "libx264"}, "card.mp4"), " ")
+	if !strings.Contains(args, "color=c=black:s=1920x1440:r=30:d=3") || !strings.Contains(args, "textfile=card_000.txt:expansion=none") {
+		t.Errorf("Unexpected title card args: %s", args)
+	}
+	// Metadata must never reach the filter graph directly
+	if strings.Contains(args, "Fallon") {
+		t.Errorf("Title text leaked into ffmpeg args: %s", args)
+	}
+}
+
+func TestWriteBatchZip(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "a.mp4")
+	second := filepath.Join(dir, "b.mp4")
+	os.WriteFile(first, []byte("first event"), 0644)
+	os.WriteFile(second, []byte("second event"), 0644)
+
+	output := filepath.Join(dir, "batch.zip")
+	if err := writeBatchZip(output, []string{first, second}, []string{"01_sentry.mp4", "02_sentry.mp4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.OpenReader(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	if len(zr.File) != 2 || zr.File[0].Name != "01_sentry.mp4" || zr.File[1].Method != zip.Store {
+		t.Errorf("Unexpected zip entries: %+v", zr.File)
+	}
+}
+
+func TestQueueBatchExport_TracksItems(t *testing.T) {
+	setupExportDB(t)
+	now := time.Now()
+	a := createBatchClip(t, "Sentry", "", "", now)
+	b := createBatchClip(t, "Sentry", "", "", now.Add(time.Minute))
+
+	// The referenced footage doesn't exist, so every item fails to encode
+	jobID, err := QueueBatchExport(BatchExportRequest{ClipIDs: []uint{a.ID, b.ID}, Cameras: []string{"front"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(jobID, "batch_") {
+		t.Errorf("Unexpected job ID %s", jobID)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	var status *ExportStatus
+	for time.Now().Before(deadline) {
+		if s, ok := GetExportStatus(jobID); ok && s.Status == "failed" {
+			status = s
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if status == nil {
+		t.Fatal("Batch did not finish")
+	}
+
+	exportQueueLock.Lock()
+	delete(exportQueue, jobID)
+	exportQueueLock.Unlock()
+
+	// Persisted record, as seen after the in-memory status expires
+	persisted, ok := GetExportStatus(jobID)
+	if !ok || len(persisted.Items) != 2 {
+		t.Fatalf("Expected two persisted items, got %+v", persisted)
+	}
+	for i, item := range persisted.Items {
+		if item.Position != i || item.Status != "failed" || item.Error == "" {
+			t.Errorf("Unexpected item %d: %+v", i, item)
+		}
+	}
+	if persisted.Items[0].ClipID != a.ID || persisted.Items[1].ClipID != b.ID {
+		t.Errorf("Items out of order: %+v", persisted.Items)
+	}
+}
@@ -0,0 +1,155 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"teslaxy/models"
+)
+
+const (
+	// streamGapTolerance absorbs the jitter between one-minute file timestamps;
+	// anything longer is shown as a gap
+	streamGapTolerance = 1.5
+	// streamMaxGapSegment splits long gaps so no entry exceeds the target duration
+	streamMaxGapSegment = 60.0
+)
+
+var ErrNoCameraFootage = errors.New("no footage for this camera")
+
+// streamEntry is one segment of a clip's continuous camera stream: either a whole
+// VideoFile remuxed to MPEG-TS, or a gap with no footage.
+type streamEntry struct {
+	File      *models.VideoFile
+	Offset    float64   // Seconds from the start of the clip timeline
+	Duration  float64   // Seconds
+	Timestamp time.Time // Wall-clock time of the first frame
+}
+
+func (e streamEntry) gap() bool { return e.File == nil }
+
+// clipStreamOrigin is time zero of every camera stream of a clip: its earliest file.
+// Sharing it keeps the streams of all cameras in sync.
+func clipStreamOrigin(clip models.Clip) time.Time {
+	origin := clip.Timestamp
+	for _, vf := range clip.VideoFiles {
+		if vf.Timestamp.Before(origin) {
+			origin = vf.Timestamp
+		}
+	}
+	return origin
+}
+
+// planClipStream lays out the files of one camera on the clip timeline. Files that
+// can't be probed (e.g. truncated by the car) become gaps like missing minutes.
+func planClipStream(clip models.Clip, camera string) ([]streamEntry, error) {
+	name := NormalizeCameraName(camera)
+	var files []models.VideoFile
+	for _, vf := range clip.VideoFiles {
+		if NormalizeCameraName(vf.Camera) == name {
+			files = append(files, vf)
+		}
+	}
+	if len(files) == 0 {
+		return nil, ErrNoCameraFootage
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Timestamp.Before(files[j].Timestamp) })
+
+	origin := clipStreamOrigin(clip)
+	var entries []streamEntry
+	cursor := 0.0
+	addGap := func(until float64) {
+		for until-cursor > streamGapTolerance {
+			length := math.Min(until-cursor, streamMaxGapSegment)
+			entries = append(entries, streamEntry{Offset: cursor, Duration: length, Timestamp: origin.Add(seconds(cursor))})
+			cursor += length
+		}
+	}
+
+	for i := range files {
+		vf := &files[i]
+		start := vf.Timestamp.Sub(origin).Seconds()
+		addGap(start)
+
+		info, err := probeVideo(vf.FilePath)
+		if err != nil {
+			continue // Covered by the gap before the next file
+		}
+		// Files overlapping the previous one are played right after it
+		entries = append(entries, streamEntry{File: vf, Offset: cursor, Duration: info.Duration, Timestamp: vf.Timestamp})
+		cursor += info.Duration
+	}
+	return entries, nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// ClipStreamPlaylist returns an HLS playlist that plays every file of one camera of a
+// clip back to back. Segments are the original files remuxed without re-encoding;
+// EXT-X-PROGRAM-DATE-TIME carries the wall-clock time and EXT-X-GAP marks missing
+// footage, so media time t is always the clip's first frame plus t seconds.
+func ClipStreamPlaylist(clip models.Clip, camera, uriSuffix string) (string, error) {
+	entries, err := planClipStream(clip, camera)
+	if err != nil {
+		return "", err
+	}
+
+	target := 1.0
+	for _, e := range entries {
+		target = math.Max(target, e.Duration)
+	}
+
+	var b strings.Builder
+	// Version 8 for EXT-X-GAP
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:8\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n",
+		int(math.Ceil(target)))
+	for i, e := range entries {
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", e.Timestamp.UTC().Format("2006-01-02T15:04:05.000Z"))
+		if e.gap() {
+			b.WriteString("#EXT-X-GAP\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%05d.ts%s\n", e.Duration, i, uriSuffix)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String(), nil
+}
+
+// clipStreamSegmentArgs remuxes a whole file to MPEG-TS, shifting its timestamps to
+// its offset on the clip timeline
+func clipStreamSegmentArgs(input string, offset float64, output string) []string {
+	return []string{"-hide_banner", "-loglevel", "error", "-i", input,
+		"-map", "0:v:0", "-c", "copy",
+		"-output_ts_offset", fmt.Sprintf("%.3f", offset), "-muxdelay", "0", "-f", "mpegts", "-y", output}
+}
+
+// ClipStreamSegment returns the path of segment index of a clip camera stream,
+// remuxing the file into the HLS cache on first request
+func ClipStreamSegment(ctx context.Context, clip models.Clip, camera string, index int) (string, error) {
+	entries, err := planClipStream(clip, camera)
+	if err != nil {
+		return "", err
+	}
+	if index < 0 || index >= len(entries) || entries[index].gap() {
+		return "", ErrSegmentNotFound
+	}
+	e := entries[index]
+
+	key, err := hlsCacheKey(e.File.FilePath)
+	if err != nil {
+		return "", err
+	}
+	// The offset is part of the name: the same file can sit at different offsets
+	// if earlier files of the clip change
+	output := filepath.Join(HLSCacheDir(), key, fmt.Sprintf("copy_%d.ts", int64(math.Round(e.Offset*1000))))
+	return cachedSegment(ctx, output, nil, func(tmp string) []string {
+		return clipStreamSegmentArgs(e.File.FilePath, e.Offset, tmp)
+	})
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"teslaxy/models"
+)
+
+// streamClip has Front minutes at 0, 1 and 3 (minute 2 missing) and a Back minute
+// starting 5s before the first Front one. Durations come from the file contents.
+func streamClip(t *testing.T) models.Clip {
+	stubHLS(t, VideoInfo{})
+	videoProber = func(path string) (VideoInfo, error) {
+		data, _ := os.ReadFile(path)
+		var d float64
+		if _, err := fmt.Sscanf(string(data), "%g", &d); err != nil {
+			return VideoInfo{}, fmt.Errorf("corrupt")
+		}
+		return VideoInfo{Duration: d}, nil
+	}
+
+	dir := t.TempDir()
+	base := time.Date(2024, 7, 1, 3, 0, 0, 0, time.UTC)
+	file := func(id uint, camera string, at time.Duration, content string) models.VideoFile {
+		path := filepath.Join(dir, fmt.Sprintf("%d-%s.mp4", id, camera))
+		os.WriteFile(path, []byte(content), 0644)
+		return models.VideoFile{ID: id, Camera: camera, FilePath: path, Timestamp: base.Add(at)}
+	}
+	return models.Clip{ID: 9, Timestamp: base, VideoFiles: []models.VideoFile{
+		file(4, "Front", 3*time.Minute, "59.5"),
+		file(1, "Front", 0, "60.2"),
+		file(2, "Front", time.Minute, "59.9"),
+		file(3, "Back", -5*time.Second, "60"),
+	}}
+}
+
+func TestPlanClipStream(t *testing.T) {
+	clip := streamClip(t)
+
+	entries, err := planClipStream(clip, "front")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Time zero is the Back file, 5s before Front starts: a leading gap, two files,
+	// a gap for the missing minute and the last file at 3:05
+	var got []string
+	for _, e := range entries {
+		id := uint(0)
+		if e.File != nil {
+			id = e.File.ID
+		}
+		got = append(got, fmt.Sprintf("%d@%.1f+%.1f", id, e.Offset, e.Duration))
+	}
+	if strings.Join(got, " ") != "0@0.0+5.0 1@5.0+60.2 2@65.2+59.9 0@125.1+59.9 4@185.0+59.5" {
+		t.Errorf("Unexpected plan: %s", strings.Join(got, " "))
+	}
+
+	if _, err := planClipStream(clip, "cabin"); err != ErrNoCameraFootage {
+		t.Errorf("Expected ErrNoCameraFootage, got %v", err)
+	}
+}
+
+func TestPlanClipStream_CorruptFileIsGap(t *testing.T) {
+	clip := streamClip(t)
+	os.WriteFile(clip.VideoFiles[2].FilePath, []byte("truncated"), 0644) // Front minute 1
+
+	entries, _ := planClipStream(clip, "Front")
+	var gaps float64
+	for _, e := range entries {
+		if e.gap() {
+			gaps += e.Duration
+		}
+	}
+	// Leading 5s plus 1:05.2 -> 3:05 as gaps
+	if len(entries) != 5 || gaps < 124.7 || gaps > 124.9 {
+		t.Errorf("Expected the corrupt minute to become a gap, got %+v", entries)
+	}
+}
+
+func TestClipStreamPlaylist(t *testing.T) {
+	clip := streamClip(t)
+
+	playlist, err := ClipStreamPlaylist(clip, "front", "?token=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"#EXT-X-VERSION:8\n",
+		"#EXT-X-TARGETDURATION:61\n",
+		"#EXT-X-PROGRAM-DATE-TIME:2024-07-01T02:59:55.000Z\n#EXT-X-GAP\n#EXTINF:5.000,\n00000.ts?token=abc\n",
+		"#EXT-X-PROGRAM-DATE-TIME:2024-07-01T03:00:00.000Z\n#EXTINF:60.200,\n00001.ts?token=abc\n",
+		"#EXT-X-PROGRAM-DATE-TIME:2024-07-01T03:03:00.000Z\n#EXTINF:59.500,\n00004.ts?token=abc\n",
+		"#EXT-X-ENDLIST\n",
+	} {
+		if !strings.Contains(playlist, want) {
+			t.Errorf("Expected playlist to contain %q:\n%s", want, playlist)
+		}
+	}
+	if strings.Count(playlist, "#EXT-X-GAP") != 2 {
+		t.Errorf("Expected two gaps:\n%s", playlist)
+	}
+}
+
+func TestClipStreamSegment(t *testing.T) {
+	clip := streamClip(t)
+	var lastArgs []string
+	var runs int32
+	hlsEncoder = func(ctx context.Context, args []string, job *transcodeJob) (time.Duration, error) {
+		if job != nil {
+			t.Error("Remuxes should not take a transcode slot")
+		}
+		atomic.AddInt32(&runs, 1)
+		lastArgs = args
+		return 0, os.WriteFile(args[len(args)-1], []byte("ts"), 0644)
+	}
+
+	path, err := ClipStreamSegment(context.Background(), clip, "front", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Join(lastArgs, " ")
+	if !strings.Contains(args, "-i "+clip.VideoFiles[2].FilePath) || !strings.Contains(args, "-c copy") || !strings.Contains(args, "-output_ts_offset 65.200") {
+		t.Errorf("Expected a remux of Front minute 1 at 65.2s, got %s", args)
+	}
+	if !strings.HasPrefix(path, HLSCacheDir()) {
+		t.Errorf("Expected the segment in the HLS cache, got %s", path)
+	}
+
+	if _, err := ClipStreamSegment(context.Background(), clip, "front", 2); err != nil || atomic.LoadInt32(&runs) != 1 {
+		t.Errorf("Expected a cache hit, err=%v runs=%d", err, runs)
+	}
+
+	for _, index := range []int{0, 3, 5, -1} {
+		if _, err := ClipStreamSegment(context.Background(), clip, "front", index); err != ErrSegmentNotFound {
+			t.Errorf("Segment %d: expected ErrSegmentNotFound for gaps and out of range, got %v", index, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	clipWorkerQueueSize  = 1024
+	clipWorkerRetryDelay = 30 * time.Second
+)
+
+// clipWorker runs background work (proxies, storyboards) for clips as the scanner
+// finds them, one clip at a time. A clip is queued at most once until picked up.
+type clipWorker struct {
+	run func(clipID uint) error
+
+	mu      sync.Mutex
+	queue   chan uint
+	pending map[uint]bool
+}
+
+func newClipWorker(run func(clipID uint) error) *clipWorker {
+	return &clipWorker{run: run, pending: make(map[uint]bool)}
+}
+
+// start launches the worker goroutine; later calls do nothing
+func (w *clipWorker) start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.queue == nil {
+		w.queue = make(chan uint, clipWorkerQueueSize)
+		go w.loop(w.queue)
+	}
+}
+
+// enqueue schedules a clip. It does nothing when the worker isn't running.
+func (w *clipWorker) enqueue(clipID uint) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.queue == nil || w.pending[clipID] {
+		return
+	}
+	select {
+	case w.queue <- clipID:
+		w.pending[clipID] = true
+	default:
+		// Full; the clip is picked up again on its next scan
+	}
+}
+
+func (w *clipWorker) pendingCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending)
+}
+
+func (w *clipWorker) loop(queue chan uint) {
+	for clipID := range queue {
+		w.mu.Lock()
+		delete(w.pending, clipID)
+		w.mu.Unlock()
+
+		// Viewers come first; try again once playback has quietened down
+		for w.run(clipID) == ErrTranscoderBusy {
+			time.Sleep(clipWorkerRetryDelay)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ConfigPath returns the writable config directory (CONFIG_PATH, default /config).
+// Exports, thumbnails and other generated files live under it.
+func ConfigPath() string {
+	configPath := os.Getenv("CONFIG_PATH")
+	if configPath == "" {
+		configPath = "/config"
+	}
+	return configPath
+}
+
+// ExportDir returns the directory finished exports are written to
+func ExportDir() string {
+	return filepath.Join(ConfigPath(), "exports")
+}
+
+// envInt reads an integer setting, falling back to def when unset or invalid
+func envInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
@@ -0,0 +1,579 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// ExportDestination uploads a finished export somewhere off-box (NAS, object storage, ...)
+type ExportDestination interface {
+	// Upload copies localPath to the destination as name, reporting bytes sent so far.
+	Upload(ctx context.Context, localPath, name string, progress func(sent, total int64)) error
+}
+
+// DestinationConfig is one entry of CONFIG_PATH/destinations.json.
+// Only the fields relevant to Type are used.
+type DestinationConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // "local", "s3", "webdav", "sftp"
+
+	// local: target directory. sftp: remote directory.
+	Path string `json:"path,omitempty"`
+
+	// s3 (AWS, MinIO, Backblaze, ...)
+	Endpoint  string `json:"endpoint,omitempty"` // e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Region    string `json:"region,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+	AccessKey string `json:"access_key,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+	PathStyle bool   `json:"path_style,omitempty"` // Required by MinIO and most self-hosted stores
+
+	// webdav: collection URL. sftp: host:port.
+	URL  string `json:"url,omitempty"`
+	Host string `json:"host,omitempty"`
+
+	// webdav / sftp credentials
+	Username       string `json:"username,omitempty"`
+	Password       string `json:"password,omitempty"`
+	PrivateKeyPath string `json:"private_key_path,omitempty"`
+	// HostKey pins the SFTP server key (authorized_keys format). Required unless InsecureIgnoreHostKey is set.
+	HostKey               string `json:"host_key,omitempty"`
+	InsecureIgnoreHostKey bool   `json:"insecure_ignore_host_key,omitempty"`
+}
+
+// DestinationInfo is the public (secret-free) view of a destination
+type DestinationInfo struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+var (
+	destinations     map[string]DestinationConfig
+	destinationsOnce sync.Once
+
+	ErrUnknownDestination = errors.New("unknown export destination")
+
+	// Upload retry policy; the delay doubles after each failed attempt
+	uploadAttempts   = 3
+	uploadRetryDelay = 5 * time.Second
+)
+
+// destinationsFile is where destinations are configured once for all exports
+func destinationsFile() string {
+	return filepath.Join(ConfigPath(), "destinations.json")
+}
+
+// loadDestinations reads the destination config. A missing file simply means none are configured.
+func loadDestinations() map[string]DestinationConfig {
+	result := make(map[string]DestinationConfig)
+	content, err := os.ReadFile(destinationsFile())
+	if err != nil {
+		return result
+	}
+
+	var file struct {
+		Destinations []DestinationConfig `json:"destinations"`
+	}
+	if err := json.Unmarshal(content, &file); err != nil {
+		log.Printf("Failed to parse %s: %v", destinationsFile(), err)
+		return result
+	}
+
+	for _, cfg := range file.Destinations {
+		if _, err := newDestination(cfg); err != nil {
+			log.Printf("Skipping export destination %q: %v", cfg.Name, err)
+			continue
+		}
+		result[cfg.Name] = cfg
+	}
+	log.Printf("Loaded %d export destination(s)", len(result))
+	return result
+}
+
+func configuredDestinations() map[string]DestinationConfig {
+	destinationsOnce.Do(func() {
+		if destinations == nil {
+			destinations = loadDestinations()
+		}
+	})
+	return destinations
+}
+
+// ListDestinations returns the configured destinations without credentials
+func ListDestinations() []DestinationInfo {
+	var list []DestinationInfo
+	for _, cfg := range configuredDestinations() {
+		list = append(list, DestinationInfo{Name: cfg.Name, Type: cfg.Type})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// GetDestination builds the uploader for a configured destination
+func GetDestination(name string) (ExportDestination, error) {
+	cfg, ok := configuredDestinations()[name]
+	if !ok {
+		return nil, ErrUnknownDestination
+	}
+	return newDestination(cfg)
+}
+
+func newDestination(cfg DestinationConfig) (ExportDestination, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	switch cfg.Type {
+	case "local":
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("path is required")
+		}
+		return &localDestination{dir: cfg.Path}, nil
+	case "s3":
+		if cfg.Endpoint == "" || cfg.Bucket == "" || cfg.AccessKey == "" || cfg.SecretKey == "" {
+			return nil, fmt.Errorf("endpoint, bucket, access_key and secret_key are required")
+		}
+		if cfg.Region == "" {
+			cfg.Region = "us-east-1"
+		}
+		return &s3Destination{cfg: cfg, client: http.DefaultClient}, nil
+	case "webdav":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		return &webdavDestination{cfg: cfg, client: http.DefaultClient}, nil
+	case "sftp":
+		if cfg.Host == "" || cfg.Username == "" {
+			return nil, fmt.Errorf("host and username are required")
+		}
+		if cfg.HostKey == "" && !cfg.InsecureIgnoreHostKey {
+			return nil, fmt.Errorf("host_key is required (or set insecure_ignore_host_key)")
+		}
+		return &sftpDestination{cfg: cfg}, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %q", cfg.Type)
+	}
+}
+
+// progressReader reports bytes read to a callback
+type progressReader struct {
+	r        io.Reader
+	sent     int64
+	total    int64
+	progress func(sent, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.sent += int64(n)
+	if p.progress != nil && n > 0 {
+		p.progress(p.sent, p.total)
+	}
+	return n, err
+}
+
+func openForUpload(localPath string, progress func(sent, total int64)) (*os.File, *progressReader, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, &progressReader{r: f, total: info.Size(), progress: progress}, nil
+}
+
+// --- Local directory (e.g. a mounted NAS share) ---
+
+type localDestination struct {
+	dir string
+}
+
+func (d *localDestination) Upload(ctx context.Context, localPath, name string, progress func(sent, total int64)) error {
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return err
+	}
+	f, reader, err := openForUpload(localPath, progress)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Write to a temp name first so a half-copied file never looks complete
+	target := filepath.Join(d.dir, filepath.Base(name))
+	tmp := target + ".part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, target)
+}
+
+// --- WebDAV (Nextcloud, NAS WebDAV servers, ...) ---
+
+type webdavDestination struct {
+	cfg    DestinationConfig
+	client *http.Client
+}
+
+func (d *webdavDestination) Upload(ctx context.Context, localPath, name string, progress func(sent, total int64)) error {
+	f, reader, err := openForUpload(localPath, progress)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	target := strings.TrimSuffix(d.cfg.URL, "/") + "/" + url.PathEscape(filepath.Base(name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, reader)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = reader.total
+	req.Header.Set("Content-Type", "video/mp4")
+	if d.cfg.Username != "" {
+		req.SetBasicAuth(d.cfg.Username, d.cfg.Password)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webdav upload failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// --- S3-compatible object storage (AWS Signature V4, single PUT) ---
+
+type s3Destination struct {
+	cfg    DestinationConfig
+	client *http.Client
+	now    func() time.Time // For tests
+}
+
+// s3ObjectURL returns the object URL for key using path-style or virtual-host addressing
+func (d *s3Destination) s3ObjectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSuffix(d.cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	escapedKey := s3EscapePath(key)
+	if d.cfg.PathStyle {
+		u.Path = "/" + d.cfg.Bucket + "/" + key
+		u.RawPath = "/" + s3EscapePath(d.cfg.Bucket) + "/" + escapedKey
+	} else {
+		u.Host = d.cfg.Bucket + "." + u.Host
+		u.Path = "/" + key
+		u.RawPath = "/" + escapedKey
+	}
+	return u, nil
+}
+
+func (d *s3Destination) Upload(ctx context.Context, localPath, name string, progress func(sent, total int64)) error {
+	f, reader, err := openForUpload(localPath, progress)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	key := path.Join(d.cfg.Prefix, filepath.Base(name))
+	u, err := d.s3ObjectURL(key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), reader)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = reader.total
+	req.Header.Set("Content-Type", "video/mp4")
+
+	now := time.Now
+	if d.now != nil {
+		now = d.now
+	}
+	signS3Request(req, d.cfg, now().UTC())
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3 upload failed: %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// s3EscapePath URI-encodes each path segment as required by SigV4 (unreserved characters only)
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		var b strings.Builder
+		for _, c := range []byte(s) {
+			if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '.' || c == '_' || c == '~' {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		segments[i] = b.String()
+	}
+	return strings.Join(segments, "/")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signS3Request adds AWS Signature Version 4 headers. The payload is sent unsigned
+// so multi-gigabyte exports don't have to be hashed before streaming.
+func signS3Request(req *http.Request, cfg DestinationConfig, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := "UNSIGNED-PAYLOAD"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", req.URL.Host, payloadHash, amzDate)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, cfg.Region)
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(hashed[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+cfg.SecretKey), date)
+	key = hmacSHA256(key, cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+// --- SFTP ---
+
+type sftpDestination struct {
+	cfg DestinationConfig
+}
+
+func (d *sftpDestination) clientConfig() (*ssh.ClientConfig, error) {
+	var auth []ssh.AuthMethod
+	if d.cfg.PrivateKeyPath != "" {
+		keyBytes, err := os.ReadFile(d.cfg.PrivateKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(keyBytes)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if d.cfg.Password != "" {
+		auth = append(auth, ssh.Password(d.cfg.Password))
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if d.cfg.HostKey != "" {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(d.cfg.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid host_key: %w", err)
+		}
+		hostKeyCallback = ssh.FixedHostKey(pub)
+	}
+
+	return &ssh.ClientConfig{
+		User:            d.cfg.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, nil
+}
+
+func (d *sftpDestination) Upload(ctx context.Context, localPath, name string, progress func(sent, total int64)) error {
+	config, err := d.clientConfig()
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Timeout: config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", d.cfg.Host)
+	if err != nil {
+		return err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, d.cfg.Host, config)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
+	defer sshClient.Close()
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	dir := d.cfg.Path
+	if dir == "" {
+		dir = "."
+	}
+	if err := client.MkdirAll(dir); err != nil {
+		return err
+	}
+
+	f, reader, err := openForUpload(localPath, progress)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	target := path.Join(dir, filepath.Base(name))
+	tmp := target + ".part"
+	out, err := client.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		out.Close()
+		client.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	client.Remove(target) // PosixRename isn't universally supported; plain Rename fails if target exists
+	return client.Rename(tmp, target)
+}
+
+// uploadExport sends a completed export to its destination, retrying with backoff.
+// Progress, attempts and the outcome are recorded on the job.
+func uploadExport(jobID, destinationName string) {
+	dest, err := GetDestination(destinationName)
+	if err != nil {
+		setUploadStatus(jobID, map[string]interface{}{"upload_status": "failed", "upload_error": err.Error()})
+		return
+	}
+
+	localPath, err := ExportFilePath(jobID)
+	if err != nil {
+		setUploadStatus(jobID, map[string]interface{}{"upload_status": "failed", "upload_error": err.Error()})
+		return
+	}
+
+	lastReported := -1.0
+	progress := func(sent, total int64) {
+		if total <= 0 {
+			return
+		}
+		pct := float64(sent) / float64(total) * 100
+		// Throttle DB writes to every 5%
+		if pct-lastReported >= 5 || sent == total {
+			lastReported = pct
+			setUploadStatus(jobID, map[string]interface{}{"upload_progress": pct})
+		}
+	}
+
+	delay := uploadRetryDelay
+	for attempt := 1; attempt <= uploadAttempts; attempt++ {
+		lastReported = -1
+		setUploadStatus(jobID, map[string]interface{}{"upload_status": "uploading", "upload_attempts": attempt, "upload_progress": 0})
+
+		err = dest.Upload(context.Background(), localPath, filepath.Base(localPath), progress)
+		if err == nil {
+			setUploadStatus(jobID, map[string]interface{}{"upload_status": "uploaded", "upload_progress": 100, "upload_error": ""})
+			log.Printf("Export %s uploaded to %s", jobID, destinationName)
+			return
+		}
+
+		log.Printf("Export %s upload to %s failed (attempt %d/%d): %v", jobID, destinationName, attempt, uploadAttempts, err)
+		setUploadStatus(jobID, map[string]interface{}{"upload_error": err.Error()})
+		if attempt < uploadAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	setUploadStatus(jobID, map[string]interface{}{"upload_status": "failed"})
+}
+
+// setUploadStatus mirrors upload state to the in-memory status and the job record
+func setUploadStatus(jobID string, updates map[string]interface{}) {
+	exportQueueLock.Lock()
+	if status, ok := exportQueue[jobID]; ok {
+		for k, v := range updates {
+			switch k {
+			case "upload_status":
+				status.UploadStatus = v.(string)
+			case "upload_progress":
+				status.UploadProgress = toFloat64(v)
+			case "upload_attempts":
+				status.UploadAttempts = v.(int)
+			case "upload_error":
+				status.UploadError = v.(string)
+			}
+		}
+	}
+	exportQueueLock.Unlock()
+
+	persistExportStatus(jobID, updates)
+}
+
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case int:
+		return float64(n)
+	}
+	return 0
+}
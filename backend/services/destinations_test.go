@@ -0,0 +1,207 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+func writeExportFixture(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "clip_export.mp4")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLocalDestination(t *testing.T) {
+	src := writeExportFixture(t, "exported video")
+	target := filepath.Join(t.TempDir(), "nas")
+
+	dest, err := newDestination(DestinationConfig{Name: "nas", Type: "local", Path: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lastSent int64
+	if err := dest.Upload(t.Context(), src, "clip_export.mp4", func(sent, total int64) { lastSent = sent }); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(target, "clip_export.mp4"))
+	if err != nil || string(data) != "exported video" {
+		t.Errorf("Unexpected uploaded content: %q (%v)", data, err)
+	}
+	if lastSent != int64(len("exported video")) {
+		t.Errorf("Expected progress to reach full size, got %d", lastSent)
+	}
+}
+
+func TestWebDAVDestination(t *testing.T) {
+	var gotPath, gotBody, gotUser string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotUser, _, _ = r.BasicAuth()
+		body, _ := io.ReadAll(r.Body)
+		gotBody = string(body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	dest, _ := newDestination(DestinationConfig{Name: "dav", Type: "webdav", URL: server.URL + "/remote.php/dav/files/me/Teslaxy", Username: "me", Password: "pw"})
+	if err := dest.Upload(t.Context(), writeExportFixture(t, "dav video"), "clip_export.mp4", nil); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	if gotPath != "/remote.php/dav/files/me/Teslaxy/clip_export.mp4" || gotBody != "dav video" || gotUser != "me" {
+		t.Errorf("Unexpected request: path=%s body=%s user=%s", gotPath, gotBody, gotUser)
+	}
+}
+
+func TestS3Destination(t *testing.T) {
+	var gotPath, gotAuth, gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		body, _ := io.ReadAll(r.Body)
+		gotBody = string(body)
+	}))
+	defer server.Close()
+
+	cfg := DestinationConfig{Name: "minio", Type: "s3", Endpoint: server.URL, Bucket: "dashcam", Prefix: "exports", AccessKey: "AKID", SecretKey: "secret", Region: "us-east-1", PathStyle: true}
+	dest, _ := newDestination(cfg)
+	s3 := dest.(*s3Destination)
+	s3.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	if err := s3.Upload(t.Context(), writeExportFixture(t, "s3 video"), "clip export.mp4", nil); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	if gotPath != "/dashcam/exports/clip export.mp4" || gotBody != "s3 video" {
+		t.Errorf("Unexpected request: path=%s body=%s", gotPath, gotBody)
+	}
+	if !strings.HasPrefix(gotAuth, "AWS4-HMAC-SHA256 Credential=AKID/20240102/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+		t.Errorf("Unexpected Authorization header: %s", gotAuth)
+	}
+}
+
+func TestS3EscapePath(t *testing.T) {
+	if got := s3EscapePath("exports/clip export+1.mp4"); got != "exports/clip%20export%2B1.mp4" {
+		t.Errorf("Unexpected escaping: %s", got)
+	}
+}
+
+// startSFTPServer runs an in-process SSH server exposing the SFTP subsystem rooted at dir
+func startSFTPServer(t *testing.T, dir string) (string, string) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "cam" && string(pass) == "pw" {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					channel, requests, _ := newChannel.Accept()
+					go func() {
+						for req := range requests {
+							ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+							req.Reply(ok, nil)
+							if ok {
+								server, _ := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(dir))
+								server.Serve()
+								channel.Close()
+							}
+						}
+					}()
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+}
+
+func TestSFTPDestination(t *testing.T) {
+	remote := t.TempDir()
+	addr, hostKey := startSFTPServer(t, remote)
+
+	dest, err := newDestination(DestinationConfig{Name: "box", Type: "sftp", Host: addr, Username: "cam", Password: "pw", HostKey: hostKey, Path: "teslaxy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dest.Upload(t.Context(), writeExportFixture(t, "sftp video"), "clip_export.mp4", nil); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(remote, "teslaxy", "clip_export.mp4"))
+	if err != nil || string(data) != "sftp video" {
+		t.Errorf("Unexpected uploaded content: %q (%v)", data, err)
+	}
+}
+
+func TestSFTPDestinationRequiresHostKey(t *testing.T) {
+	if _, err := newDestination(DestinationConfig{Name: "box", Type: "sftp", Host: "nas:22", Username: "cam"}); err == nil {
+		t.Error("Expected unpinned SFTP host key to be rejected")
+	}
+}
+
+func TestUploadExport_RetriesAndRecordsFailure(t *testing.T) {
+	setupExportDB(t)
+	createFinishedExport(t, "job_upload", 10, time.Now())
+
+	// A regular file where the target directory should be makes every attempt fail
+	blocker := filepath.Join(t.TempDir(), "not_a_dir")
+	os.WriteFile(blocker, []byte("x"), 0644)
+
+	originalDestinations, originalDelay := destinations, uploadRetryDelay
+	destinations = map[string]DestinationConfig{"broken": {Name: "broken", Type: "local", Path: filepath.Join(blocker, "sub")}}
+	uploadRetryDelay = time.Millisecond
+	defer func() { destinations, uploadRetryDelay = originalDestinations, originalDelay }()
+
+	uploadExport("job_upload", "broken")
+
+	var job models.ExportJob
+	database.DB.Where("job_id = ?", "job_upload").First(&job)
+	if job.UploadStatus != "failed" || job.UploadAttempts != uploadAttempts || job.UploadError == "" {
+		t.Errorf("Expected failed upload after %d attempts, got status=%s attempts=%d error=%q", uploadAttempts, job.UploadStatus, job.UploadAttempts, job.UploadError)
+	}
+}
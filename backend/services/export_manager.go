@@ -0,0 +1,236 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+// Export retention defaults. Override with EXPORT_RETENTION_HOURS and
+// EXPORT_QUOTA_MB; a value of 0 disables the respective limit.
+const (
+	defaultExportRetentionHours = 7 * 24
+	defaultExportQuotaMB        = 10 * 1024
+)
+
+var (
+	ErrExportNotFound = errors.New("export not found")
+	ErrExportRunning  = errors.New("export is still running or uploading")
+	ErrExportNotReady = errors.New("export has not completed")
+)
+
+// recordExportJob persists a newly queued job and, for batches, its items
+func recordExportJob(jobID, kind string, clipID uint, destination string, items []models.ExportJobItem) {
+	if database.DB == nil {
+		return
+	}
+	job := models.ExportJob{JobID: jobID, Kind: kind, ClipID: clipID, Status: "pending", Destination: destination}
+	if destination != "" {
+		job.UploadStatus = "pending"
+	}
+	if err := database.DB.Create(&job).Error; err != nil {
+		log.Printf("Failed to record export job %s: %v", jobID, err)
+	}
+	for _, item := range items {
+		if err := database.DB.Create(&item).Error; err != nil {
+			log.Printf("Failed to record item %d of export job %s: %v", item.Position, jobID, err)
+		}
+	}
+}
+
+// persistExportStatus mirrors in-memory status changes to the job record
+func persistExportStatus(jobID string, updates map[string]interface{}) {
+	if database.DB == nil {
+		return
+	}
+	if err := database.DB.Model(&models.ExportJob{}).Where("job_id = ?", jobID).Updates(updates).Error; err != nil {
+		log.Printf("Failed to update export job %s: %v", jobID, err)
+	}
+}
+
+// completeExport marks a job finished, records its output file and applies the quota
+func completeExport(jobID, fileName string) {
+	var size int64
+	if info, err := os.Stat(filepath.Join(ExportDir(), fileName)); err == nil {
+		size = info.Size()
+	}
+
+	exportQueueLock.Lock()
+	if status, ok := exportQueue[jobID]; ok {
+		status.Status = "completed"
+		status.Progress = 100
+		status.Error = ""
+		status.FilePath = fileName // just filename relative to export dir
+	}
+	exportQueueLock.Unlock()
+
+	now := time.Now()
+	persistExportStatus(jobID, map[string]interface{}{
+		"status":       "completed",
+		"progress":     100,
+		"error":        "",
+		"file_name":    fileName,
+		"size_bytes":   size,
+		"completed_at": &now,
+	})
+
+	// A large export may push us over quota; evict right away rather than waiting for the
+	// janitor, but never the export that was just made
+	enforceExportRetention(now, jobID)
+}
+
+// GetExportJob returns the persisted record for a job
+func GetExportJob(jobID string) (*models.ExportJob, error) {
+	if database.DB == nil {
+		return nil, ErrExportNotFound
+	}
+	var job models.ExportJob
+	if err := database.DB.Where("job_id = ?", jobID).First(&job).Error; err != nil {
+		return nil, ErrExportNotFound
+	}
+	return &job, nil
+}
+
+// ListExports returns all known exports, newest first
+func ListExports() ([]models.ExportJob, error) {
+	var jobs []models.ExportJob
+	err := database.DB.Order("created_at desc").Find(&jobs).Error
+	return jobs, err
+}
+
+// ExportFilePath resolves the output file of a completed job.
+// Downloads are authorised by job ID; the stored filename never comes from the client.
+func ExportFilePath(jobID string) (string, error) {
+	job, err := GetExportJob(jobID)
+	if err != nil {
+		return "", err
+	}
+	if job.Status != "completed" || job.FileName == "" {
+		return "", ErrExportNotReady
+	}
+
+	exportDir := filepath.Clean(ExportDir())
+	fullPath := filepath.Join(exportDir, job.FileName)
+	if !strings.HasPrefix(fullPath, exportDir+string(os.PathSeparator)) {
+		return "", ErrExportNotFound
+	}
+	if _, err := os.Stat(fullPath); err != nil {
+		return "", ErrExportNotFound
+	}
+	return fullPath, nil
+}
+
+// DeleteExport removes a finished or failed export and its file. Exports with an
+// upload pending or running are kept until the uploader is done with the file.
+func DeleteExport(jobID string) error {
+	job, err := GetExportJob(jobID)
+	if err != nil {
+		return err
+	}
+	if job.Status == "pending" || job.Status == "processing" || job.UploadStatus == "pending" || job.UploadStatus == "uploading" {
+		return ErrExportRunning
+	}
+	removeExport(*job)
+	return nil
+}
+
+func removeExport(job models.ExportJob) {
+	if job.FileName != "" {
+		path := filepath.Join(ExportDir(), filepath.Base(job.FileName))
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove export file %s: %v", path, err)
+		}
+	}
+	database.DB.Unscoped().Delete(&job)
+	database.DB.Unscoped().Where("job_id = ?", job.JobID).Delete(&models.ExportJobItem{})
+
+	exportQueueLock.Lock()
+	delete(exportQueue, job.JobID)
+	exportQueueLock.Unlock()
+}
+
+// enforceExportRetention expires old exports and evicts the oldest completed
+// exports until the total size fits the quota. The keep job, and exports that are
+// shared or still uploading, are left alone.
+func enforceExportRetention(now time.Time, keep string) {
+	if database.DB == nil {
+		return
+	}
+	pinned := pinnedExports(now)
+	pinned[keep] = true
+
+	if hours := envInt("EXPORT_RETENTION_HOURS", defaultExportRetentionHours); hours > 0 {
+		cutoff := now.Add(-time.Duration(hours) * time.Hour)
+		var expired []models.ExportJob
+		database.DB.Where("status IN (?) AND COALESCE(completed_at, created_at) < ?", []string{"completed", "failed"}, cutoff).Find(&expired)
+		for _, job := range expired {
+			if pinned[job.JobID] {
+				continue
+			}
+			log.Printf("Export %s expired (older than %dh), removing", job.JobID, hours)
+			removeExport(job)
+		}
+	}
+
+	if quotaMB := envInt("EXPORT_QUOTA_MB", defaultExportQuotaMB); quotaMB > 0 {
+		quota := int64(quotaMB) * 1024 * 1024
+		var completed []models.ExportJob
+		database.DB.Where("status = ?", "completed").Order("completed_at asc").Find(&completed)
+
+		var total int64
+		for _, job := range completed {
+			total += job.SizeBytes
+		}
+		for _, job := range completed {
+			if total <= quota {
+				break
+			}
+			if pinned[job.JobID] {
+				continue
+			}
+			log.Printf("Export quota exceeded (%d > %d bytes), evicting %s", total, quota, job.JobID)
+			removeExport(job)
+			total -= job.SizeBytes
+		}
+	}
+}
+
+// pinnedExports returns the exports retention must not remove: those behind a
+// share link that can still be opened, and those with an upload pending or running
+func pinnedExports(now time.Time) map[string]bool {
+	pinned := make(map[string]bool)
+	var shares []models.ShareLink
+	database.DB.Select("export_job_id").
+		Where("kind = ? AND revoked_at IS NULL AND expires_at > ? AND (max_views = 0 OR views < max_views)", "export", now).
+		Find(&shares)
+	for _, share := range shares {
+		pinned[share.ExportJobID] = true
+	}
+	var uploading []models.ExportJob
+	database.DB.Select("job_id").Where("upload_status IN (?)", []string{"pending", "uploading"}).Find(&uploading)
+	for _, job := range uploading {
+		pinned[job.JobID] = true
+	}
+	return pinned
+}
+
+// RecoverInterruptedExports marks jobs that were running when the server stopped as failed.
+// Their ffmpeg processes died with us, so they will never complete.
+func RecoverInterruptedExports() {
+	if database.DB == nil {
+		return
+	}
+	database.DB.Model(&models.ExportJob{}).Where("status IN (?)", []string{"pending", "processing"}).
+		Updates(map[string]interface{}{"status": "failed", "error": "Interrupted by server restart"})
+	database.DB.Model(&models.ExportJobItem{}).Where("status IN (?)", []string{"pending", "processing"}).
+		Updates(map[string]interface{}{"status": "failed", "error": "Interrupted by server restart"})
+	database.DB.Model(&models.ExportJob{}).Where("upload_status IN (?)", []string{"pending", "uploading"}).
+		Updates(map[string]interface{}{"upload_status": "failed", "upload_error": "Interrupted by server restart"})
+	enforceExportRetention(time.Now(), "")
+}
@@ -0,0 +1,182 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+func setupExportDB(t *testing.T) string {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	db.AutoMigrate(&models.Clip{}, &models.VideoFile{}, &models.ExportJob{}, &models.ExportJobItem{}, &models.ShareLink{})
+	database.DB = db
+	t.Cleanup(func() {
+		db.Close()
+		database.DB = nil
+	})
+
+	configDir := t.TempDir()
+	os.Setenv("CONFIG_PATH", configDir)
+	t.Cleanup(func() { os.Unsetenv("CONFIG_PATH") })
+	os.MkdirAll(ExportDir(), 0755)
+	return configDir
+}
+
+func createFinishedExport(t *testing.T, jobID string, size int, completedAt time.Time) string {
+	name := jobID + ".mp4"
+	if err := os.WriteFile(filepath.Join(ExportDir(), name), make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	job := models.ExportJob{JobID: jobID, Kind: "clip", Status: "completed", FileName: name, SizeBytes: int64(size), CompletedAt: &completedAt}
+	database.DB.Create(&job)
+	return name
+}
+
+func TestExportDirFollowsConfigPath(t *testing.T) {
+	configDir := setupExportDB(t)
+	if ExportDir() != filepath.Join(configDir, "exports") {
+		t.Errorf("Expected exports under CONFIG_PATH, got %s", ExportDir())
+	}
+}
+
+func TestEnforceExportRetention_Expiry(t *testing.T) {
+	setupExportDB(t)
+	os.Setenv("EXPORT_RETENTION_HOURS", "24")
+	defer os.Unsetenv("EXPORT_RETENTION_HOURS")
+
+	now := time.Now()
+	oldFile := createFinishedExport(t, "old", 10, now.Add(-48*time.Hour))
+	createFinishedExport(t, "fresh", 10, now.Add(-time.Hour))
+
+	enforceExportRetention(now, "")
+
+	if _, err := GetExportJob("old"); err == nil {
+		t.Error("Expected expired job to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(ExportDir(), oldFile)); !os.IsNotExist(err) {
+		t.Error("Expected expired file to be deleted")
+	}
+	if _, err := GetExportJob("fresh"); err != nil {
+		t.Error("Fresh job should be kept")
+	}
+}
+
+func TestEnforceExportRetention_QuotaEvictsOldestFirst(t *testing.T) {
+	setupExportDB(t)
+	os.Setenv("EXPORT_QUOTA_MB", "1")
+	defer os.Unsetenv("EXPORT_QUOTA_MB")
+
+	now := time.Now()
+	mb := 1024 * 1024
+	createFinishedExport(t, "first", mb/2, now.Add(-3*time.Hour))
+	createFinishedExport(t, "second", mb/2, now.Add(-2*time.Hour))
+	createFinishedExport(t, "third", mb/2, now.Add(-time.Hour))
+
+	enforceExportRetention(now, "")
+
+	if _, err := GetExportJob("first"); err == nil {
+		t.Error("Expected oldest export to be evicted")
+	}
+	for _, id := range []string{"second", "third"} {
+		if _, err := GetExportJob(id); err != nil {
+			t.Errorf("Expected %s to be kept", id)
+		}
+	}
+}
+
+func TestEnforceExportRetention_KeepsPinnedExports(t *testing.T) {
+	setupExportDB(t)
+	os.Setenv("EXPORT_QUOTA_MB", "1")
+	defer os.Unsetenv("EXPORT_QUOTA_MB")
+
+	now := time.Now()
+	mb := 1024 * 1024
+	createFinishedExport(t, "revoked", mb/2, now.Add(-5*time.Hour))
+	createFinishedExport(t, "shared", mb/2, now.Add(-4*time.Hour))
+	createFinishedExport(t, "uploading", mb/2, now.Add(-3*time.Hour))
+	createFinishedExport(t, "plain", mb/2, now.Add(-2*time.Hour))
+	createFinishedExport(t, "new", mb/2, now)
+	database.DB.Model(&models.ExportJob{}).Where("job_id = ?", "uploading").Update("upload_status", "uploading")
+	database.DB.Create(&models.ShareLink{TokenID: "a", Kind: "export", ExportJobID: "shared", ExpiresAt: now.Add(time.Hour)})
+	database.DB.Create(&models.ShareLink{TokenID: "b", Kind: "export", ExportJobID: "revoked", ExpiresAt: now.Add(time.Hour), RevokedAt: &now})
+
+	enforceExportRetention(now, "new")
+
+	for _, id := range []string{"revoked", "plain"} {
+		if _, err := GetExportJob(id); err == nil {
+			t.Errorf("Expected %s to be evicted", id)
+		}
+	}
+	// Still over quota, but the rest is shared, uploading or just made
+	for _, id := range []string{"shared", "uploading", "new"} {
+		if _, err := GetExportJob(id); err != nil {
+			t.Errorf("Expected %s to be kept", id)
+		}
+	}
+}
+
+func TestGetExportStatusReturnsCopy(t *testing.T) {
+	exportQueueLock.Lock()
+	exportQueue["live"] = &ExportStatus{JobID: "live", Status: "processing", Items: []models.ExportJobItem{{Status: "pending"}}}
+	exportQueueLock.Unlock()
+	t.Cleanup(func() {
+		exportQueueLock.Lock()
+		delete(exportQueue, "live")
+		exportQueueLock.Unlock()
+	})
+
+	status, _ := GetExportStatus("live")
+	status.Status = "completed"
+	status.Items[0].Status = "completed"
+
+	exportQueueLock.Lock()
+	defer exportQueueLock.Unlock()
+	if exportQueue["live"].Status != "processing" || exportQueue["live"].Items[0].Status != "pending" {
+		t.Error("Expected callers to get a copy of the live status")
+	}
+}
+
+func TestExportFilePathAndDelete(t *testing.T) {
+	setupExportDB(t)
+	createFinishedExport(t, "done", 10, time.Now())
+	database.DB.Create(&models.ExportJob{JobID: "running", Status: "processing"})
+
+	path, err := ExportFilePath("done")
+	if err != nil || filepath.Base(path) != "done.mp4" {
+		t.Errorf("Expected done.mp4, got %s (%v)", path, err)
+	}
+
+	if _, err := ExportFilePath("running"); err != ErrExportNotReady {
+		t.Errorf("Expected ErrExportNotReady, got %v", err)
+	}
+	if _, err := ExportFilePath("missing"); err != ErrExportNotFound {
+		t.Errorf("Expected ErrExportNotFound, got %v", err)
+	}
+
+	if err := DeleteExport("running"); err != ErrExportRunning {
+		t.Errorf("Expected ErrExportRunning, got %v", err)
+	}
+	createFinishedExport(t, "uploading", 10, time.Now())
+	database.DB.Model(&models.ExportJob{}).Where("job_id = ?", "uploading").Update("upload_status", "uploading")
+	if err := DeleteExport("uploading"); err != ErrExportRunning {
+		t.Errorf("Expected ErrExportRunning while uploading, got %v", err)
+	}
+	if _, err := ExportFilePath("uploading"); err != nil {
+		t.Errorf("Expected the uploading export to be kept, got %v", err)
+	}
+	if err := DeleteExport("done"); err != nil {
+		t.Fatalf("DeleteExport failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Expected export file to be deleted")
+	}
+}
@@ -20,16 +20,60 @@ var (
 	gpuCheckLock sync.Mutex
 )
 
+// Export modes
+const (
+	ExportModeClip      = "clip"      // Real-time export of a window of one clip (default)
+	ExportModeTimelapse = "timelapse" // Sped-up export of a whole clip or date range
+)
+
 // ExportRequest defines the parameters for exporting a clip
 type ExportRequest struct {
 	ClipID    uint     `json:"clip_id"`
 	Cameras   []string `json:"cameras"`    // "front", "back", "left_repeater", "right_repeater"
 	StartTime float64  `json:"start_time"` // Relative start time in seconds
 	Duration  float64  `json:"duration"`   // Duration in seconds
+
+	// Timelapse options (Mode == "timelapse")
+	Mode           string     `json:"mode,omitempty"`            // "clip" (default) or "timelapse"
+	SpeedUp        float64    `json:"speed_up,omitempty"`        // e.g. 10 for 10x, 60 for 60x
+	SkipStationary bool       `json:"skip_stationary,omitempty"` // Drop periods where SEI vehicle_speed_mps is ~0
+	From           *time.Time `json:"from,omitempty"`            // Date range (used instead of ClipID)
+	To             *time.Time `json:"to,omitempty"`
+
+	// Destination optionally names a configured destination (destinations.json) to upload the result to
+	Destination string `json:"destination,omitempty"`
+
+	// Privacy masks (clip mode). Saved camera masks are added unless IgnoreSavedMasks is set.
+	Masks            []MaskRegion `json:"masks,omitempty"`
+	IgnoreSavedMasks bool         `json:"ignore_saved_masks,omitempty"`
 }
 
 // Validate enforces security constraints on the export request
 func (r *ExportRequest) Validate() error {
+	switch r.Mode {
+	case "", ExportModeClip:
+		if err := r.validateClipWindow(); err != nil {
+			return err
+		}
+	case ExportModeTimelapse:
+		if err := r.validateTimelapse(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid export mode: %s", r.Mode)
+	}
+
+	// Timed masks are relative to a real-time export; chunked modes only get saved (static) masks
+	if len(r.Masks) > 0 && r.Mode == ExportModeTimelapse {
+		return fmt.Errorf("masks are only supported in clip mode; use saved camera masks for timelapses")
+	}
+	if err := ValidateMasks(r.Masks); err != nil {
+		return err
+	}
+	return ValidateCameras(r.Cameras)
+}
+
+func (r *ExportRequest) validateClipWindow() error {
 	// 1. Duration Limits (DoS prevention)
 	const MaxDuration = 20 * 60 // 20 minutes
 	if r.Duration <= 0 {
@@ -43,7 +87,34 @@ func (r *ExportRequest) Validate() error {
 	if r.StartTime < 0 {
 		return fmt.Errorf("start_time cannot be negative")
 	}
+	return nil
+}
+
+func (r *ExportRequest) validateTimelapse() error {
+	if r.SpeedUp < MinTimelapseSpeedUp || r.SpeedUp > MaxTimelapseSpeedUp {
+		return fmt.Errorf("speed_up must be between %.0f and %.0f", MinTimelapseSpeedUp, MaxTimelapseSpeedUp)
+	}
+	if r.StartTime < 0 || r.Duration < 0 {
+		return fmt.Errorf("start_time and duration cannot be negative")
+	}
+
+	// Either a single clip or a bounded date range
+	if r.ClipID == 0 {
+		if r.From == nil || r.To == nil {
+			return fmt.Errorf("clip_id or from/to is required")
+		}
+		if !r.To.After(*r.From) {
+			return fmt.Errorf("to must be after from")
+		}
+		if r.To.Sub(*r.From) > MaxTimelapseRange {
+			return fmt.Errorf("date range cannot exceed 24 hours")
+		}
+	}
+	return nil
+}
 
+// ValidateCameras checks the requested cameras against the allowlist
+func ValidateCameras(cameras []string) error {
 	// 3. Camera Allowlist (Injection prevention)
 	validCameras := map[string]bool{
 		"front":          true,
@@ -57,11 +128,11 @@ func (r *ExportRequest) Validate() error {
 		"Right Repeater": true,
 	}
 
-	if len(r.Cameras) == 0 {
+	if len(cameras) == 0 {
 		return fmt.Errorf("at least one camera must be selected")
 	}
 
-	for _, cam := range r.Cameras {
+	for _, cam := range cameras {
 		if !validCameras[cam] {
 			return fmt.Errorf("invalid camera name: %s", cam)
 		}
@@ -78,6 +149,16 @@ type ExportStatus struct {
 	FilePath  string  `json:"file_path"`
 	Error     string  `json:"error,omitempty"`
 	CreatedAt time.Time
+
+	// Upload to an export destination (only when one was requested)
+	Destination    string  `json:"destination,omitempty"`
+	UploadStatus   string  `json:"upload_status,omitempty"` // "pending", "uploading", "uploaded", "failed"
+	UploadProgress float64 `json:"upload_progress,omitempty"`
+	UploadAttempts int     `json:"upload_attempts,omitempty"`
+	UploadError    string  `json:"upload_error,omitempty"`
+
+	// Items tracks the individual clips of a batch export
+	Items []models.ExportJobItem `json:"items,omitempty"`
 }
 
 var exportQueue = make(map[string]*ExportStatus)
@@ -120,11 +201,42 @@ func CheckForNvidiaGPU() bool {
 
 // QueueExport adds an export job to the queue
 func QueueExport(req ExportRequest) (string, error) {
-	var clip models.Clip
-	if err := database.DB.Preload("VideoFiles").First(&clip, req.ClipID).Error; err != nil {
-		return "", err
+	if req.Destination != "" {
+		if _, err := GetDestination(req.Destination); err != nil {
+			return "", err
+		}
+	}
+
+	var run func(jobID string)
+	jobPrefix := fmt.Sprintf("export_%d", req.ClipID)
+
+	if req.Mode == ExportModeTimelapse {
+		clips, err := loadTimelapseClips(req)
+		if err != nil {
+			return "", err
+		}
+		if req.ClipID == 0 {
+			jobPrefix = "timelapse"
+		}
+		run = func(jobID string) { processTimelapse(jobID, req, clips) }
+	} else {
+		var clip models.Clip
+		if err := database.DB.Preload("VideoFiles").First(&clip, req.ClipID).Error; err != nil {
+			return "", err
+		}
+		run = func(jobID string) { processExport(jobID, req, clip) }
+	}
+
+	kind := req.Mode
+	if kind == "" {
+		kind = ExportModeClip
 	}
+	return startExportJob(jobPrefix, kind, req.ClipID, req.Destination, nil, run)
+}
 
+// startExportJob reserves a concurrency slot, registers the job and runs it in the background.
+// When a destination is set, the finished file is uploaded afterwards.
+func startExportJob(jobPrefix, kind string, clipID uint, destination string, items []models.ExportJobItem, run func(jobID string)) (string, error) {
 	// Sentinel: Concurrency Control
 	activeJobsLock.Lock()
 	if activeJobs >= MaxConcurrentExports {
@@ -134,35 +246,83 @@ func QueueExport(req ExportRequest) (string, error) {
 	activeJobs++
 	activeJobsLock.Unlock()
 
-	jobID := fmt.Sprintf("export_%d_%d", req.ClipID, time.Now().Unix())
+	// Nanoseconds: job IDs are persisted keys and must not collide within a second
+	jobID := fmt.Sprintf("%s_%d", jobPrefix, time.Now().UnixNano())
+	for i := range items {
+		items[i].JobID = jobID
+	}
 	status := &ExportStatus{
-		JobID:     jobID,
-		Status:    "pending",
-		CreatedAt: time.Now(),
+		JobID:       jobID,
+		Status:      "pending",
+		CreatedAt:   time.Now(),
+		Destination: destination,
+		Items:       items,
+	}
+	if destination != "" {
+		status.UploadStatus = "pending"
 	}
 
 	exportQueueLock.Lock()
 	exportQueue[jobID] = status
 	exportQueueLock.Unlock()
 
+	recordExportJob(jobID, kind, clipID, destination, items)
+
 	go func() {
 		defer func() {
 			activeJobsLock.Lock()
 			activeJobs--
 			activeJobsLock.Unlock()
 		}()
-		processExport(jobID, req, clip)
+		run(jobID)
+
+		if destination != "" {
+			if status, ok := GetExportStatus(jobID); ok && status.Status == "completed" {
+				uploadExport(jobID, destination)
+			} else {
+				setUploadStatus(jobID, map[string]interface{}{"upload_status": "failed", "upload_error": "Export did not complete"})
+			}
+		}
 	}()
 
 	return jobID, nil
 }
 
-// GetExportStatus returns the status of a job
+// GetExportStatus returns the status of a job.
+// Live jobs come from memory; older ones fall back to the persisted record.
+// Live statuses are copied under the lock, since the job keeps updating them.
 func GetExportStatus(jobID string) (*ExportStatus, bool) {
 	exportQueueLock.Lock()
-	defer exportQueueLock.Unlock()
-	status, exists := exportQueue[jobID]
-	return status, exists
+	if status, exists := exportQueue[jobID]; exists {
+		snapshot := *status
+		snapshot.Items = append([]models.ExportJobItem(nil), status.Items...)
+		exportQueueLock.Unlock()
+		return &snapshot, true
+	}
+	exportQueueLock.Unlock()
+
+	job, err := GetExportJob(jobID)
+	if err != nil {
+		return nil, false
+	}
+	var items []models.ExportJobItem
+	if job.Kind == ExportKindBatch || job.Kind == ExportKindHighlight {
+		database.DB.Where("job_id = ?", jobID).Order("position asc").Find(&items)
+	}
+	return &ExportStatus{
+		JobID:          job.JobID,
+		Status:         job.Status,
+		Progress:       job.Progress,
+		FilePath:       job.FileName,
+		Error:          job.Error,
+		CreatedAt:      job.CreatedAt,
+		Destination:    job.Destination,
+		UploadStatus:   job.UploadStatus,
+		UploadProgress: job.UploadProgress,
+		UploadAttempts: job.UploadAttempts,
+		UploadError:    job.UploadError,
+		Items:          items,
+	}, true
 }
 
 func cleanupExportHistory() {
@@ -175,6 +335,8 @@ func cleanupExportHistory() {
 			}
 		}
 		exportQueueLock.Unlock()
+
+		enforceExportRetention(time.Now(), "")
 	}
 }
 
@@ -194,9 +356,11 @@ func processExport(jobID string, req ExportRequest, clip models.Clip) {
 	}
 
 	// Filter requested cameras
+	var inputCameras []string
 	for _, cam := range req.Cameras {
 		if path, ok := fileMap[cam]; ok {
 			inputs = append(inputs, path)
+			inputCameras = append(inputCameras, NormalizeCameraName(cam))
 		}
 	}
 
@@ -206,8 +370,8 @@ func processExport(jobID string, req ExportRequest, clip models.Clip) {
 	}
 
 	// 2. Prepare Output Path
-	// /config/exports/
-	exportDir := filepath.Join("/config", "exports")
+	// $CONFIG_PATH/exports/
+	exportDir := ExportDir()
 	if err := os.MkdirAll(exportDir, 0755); err != nil {
 		updateStatus(jobID, "failed", 0, "Failed to create export directory: "+err.Error())
 		return
@@ -241,25 +405,12 @@ func processExport(jobID string, req ExportRequest, clip models.Clip) {
 	}
 
 	// Filter Complex Construction
-	filterComplex := ""
-	numInputs := len(inputs)
-
-	if numInputs == 1 {
-		// No complex filter needed for geometry, just maybe scaling?
-	} else {
-		// Grid Layout logic
-		layout := ""
-		if numInputs == 2 {
-			layout = "hstack"
-			filterComplex = fmt.Sprintf("[0:v][1:v]%s=inputs=2[v]", layout)
-		} else if numInputs == 3 {
-			layout = "hstack=inputs=3"
-			filterComplex = fmt.Sprintf("[0:v][1:v][2:v]%s[v]", layout)
-		} else if numInputs >= 4 {
-			// xstack 2x2
-			filterComplex = "[0:v][1:v][2:v][3:v]xstack=inputs=4:layout=0_0|w0_0|0_h0|w0_h0[v]"
-		}
+	// Privacy masks are applied per input before the grid layout, so they follow the camera wherever it lands
+	masks := exportMasks(req)
+	if cams := sortedMaskCameras(masks); len(cams) > 0 {
+		log.Printf("Export %s: applying privacy masks to %s", jobID, strings.Join(cams, ", "))
 	}
+	filterComplex := exportFilterGraph(inputCameras, masks)
 
 	if filterComplex != "" {
 		args = append(args, "-filter_complex", filterComplex)
@@ -291,22 +442,45 @@ func processExport(jobID string, req ExportRequest, clip models.Clip) {
 		return
 	}
 
-	updateStatus(jobID, "completed", 100, "")
+	completeExport(jobID, outputFilename)
+}
+
+// layoutFilter stacks the given input labels into a grid and writes the result to out.
+// 2 cams: side by side, 3 cams: row of three, 4 cams: 2x2 grid, 5-6 cams: 3x2 grid.
+// Inputs beyond six are ignored. Tiles are expected to share a common size.
+func layoutFilter(labels []string, out string) string {
+	n := len(labels)
+	if n > 6 {
+		labels = labels[:6]
+		n = 6
+	}
 
-	// Update path in status
-	exportQueueLock.Lock()
-	if status, ok := exportQueue[jobID]; ok {
-		status.FilePath = outputFilename // just filename relative to export dir
+	switch {
+	case n == 0:
+		return ""
+	case n == 1:
+		return fmt.Sprintf("%snull%s", labels[0], out)
+	case n <= 3:
+		return fmt.Sprintf("%shstack=inputs=%d%s", strings.Join(labels, ""), n, out)
+	case n == 4:
+		return fmt.Sprintf("%sxstack=inputs=4:layout=0_0|w0_0|0_h0|w0_h0%s", strings.Join(labels, ""), out)
+	default:
+		layout := "0_0|w0_0|w0+w1_0|0_h0|w0_h0"
+		if n == 6 {
+			layout += "|w0+w1_h0"
+		}
+		return fmt.Sprintf("%sxstack=inputs=%d:layout=%s:fill=black%s", strings.Join(labels, ""), n, layout, out)
 	}
-	exportQueueLock.Unlock()
 }
 
 func updateStatus(jobID, state string, progress float64, errMsg string) {
 	exportQueueLock.Lock()
-	defer exportQueueLock.Unlock()
 	if status, ok := exportQueue[jobID]; ok {
 		status.Status = state
 		status.Progress = progress
 		status.Error = errMsg
 	}
+	exportQueueLock.Unlock()
+
+	persistExportStatus(jobID, map[string]interface{}{"status": state, "progress": progress, "error": errMsg})
 }
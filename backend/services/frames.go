@@ -0,0 +1,307 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"teslaxy/models"
+)
+
+const (
+	// frameGPSWindow is how far from the instant a telemetry sample may be to tag its GPS
+	frameGPSWindow = 2.0
+	// frameSeekMargin is how far before the instant the fast input seek stops; the
+	// rest is decoded frame by frame
+	frameSeekMargin  = 2.0
+	frameGrabTimeout = 30 * time.Second
+)
+
+var (
+	ErrFrameOutOfRange = errors.New("no footage at that time or frame")
+	ErrFrameCount      = errors.New("frame count unavailable for this footage")
+)
+
+// exactFrameGrabber decodes one frame at native resolution as PNG, either at offset
+// seconds (frame < 0) or the frame-th frame of the file; swappable for tests. It
+// waits for a transcoder slot like any other decode and gives up after
+// frameGrabTimeout or when ctx ends.
+var exactFrameGrabber = func(ctx context.Context, path string, offset float64, frame int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, frameGrabTimeout)
+	defer cancel()
+	job := &transcodeJob{file: filepath.Base(path), quality: "frame"}
+	if err := scheduler().acquire(ctx, job); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	cmd, stderrDone, err := startScheduledFFmpeg(ctx, job, exactFrameArgs(path, offset, frame), &out)
+	if err != nil {
+		scheduler().release(job, 0)
+		return nil, err
+	}
+	<-stderrDone
+	err = cmd.Wait()
+	scheduler().release(job, cpuTime(cmd))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("ffmpeg failed: %v", err)
+	}
+	if out.Len() == 0 {
+		return nil, ErrFrameOutOfRange
+	}
+	return out.Bytes(), nil
+}
+
+// exactFrameArgs seeks the input to shortly before the instant, then on the output
+// side for the rest, so the frames in between are decoded and the result is exact
+// rather than the nearest keyframe. Frames picked by number are counted from the
+// start of the file, so those decode it all.
+func exactFrameArgs(path string, offset float64, frame int) []string {
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	if frame < 0 && offset > frameSeekMargin {
+		args = append(args, "-ss", fmt.Sprintf("%.3f", offset-frameSeekMargin))
+		offset = frameSeekMargin
+	}
+	args = append(args, "-i", path, "-an")
+	if frame >= 0 {
+		args = append(args, "-vf", fmt.Sprintf(`select=eq(n\,%d)`, frame), "-vsync", "0")
+	} else {
+		args = append(args, "-ss", fmt.Sprintf("%.3f", offset))
+	}
+	return append(args, "-frames:v", "1", "-c:v", "png", "-pix_fmt", "rgb24", "-f", "image2pipe", "pipe:1")
+}
+
+// FrameGrab is one lossless still with its provenance
+type FrameGrab struct {
+	Camera string
+	File   models.VideoFile
+	Offset float64 // Seconds into the file
+	Frame  int     // Frame index in the file, or -1 when grabbed by time
+	Time   time.Time
+	SHA256 string // Of the source file
+	GPS    *[2]float64
+	PNG    []byte // With the above embedded as tEXt chunks
+}
+
+// cameraFiles returns the files of one camera, oldest first
+func cameraFiles(clip models.Clip, camera string) []models.VideoFile {
+	name := NormalizeCameraName(camera)
+	var files []models.VideoFile
+	for _, vf := range clip.VideoFiles {
+		if NormalizeCameraName(vf.Camera) == name {
+			files = append(files, vf)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Timestamp.Before(files[j].Timestamp) })
+	return files
+}
+
+// locateTime finds the file of a camera showing instant and the offset into it
+func locateTime(files []models.VideoFile, instant time.Time) (models.VideoFile, float64, error) {
+	for i := len(files) - 1; i >= 0; i-- {
+		offset := instant.Sub(files[i].Timestamp).Seconds()
+		if offset < 0 {
+			continue
+		}
+		info, err := probeVideo(files[i].FilePath)
+		if err != nil || offset >= info.Duration {
+			break // Instant falls in a gap or in unreadable footage
+		}
+		return files[i], offset, nil
+	}
+	return models.VideoFile{}, 0, ErrFrameOutOfRange
+}
+
+// locateFrame finds the file holding the n-th frame of a camera, counting across
+// its files in time order, and the frame's index and offset within that file
+func locateFrame(files []models.VideoFile, n int) (models.VideoFile, int, float64, error) {
+	if n < 0 {
+		return models.VideoFile{}, 0, 0, ErrFrameOutOfRange
+	}
+	for _, vf := range files {
+		info, err := probeVideo(vf.FilePath)
+		if err != nil || info.Frames == 0 {
+			return models.VideoFile{}, 0, 0, ErrFrameCount
+		}
+		if n < info.Frames {
+			return vf, n, float64(n) * info.Duration / float64(info.Frames), nil
+		}
+		n -= info.Frames
+	}
+	return models.VideoFile{}, 0, 0, ErrFrameOutOfRange
+}
+
+// GrabFrame extracts the exact frame of a camera at instant, or its frame-th frame
+// when frame >= 0. The position is only embedded with withGPS.
+func GrabFrame(ctx context.Context, clip models.Clip, camera string, instant time.Time, frame int, withGPS bool) (*FrameGrab, error) {
+	files := cameraFiles(clip, camera)
+	if len(files) == 0 {
+		return nil, ErrNoCameraFootage
+	}
+
+	g := &FrameGrab{Camera: NormalizeCameraName(camera), Frame: -1}
+	var err error
+	if frame >= 0 {
+		g.File, g.Frame, g.Offset, err = locateFrame(files, frame)
+	} else {
+		g.File, g.Offset, err = locateTime(files, instant)
+	}
+	if err != nil {
+		return nil, err
+	}
+	g.Time = g.File.Timestamp.Add(time.Duration(g.Offset * float64(time.Second)))
+
+	raw, err := exactFrameGrabber(ctx, g.File.FilePath, g.Offset, g.Frame)
+	if err != nil {
+		return nil, err
+	}
+	if g.SHA256, _, err = hashFile(g.File.FilePath); err != nil {
+		return nil, err
+	}
+	if withGPS {
+		g.GPS = frameGPS(clip, g.Time)
+	}
+
+	if g.PNG, err = addPNGText(raw, g.metadata(clip)); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// GrabAllCameras extracts the same instant from every camera with footage at it
+func GrabAllCameras(ctx context.Context, clip models.Clip, instant time.Time, withGPS bool) ([]*FrameGrab, error) {
+	seen := map[string]bool{}
+	var cameras []string
+	for _, cam := range cameraOrder {
+		seen[cam] = true
+		cameras = append(cameras, cam)
+	}
+	for _, vf := range clip.VideoFiles {
+		if cam := NormalizeCameraName(vf.Camera); !seen[cam] {
+			seen[cam] = true
+			cameras = append(cameras, cam)
+		}
+	}
+
+	var grabs []*FrameGrab
+	for _, cam := range cameras {
+		g, err := GrabFrame(ctx, clip, cam, instant, -1, withGPS)
+		if err == ErrNoCameraFootage || err == ErrFrameOutOfRange {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cam, err)
+		}
+		grabs = append(grabs, g)
+	}
+	if len(grabs) == 0 {
+		return nil, ErrFrameOutOfRange
+	}
+	return grabs, nil
+}
+
+// frameGPS returns the position from the Front camera's SEI closest to instant
+func frameGPS(clip models.Clip, instant time.Time) *[2]float64 {
+	// Only extract telemetry from files that can cover the instant
+	var nearby []models.VideoFile
+	for _, vf := range cameraFiles(clip, "Front") {
+		if d := instant.Sub(vf.Timestamp); d > -frameGPSWindow*time.Second && d < 2*defaultSegmentDuration*time.Second {
+			nearby = append(nearby, vf)
+		}
+	}
+
+	var best *ReportSample
+	for _, s := range reportSamples(nearby, instant, frameGPSWindow) {
+		if s.Latitude == 0 && s.Longitude == 0 {
+			continue
+		}
+		if best == nil || math.Abs(s.Offset) < math.Abs(best.Offset) {
+			s := s
+			best = &s
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return &[2]float64{best.Latitude, best.Longitude}
+}
+
+// metadata is written into the PNG as tEXt key/value pairs
+func (g *FrameGrab) metadata(clip models.Clip) [][2]string {
+	text := [][2]string{
+		{"Title", fmt.Sprintf("Clip %d, %s camera", clip.ID, g.Camera)},
+		{"Creation Time", g.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00")},
+		{"Source", filepath.Base(g.File.FilePath)},
+		{"Source SHA256", g.SHA256},
+		{"Offset", fmt.Sprintf("%.3f", g.Offset)},
+	}
+	if g.Frame >= 0 {
+		text = append(text, [2]string{"Frame", fmt.Sprint(g.Frame)})
+	}
+	if g.GPS != nil {
+		text = append(text, [2]string{"GPS", fmt.Sprintf("%.6f,%.6f", g.GPS[0], g.GPS[1])})
+	}
+	return append(text, [2]string{"Software", "Teslaxy"})
+}
+
+// FileName names a grab after its camera and time
+func (g *FrameGrab) FileName() string {
+	camera := strings.ToLower(strings.ReplaceAll(g.Camera, " ", "_"))
+	return fmt.Sprintf("%s_%s.png", g.Time.UTC().Format("20060102_150405.000"), camera)
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// addPNGText inserts tEXt chunks right after the IHDR chunk of a PNG
+func addPNGText(png []byte, text [][2]string) ([]byte, error) {
+	const ihdrEnd = 8 + 4 + 4 + 13 + 4 // Signature, then length, type, data and CRC
+	if len(png) < ihdrEnd || !bytes.Equal(png[:8], pngSignature) || string(png[12:16]) != "IHDR" {
+		return nil, errors.New("not a PNG image")
+	}
+
+	var out bytes.Buffer
+	out.Write(png[:ihdrEnd])
+	for _, kv := range text {
+		// tEXt is Latin-1; keep it to printable ASCII
+		data := []byte(asciiOnly(kv[0]) + "\x00" + asciiOnly(kv[1]))
+		binary.Write(&out, binary.BigEndian, uint32(len(data)))
+		chunk := append([]byte("tEXt"), data...)
+		out.Write(chunk)
+		binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	}
+	out.Write(png[ihdrEnd:])
+	return out.Bytes(), nil
+}
+
+func asciiOnly(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// WriteFrameZip writes grabs of several cameras as one ZIP
+func WriteFrameZip(w io.Writer, grabs []*FrameGrab) error {
+	archive := &zipArchive{zw: zip.NewWriter(w)}
+	for _, g := range grabs {
+		if err := archive.add(g.FileName(), int64(len(g.PNG)), g.Time, bytes.NewReader(g.PNG)); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"image"
+	"image/png"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type frameCall struct {
+	path   string
+	offset float64
+	frame  int
+}
+
+// stubFrames fakes ffprobe (60s, 2160 frames per file), SEI and the PNG grabber
+func stubFrames(t *testing.T) *[]frameCall {
+	stubHLS(t, VideoInfo{Duration: 60, Width: 64, Height: 48, Frames: 2160})
+	stubReportSources(t)
+
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 64, 48)))
+	var calls []frameCall
+	original := exactFrameGrabber
+	exactFrameGrabber = func(ctx context.Context, path string, offset float64, frame int) ([]byte, error) {
+		calls = append(calls, frameCall{path, offset, frame})
+		return img.Bytes(), nil
+	}
+	t.Cleanup(func() { exactFrameGrabber = original })
+	return &calls
+}
+
+// pngText reads the tEXt chunks of a PNG
+func pngText(t *testing.T, data []byte) map[string]string {
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatalf("Invalid PNG: %v", err) // Also verifies every chunk CRC
+	}
+	text := map[string]string{}
+	for pos := 8; pos+8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[pos:]))
+		if string(data[pos+4:pos+8]) == "tEXt" {
+			kv := strings.SplitN(string(data[pos+8:pos+8+n]), "\x00", 2)
+			text[kv[0]] = kv[1]
+		}
+		pos += 12 + n
+	}
+	return text
+}
+
+func TestExactFrameArgs(t *testing.T) {
+	byTime := strings.Join(exactFrameArgs("/f/front.mp4", 15.5, -1), " ")
+	if !strings.Contains(byTime, "-ss 13.500 -i /f/front.mp4 -an -ss 2.000 -frames:v 1 -c:v png") {
+		t.Errorf("Expected a fast input seek, then a short exact one to a lossless PNG, got %s", byTime)
+	}
+	early := strings.Join(exactFrameArgs("/f/front.mp4", 1.5, -1), " ")
+	if !strings.Contains(early, "-loglevel error -i /f/front.mp4 -an -ss 1.500 -frames:v 1") {
+		t.Errorf("Expected only an output-side seek near the start, got %s", early)
+	}
+	byFrame := strings.Join(exactFrameArgs("/f/front.mp4", 0, 36), " ")
+	if !strings.Contains(byFrame, `-vf select=eq(n\,36) -vsync 0 -frames:v 1`) || strings.Contains(byFrame, "-ss") {
+		t.Errorf("Expected the frame to be selected by number, got %s", byFrame)
+	}
+}
+
+func TestGrabFrame_ByTime(t *testing.T) {
+	calls := stubFrames(t)
+	clip := archiveFixture(t)
+
+	grab, err := GrabFrame(context.Background(), clip, "front", clip.Timestamp.Add(75500*time.Millisecond), -1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front2 := clip.VideoFiles[2].FilePath
+	if len(*calls) != 1 || (*calls)[0] != (frameCall{front2, 15.5, -1}) {
+		t.Errorf("Expected Front minute two at 15.5s, got %+v", *calls)
+	}
+
+	data, _ := os.ReadFile(front2)
+	sum := sha256.Sum256(data)
+	text := pngText(t, grab.PNG)
+	for key, want := range map[string]string{
+		"Creation Time": "2024-06-01T21:01:15.500Z",
+		"Source":        "2024-06-01_21-01-00-front.mp4",
+		"Source SHA256": hex.EncodeToString(sum[:]),
+		"Offset":        "15.500",
+		"GPS":           "-34.899850,138.600150", // SEI sample closest to the instant
+		"Title":         "Clip 7, Front camera",
+	} {
+		if text[key] != want {
+			t.Errorf("%s: expected %q, got %q", key, want, text[key])
+		}
+	}
+	if grab.FileName() != "20240601_210115.500_front.png" {
+		t.Errorf("Unexpected file name %s", grab.FileName())
+	}
+
+	grab, _ = GrabFrame(context.Background(), clip, "front", clip.Timestamp.Add(75500*time.Millisecond), -1, false)
+	if _, ok := pngText(t, grab.PNG)["GPS"]; ok || grab.GPS != nil {
+		t.Error("Expected no GPS without withGPS")
+	}
+}
+
+func TestGrabFrame_ByNumber(t *testing.T) {
+	calls := stubFrames(t)
+	clip := archiveFixture(t)
+
+	// Frames are counted across the camera's files
+	grab, err := GrabFrame(context.Background(), clip, "Front", time.Time{}, 2160+36, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (*calls)[0] != (frameCall{clip.VideoFiles[2].FilePath, 1, 36}) {
+		t.Errorf("Expected frame 36 of Front minute two, got %+v", *calls)
+	}
+	if text := pngText(t, grab.PNG); text["Frame"] != "36" || text["Creation Time"] != "2024-06-01T21:01:01.000Z" {
+		t.Errorf("Unexpected metadata %v", text)
+	}
+
+	if _, err := GrabFrame(context.Background(), clip, "Front", time.Time{}, 2*2160, true); err != ErrFrameOutOfRange {
+		t.Errorf("Expected ErrFrameOutOfRange past the last frame, got %v", err)
+	}
+	videoProber = func(path string) (VideoInfo, error) { return VideoInfo{Duration: 60}, nil }
+	if _, err := GrabFrame(context.Background(), clip, "Back", time.Time{}, 10, true); err != ErrFrameCount {
+		t.Errorf("Expected ErrFrameCount without a frame count, got %v", err)
+	}
+}
+
+func TestGrabFrame_OutOfRange(t *testing.T) {
+	stubFrames(t)
+	clip := archiveFixture(t)
+
+	for _, at := range []time.Duration{-time.Second, 120 * time.Second, 90 * time.Minute} {
+		if _, err := GrabFrame(context.Background(), clip, "Front", clip.Timestamp.Add(at), -1, true); err != ErrFrameOutOfRange {
+			t.Errorf("%v: expected ErrFrameOutOfRange, got %v", at, err)
+		}
+	}
+	if _, err := GrabFrame(context.Background(), clip, "Cabin", clip.Timestamp, -1, true); err != ErrNoCameraFootage {
+		t.Errorf("Expected ErrNoCameraFootage, got %v", err)
+	}
+}
+
+func TestGrabAllCameras(t *testing.T) {
+	stubFrames(t)
+	clip := archiveFixture(t)
+
+	// Back only has the first minute
+	grabs, err := GrabAllCameras(context.Background(), clip, clip.Timestamp.Add(30*time.Second), true)
+	if err != nil || len(grabs) != 2 || grabs[0].Camera != "Front" || grabs[1].Camera != "Back" {
+		t.Fatalf("Expected Front and Back, got %d grabs (%v)", len(grabs), err)
+	}
+	if grabs, _ := GrabAllCameras(context.Background(), clip, clip.Timestamp.Add(90*time.Second), true); len(grabs) != 1 {
+		t.Errorf("Expected only Front in the second minute, got %d", len(grabs))
+	}
+
+	var buf bytes.Buffer
+	if err := WriteFrameZip(&buf, grabs); err != nil {
+		t.Fatal(err)
+	}
+	zr, _ := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if len(zr.File) != 2 || zr.File[0].Name != "20240601_210030.000_front.png" || zr.File[1].Name != "20240601_210030.000_back.png" {
+		t.Errorf("Unexpected ZIP entries %v", zr.File)
+	}
+}
+
+func TestAddPNGText_RejectsOtherImages(t *testing.T) {
+	if _, err := addPNGText([]byte("\xff\xd8\xff\xe0 not a png"), nil); err == nil {
+		t.Error("Expected an error for a JPEG")
+	}
+}
@@ -0,0 +1,293 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"teslaxy/models"
+)
+
+// ExportKindHighlight is the ExportJob kind of a highlight reel
+const ExportKindHighlight = "highlight"
+
+const (
+	DefaultHighlightBefore = 10.0
+	DefaultHighlightAfter  = 20.0
+	MaxHighlightWindow     = 120.0 // Per side, seconds
+
+	// highlightRetryDelay spaces out scheduled attempts while the export queue is full
+	highlightRetryDelay = 5 * time.Minute
+	highlightRetries    = 12
+)
+
+// HighlightRequest compiles the events of a day (or filter) into one video
+type HighlightRequest struct {
+	Date   string             `json:"date,omitempty"`   // YYYY-MM-DD (server local time); Sentry events of that day
+	Filter *BatchExportFilter `json:"filter,omitempty"` // Any other selection
+
+	Before float64 `json:"before,omitempty"` // Seconds before each EventTimestamp (default 10)
+	After  float64 `json:"after,omitempty"`  // Seconds after each EventTimestamp (default 20)
+
+	// Cameras overrides the per-event triggering camera (from event.json) with a fixed set
+	Cameras      []string `json:"cameras,omitempty"`
+	CaptionCards *bool    `json:"caption_cards,omitempty"` // Defaults to true
+
+	Destination      string `json:"destination,omitempty"`
+	IgnoreSavedMasks bool   `json:"ignore_saved_masks,omitempty"`
+}
+
+// Validate enforces security constraints on the highlight request
+func (r *HighlightRequest) Validate() error {
+	if (r.Date == "") == (r.Filter == nil) {
+		return fmt.Errorf("exactly one of date or filter is required")
+	}
+	if r.Date != "" {
+		if _, err := time.ParseInLocation("2006-01-02", r.Date, time.Local); err != nil {
+			return fmt.Errorf("date must be YYYY-MM-DD")
+		}
+	}
+	if r.Filter != nil {
+		if err := (&BatchExportRequest{Filter: r.Filter, Cameras: []string{"front"}}).Validate(); err != nil {
+			return err
+		}
+	}
+	if r.Before < 0 || r.After < 0 || r.Before > MaxHighlightWindow || r.After > MaxHighlightWindow {
+		return fmt.Errorf("before and after must be between 0 and %.0f seconds", MaxHighlightWindow)
+	}
+	if len(r.Cameras) > 0 {
+		return ValidateCameras(r.Cameras)
+	}
+	return nil
+}
+
+// window returns the seconds to keep before and after each event, applying defaults
+func (r *HighlightRequest) window() (float64, float64) {
+	before, after := r.Before, r.After
+	if before == 0 && after == 0 {
+		before, after = DefaultHighlightBefore, DefaultHighlightAfter
+	}
+	return before, after
+}
+
+// filter resolves Date into a Sentry filter for that local day
+func (r *HighlightRequest) filter() *BatchExportFilter {
+	if r.Filter != nil {
+		return r.Filter
+	}
+	day, _ := time.ParseInLocation("2006-01-02", r.Date, time.Local)
+	to := day.AddDate(0, 0, 1)
+	return &BatchExportFilter{From: &day, To: &to, Event: "Sentry"}
+}
+
+// eventCameras maps the "camera" field of event.json to camera names.
+// Tesla writes the index of the camera that triggered the event.
+var eventCameras = map[string]string{
+	"0": "Front", "1": "Front", "2": "Front",
+	"3": "Left Pillar", "4": "Right Pillar",
+	"5": "Left Repeater", "6": "Right Repeater",
+	"7": "Back", "8": "Cabin",
+}
+
+// triggeringCamera returns the camera that triggered an event, falling back to Front
+// when event.json is missing, has no camera or the camera has no footage in the clip.
+func triggeringCamera(clip models.Clip) string {
+	camera := "Front"
+	if clip.SourceDir != "" {
+		if data, err := os.ReadFile(filepath.Join(clip.SourceDir, "event.json")); err == nil {
+			var ev struct {
+				Camera interface{} `json:"camera"`
+			}
+			if json.Unmarshal(data, &ev) == nil && ev.Camera != nil {
+				raw := strings.TrimSpace(fmt.Sprint(ev.Camera))
+				if name, ok := eventCameras[raw]; ok {
+					camera = name
+				} else if raw != "" {
+					camera = NormalizeCameraName(raw)
+				}
+			}
+		}
+	}
+
+	for _, vf := range clip.VideoFiles {
+		if NormalizeCameraName(vf.Camera) == camera {
+			return camera
+		}
+	}
+	return "Front"
+}
+
+// highlightItems cuts a window around each event from its triggering camera (or the fixed set)
+func highlightItems(req HighlightRequest, clips []models.Clip) []batchItem {
+	before, after := req.window()
+
+	var fixed []string
+	seen := make(map[string]bool)
+	for _, cam := range req.Cameras {
+		if name := NormalizeCameraName(cam); !seen[name] {
+			seen[name] = true
+			fixed = append(fixed, name)
+		}
+	}
+
+	items := make([]batchItem, len(clips))
+	for i, clip := range clips {
+		cameras := fixed
+		trigger := triggeringCamera(clip)
+		if len(cameras) == 0 {
+			cameras = []string{trigger}
+		}
+
+		event := clip.Timestamp
+		if clip.EventTimestamp != nil {
+			event = *clip.EventTimestamp
+		}
+
+		// planTimelapse measures start from the first segment of the selected cameras
+		var origin time.Time
+		for _, vf := range clip.VideoFiles {
+			if !includesCamera(cameras, vf.Camera) {
+				continue
+			}
+			if origin.IsZero() || vf.Timestamp.Before(origin) {
+				origin = vf.Timestamp
+			}
+		}
+		start := event.Sub(origin).Seconds() - before
+		length := before + after
+		if start < 0 {
+			length += start
+			start = 0
+		}
+		if length <= 0 {
+			// Event precedes the footage entirely; show the opening instead
+			length = before + after
+		}
+
+		caption := titleCardText(clip) + "\nTriggered by " + trigger
+		items[i] = batchItem{Clip: clip, Cameras: cameras, Start: start, Length: length, Caption: caption}
+	}
+	return items
+}
+
+// includesCamera reports whether camera (any spelling) is one of the normalized names
+func includesCamera(cameras []string, camera string) bool {
+	name := NormalizeCameraName(camera)
+	for _, c := range cameras {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// QueueHighlightReel compiles the selected events into one video with caption cards.
+// It shows up in the exports list with kind "highlight".
+func QueueHighlightReel(req HighlightRequest) (string, error) {
+	if req.Destination != "" {
+		if _, err := GetDestination(req.Destination); err != nil {
+			return "", err
+		}
+	}
+
+	clips, err := loadBatchClips(BatchExportRequest{Filter: req.filter()})
+	if err != nil {
+		return "", err
+	}
+
+	items := highlightItems(req, clips)
+	jobItems := make([]models.ExportJobItem, len(clips))
+	for i, clip := range clips {
+		jobItems[i] = models.ExportJobItem{Position: i, ClipID: clip.ID, Status: "pending"}
+	}
+
+	opts := batchRender{TitleCards: req.CaptionCards == nil || *req.CaptionCards, NamePrefix: "highlights", Masks: map[string][]MaskRegion{}}
+	if !req.IgnoreSavedMasks {
+		opts.Masks = savedMasks()
+	}
+
+	return startExportJob("highlight", ExportKindHighlight, 0, req.Destination, jobItems, func(jobID string) {
+		renderBatch(jobID, items, opts)
+	})
+}
+
+// parseHighlightSchedule parses HIGHLIGHT_SCHEDULE ("HH:MM", server local time)
+func parseHighlightSchedule(v string) (int, int, error) {
+	parts := strings.Split(v, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected HH:MM")
+	}
+	hour, err1 := strconv.Atoi(parts[0])
+	minute, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, 0, fmt.Errorf("expected HH:MM")
+	}
+	return hour, minute, nil
+}
+
+// nextHighlightRun returns the next occurrence of hour:minute after now
+func nextHighlightRun(now time.Time, hour, minute int) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// scheduledHighlightRequest builds the nightly request for the day before run
+func scheduledHighlightRequest(run time.Time) HighlightRequest {
+	req := HighlightRequest{
+		Date:        run.AddDate(0, 0, -1).Format("2006-01-02"),
+		Before:      float64(envInt("HIGHLIGHT_BEFORE", int(DefaultHighlightBefore))),
+		After:       float64(envInt("HIGHLIGHT_AFTER", int(DefaultHighlightAfter))),
+		Destination: os.Getenv("HIGHLIGHT_DESTINATION"),
+	}
+	if cams := os.Getenv("HIGHLIGHT_CAMERAS"); cams != "" {
+		req.Cameras = strings.Split(cams, ",")
+	}
+	return req
+}
+
+// StartHighlightScheduler compiles the previous day's Sentry events every night at
+// HIGHLIGHT_SCHEDULE (HH:MM). It does nothing when the variable is unset.
+func StartHighlightScheduler() {
+	schedule := os.Getenv("HIGHLIGHT_SCHEDULE")
+	if schedule == "" {
+		return
+	}
+	hour, minute, err := parseHighlightSchedule(schedule)
+	if err != nil {
+		log.Printf("Invalid HIGHLIGHT_SCHEDULE %q (%v); nightly highlights disabled", schedule, err)
+		return
+	}
+
+	go func() {
+		for {
+			run := nextHighlightRun(time.Now(), hour, minute)
+			time.Sleep(time.Until(run))
+
+			req := scheduledHighlightRequest(run)
+			if err := req.Validate(); err != nil {
+				log.Printf("Nightly highlights misconfigured: %v", err)
+				continue
+			}
+			for attempt := 0; attempt <= highlightRetries; attempt++ {
+				jobID, err := QueueHighlightReel(req)
+				if err == nil {
+					log.Printf("Nightly highlights for %s queued as %s", req.Date, jobID)
+					break
+				}
+				if !strings.Contains(err.Error(), "server busy") {
+					log.Printf("Nightly highlights for %s skipped: %v", req.Date, err)
+					break
+				}
+				time.Sleep(highlightRetryDelay)
+			}
+		}
+	}()
+}
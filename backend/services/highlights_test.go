@@ -0,0 +1,184 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+func TestHighlightRequestValidation(t *testing.T) {
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		req     HighlightRequest
+		wantErr bool
+	}{
+		{"Date", HighlightRequest{Date: "2024-05-01"}, false},
+		{"Filter", HighlightRequest{Filter: &BatchExportFilter{From: &from, Reason: "sentry_aware_object_detection"}}, false},
+		{"Custom window", HighlightRequest{Date: "2024-05-01", Before: 5, After: 60, Cameras: []string{"back"}}, false},
+		{"Neither", HighlightRequest{}, true},
+		{"Both", HighlightRequest{Date: "2024-05-01", Filter: &BatchExportFilter{Event: "Sentry"}}, true},
+		{"Bad date", HighlightRequest{Date: "01/05/2024"}, true},
+		{"Empty filter", HighlightRequest{Filter: &BatchExportFilter{}}, true},
+		{"Negative window", HighlightRequest{Date: "2024-05-01", Before: -1}, true},
+		{"Window too long", HighlightRequest{Date: "2024-05-01", After: MaxHighlightWindow + 1}, true},
+		{"Invalid camera", HighlightRequest{Date: "2024-05-01", Cameras: []string{"front;id"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.req.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHighlightDateFilter(t *testing.T) {
+	f := (&HighlightRequest{Date: "2024-05-01"}).filter()
+	if f.Event != "Sentry" || f.From.Hour() != 0 || f.To.Sub(*f.From) != 24*time.Hour || f.From.Location() != time.Local {
+		t.Errorf("Unexpected filter %+v", f)
+	}
+}
+
+// highlightClip returns an unsaved clip with Front and Back minutes and an event.json
+func highlightClip(t *testing.T, eventJSON string, ts time.Time, event time.Time) models.Clip {
+	dir := t.TempDir()
+	if eventJSON != "" {
+		if err := os.WriteFile(filepath.Join(dir, "event.json"), []byte(eventJSON), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var files []models.VideoFile
+	for _, cam := range []string{"Front", "Back"} {
+		for m := 0; m < 2; m++ {
+			files = append(files, models.VideoFile{Camera: cam, FilePath: filepath.Join(dir, cam+".mp4"), Timestamp: ts.Add(time.Duration(m) * time.Minute)})
+		}
+	}
+	return models.Clip{Timestamp: ts, EventTimestamp: &event, Event: "Sentry", Reason: "sentry_aware_object_detection", City: "Springfield", SourceDir: dir, VideoFiles: files}
+}
+
+func TestTriggeringCamera(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 22, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		event string
+		want  string
+	}{
+		{"Index", `{"camera":"7"}`, "Back"},
+		{"Numeric", `{"camera":7}`, "Back"},
+		{"Front", `{"camera":"0"}`, "Front"},
+		{"Name", `{"camera":"back"}`, "Back"},
+		{"No footage for camera", `{"camera":"5"}`, "Front"},
+		{"Missing field", `{"reason":"sentry_aware_object_detection"}`, "Front"},
+		{"No event.json", "", "Front"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := triggeringCamera(highlightClip(t, tt.event, ts, ts)); got != tt.want {
+				t.Errorf("triggeringCamera() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHighlightItems(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 22, 0, 0, 0, time.UTC)
+	mid := highlightClip(t, `{"camera":"7"}`, ts, ts.Add(70*time.Second))
+	early := highlightClip(t, `{"camera":"0"}`, ts, ts.Add(4*time.Second))
+
+	items := highlightItems(HighlightRequest{Date: "2024-05-01"}, []models.Clip{mid, early})
+
+	if got := items[0]; len(got.Cameras) != 1 || got.Cameras[0] != "Back" || got.Start != 60 || got.Length != 30 {
+		t.Errorf("Unexpected item %+v", got)
+	}
+	if !strings.Contains(items[0].Caption, "Springfield") || !strings.Contains(items[0].Caption, "Triggered by Back") {
+		t.Errorf("Unexpected caption %q", items[0].Caption)
+	}
+
+	// The window is clamped to the start of the footage
+	if got := items[1]; got.Start != 0 || got.Length != 24 {
+		t.Errorf("Unexpected clamped item %+v", got)
+	}
+
+	// A fixed camera set replaces the triggering camera
+	items = highlightItems(HighlightRequest{Date: "2024-05-01", Before: 5, After: 5, Cameras: []string{"front", "Front", "back"}}, []models.Clip{mid})
+	if got := items[0]; len(got.Cameras) != 2 || got.Start != 65 || got.Length != 10 {
+		t.Errorf("Unexpected item %+v", got)
+	}
+}
+
+func TestNextHighlightRun(t *testing.T) {
+	loc := time.FixedZone("ACST", 9*3600+1800)
+	now := time.Date(2024, 5, 1, 1, 30, 0, 0, loc)
+
+	if got := nextHighlightRun(now, 2, 0); !got.Equal(time.Date(2024, 5, 1, 2, 0, 0, 0, loc)) {
+		t.Errorf("Expected later today, got %v", got)
+	}
+	if got := nextHighlightRun(now, 1, 30); !got.Equal(time.Date(2024, 5, 2, 1, 30, 0, 0, loc)) {
+		t.Errorf("Expected tomorrow, got %v", got)
+	}
+
+	for _, bad := range []string{"", "24:00", "2", "02:60", "ab:cd"} {
+		if _, _, err := parseHighlightSchedule(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+	if h, m, err := parseHighlightSchedule("02:15"); err != nil || h != 2 || m != 15 {
+		t.Errorf("Unexpected parse: %d:%d %v", h, m, err)
+	}
+
+	if req := scheduledHighlightRequest(time.Date(2024, 5, 1, 2, 0, 0, 0, time.Local)); req.Date != "2024-04-30" || req.Validate() != nil {
+		t.Errorf("Unexpected scheduled request %+v", req)
+	}
+}
+
+func TestQueueHighlightReel(t *testing.T) {
+	setupExportDB(t)
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)
+	a := createBatchClip(t, "Sentry", "sentry_aware_object_detection", "", day.Add(3*time.Hour))
+	createBatchClip(t, "Saved", "user_interaction_honk", "", day.Add(4*time.Hour))
+	createBatchClip(t, "Sentry", "sentry_aware_object_detection", "", day.Add(25*time.Hour))
+
+	jobID, err := QueueHighlightReel(HighlightRequest{Date: "2024-05-01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(jobID, "highlight_") {
+		t.Errorf("Unexpected job ID %s", jobID)
+	}
+
+	// The referenced footage doesn't exist, so the reel fails
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if s, ok := GetExportStatus(jobID); ok && s.Status == "failed" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	exportQueueLock.Lock()
+	delete(exportQueue, jobID)
+	exportQueueLock.Unlock()
+
+	var job models.ExportJob
+	if err := database.DB.Where("job_id = ?", jobID).First(&job).Error; err != nil || job.Kind != ExportKindHighlight {
+		t.Fatalf("Expected a highlight job in the exports list, got %+v (%v)", job, err)
+	}
+	persisted, ok := GetExportStatus(jobID)
+	if !ok || len(persisted.Items) != 1 || persisted.Items[0].ClipID != a.ID {
+		t.Errorf("Expected one item for the day's Sentry event, got %+v", persisted)
+	}
+
+	if _, err := QueueHighlightReel(HighlightRequest{Date: "2024-06-01"}); err == nil {
+		t.Error("Expected an error for a day without events")
+	}
+}
@@ -0,0 +1,489 @@
+package services
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HLS cache defaults. Override with HLS_CACHE_MB and HLS_CACHE_MAX_AGE_HOURS;
+// a value of 0 disables the respective limit.
+const (
+	defaultHLSCacheMB       = 2 * 1024
+	defaultHLSCacheMaxAgeHr = 24
+
+	// HLSSegmentDuration is the length of every segment but the last, in seconds
+	HLSSegmentDuration = 4.0
+
+	hlsSegmentTimeout   = 2 * time.Minute
+	hlsJanitorInterval  = 10 * time.Minute
+	hlsStaleTempFileAge = time.Hour
+	// maxProbeCacheEntries bounds the memoized probes; every version of every file
+	// ever watched would otherwise stay in memory
+	maxProbeCacheEntries = 10000
+)
+
+var (
+	ErrUnknownRendition = errors.New("unknown rendition")
+	ErrSegmentNotFound  = errors.New("segment out of range")
+)
+
+// VideoInfo is what the HLS playlists need to know about a source file
+type VideoInfo struct {
+	Duration float64
+	Width    int
+	Height   int
+	Frames   int // From the container; 0 if unknown
+}
+
+// videoProber reads duration, frame size and frame count with ffprobe; swapped out in tests
+var videoProber = func(path string) (VideoInfo, error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height,nb_frames:format=duration", "-of", "json", path).Output()
+	if err != nil {
+		return VideoInfo{}, fmt.Errorf("ffprobe failed: %v", err)
+	}
+	var probe struct {
+		Streams []struct {
+			Width    int    `json:"width"`
+			Height   int    `json:"height"`
+			NbFrames string `json:"nb_frames"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return VideoInfo{}, err
+	}
+	duration, _ := strconv.ParseFloat(probe.Format.Duration, 64)
+	if len(probe.Streams) == 0 || duration <= 0 {
+		return VideoInfo{}, fmt.Errorf("no video stream in %s", filepath.Base(path))
+	}
+	frames, _ := strconv.Atoi(probe.Streams[0].NbFrames)
+	return VideoInfo{Duration: duration, Width: probe.Streams[0].Width, Height: probe.Streams[0].Height, Frames: frames}, nil
+}
+
+// hlsEncoder runs ffmpeg for one segment; swapped out in tests
+var hlsEncoder = runFFmpeg
+
+// runFFmpeg runs ffmpeg to completion and returns its CPU time. Transcodes carry
+// their scheduler job (for progress stats); remuxes pass nil.
+func runFFmpeg(ctx context.Context, args []string, job *transcodeJob) (time.Duration, error) {
+	if job == nil {
+		cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return cpuTime(cmd), fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return cpuTime(cmd), nil
+	}
+
+	cmd, stderrDone, err := startScheduledFFmpeg(ctx, job, args, io.Discard)
+	if err != nil {
+		return 0, err
+	}
+	<-stderrDone
+	if err := cmd.Wait(); err != nil {
+		return cpuTime(cmd), fmt.Errorf("ffmpeg failed: %v", err)
+	}
+	return cpuTime(cmd), nil
+}
+
+var (
+	// probeCache holds probes by hlsCacheKey; probeOrder has the most recently used first
+	probeCache     = make(map[string]*list.Element)
+	probeOrder     = list.New()
+	probeCacheLock sync.Mutex
+
+	// hlsFlights shares a segment that is being generated between every viewer asking for it
+	hlsFlights     = make(map[string]*hlsFlight)
+	hlsFlightsLock sync.Mutex
+)
+
+type hlsFlight struct {
+	done    chan struct{}
+	err     error
+	waiters int                // Guarded by hlsFlightsLock
+	cancel  context.CancelFunc // Stops the run
+}
+
+// cacheOptions controls a cachedFile run
+type cacheOptions struct {
+	timeout time.Duration
+	// abandon stops the run once every caller waiting for it has gone
+	abandon bool
+}
+
+// HLSCacheDir returns the directory transcoded segments are cached in
+func HLSCacheDir() string {
+	return filepath.Join(ConfigPath(), "cache", "hls")
+}
+
+// hlsCacheKey identifies a source file by path, size and modification time, so a
+// replaced file never serves stale segments.
+func hlsCacheKey(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", path, info.Size(), info.ModTime().UnixNano())))
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// probeVideo returns (and memoizes) the duration and frame size of a file
+func probeVideo(path string) (VideoInfo, error) {
+	key, err := hlsCacheKey(path)
+	if err != nil {
+		return VideoInfo{}, err
+	}
+	probeCacheLock.Lock()
+	if e, ok := probeCache[key]; ok {
+		probeOrder.MoveToFront(e)
+		info := e.Value.(probedVideo).info
+		probeCacheLock.Unlock()
+		return info, nil
+	}
+	probeCacheLock.Unlock()
+
+	info, err := videoProber(path)
+	if err != nil {
+		return VideoInfo{}, err
+	}
+	probeCacheLock.Lock()
+	if _, ok := probeCache[key]; !ok {
+		probeCache[key] = probeOrder.PushFront(probedVideo{key, info})
+		for probeOrder.Len() > maxProbeCacheEntries {
+			oldest := probeOrder.Back()
+			probeOrder.Remove(oldest)
+			delete(probeCache, oldest.Value.(probedVideo).key)
+		}
+	}
+	probeCacheLock.Unlock()
+	return info, nil
+}
+
+type probedVideo struct {
+	key  string
+	info VideoInfo
+}
+
+// hlsRenditions lists the qualityMap renditions worth offering for a source, lowest
+// first. Renditions taller than the source would only upscale, so they are skipped;
+// the smallest is always offered.
+func hlsRenditions(info VideoInfo) []string {
+	var names []string
+	for name := range qualityMap {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return qualityMap[names[i]].Height < qualityMap[names[j]].Height })
+
+	var renditions []string
+	for i, name := range names {
+		if i == 0 || info.Height == 0 || qualityMap[name].Height <= info.Height {
+			renditions = append(renditions, name)
+		}
+	}
+	return renditions
+}
+
+// bitrateBits converts an ffmpeg bitrate such as "2M" or "800k" to bits per second
+func bitrateBits(rate string) int {
+	mult := 1.0
+	switch {
+	case strings.HasSuffix(rate, "M"):
+		mult, rate = 1e6, strings.TrimSuffix(rate, "M")
+	case strings.HasSuffix(rate, "k"):
+		mult, rate = 1e3, strings.TrimSuffix(rate, "k")
+	}
+	v, _ := strconv.ParseFloat(rate, 64)
+	return int(v * mult)
+}
+
+// hlsSegmentCount returns the number of segments a file of the given duration has
+func hlsSegmentCount(duration float64) int {
+	return int(math.Ceil(duration/HLSSegmentDuration - 1e-6))
+}
+
+// HLSMasterPlaylist lists the renditions of a file. uriSuffix (e.g. a query string)
+// is appended to every URI so players that can't set headers stay authenticated.
+func HLSMasterPlaylist(path, uriSuffix string) (string, error) {
+	info, err := probeVideo(path)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, name := range hlsRenditions(info) {
+		q := qualityMap[name]
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", bitrateBits(q.Bitrate))
+		if info.Width > 0 && info.Height > 0 {
+			// Matches scale=-2:HEIGHT: aspect ratio kept, width rounded to even
+			width := int(math.Round(float64(info.Width)*float64(q.Height)/float64(info.Height)/2)) * 2
+			fmt.Fprintf(&b, ",RESOLUTION=%dx%d", width, q.Height)
+		}
+		fmt.Fprintf(&b, ",NAME=\"%s\"\n%s/index.m3u8%s\n", name, name, uriSuffix)
+	}
+	return b.String(), nil
+}
+
+// HLSMediaPlaylist lists the segments of one rendition of a file
+func HLSMediaPlaylist(path, rendition, uriSuffix string) (string, error) {
+	if _, ok := qualityMap[rendition]; !ok {
+		return "", ErrUnknownRendition
+	}
+	info, err := probeVideo(path)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n",
+		int(math.Ceil(HLSSegmentDuration)))
+	count := hlsSegmentCount(info.Duration)
+	for i := 0; i < count; i++ {
+		length := math.Min(HLSSegmentDuration, info.Duration-float64(i)*HLSSegmentDuration)
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%05d.ts%s\n", length, i, uriSuffix)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String(), nil
+}
+
+// hlsSegmentArgs transcodes [start, start+length) of input to an MPEG-TS segment.
+// Timestamps are offset by start so segments line up on the playlist timeline.
+func hlsSegmentArgs(input string, q TranscodeQuality, start, length float64, output string) []string {
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	if hasNvenc {
+		args = append(args, "-hwaccel", "cuda")
+	}
+	args = append(args, "-ss", fmt.Sprintf("%.3f", start), "-i", input, "-t", fmt.Sprintf("%.3f", length), "-an")
+	args = append(args, transcodeVideoArgs(q)...)
+	args = append(args, "-output_ts_offset", fmt.Sprintf("%.3f", start), "-muxdelay", "0", "-f", "mpegts", "-y", output)
+	return args
+}
+
+// HLSSegment returns the path of a cached segment, transcoding it first if needed.
+// Transcodes go through the scheduler and fail with ErrTranscoderBusy when it is full;
+// opts.Focused moves the segment ahead of other cameras.
+func HLSSegment(ctx context.Context, path, rendition string, index int, opts TranscodeOptions) (string, error) {
+	q, ok := qualityMap[rendition]
+	if !ok {
+		return "", ErrUnknownRendition
+	}
+	info, err := probeVideo(path)
+	if err != nil {
+		return "", err
+	}
+	if index < 0 || index >= hlsSegmentCount(info.Duration) {
+		return "", ErrSegmentNotFound
+	}
+	key, err := hlsCacheKey(path)
+	if err != nil {
+		return "", err
+	}
+	output := filepath.Join(HLSCacheDir(), key, rendition, fmt.Sprintf("%05d.ts", index))
+
+	start := float64(index) * HLSSegmentDuration
+	length := math.Min(HLSSegmentDuration, info.Duration-start)
+	// Segments are shared between viewers, so no session replaces another's
+	job := &transcodeJob{file: filepath.Base(path), quality: rendition, opts: TranscodeOptions{Focused: opts.Focused}}
+	return cachedSegment(ctx, output, job, func(tmp string) []string {
+		return hlsSegmentArgs(path, q, start, length, tmp)
+	})
+}
+
+// cachedSegment returns output if it is cached, otherwise runs ffmpeg with args(tmp)
+// and renames the result into place. A non-nil job waits for a transcoder slot first;
+// remuxes (nil) are cheap enough to run unscheduled. Concurrent callers for the same output share one
+// run; ctx only bounds how long this caller waits, so a viewer leaving doesn't abort
+// it for the others.
+func cachedSegment(ctx context.Context, output string, job *transcodeJob, args func(tmp string) []string) (string, error) {
+	return cachedFile(ctx, output, job, cacheOptions{timeout: hlsSegmentTimeout}, args)
+}
+
+// cachedFile is cachedSegment with a configurable timeout and abandonment
+func cachedFile(ctx context.Context, output string, job *transcodeJob, opts cacheOptions, args func(tmp string) []string) (string, error) {
+	hlsFlightsLock.Lock()
+	if fi, err := os.Stat(output); err == nil && fi.Size() > 0 {
+		hlsFlightsLock.Unlock()
+		// Touch so eviction drops the least recently watched files first
+		now := time.Now()
+		os.Chtimes(output, now, now)
+		return output, nil
+	}
+	flight, running := hlsFlights[output]
+	if !running {
+		runCtx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+		flight = &hlsFlight{done: make(chan struct{}), cancel: cancel}
+		hlsFlights[output] = flight
+		go func() {
+			defer cancel()
+			flight.err = generateSegment(runCtx, output, job, args)
+			hlsFlightsLock.Lock()
+			delete(hlsFlights, output)
+			hlsFlightsLock.Unlock()
+			close(flight.done)
+		}()
+	}
+	flight.waiters++
+	hlsFlightsLock.Unlock()
+
+	select {
+	case <-flight.done:
+		if flight.err != nil {
+			return "", flight.err
+		}
+		return output, nil
+	case <-ctx.Done():
+		hlsFlightsLock.Lock()
+		flight.waiters--
+		if opts.abandon && flight.waiters == 0 {
+			flight.cancel()
+		}
+		hlsFlightsLock.Unlock()
+		return "", ctx.Err()
+	}
+}
+
+// generateSegment encodes to a temporary file and renames it into place, so a
+// partially written file is never served. It returns ctx's error if ctx ended the run.
+func generateSegment(ctx context.Context, output string, job *transcodeJob, args func(tmp string) []string) error {
+	AutoDetectEncoder()
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return err
+	}
+	if job != nil {
+		if err := scheduler().acquire(ctx, job); err != nil {
+			return err
+		}
+	}
+
+	tmp := output + ".tmp"
+	cpu, err := hlsEncoder(ctx, args(tmp), job)
+	if job != nil {
+		scheduler().release(job, cpu)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		log.Printf("Generating %s failed: %v", output, err)
+		return err
+	}
+	return os.Rename(tmp, output)
+}
+
+// EvictHLSCache removes segments not watched within HLS_CACHE_MAX_AGE_HOURS, then the
+// least recently watched ones until the cache fits HLS_CACHE_MB.
+func EvictHLSCache(now time.Time) {
+	maxAge := time.Duration(envInt("HLS_CACHE_MAX_AGE_HOURS", defaultHLSCacheMaxAgeHr)) * time.Hour
+	quota := int64(envInt("HLS_CACHE_MB", defaultHLSCacheMB)) * 1024 * 1024
+	evictCache(HLSCacheDir(), maxAge, quota, now)
+}
+
+// evictCache removes files under root older than maxAge, then the least recently used
+// ones until the rest fits quota (0 disables either limit). It returns how many
+// files were removed.
+func evictCache(root string, maxAge time.Duration, quota int64, now time.Time) int {
+	type cached struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []cached
+	var total int64
+	removed := 0
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(path, ".tmp") {
+			// Leftovers of a crash; in-flight runs are much younger
+			if now.Sub(info.ModTime()) > hlsStaleTempFileAge {
+				os.Remove(path)
+			}
+			return nil
+		}
+		if maxAge > 0 && now.Sub(info.ModTime()) > maxAge {
+			if os.Remove(path) == nil {
+				removed++
+			}
+			return nil
+		}
+		files = append(files, cached{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+
+	if quota > 0 && total > quota {
+		sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+		for _, f := range files {
+			if total <= quota {
+				break
+			}
+			if os.Remove(f.path) == nil {
+				total -= f.size
+				removed++
+			}
+		}
+	}
+
+	removeEmptyDirs(root)
+	return removed
+}
+
+// removeEmptyDirs deletes empty directories below root (but not root itself). A
+// run creates its directory before it has written anything there, so the
+// directories of runs in flight are kept; holding hlsFlightsLock keeps new runs
+// from starting until the removal is done.
+func removeEmptyDirs(root string) {
+	var dirs []string
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+
+	hlsFlightsLock.Lock()
+	defer hlsFlightsLock.Unlock()
+	busy := make(map[string]bool)
+	for output := range hlsFlights {
+		for dir := filepath.Dir(output); len(dir) > len(root); dir = filepath.Dir(dir) {
+			busy[dir] = true
+		}
+	}
+	// Deepest first, so parents empty out before they are checked
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if !busy[dirs[i]] {
+			os.Remove(dirs[i]) // Fails harmlessly when not empty
+		}
+	}
+}
+
+// StartCacheJanitor evicts old HLS segments and thumbnails in the background
+func StartCacheJanitor() {
+	go func() {
+		for {
+			EvictHLSCache(time.Now())
+			EvictThumbnailCache(time.Now())
+			time.Sleep(hlsJanitorInterval)
+		}
+	}()
+}
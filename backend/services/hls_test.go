@@ -0,0 +1,197 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubHLS fakes ffprobe and ffmpeg; the encoder writes the segment and counts runs
+func stubHLS(t *testing.T, info VideoInfo) (string, *int32) {
+	configDir := t.TempDir()
+	os.Setenv("CONFIG_PATH", configDir)
+	t.Cleanup(func() { os.Unsetenv("CONFIG_PATH") })
+
+	source := filepath.Join(t.TempDir(), "2024-07-01_03-00-00-front.mp4")
+	os.WriteFile(source, []byte("front footage"), 0644)
+
+	var runs int32
+	originalProber, originalEncoder := videoProber, hlsEncoder
+	videoProber = func(path string) (VideoInfo, error) { return info, nil }
+	hlsEncoder = func(ctx context.Context, args []string, job *transcodeJob) (time.Duration, error) {
+		atomic.AddInt32(&runs, 1)
+		time.Sleep(50 * time.Millisecond)
+		return time.Second, os.WriteFile(args[len(args)-1], []byte("segment"), 0644)
+	}
+	t.Cleanup(func() { videoProber, hlsEncoder = originalProber, originalEncoder })
+	return source, &runs
+}
+
+func TestHLSMasterPlaylist(t *testing.T) {
+	source, _ := stubHLS(t, VideoInfo{Duration: 60, Width: 1280, Height: 960})
+
+	playlist, err := HLSMasterPlaylist(source, "?token=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1080p would upscale a 960p camera, so only 480p and 720p are offered, lowest first
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=640x480,NAME=\"480p\"\n480p/index.m3u8?token=abc\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=960x720,NAME=\"720p\"\n720p/index.m3u8?token=abc\n"
+	if playlist != want {
+		t.Errorf("Unexpected master playlist:\n%s", playlist)
+	}
+}
+
+func TestHLSMediaPlaylist(t *testing.T) {
+	source, _ := stubHLS(t, VideoInfo{Duration: 10.5, Width: 1280, Height: 960})
+
+	playlist, err := HLSMediaPlaylist(source, "720p", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"#EXT-X-TARGETDURATION:4\n", "#EXTINF:4.000,\n00000.ts\n", "#EXTINF:2.500,\n00002.ts\n", "#EXT-X-ENDLIST\n"} {
+		if !strings.Contains(playlist, want) {
+			t.Errorf("Expected playlist to contain %q:\n%s", want, playlist)
+		}
+	}
+	if strings.Count(playlist, "#EXTINF") != 3 {
+		t.Errorf("Expected 3 segments:\n%s", playlist)
+	}
+
+	if _, err := HLSMediaPlaylist(source, "4k", ""); err != ErrUnknownRendition {
+		t.Errorf("Expected ErrUnknownRendition, got %v", err)
+	}
+}
+
+func TestHLSSegmentArgs(t *testing.T) {
+	args := strings.Join(hlsSegmentArgs("/footage/front.mp4", qualityMap["720p"], 8, 4, "/cache/00002.ts"), " ")
+	for _, want := range []string{"-ss 8.000 -i /footage/front.mp4 -t 4.000", "scale=-2:720", "-output_ts_offset 8.000", "-f mpegts -y /cache/00002.ts"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("Expected %q in %s", want, args)
+		}
+	}
+}
+
+func TestHLSSegment_SharedAndCached(t *testing.T) {
+	source, runs := stubHLS(t, VideoInfo{Duration: 60, Height: 960})
+
+	var wg sync.WaitGroup
+	paths := make([]string, 5)
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p, err := HLSSegment(context.Background(), source, "480p", 3, TranscodeOptions{})
+			if err != nil {
+				t.Error(err)
+			}
+			paths[i] = p
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(runs); n != 1 {
+		t.Errorf("Expected concurrent viewers to share one transcode, got %d", n)
+	}
+	if paths[0] == "" || paths[0] != paths[4] || !strings.HasPrefix(paths[0], HLSCacheDir()) || filepath.Base(paths[0]) != "00003.ts" {
+		t.Errorf("Unexpected segment paths %v", paths)
+	}
+
+	// Served from disk from now on
+	if _, err := HLSSegment(context.Background(), source, "480p", 3, TranscodeOptions{}); err != nil || atomic.LoadInt32(runs) != 1 {
+		t.Errorf("Expected a cache hit, err=%v runs=%d", err, atomic.LoadInt32(runs))
+	}
+	// Another rendition is cached separately
+	if p, _ := HLSSegment(context.Background(), source, "720p", 3, TranscodeOptions{}); p == paths[0] || atomic.LoadInt32(runs) != 2 {
+		t.Errorf("Expected a separate 720p segment, got %s", p)
+	}
+
+	if _, err := HLSSegment(context.Background(), source, "480p", 15, TranscodeOptions{}); err != ErrSegmentNotFound {
+		t.Errorf("Expected ErrSegmentNotFound past the end, got %v", err)
+	}
+}
+
+func TestHLSSegment_ViewerLeaves(t *testing.T) {
+	source, runs := stubHLS(t, VideoInfo{Duration: 60, Height: 960})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := HLSSegment(ctx, source, "480p", 0, TranscodeOptions{}); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	// The transcode carries on for the next viewer
+	if _, err := HLSSegment(context.Background(), source, "480p", 0, TranscodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(runs); n != 1 {
+		t.Errorf("Expected a single transcode, got %d", n)
+	}
+}
+
+func TestHLSCacheKeyChangesWithFile(t *testing.T) {
+	source, _ := stubHLS(t, VideoInfo{Duration: 60, Height: 960})
+	before, _ := hlsCacheKey(source)
+	os.WriteFile(source, []byte("replaced footage, longer"), 0644)
+	after, _ := hlsCacheKey(source)
+	if before == after {
+		t.Error("Expected a new cache key when the source changes")
+	}
+}
+
+func TestEvictHLSCache(t *testing.T) {
+	stubHLS(t, VideoInfo{})
+	os.Setenv("HLS_CACHE_MB", "1")
+	os.Setenv("HLS_CACHE_MAX_AGE_HOURS", "24")
+	t.Cleanup(func() { os.Unsetenv("HLS_CACHE_MB"); os.Unsetenv("HLS_CACHE_MAX_AGE_HOURS") })
+
+	now := time.Now()
+	write := func(rel string, size int, age time.Duration) string {
+		p := filepath.Join(HLSCacheDir(), rel)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, make([]byte, size), 0644)
+		os.Chtimes(p, now.Add(-age), now.Add(-age))
+		return p
+	}
+	expired := write("aaaa/480p/00000.ts", 10, 48*time.Hour)
+	oldest := write("bbbb/480p/00000.ts", 600*1024, 3*time.Hour)
+	newest := write("bbbb/480p/00001.ts", 600*1024, time.Hour)
+	inFlight := write("bbbb/480p/00002.ts.tmp", 10, time.Minute)
+	stale := write("bbbb/480p/00003.ts.tmp", 10, 2*time.Hour)
+	// A run that created its directory but hasn't written to it yet
+	starting := filepath.Join(HLSCacheDir(), "cccc", "720p")
+	os.MkdirAll(starting, 0755)
+	hlsFlightsLock.Lock()
+	hlsFlights[filepath.Join(starting, "00000.ts")] = &hlsFlight{done: make(chan struct{})}
+	hlsFlightsLock.Unlock()
+	t.Cleanup(func() {
+		hlsFlightsLock.Lock()
+		delete(hlsFlights, filepath.Join(starting, "00000.ts"))
+		hlsFlightsLock.Unlock()
+	})
+
+	EvictHLSCache(now)
+
+	for _, p := range []string{expired, oldest, stale} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be evicted", p)
+		}
+	}
+	for _, p := range []string{newest, inFlight} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("Expected %s to be kept", p)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(HLSCacheDir(), "aaaa")); !os.IsNotExist(err) {
+		t.Error("Expected empty cache directories to be removed")
+	}
+	if _, err := os.Stat(starting); err != nil {
+		t.Error("Expected the directory of a run in flight to be kept")
+	}
+}
@@ -0,0 +1,278 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+// Mask modes
+const (
+	MaskModeBlur     = "blur"
+	MaskModePixelate = "pixelate"
+)
+
+const (
+	// MaxMasksPerExport bounds the size of the generated filter graph
+	MaxMasksPerExport = 32
+	// MaxMaskKeyframes bounds the number of positions a single region can take
+	MaxMaskKeyframes = 120
+
+	maskBlurSigma      = 25
+	maskPixelBlockSize = 16
+)
+
+// MaskKeyframe moves a region at Time seconds (relative to the start of the export).
+// The region holds its position until the next keyframe.
+type MaskKeyframe struct {
+	Time   float64 `json:"time"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// MaskRegion hides a rectangle of one camera. Coordinates are fractions (0-1) of the
+// camera frame so masks don't depend on the source resolution.
+type MaskRegion struct {
+	Camera string  `json:"camera"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+	Mode   string  `json:"mode,omitempty"` // "blur" (default) or "pixelate"
+
+	// Optional time bounds, in seconds relative to the start of the export
+	Start *float64 `json:"start,omitempty"`
+	End   *float64 `json:"end,omitempty"`
+
+	// Keyframes, when present, replace X/Y/Width/Height over time
+	Keyframes []MaskKeyframe `json:"keyframes,omitempty"`
+}
+
+// validRect checks that a normalised rectangle lies within the frame
+func validRect(x, y, w, h float64) error {
+	if w <= 0 || h <= 0 || x < 0 || y < 0 || x+w > 1 || y+h > 1 {
+		return fmt.Errorf("mask rectangle must lie within the frame (0-1)")
+	}
+	return nil
+}
+
+// ValidateMaskMode checks a mask mode; empty means blur
+func ValidateMaskMode(mode string) error {
+	switch mode {
+	case "", MaskModeBlur, MaskModePixelate:
+		return nil
+	}
+	return fmt.Errorf("invalid mask mode: %s", mode)
+}
+
+// Validate enforces bounds on a mask region. Every value ends up in an ffmpeg
+// filter graph, so only numbers and allowlisted names are accepted.
+func (m *MaskRegion) Validate() error {
+	if err := ValidateCameras([]string{m.Camera}); err != nil {
+		return err
+	}
+	if err := ValidateMaskMode(m.Mode); err != nil {
+		return err
+	}
+	if m.Start != nil && *m.Start < 0 {
+		return fmt.Errorf("mask start cannot be negative")
+	}
+	if m.Start != nil && m.End != nil && *m.End <= *m.Start {
+		return fmt.Errorf("mask end must be after start")
+	}
+
+	if len(m.Keyframes) == 0 {
+		return validRect(m.X, m.Y, m.Width, m.Height)
+	}
+	if len(m.Keyframes) > MaxMaskKeyframes {
+		return fmt.Errorf("a mask cannot have more than %d keyframes", MaxMaskKeyframes)
+	}
+	for i, kf := range m.Keyframes {
+		if kf.Time < 0 || (i > 0 && kf.Time <= m.Keyframes[i-1].Time) {
+			return fmt.Errorf("mask keyframe times must be increasing and non-negative")
+		}
+		if err := validRect(kf.X, kf.Y, kf.Width, kf.Height); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateMasks checks all regions of an export request
+func ValidateMasks(masks []MaskRegion) error {
+	if len(masks) > MaxMasksPerExport {
+		return fmt.Errorf("an export cannot have more than %d masks", MaxMasksPerExport)
+	}
+	for i := range masks {
+		if err := masks[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maskSpan is one rectangle shown during [start, end); end < 0 means until the end
+type maskSpan struct {
+	x, y, w, h float64
+	start, end float64
+	mode       string
+}
+
+// spans expands a region (and its keyframes) into fixed rectangles with time bounds
+func (m MaskRegion) spans() []maskSpan {
+	start, end := 0.0, -1.0
+	if m.Start != nil {
+		start = *m.Start
+	}
+	if m.End != nil {
+		end = *m.End
+	}
+	mode := m.Mode
+	if mode == "" {
+		mode = MaskModeBlur
+	}
+
+	if len(m.Keyframes) == 0 {
+		return []maskSpan{{m.X, m.Y, m.Width, m.Height, start, end, mode}}
+	}
+
+	var spans []maskSpan
+	for i, kf := range m.Keyframes {
+		s, e := kf.Time, end
+		if i+1 < len(m.Keyframes) {
+			e = m.Keyframes[i+1].Time
+		}
+		// Clip to the region's own time bounds
+		if s < start {
+			s = start
+		}
+		if end >= 0 && e > end {
+			e = end
+		}
+		if e >= 0 && e <= s {
+			continue
+		}
+		spans = append(spans, maskSpan{kf.X, kf.Y, kf.Width, kf.Height, s, e, mode})
+	}
+	return spans
+}
+
+// maskFilter hides the given regions of input label in and writes the result to out.
+// Each span crops its rectangle, blurs or pixelates it and overlays it back in place,
+// enabled only during its time window. Rectangles are truncated to whole pixels the
+// same way for the crop and the overlay so they line up exactly.
+func maskFilter(in string, regions []MaskRegion, out string, prefix string) string {
+	var spans []maskSpan
+	for _, r := range regions {
+		spans = append(spans, r.spans()...)
+	}
+	if len(spans) == 0 {
+		return fmt.Sprintf("%snull%s", in, out)
+	}
+
+	var parts []string
+	current := in
+	for i, s := range spans {
+		base := fmt.Sprintf("[%sb%d]", prefix, i)
+		patch := fmt.Sprintf("[%sp%d]", prefix, i)
+		masked := fmt.Sprintf("[%sm%d]", prefix, i)
+		next := fmt.Sprintf("[%sc%d]", prefix, i)
+		if i == len(spans)-1 {
+			next = out
+		}
+
+		var crop, effect string
+		if s.mode == MaskModePixelate {
+			// Whole blocks only, so downscaling and upscaling returns the exact crop size
+			crop = fmt.Sprintf("crop=w='max(%d,trunc(iw*%g/%d)*%d)':h='max(%d,trunc(ih*%g/%d)*%d)':x='trunc(iw*%g)':y='trunc(ih*%g)'",
+				maskPixelBlockSize, s.w, maskPixelBlockSize, maskPixelBlockSize, maskPixelBlockSize, s.h, maskPixelBlockSize, maskPixelBlockSize, s.x, s.y)
+			effect = fmt.Sprintf("scale=iw/%d:ih/%d:flags=area,scale=iw*%d:ih*%d:flags=neighbor",
+				maskPixelBlockSize, maskPixelBlockSize, maskPixelBlockSize, maskPixelBlockSize)
+		} else {
+			crop = fmt.Sprintf("crop=w='max(2,trunc(iw*%g))':h='max(2,trunc(ih*%g))':x='trunc(iw*%g)':y='trunc(ih*%g)'", s.w, s.h, s.x, s.y)
+			effect = fmt.Sprintf("gblur=sigma=%d:steps=3", maskBlurSigma)
+		}
+
+		enable := fmt.Sprintf("gte(t,%g)", s.start)
+		if s.end >= 0 {
+			enable = fmt.Sprintf("between(t,%g,%g)", s.start, s.end)
+		}
+
+		parts = append(parts,
+			fmt.Sprintf("%ssplit%s%s", current, base, patch),
+			fmt.Sprintf("%s%s,%s%s", patch, crop, effect, masked),
+			fmt.Sprintf("%s%soverlay=x='trunc(W*%g)':y='trunc(H*%g)':enable='%s'%s", base, masked, s.x, s.y, enable, next),
+		)
+		current = next
+	}
+	return strings.Join(parts, ";")
+}
+
+// savedMasks returns the enabled saved masks keyed by normalized camera name
+func savedMasks() map[string][]MaskRegion {
+	result := make(map[string][]MaskRegion)
+	if database.DB == nil {
+		return result
+	}
+	var saved []models.CameraMask
+	database.DB.Where("enabled = ?", true).Order("id asc").Find(&saved)
+	for _, s := range saved {
+		cam := NormalizeCameraName(s.Camera)
+		result[cam] = append(result[cam], MaskRegion{Camera: s.Camera, X: s.X, Y: s.Y, Width: s.Width, Height: s.Height, Mode: s.Mode})
+	}
+	return result
+}
+
+// exportMasks returns the regions to apply per camera: the request's own masks plus,
+// unless disabled, the enabled saved masks. Keys are normalized camera names.
+func exportMasks(req ExportRequest) map[string][]MaskRegion {
+	result := make(map[string][]MaskRegion)
+	if !req.IgnoreSavedMasks {
+		result = savedMasks()
+	}
+	for _, m := range req.Masks {
+		cam := NormalizeCameraName(m.Camera)
+		result[cam] = append(result[cam], m)
+	}
+	return result
+}
+
+// exportFilterGraph builds the filter graph for processExport: each input is masked
+// (if it has masks) and the results are stacked with layoutFilter into [v].
+// Returns "" when a single unmasked input needs no filtering.
+func exportFilterGraph(cameras []string, masks map[string][]MaskRegion) string {
+	if len(cameras) == 1 && len(masks[cameras[0]]) == 0 {
+		return ""
+	}
+
+	var parts []string
+	var labels []string
+	for i, cam := range cameras {
+		label := fmt.Sprintf("[%d:v]", i)
+		if regions := masks[cam]; len(regions) > 0 {
+			masked := fmt.Sprintf("[k%d]", i)
+			parts = append(parts, maskFilter(label, regions, masked, fmt.Sprintf("k%d", i)))
+			label = masked
+		}
+		labels = append(labels, label)
+	}
+	parts = append(parts, layoutFilter(labels, "[v]"))
+	return strings.Join(parts, ";")
+}
+
+// sortedMaskCameras lists the cameras that have masks, for logging
+func sortedMaskCameras(masks map[string][]MaskRegion) []string {
+	var cams []string
+	for cam, regions := range masks {
+		if len(regions) > 0 {
+			cams = append(cams, cam)
+		}
+	}
+	sort.Strings(cams)
+	return cams
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+func floatPtr(f float64) *float64 { return &f }
+
+func TestMaskRegionValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		mask    MaskRegion
+		wantErr bool
+	}{
+		{"Valid blur", MaskRegion{Camera: "back", X: 0.4, Y: 0.7, Width: 0.2, Height: 0.1}, false},
+		{"Valid pixelate with window", MaskRegion{Camera: "Front", X: 0, Y: 0, Width: 1, Height: 0.2, Mode: MaskModePixelate, Start: floatPtr(2), End: floatPtr(5)}, false},
+		{"Outside frame", MaskRegion{Camera: "back", X: 0.9, Y: 0.7, Width: 0.2, Height: 0.1}, true},
+		{"Zero size", MaskRegion{Camera: "back", X: 0.1, Y: 0.1}, true},
+		{"Unknown camera", MaskRegion{Camera: "roof", X: 0.1, Y: 0.1, Width: 0.1, Height: 0.1}, true},
+		{"Unknown mode", MaskRegion{Camera: "back", X: 0.1, Y: 0.1, Width: 0.1, Height: 0.1, Mode: "drawbox"}, true},
+		{"End before start", MaskRegion{Camera: "back", X: 0.1, Y: 0.1, Width: 0.1, Height: 0.1, Start: floatPtr(5), End: floatPtr(5)}, true},
+		{"Keyframes", MaskRegion{Camera: "back", Keyframes: []MaskKeyframe{{Time: 0, X: 0.1, Y: 0.1, Width: 0.1, Height: 0.1}, {Time: 2, X: 0.2, Y: 0.1, Width: 0.1, Height: 0.1}}}, false},
+		{"Unordered keyframes", MaskRegion{Camera: "back", Keyframes: []MaskKeyframe{{Time: 2, X: 0.1, Y: 0.1, Width: 0.1, Height: 0.1}, {Time: 1, X: 0.2, Y: 0.1, Width: 0.1, Height: 0.1}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.mask.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExportRequestRejectsMasksInTimelapse(t *testing.T) {
+	req := ExportRequest{ClipID: 1, Cameras: []string{"back"}, Mode: ExportModeTimelapse, SpeedUp: 10,
+		Masks: []MaskRegion{{Camera: "back", X: 0.1, Y: 0.1, Width: 0.1, Height: 0.1}}}
+	if err := req.Validate(); err == nil {
+		t.Error("Expected per-request masks to be rejected for timelapses")
+	}
+
+	req.Mode, req.SpeedUp, req.Duration = ExportModeClip, 0, 10
+	if err := req.Validate(); err != nil {
+		t.Errorf("Expected masks to be accepted in clip mode: %v", err)
+	}
+}
+
+func TestMaskSpans_Keyframes(t *testing.T) {
+	m := MaskRegion{Camera: "back", End: floatPtr(10), Keyframes: []MaskKeyframe{
+		{Time: 0, X: 0.1, Y: 0.5, Width: 0.1, Height: 0.1},
+		{Time: 4, X: 0.3, Y: 0.5, Width: 0.1, Height: 0.1},
+		{Time: 12, X: 0.5, Y: 0.5, Width: 0.1, Height: 0.1}, // after End: dropped
+	}}
+
+	spans := m.spans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %+v", spans)
+	}
+	if spans[0].start != 0 || spans[0].end != 4 || spans[1].x != 0.3 || spans[1].start != 4 || spans[1].end != 10 {
+		t.Errorf("Unexpected spans: %+v", spans)
+	}
+}
+
+func TestMaskFilter(t *testing.T) {
+	graph := maskFilter("[0:v]", []MaskRegion{
+		{Camera: "back", X: 0.4, Y: 0.7, Width: 0.2, Height: 0.1},
+		{Camera: "back", X: 0.1, Y: 0.1, Width: 0.25, Height: 0.25, Mode: MaskModePixelate, Start: floatPtr(1.5), End: floatPtr(3)},
+	}, "[out]", "k0")
+
+	for _, want := range []string{
+		"[0:v]split[k0b0][k0p0]",
+		"[k0p0]crop=w='max(2,trunc(iw*0.2))':h='max(2,trunc(ih*0.1))':x='trunc(iw*0.4)':y='trunc(ih*0.7)',gblur=sigma=25:steps=3[k0m0]",
+		"[k0b0][k0m0]overlay=x='trunc(W*0.4)':y='trunc(H*0.7)':enable='gte(t,0)'[k0c0]",
+		"[k0c0]split[k0b1][k0p1]",
+		"scale=iw/16:ih/16:flags=area,scale=iw*16:ih*16:flags=neighbor[k0m1]",
+		"enable='between(t,1.5,3)'[out]",
+	} {
+		if !strings.Contains(graph, want) {
+			t.Errorf("Expected filter graph to contain %q, got:\n%s", want, graph)
+		}
+	}
+}
+
+func TestExportFilterGraph(t *testing.T) {
+	masks := map[string][]MaskRegion{"Back": {{Camera: "back", X: 0.4, Y: 0.7, Width: 0.2, Height: 0.1}}}
+
+	if graph := exportFilterGraph([]string{"Front"}, masks); graph != "" {
+		t.Errorf("Expected no filter for a single unmasked camera, got %s", graph)
+	}
+
+	single := exportFilterGraph([]string{"Back"}, masks)
+	if !strings.HasPrefix(single, "[0:v]split") || !strings.HasSuffix(single, "[k0]null[v]") {
+		t.Errorf("Unexpected single-camera graph: %s", single)
+	}
+
+	// The masked camera keeps its position in the grid
+	grid := exportFilterGraph([]string{"Front", "Back", "Left Repeater", "Right Repeater"}, masks)
+	if !strings.Contains(grid, "[1:v]split[k1b0][k1p0]") || !strings.HasSuffix(grid, "[0:v][k1][2:v][3:v]xstack=inputs=4:layout=0_0|w0_0|0_h0|w0_h0[v]") {
+		t.Errorf("Unexpected grid graph: %s", grid)
+	}
+}
+
+func TestSavedMasksAppliedToExports(t *testing.T) {
+	setupExportDB(t)
+	database.DB.AutoMigrate(&models.CameraMask{})
+	database.DB.Create(&models.CameraMask{Name: "Plate", Camera: "back", X: 0.4, Y: 0.8, Width: 0.2, Height: 0.1, Mode: MaskModeBlur, Enabled: true})
+	database.DB.Create(&models.CameraMask{Name: "Old", Camera: "front", X: 0.1, Y: 0.1, Width: 0.1, Height: 0.1, Mode: MaskModeBlur, Enabled: false})
+
+	req := ExportRequest{Masks: []MaskRegion{{Camera: "Left Repeater", X: 0.1, Y: 0.1, Width: 0.1, Height: 0.1}}}
+	masks := exportMasks(req)
+	if len(masks["Back"]) != 1 || len(masks["Front"]) != 0 || len(masks["Left Repeater"]) != 1 {
+		t.Errorf("Unexpected masks: %+v", masks)
+	}
+
+	req.IgnoreSavedMasks = true
+	if masks := exportMasks(req); len(masks["Back"]) != 0 {
+		t.Errorf("Expected saved masks to be skipped, got %+v", masks)
+	}
+
+	// Timelapse chunks mask real footage but not the black filler tiles
+	seg := timelapseSegment{Start: time.Now(), Duration: 60, Files: map[string]string{"Back": "/footage/back.mp4"}}
+	args := strings.Join(timelapseChunkArgs(seg, timeWindow{Start: 0, End: 60}, []string{"Front", "Back"}, savedMasks(), 10, nil, "/tmp/out.mp4"), " ")
+	if !strings.Contains(args, "[1:v]split[k1b0][k1p0]") || strings.Contains(args, "[0:v]split") {
+		t.Errorf("Unexpected timelapse masking: %s", args)
+	}
+}
@@ -0,0 +1,401 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"strings"
+)
+
+// A deliberately small PDF writer: A4 pages, the standard Helvetica fonts (never embedded,
+// so no font files or services are needed), strokes and JPEG images (embedded as-is).
+// Coordinates are in points with the origin at the top-left, like the SVG renderers.
+
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+)
+
+type pdfImage struct {
+	data          []byte
+	width, height int
+	colorSpace    string
+}
+
+type pdfPage struct {
+	content bytes.Buffer
+	images  []pdfImage
+}
+
+type pdfDocument struct {
+	pages []*pdfPage
+}
+
+func (d *pdfDocument) newPage() *pdfPage {
+	p := &pdfPage{}
+	d.pages = append(d.pages, p)
+	return p
+}
+
+// pdfText encodes s as a PDF literal string in WinAnsi; unsupported runes become '?'
+func pdfText(s string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// text draws s with its baseline at y
+func (p *pdfPage) text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&p.content, "BT /%s %.1f Tf %.2f %.2f Td %s Tj ET\n", font, size, x, pdfPageHeight-y, pdfText(s))
+}
+
+func (p *pdfPage) strokeColor(r, g, b float64) {
+	fmt.Fprintf(&p.content, "%.3f %.3f %.3f RG\n", r, g, b)
+}
+
+func (p *pdfPage) fillColor(r, g, b float64) {
+	fmt.Fprintf(&p.content, "%.3f %.3f %.3f rg\n", r, g, b)
+}
+
+func (p *pdfPage) polyline(pts [][2]float64, width float64) {
+	if len(pts) < 2 {
+		return
+	}
+	fmt.Fprintf(&p.content, "%.2f w 1 j\n%.2f %.2f m\n", width, pts[0][0], pdfPageHeight-pts[0][1])
+	for _, pt := range pts[1:] {
+		fmt.Fprintf(&p.content, "%.2f %.2f l\n", pt[0], pdfPageHeight-pt[1])
+	}
+	p.content.WriteString("S\n")
+}
+
+func (p *pdfPage) line(x1, y1, x2, y2, width float64) {
+	p.polyline([][2]float64{{x1, y1}, {x2, y2}}, width)
+}
+
+// rect strokes (or fills) a rectangle whose top-left corner is x, y
+func (p *pdfPage) rect(x, y, w, h float64, fill bool) {
+	op := "S"
+	if fill {
+		op = "f"
+	}
+	fmt.Fprintf(&p.content, "0.5 w %.2f %.2f %.2f %.2f re %s\n", x, pdfPageHeight-y-h, w, h, op)
+}
+
+// circle approximates a circle with four Bezier curves
+func (p *pdfPage) circle(cx, cy, r, width float64, fill bool) {
+	const k = 0.5523
+	y := pdfPageHeight - cy
+	fmt.Fprintf(&p.content, "%.2f w %.2f %.2f m\n", width, cx+r, y)
+	fmt.Fprintf(&p.content, "%.2f %.2f %.2f %.2f %.2f %.2f c\n", cx+r, y+k*r, cx+k*r, y+r, cx, y+r)
+	fmt.Fprintf(&p.content, "%.2f %.2f %.2f %.2f %.2f %.2f c\n", cx-k*r, y+r, cx-r, y+k*r, cx-r, y)
+	fmt.Fprintf(&p.content, "%.2f %.2f %.2f %.2f %.2f %.2f c\n", cx-r, y-k*r, cx-k*r, y-r, cx, y-r)
+	fmt.Fprintf(&p.content, "%.2f %.2f %.2f %.2f %.2f %.2f c\n", cx+k*r, y-r, cx+r, y-k*r, cx+r, y)
+	if fill {
+		p.content.WriteString("f\n")
+	} else {
+		p.content.WriteString("S\n")
+	}
+}
+
+// image places a baseline JPEG scaled to w x h with its top-left corner at x, y
+func (p *pdfPage) image(data []byte, x, y, w, h float64) error {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	colorSpace := "DeviceRGB"
+	if cfg.ColorModel == color.GrayModel {
+		colorSpace = "DeviceGray"
+	}
+	p.images = append(p.images, pdfImage{data: data, width: cfg.Width, height: cfg.Height, colorSpace: colorSpace})
+	fmt.Fprintf(&p.content, "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", w, h, x, pdfPageHeight-y-h, len(p.images))
+	return nil
+}
+
+// write serialises the document with a cross-reference table
+func (d *pdfDocument) write(w io.Writer) error {
+	var buf bytes.Buffer
+	var offsets []int
+	obj := func(body string, stream []byte) int {
+		offsets = append(offsets, buf.Len())
+		id := len(offsets)
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\n", id, body)
+		if stream != nil {
+			buf.WriteString("stream\n")
+			buf.Write(stream)
+			buf.WriteString("\nendstream\n")
+		}
+		buf.WriteString("endobj\n")
+		return id
+	}
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Object numbers are fixed up front: 1 catalog, 2 page tree, 3-4 fonts
+	obj("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	pagesAt := len(offsets)
+	offsets = append(offsets, 0) // Page tree is written last, once the kids are known
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>", nil)
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>", nil)
+
+	var kids []string
+	for _, page := range d.pages {
+		var xobjects []string
+		for i, img := range page.images {
+			id := obj(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /%s /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>",
+				img.width, img.height, img.colorSpace, len(img.data)), img.data)
+			xobjects = append(xobjects, fmt.Sprintf("/Im%d %d 0 R", i+1, id))
+		}
+		content := page.content.Bytes()
+		contentID := obj(fmt.Sprintf("<< /Length %d >>", len(content)), content)
+		pageID := obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Contents %d 0 R /Resources << /Font << /F1 3 0 R /F2 4 0 R >> /XObject << %s >> >> >>",
+			pdfPageWidth, pdfPageHeight, contentID, strings.Join(xobjects, " ")), nil)
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageID))
+	}
+
+	offsets[pagesAt] = buf.Len()
+	fmt.Fprintf(&buf, "2 0 obj\n<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(kids, " "), len(kids))
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// reportLayout flows report content down A4 pages, breaking when a block doesn't fit
+type reportLayout struct {
+	doc  *pdfDocument
+	page *pdfPage
+	y    float64
+}
+
+const (
+	pdfMargin      = 40.0
+	pdfContentWide = pdfPageWidth - 2*pdfMargin
+)
+
+func (l *reportLayout) need(h float64) {
+	if l.page == nil || l.y+h > pdfPageHeight-pdfMargin {
+		l.page = l.doc.newPage()
+		l.y = pdfMargin
+	}
+}
+
+func (l *reportLayout) heading(s string) {
+	l.need(40)
+	l.y += 22
+	l.page.text(pdfMargin, l.y, 14, true, s)
+	l.y += 4
+	l.page.strokeColor(0.7, 0.7, 0.7)
+	l.page.line(pdfMargin, l.y, pdfMargin+pdfContentWide, l.y, 0.5)
+	l.page.strokeColor(0, 0, 0)
+	l.y += 14
+}
+
+// row draws a label/value line; long values are wrapped on character count
+func (l *reportLayout) row(label, value string, size float64) {
+	const labelWidth = 110.0
+	perLine := int((pdfContentWide - labelWidth) / (size * 0.5))
+	lines := wrapText(value, perLine)
+	l.need(float64(len(lines)) * (size + 3))
+	l.page.text(pdfMargin, l.y, size, true, label)
+	for _, line := range lines {
+		l.page.text(pdfMargin+labelWidth, l.y, size, false, line)
+		l.y += size + 3
+	}
+}
+
+// para draws wrapped full-width text
+func (l *reportLayout) para(s string, size float64, bold bool) {
+	for _, line := range wrapText(s, int(pdfContentWide/(size*0.5))) {
+		l.need(size + 3)
+		l.page.text(pdfMargin, l.y, size, bold, line)
+		l.y += size + 3
+	}
+}
+
+func (l *reportLayout) note(s string) {
+	l.need(14)
+	l.page.fillColor(0.45, 0.45, 0.45)
+	l.page.text(pdfMargin, l.y, 9, false, s)
+	l.page.fillColor(0, 0, 0)
+	l.y += 14
+}
+
+func wrapText(s string, perLine int) []string {
+	if perLine < 10 {
+		perLine = 10
+	}
+	runes := []rune(s)
+	var lines []string
+	for len(runes) > perLine {
+		cut := perLine
+		for i := perLine; i > 0; i-- {
+			if runes[i] == ' ' {
+				cut = i
+				break
+			}
+		}
+		lines = append(lines, string(runes[:cut]))
+		runes = []rune(strings.TrimLeft(string(runes[cut:]), " "))
+	}
+	return append(lines, string(runes))
+}
+
+// WriteReportPDF renders the incident report as a PDF using only built-in fonts
+func WriteReportPDF(w io.Writer, r *IncidentReport) error {
+	l := &reportLayout{doc: &pdfDocument{}}
+	l.need(0)
+
+	l.page.text(pdfMargin, l.y+18, 20, true, "Incident report")
+	l.y += 34
+	l.note(fmt.Sprintf("Clip %d - generated %s", r.ClipID, r.GeneratedAt.UTC().Format("2006-01-02 15:04:05 MST")))
+
+	l.heading("Event")
+	l.row("Type", r.Event, 10)
+	l.row("Reason", r.Reason, 10)
+	l.row("Time", r.IncidentTime.UTC().Format("2006-01-02 15:04:05 MST"), 10)
+	location := r.City
+	if r.Latitude != 0 || r.Longitude != 0 {
+		location += fmt.Sprintf(" (%.6f, %.6f)", r.Latitude, r.Longitude)
+	}
+	l.row("Location", location, 10)
+	for _, kv := range r.EventData {
+		l.row(kv[0], kv[1], 9)
+	}
+
+	l.heading("Route")
+	const mapH = 280.0
+	if pts, incident, barPx, barMetres := r.routePlot(pdfContentWide, mapH); len(pts) > 0 {
+		l.need(mapH + 20)
+		x0, y0 := pdfMargin, l.y
+		offset := func(in [][2]float64) [][2]float64 {
+			out := make([][2]float64, len(in))
+			for i, p := range in {
+				out[i] = [2]float64{x0 + p[0], y0 + p[1]}
+			}
+			return out
+		}
+		l.page.strokeColor(0.6, 0.6, 0.6)
+		l.page.rect(x0, y0, pdfContentWide, mapH, false)
+		l.page.strokeColor(0.12, 0.44, 0.92)
+		l.page.polyline(offset(pts), 2)
+		l.page.fillColor(0.18, 0.64, 0.31)
+		l.page.circle(x0+pts[0][0], y0+pts[0][1], 4, 1, true)
+		l.page.fillColor(0.33, 0.33, 0.33)
+		l.page.circle(x0+pts[len(pts)-1][0], y0+pts[len(pts)-1][1], 4, 1, true)
+		if incident != nil {
+			l.page.strokeColor(0.82, 0.14, 0.18)
+			l.page.circle(x0+incident[0], y0+incident[1], 7, 2, false)
+		}
+		l.page.strokeColor(0.2, 0.2, 0.2)
+		l.page.line(x0+15, y0+mapH-15, x0+15+barPx, y0+mapH-15, 2)
+		l.page.fillColor(0, 0, 0)
+		l.page.text(x0+15, y0+mapH-21, 8, false, fmt.Sprintf("%g m", barMetres))
+		l.page.text(x0+pdfContentWide-20, y0+14, 9, true, "N")
+		l.y += mapH + 8
+		l.note("Green: start, grey: end, red ring: incident. Drawn from GPS telemetry; no map tiles.")
+	} else {
+		l.note("No GPS telemetry in this window.")
+	}
+
+	l.heading(fmt.Sprintf("Telemetry (+/-%gs)", r.Window))
+	if len(r.Samples) == 0 {
+		l.note("No SEI telemetry in this window.")
+	}
+	const chartH, chartLeft = 90.0, 40.0
+	for _, ch := range r.charts() {
+		if len(r.Samples) == 0 {
+			break
+		}
+		l.need(chartH + 40)
+		l.page.text(pdfMargin, l.y, 10, true, fmt.Sprintf("%s (%s)", ch.Title, ch.Unit))
+		l.y += 8
+		x0, y0, pw := pdfMargin+chartLeft, l.y, pdfContentWide-chartLeft
+		pts, yMin, yMax := ch.plot(r.Window, pw, chartH)
+		for i := range pts {
+			pts[i] = [2]float64{x0 + pts[i][0], y0 + pts[i][1]}
+		}
+		l.page.strokeColor(0.6, 0.6, 0.6)
+		l.page.rect(x0, y0, pw, chartH, false)
+		l.page.strokeColor(0.82, 0.14, 0.18)
+		l.page.line(x0+pw/2, y0, x0+pw/2, y0+chartH, 0.5)
+		l.page.strokeColor(0.12, 0.44, 0.92)
+		l.page.polyline(pts, 1.2)
+		l.page.strokeColor(0, 0, 0)
+		l.page.text(pdfMargin, y0+8, 8, false, fmt.Sprintf("%g", yMax))
+		l.page.text(pdfMargin, y0+chartH, 8, false, fmt.Sprintf("%g", yMin))
+		l.page.text(x0, y0+chartH+10, 8, false, fmt.Sprintf("-%gs", r.Window))
+		l.page.text(x0+pw/2-15, y0+chartH+10, 8, false, "incident")
+		l.page.text(x0+pw-20, y0+chartH+10, 8, false, fmt.Sprintf("+%gs", r.Window))
+		l.y += chartH + 22
+	}
+
+	l.heading("Still frames")
+	if len(r.Frames) == 0 {
+		l.note("No frames available.")
+	}
+	const gap = 10.0
+	frameW := (pdfContentWide - gap) / 2
+	for i := 0; i < len(r.Frames); i += 2 {
+		rowH := 0.0
+		for _, f := range r.Frames[i:min(i+2, len(r.Frames))] {
+			if cfg, err := jpeg.DecodeConfig(bytes.NewReader(f.JPEG)); err == nil && cfg.Width > 0 {
+				rowH = max(rowH, frameW*float64(cfg.Height)/float64(cfg.Width))
+			}
+		}
+		if rowH == 0 {
+			continue
+		}
+		l.need(rowH + 16)
+		for j, f := range r.Frames[i:min(i+2, len(r.Frames))] {
+			x := pdfMargin + float64(j)*(frameW+gap)
+			if cfg, err := jpeg.DecodeConfig(bytes.NewReader(f.JPEG)); err == nil {
+				h := frameW * float64(cfg.Height) / float64(cfg.Width)
+				l.page.image(f.JPEG, x, l.y, frameW, h)
+			}
+			l.page.text(x, l.y+rowH+10, 8, false, f.Camera)
+		}
+		l.y += rowH + 18
+	}
+
+	l.heading("Source files (SHA-256)")
+	for _, f := range r.Files {
+		l.row(f.Camera, fmt.Sprintf("%s  %d bytes", f.Name, f.Size), 8)
+		l.row("", f.SHA256, 8)
+	}
+
+	l.heading("Downloads")
+	for _, link := range r.Links {
+		l.para(link.Label, 9, true)
+		l.para(link.URL, 8, false)
+		l.y += 4
+	}
+
+	return l.doc.write(w)
+}
@@ -0,0 +1,228 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+// Preview layout: event clips show previewEventBefore..previewEventAfter seconds
+// around the trigger from its camera, other clips previewSamples one-second shots
+// spread evenly over the Front camera.
+const (
+	previewEventBefore = 2.0
+	previewEventAfter  = 3.0
+	previewSamples     = 5
+	previewSampleSecs  = 1.0
+	previewWidth       = 320
+	previewFPS         = 10
+)
+
+var ErrNoPreview = errors.New("no playable footage for a preview")
+
+// PreviewFormat is a container for animated previews
+type PreviewFormat struct {
+	Name        string
+	ContentType string
+	Ext         string
+	codec       []string
+}
+
+var (
+	PreviewMP4  = PreviewFormat{"mp4", "video/mp4", ".mp4", []string{"-c:v", "libx264", "-preset", "veryfast", "-crf", "32", "-pix_fmt", "yuv420p", "-movflags", "+faststart", "-f", "mp4"}}
+	PreviewWebP = PreviewFormat{"webp", "image/webp", ".webp", []string{"-c:v", "libwebp", "-loop", "0", "-quality", "50", "-f", "webp"}}
+)
+
+// PreviewFormatByName returns a supported preview format; ok is false for unknown
+// names and for WebP when ffmpeg lacks libwebp.
+func PreviewFormatByName(name string) (PreviewFormat, bool) {
+	switch strings.ToLower(name) {
+	case "", "mp4":
+		return PreviewMP4, true
+	case "webp":
+		return PreviewWebP, thumbnailFormatSupported(ThumbnailWebP)
+	}
+	return PreviewFormat{}, false
+}
+
+// PreviewDir returns where previews are cached, alongside the thumbnails
+func PreviewDir() string {
+	return filepath.Join(ThumbnailDir(), "previews")
+}
+
+// previewShot is one stretch of footage in a preview
+type previewShot struct {
+	Path   string
+	Start  float64 // Seconds into the file
+	Length float64
+}
+
+// previewShots picks the footage of a clip's preview
+func previewShots(clip models.Clip) ([]previewShot, error) {
+	if clip.EventTimestamp != nil {
+		if shot, ok := eventPreviewShot(clip); ok {
+			return []previewShot{shot}, nil
+		}
+	}
+
+	entries, err := planClipStream(clip, "Front")
+	if err == ErrNoCameraFootage && len(clip.VideoFiles) > 0 {
+		entries, err = planClipStream(clip, clip.VideoFiles[0].Camera)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var footage []streamEntry
+	total := 0.0
+	for _, e := range entries {
+		if !e.gap() {
+			footage = append(footage, e)
+			total += e.Duration
+		}
+	}
+	if total == 0 {
+		return nil, ErrNoPreview
+	}
+
+	// Sample the footage itself, so gaps don't waste shots
+	var shots []previewShot
+	for i := 0; i < previewSamples; i++ {
+		at := (float64(i) + 0.5) * total / previewSamples
+		for _, e := range footage {
+			if at < e.Duration {
+				start := math.Max(0, math.Min(at-previewSampleSecs/2, e.Duration-previewSampleSecs))
+				shots = append(shots, previewShot{e.File.FilePath, start, math.Min(previewSampleSecs, e.Duration)})
+				break
+			}
+			at -= e.Duration
+		}
+	}
+	return shots, nil
+}
+
+// eventPreviewShot covers the trigger from the camera that saw it
+func eventPreviewShot(clip models.Clip) (previewShot, bool) {
+	entries, err := planClipStream(clip, triggeringCamera(clip))
+	if err != nil {
+		return previewShot{}, false
+	}
+	at := clip.EventTimestamp.Sub(clipStreamOrigin(clip)).Seconds()
+	for _, e := range entries {
+		if e.gap() || at < e.Offset || at >= e.Offset+e.Duration {
+			continue
+		}
+		start := math.Max(0, at-e.Offset-previewEventBefore)
+		end := math.Min(e.Duration, at-e.Offset+previewEventAfter)
+		return previewShot{e.File.FilePath, start, end - start}, true
+	}
+	return previewShot{}, false
+}
+
+// previewArgs cuts the shots, scales them down and joins them into one silent loop
+func previewArgs(shots []previewShot, format PreviewFormat, output string) []string {
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	var filters, labels []string
+	for i, s := range shots {
+		args = append(args, "-ss", fmt.Sprintf("%.3f", s.Start), "-t", fmt.Sprintf("%.3f", s.Length), "-i", s.Path)
+		filters = append(filters, fmt.Sprintf("[%d:v]fps=%d,scale=%d:-2,setsar=1,setpts=PTS-STARTPTS[v%d]", i, previewFPS, previewWidth, i))
+		labels = append(labels, fmt.Sprintf("[v%d]", i))
+	}
+	filters = append(filters, fmt.Sprintf("%sconcat=n=%d:v=1:a=0[out]", strings.Join(labels, ""), len(shots)))
+	args = append(args, "-filter_complex", strings.Join(filters, ";"), "-map", "[out]", "-an")
+	args = append(args, format.codec...)
+	return append(args, "-y", output)
+}
+
+// previewVersion identifies the footage a preview was made from; it changes when
+// the clip gains files, so stale previews are never served
+func previewVersion(clip models.Clip) string {
+	ids := make([]string, 0, len(clip.VideoFiles))
+	for _, vf := range clip.VideoFiles {
+		ids = append(ids, fmt.Sprintf("%d:%s", vf.ID, vf.FilePath))
+	}
+	sort.Strings(ids)
+	event := ""
+	if clip.EventTimestamp != nil {
+		event = clip.EventTimestamp.UTC().String()
+	}
+	sum := sha256.Sum256([]byte(strings.Join(ids, "|") + "|" + event))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ClipPreview returns the path of a clip's animated preview, generating it on first
+// request and removing previews of older versions of the clip. Background requests
+// queue behind viewers and leave them a transcoder slot.
+func ClipPreview(ctx context.Context, clip models.Clip, format PreviewFormat, background bool) (string, error) {
+	prefix := fmt.Sprintf("%d_", clip.ID)
+	output := filepath.Join(PreviewDir(), prefix+previewVersion(clip)+format.Ext)
+	if fi, err := os.Stat(output); err == nil && fi.Size() > 0 {
+		// Touch so eviction drops the least recently viewed previews first
+		now := time.Now()
+		os.Chtimes(output, now, now)
+		return output, nil
+	}
+
+	shots, err := previewShots(clip)
+	if err != nil {
+		return "", err
+	}
+	job := &transcodeJob{file: fmt.Sprintf("clip %d", clip.ID), quality: "preview", background: background}
+	preview, err := cachedSegment(ctx, output, job, func(tmp string) []string {
+		return previewArgs(shots, format, tmp)
+	})
+	if err == nil {
+		stale, _ := filepath.Glob(filepath.Join(PreviewDir(), prefix+"*"+format.Ext))
+		for _, p := range stale {
+			if p != output {
+				os.Remove(p)
+			}
+		}
+	}
+	return preview, err
+}
+
+var previewWorker = newClipWorker(generateClipPreview)
+
+// StartPreviewWorker pre-generates the MP4 preview of every scanned clip unless
+// PREVIEW_PREGENERATE is false
+func StartPreviewWorker() {
+	if strings.EqualFold(os.Getenv("PREVIEW_PREGENERATE"), "false") {
+		return
+	}
+	previewWorker.start()
+}
+
+// QueuePreview schedules the preview of a clip, e.g. after it gained files
+func QueuePreview(clipID uint) {
+	previewWorker.enqueue(clipID)
+}
+
+func generateClipPreview(clipID uint) error {
+	if database.DB == nil {
+		return nil
+	}
+	var clip models.Clip
+	if err := database.DB.Preload("VideoFiles").First(&clip, clipID).Error; err != nil {
+		return err
+	}
+	_, err := ClipPreview(context.Background(), clip, PreviewMP4, true)
+	if err == ErrTranscoderBusy {
+		return err
+	}
+	if err != nil {
+		log.Printf("Preview for clip %d failed: %v", clipID, err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"teslaxy/models"
+)
+
+func shotsString(shots []previewShot) string {
+	var parts []string
+	for _, s := range shots {
+		parts = append(parts, fmt.Sprintf("%s@%.2f+%.2f", strings.TrimSuffix(filepath.Base(s.Path), ".mp4"), s.Start, s.Length))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestPreviewShots_Sampled(t *testing.T) {
+	clip := streamClip(t)
+
+	shots, err := previewShots(clip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Five one-second shots spread over the 179.6s of Front footage, skipping the
+	// missing minute
+	want := "1-Front@17.46+1.00 1-Front@53.38+1.00 2-Front@29.10+1.00 4-Front@5.12+1.00 4-Front@41.04+1.00"
+	if got := shotsString(shots); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestPreviewShots_Event(t *testing.T) {
+	clip := streamClip(t)
+	base := time.Date(2024, 7, 1, 3, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name  string
+		event time.Duration
+		want  string
+	}{
+		{"Around the trigger", 30 * time.Second, "1-Front@28.00+5.00"},
+		{"Cut at the end of the file", 60 * time.Second, "1-Front@58.00+2.20"},
+		{"Cut at the start of the file", 61 * time.Second, "2-Front@0.00+3.80"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			event := base.Add(tc.event)
+			clip.EventTimestamp = &event
+			shots, _ := previewShots(clip)
+			if got := shotsString(shots); got != tc.want {
+				t.Errorf("Expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+
+	// A trigger in missing footage falls back to sampling the clip
+	event := base.Add(150 * time.Second)
+	clip.EventTimestamp = &event
+	if shots, _ := previewShots(clip); len(shots) != previewSamples {
+		t.Errorf("Expected sampled shots, got %s", shotsString(shots))
+	}
+}
+
+func TestPreviewArgs(t *testing.T) {
+	shots := []previewShot{{"/f/a.mp4", 1, 1}, {"/f/b.mp4", 2.5, 1}}
+	args := strings.Join(previewArgs(shots, PreviewWebP, "/config/p.webp.tmp"), " ")
+	for _, want := range []string{
+		"-ss 1.000 -t 1.000 -i /f/a.mp4 -ss 2.500 -t 1.000 -i /f/b.mp4",
+		"[0:v]fps=10,scale=320:-2,setsar=1,setpts=PTS-STARTPTS[v0];[1:v]",
+		"[v0][v1]concat=n=2:v=1:a=0[out] -map [out] -an",
+		"-c:v libwebp -loop 0",
+		"-f webp -y /config/p.webp.tmp",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("Expected %q in %s", want, args)
+		}
+	}
+}
+
+func TestClipPreview_InvalidatedByNewFiles(t *testing.T) {
+	clip := streamClip(t)
+	var runs int32
+	hlsEncoder = func(ctx context.Context, args []string, job *transcodeJob) (time.Duration, error) {
+		atomic.AddInt32(&runs, 1)
+		return 0, os.WriteFile(args[len(args)-1], []byte("preview"), 0644)
+	}
+
+	first, err := ClipPreview(context.Background(), clip, PreviewMP4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(first, PreviewDir()) || !strings.HasPrefix(filepath.Base(first), "9_") || !strings.HasSuffix(first, ".mp4") {
+		t.Errorf("Unexpected preview path %s", first)
+	}
+	if again, _ := ClipPreview(context.Background(), clip, PreviewMP4, false); again != first || atomic.LoadInt32(&runs) != 1 {
+		t.Errorf("Expected a cache hit, got %s after %d runs", again, atomic.LoadInt32(&runs))
+	}
+
+	// The clip gains a minute: the preview is rebuilt and the old one removed
+	extra := filepath.Join(filepath.Dir(clip.VideoFiles[0].FilePath), "5-Front.mp4")
+	os.WriteFile(extra, []byte("60"), 0644)
+	clip.VideoFiles = append(clip.VideoFiles, models.VideoFile{ID: 5, Camera: "Front", FilePath: extra, Timestamp: clip.Timestamp.Add(4 * time.Minute)})
+
+	second, err := ClipPreview(context.Background(), clip, PreviewMP4, false)
+	if err != nil || second == first || atomic.LoadInt32(&runs) != 2 {
+		t.Fatalf("Expected a new preview, got %s (%v)", second, err)
+	}
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Error("Expected the outdated preview to be removed")
+	}
+}
+
+func TestClipPreview_NoFootage(t *testing.T) {
+	clip := streamClip(t)
+	for _, vf := range clip.VideoFiles {
+		os.WriteFile(vf.FilePath, []byte("truncated"), 0644)
+	}
+	if _, err := ClipPreview(context.Background(), clip, PreviewMP4, false); err != ErrNoPreview {
+		t.Errorf("Expected ErrNoPreview, got %v", err)
+	}
+}
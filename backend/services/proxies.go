@@ -0,0 +1,241 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+// Proxy defaults. Proxies are off unless PROXY_ENABLED=true; PROXY_EVENTS lists the
+// event types that get them ("all" for every clip) and PROXY_BUDGET_MB caps their
+// total size (0 disables the cap).
+const (
+	defaultProxyEvents   = "Sentry,Saved"
+	defaultProxyBudgetMB = 20 * 1024
+
+	// ProxyQuality is the quality= value served from proxies when available
+	ProxyQuality = "480p"
+
+	proxyTimeout = 10 * time.Minute
+)
+
+// proxyEncoder runs one proxy encode; swapped out in tests
+var proxyEncoder = runFFmpeg
+
+var proxyWorker = newClipWorker(generateClipProxies)
+
+// ProxyDir returns the directory proxies are written to
+func ProxyDir() string {
+	return filepath.Join(ConfigPath(), "proxies")
+}
+
+// proxyEvents returns the event types configured to get proxies; nil means all
+func proxyEvents() map[string]bool {
+	v := os.Getenv("PROXY_EVENTS")
+	if v == "" {
+		v = defaultProxyEvents
+	}
+	if strings.EqualFold(strings.TrimSpace(v), "all") {
+		return nil
+	}
+	events := make(map[string]bool)
+	for _, e := range strings.Split(v, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			events[strings.ToLower(e)] = true
+		}
+	}
+	return events
+}
+
+// proxyWanted applies the event-type rule to a clip
+func proxyWanted(clip models.Clip) bool {
+	events := proxyEvents()
+	return events == nil || events[strings.ToLower(clip.Event)]
+}
+
+// proxyArgs encodes a small, seekable 480p H.264 copy without audio. Unlike live
+// transcodes, proxies are made ahead of time, so a slower preset buys smaller files.
+func proxyArgs(input, output string) []string {
+	q := qualityMap[ProxyQuality]
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	if hasNvenc {
+		args = append(args, "-hwaccel", "cuda")
+	}
+	args = append(args, "-i", input, "-an", "-vf", fmt.Sprintf("scale=-2:%d", q.Height), "-c:v", encoder)
+	if hasNvenc {
+		args = append(args, "-preset", "p5", "-rc", "vbr", "-cq", "30")
+	} else {
+		args = append(args, "-preset", "veryfast", "-crf", "28")
+	}
+	args = append(args, "-maxrate", "800k", "-bufsize", "1600k", "-pix_fmt", "yuv420p",
+		"-movflags", "+faststart", "-f", "mp4", "-y", output)
+	return args
+}
+
+// StartProxyWorker starts the background proxy generator if PROXY_ENABLED is set.
+// It reports whether proxies are enabled.
+func StartProxyWorker() bool {
+	if !strings.EqualFold(os.Getenv("PROXY_ENABLED"), "true") {
+		return false
+	}
+	proxyWorker.start()
+	log.Printf("Proxy generation enabled for %s (budget %d MB)", proxyEventsLabel(), envInt("PROXY_BUDGET_MB", defaultProxyBudgetMB))
+	return true
+}
+
+func proxyEventsLabel() string {
+	if os.Getenv("PROXY_EVENTS") == "" {
+		return defaultProxyEvents
+	}
+	return os.Getenv("PROXY_EVENTS")
+}
+
+// QueueProxies schedules proxy generation for a clip. It does nothing when proxies
+// are disabled.
+func QueueProxies(clipID uint) {
+	proxyWorker.enqueue(clipID)
+}
+
+// generateClipProxies creates the missing proxies of a clip, keeping the total within
+// the budget by evicting the proxies of older clips first. Viewers always take
+// precedence: it returns ErrTranscoderBusy when no transcode slot is free.
+func generateClipProxies(clipID uint) error {
+	if database.DB == nil {
+		return nil
+	}
+	var clip models.Clip
+	if err := database.DB.Preload("VideoFiles").First(&clip, clipID).Error; err != nil {
+		return err
+	}
+	if !proxyWanted(clip) {
+		return nil
+	}
+	AutoDetectEncoder()
+
+	for _, vf := range clip.VideoFiles {
+		if vf.ProxyPath != "" {
+			if _, err := os.Stat(vf.ProxyPath); err == nil {
+				continue
+			}
+		}
+		if !makeProxyRoom(clip) {
+			log.Printf("Proxy budget full of newer clips; skipping clip %d", clip.ID)
+			return nil
+		}
+
+		job := &transcodeJob{file: filepath.Base(vf.FilePath), quality: ProxyQuality, background: true}
+		if err := scheduler().acquire(context.Background(), job); err != nil {
+			return err
+		}
+		output := filepath.Join(ProxyDir(), fmt.Sprintf("%d", clip.ID), fmt.Sprintf("%d.mp4", vf.ID))
+		err := writeProxy(job, vf.FilePath, output)
+		if err != nil {
+			log.Printf("Proxy for %s failed: %v", vf.FilePath, err)
+			continue
+		}
+
+		info, _ := os.Stat(output)
+		database.DB.Model(&vf).Updates(map[string]interface{}{"proxy_path": output, "proxy_size": info.Size()})
+	}
+	return nil
+}
+
+// writeProxy encodes to a temporary file and renames it into place, releasing the
+// job's transcode slot when done
+func writeProxy(job *transcodeJob, input, output string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), proxyTimeout)
+	defer cancel()
+
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		scheduler().release(job, 0)
+		return err
+	}
+	tmp := output + ".tmp"
+	cpu, err := proxyEncoder(ctx, proxyArgs(input, tmp), job)
+	scheduler().release(job, cpu)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, output)
+}
+
+// makeProxyRoom evicts proxies of clips older than clip while the budget is used up.
+// It reports false when only newer (or this clip's own) proxies remain to evict.
+func makeProxyRoom(clip models.Clip) bool {
+	budgetMB := envInt("PROXY_BUDGET_MB", defaultProxyBudgetMB)
+	if budgetMB <= 0 {
+		return true
+	}
+	budget := int64(budgetMB) * 1024 * 1024
+
+	var used struct{ Total int64 }
+	database.DB.Model(&models.VideoFile{}).Select("COALESCE(SUM(proxy_size), 0) AS total").Where("proxy_path <> ''").Scan(&used)
+	if used.Total < budget {
+		return true
+	}
+
+	// Oldest footage first
+	var victims []models.VideoFile
+	database.DB.Table("video_files").Select("video_files.*").
+		Joins("JOIN clips ON clips.id = video_files.clip_id").
+		Where("video_files.proxy_path <> '' AND video_files.deleted_at IS NULL AND clips.timestamp < ?", clip.Timestamp).
+		Order("clips.timestamp asc, video_files.id asc").Find(&victims)
+	for _, vf := range victims {
+		if used.Total < budget {
+			break
+		}
+		removeProxy(vf)
+		used.Total -= vf.ProxySize
+	}
+	return used.Total < budget
+}
+
+// removeProxy deletes a proxy file and clears it from its VideoFile
+func removeProxy(vf models.VideoFile) {
+	os.Remove(vf.ProxyPath)
+	os.Remove(filepath.Dir(vf.ProxyPath)) // Only succeeds once the clip has no proxies left
+	database.DB.Model(&vf).Updates(map[string]interface{}{"proxy_path": "", "proxy_size": 0})
+}
+
+// ProxyFor returns the proxy of a footage file if one exists
+func ProxyFor(filePath string) (string, bool) {
+	if database.DB == nil {
+		return "", false
+	}
+	var vf models.VideoFile
+	if err := database.DB.Select("proxy_path").Where("file_path = ? AND proxy_path <> ''", filePath).First(&vf).Error; err != nil {
+		return "", false
+	}
+	if _, err := os.Stat(vf.ProxyPath); err != nil {
+		return "", false
+	}
+	return vf.ProxyPath, true
+}
+
+// proxyStats summarises stored proxies for GetTranscoderStatus
+func proxyStats() map[string]interface{} {
+	stats := map[string]interface{}{
+		"enabled":   strings.EqualFold(os.Getenv("PROXY_ENABLED"), "true"),
+		"budget_mb": envInt("PROXY_BUDGET_MB", defaultProxyBudgetMB),
+	}
+	if database.DB == nil {
+		return stats
+	}
+	var used struct {
+		Count int64
+		Total int64
+	}
+	database.DB.Model(&models.VideoFile{}).Select("COUNT(*) AS count, COALESCE(SUM(proxy_size), 0) AS total").Where("proxy_path <> ''").Scan(&used)
+	stats["pending_clips"] = proxyWorker.pendingCount()
+	stats["count"] = used.Count
+	stats["bytes"] = used.Total
+	return stats
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+// stubProxyEncoder records encoder args and writes size bytes as the proxy
+func stubProxyEncoder(t *testing.T, size int) *[][]string {
+	var calls [][]string
+	original := proxyEncoder
+	proxyEncoder = func(ctx context.Context, args []string, job *transcodeJob) (time.Duration, error) {
+		if job == nil || !job.background {
+			t.Error("Expected proxies to run as background transcode jobs")
+		}
+		calls = append(calls, args)
+		return time.Second, os.WriteFile(args[len(args)-1], make([]byte, size), 0644)
+	}
+	t.Cleanup(func() { proxyEncoder = original })
+	return &calls
+}
+
+func createProxyClip(t *testing.T, event string, ts time.Time, cameras ...string) models.Clip {
+	dir := t.TempDir()
+	clip := models.Clip{Event: event, Timestamp: ts}
+	database.DB.Create(&clip)
+	for _, camera := range cameras {
+		vf := models.VideoFile{ClipID: clip.ID, Camera: camera, FilePath: filepath.Join(dir, camera+".mp4"), Timestamp: ts}
+		os.WriteFile(vf.FilePath, []byte(camera+" footage"), 0644)
+		database.DB.Create(&vf)
+	}
+	return clip
+}
+
+func proxyFiles(clipID uint) []models.VideoFile {
+	var files []models.VideoFile
+	database.DB.Where("clip_id = ?", clipID).Order("id").Find(&files)
+	return files
+}
+
+func TestProxyWanted(t *testing.T) {
+	for _, tc := range []struct {
+		env, event string
+		want       bool
+	}{
+		{"", "Sentry", true},
+		{"", "Saved", true},
+		{"", "Recent", false},
+		{"all", "Recent", true},
+		{" recent , sentry", "Recent", true},
+		{"Saved", "Sentry", false},
+	} {
+		os.Setenv("PROXY_EVENTS", tc.env)
+		if got := proxyWanted(models.Clip{Event: tc.event}); got != tc.want {
+			t.Errorf("PROXY_EVENTS=%q, event %s: expected %v, got %v", tc.env, tc.event, tc.want, got)
+		}
+	}
+	os.Unsetenv("PROXY_EVENTS")
+}
+
+func TestProxyArgs(t *testing.T) {
+	AutoDetectEncoder()
+	args := strings.Join(proxyArgs("/footage/front.mp4", "/config/proxies/1/2.mp4.tmp"), " ")
+	for _, want := range []string{"-i /footage/front.mp4 -an", "scale=-2:480", "-maxrate 800k", "-movflags +faststart", "-f mp4 -y /config/proxies/1/2.mp4.tmp"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("Expected %q in %s", want, args)
+		}
+	}
+}
+
+func TestGenerateClipProxies(t *testing.T) {
+	setupExportDB(t)
+	useScheduler(t, 1, 4, time.Second)
+	calls := stubProxyEncoder(t, 100)
+
+	clip := createProxyClip(t, "Sentry", time.Now(), "Front", "Back")
+	if err := generateClipProxies(clip.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 2 {
+		t.Fatalf("Expected a proxy per camera, got %d encodes", len(*calls))
+	}
+	for _, vf := range proxyFiles(clip.ID) {
+		if !strings.HasPrefix(vf.ProxyPath, ProxyDir()) || vf.ProxySize != 100 {
+			t.Errorf("Expected the proxy to be recorded on %s, got %q (%d bytes)", vf.Camera, vf.ProxyPath, vf.ProxySize)
+		}
+		if proxy, ok := ProxyFor(vf.FilePath); !ok || proxy != vf.ProxyPath {
+			t.Errorf("Expected ProxyFor to find %s", vf.ProxyPath)
+		}
+		if _, err := os.Stat(vf.ProxyPath + ".tmp"); !os.IsNotExist(err) {
+			t.Error("Expected the temporary file to be renamed")
+		}
+	}
+
+	// Existing proxies are kept; clips outside the rules are skipped
+	generateClipProxies(clip.ID)
+	recent := createProxyClip(t, "Recent", time.Now(), "Front")
+	generateClipProxies(recent.ID)
+	if len(*calls) != 2 || proxyFiles(recent.ID)[0].ProxyPath != "" {
+		t.Errorf("Expected no further encodes, got %d", len(*calls))
+	}
+	if stats := proxyStats(); stats["count"] != int64(2) || stats["bytes"] != int64(200) {
+		t.Errorf("Unexpected proxy stats %v", stats)
+	}
+}
+
+func TestGenerateClipProxies_Busy(t *testing.T) {
+	setupExportDB(t)
+	s := useScheduler(t, 1, 4, 20*time.Millisecond)
+	calls := stubProxyEncoder(t, 100)
+	s.acquire(context.Background(), &transcodeJob{file: "viewer.mp4"})
+
+	clip := createProxyClip(t, "Saved", time.Now(), "Front")
+	if err := generateClipProxies(clip.ID); err != ErrTranscoderBusy {
+		t.Errorf("Expected ErrTranscoderBusy while a viewer holds the slot, got %v", err)
+	}
+	if len(*calls) != 0 {
+		t.Error("Expected no encode without a slot")
+	}
+}
+
+func TestGenerateClipProxies_Budget(t *testing.T) {
+	setupExportDB(t)
+	useScheduler(t, 1, 4, time.Second)
+	stubProxyEncoder(t, 600*1024)
+	os.Setenv("PROXY_BUDGET_MB", "1")
+	t.Cleanup(func() { os.Unsetenv("PROXY_BUDGET_MB") })
+
+	now := time.Now()
+	oldest := createProxyClip(t, "Sentry", now.Add(-2*time.Hour), "Front")
+	middle := createProxyClip(t, "Sentry", now.Add(-time.Hour), "Front")
+	generateClipProxies(oldest.ID)
+	generateClipProxies(middle.ID)
+
+	// 1.2 MB is over budget, so the oldest clip's proxy makes way for the newest
+	newest := createProxyClip(t, "Sentry", now, "Front")
+	generateClipProxies(newest.ID)
+	evicted := proxyFiles(oldest.ID)[0]
+	if evicted.ProxyPath != "" || evicted.ProxySize != 0 {
+		t.Errorf("Expected the oldest proxy to be evicted, got %q", evicted.ProxyPath)
+	}
+	if _, err := os.Stat(filepath.Join(ProxyDir(), "1")); !os.IsNotExist(err) {
+		t.Error("Expected the evicted proxy and its directory to be removed")
+	}
+	if proxyFiles(newest.ID)[0].ProxyPath == "" || proxyFiles(middle.ID)[0].ProxyPath == "" {
+		t.Error("Expected the newer proxies to be kept")
+	}
+
+	// A clip older than everything stored doesn't push out newer footage
+	older := createProxyClip(t, "Sentry", now.Add(-3*time.Hour), "Front")
+	generateClipProxies(older.ID)
+	if proxyFiles(older.ID)[0].ProxyPath != "" || proxyFiles(middle.ID)[0].ProxyPath == "" {
+		t.Error("Expected the old clip to be skipped once the budget is full")
+	}
+}
+
+func TestQueueProxies_WorkerDisabled(t *testing.T) {
+	setupExportDB(t)
+	os.Unsetenv("PROXY_ENABLED")
+	if StartProxyWorker() {
+		t.Fatal("Expected proxies to be off by default")
+	}
+	QueueProxies(1)
+	if proxyWorker.pendingCount() != 0 {
+		t.Error("Expected nothing to be queued without a worker")
+	}
+}
@@ -0,0 +1,537 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+const (
+	// DefaultReportWindow is the telemetry window either side of the incident (seconds)
+	DefaultReportWindow = 30.0
+	// MaxReportWindow bounds SEI extraction and hashing work per report
+	MaxReportWindow = 300.0
+
+	reportFrameWidth = 640
+)
+
+// frameGrabber extracts a single JPEG frame at offset seconds; swappable for tests
+var frameGrabber = func(path string, offset float64, width int) ([]byte, error) {
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-loglevel", "error",
+		"-ss", fmt.Sprintf("%f", offset), "-i", path,
+		"-frames:v", "1", "-vf", fmt.Sprintf("scale=%d:-2", width),
+		"-c:v", "mjpeg", "-q:v", "4", "-f", "image2", "pipe:1")
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out.Bytes(), nil
+}
+
+// ReportOptions controls what an incident report covers
+type ReportOptions struct {
+	Window  float64 // Seconds either side of the incident
+	BaseURL string  // Prepended to export links, e.g. https://teslaxy.lan
+}
+
+// ReportSample is one telemetry sample relative to the incident time
+type ReportSample struct {
+	Offset    float64 // Seconds relative to the incident (negative = before)
+	SpeedKmh  float64
+	Brake     bool
+	Steering  float64
+	Throttle  float64
+	Latitude  float64
+	Longitude float64
+}
+
+// ReportFrame is a still image from one camera at the incident
+type ReportFrame struct {
+	Camera string
+	Offset float64
+	JPEG   []byte
+}
+
+// ReportFile is a source file with its checksum
+type ReportFile struct {
+	Name   string
+	Camera string
+	Size   int64
+	SHA256 string
+}
+
+// ReportLink points at a downloadable artefact related to the incident
+type ReportLink struct {
+	Label string
+	URL   string
+}
+
+// IncidentReport holds everything rendered into the HTML and PDF reports
+type IncidentReport struct {
+	ClipID       uint
+	Event        string
+	Reason       string
+	City         string
+	IncidentTime time.Time
+	Latitude     float64
+	Longitude    float64
+	EventData    [][2]string // event.json key/value pairs, sorted by key
+	Window       float64
+	Samples      []ReportSample
+	Frames       []ReportFrame
+	Files        []ReportFile
+	Links        []ReportLink
+	GeneratedAt  time.Time
+}
+
+// BuildIncidentReport gathers metadata, telemetry, stills and checksums around a clip's incident
+func BuildIncidentReport(clip models.Clip, opts ReportOptions) (*IncidentReport, error) {
+	if opts.Window <= 0 {
+		opts.Window = DefaultReportWindow
+	}
+	if opts.Window > MaxReportWindow {
+		opts.Window = MaxReportWindow
+	}
+
+	incident := clip.Timestamp
+	if clip.EventTimestamp != nil {
+		incident = *clip.EventTimestamp
+	}
+
+	report := &IncidentReport{
+		ClipID:       clip.ID,
+		Event:        clip.Event,
+		Reason:       clip.Reason,
+		City:         clip.City,
+		IncidentTime: incident,
+		Latitude:     clip.Telemetry.Latitude,
+		Longitude:    clip.Telemetry.Longitude,
+		Window:       opts.Window,
+		GeneratedAt:  time.Now().UTC(),
+	}
+
+	if clip.SourceDir != "" {
+		report.EventData = readEventData(filepath.Join(clip.SourceDir, "event.json"))
+	}
+
+	from := incident.Add(-time.Duration(opts.Window * float64(time.Second)))
+	to := incident.Add(time.Duration(opts.Window * float64(time.Second)))
+	files := ArchiveFiles(clip, ArchiveOptions{From: &from, To: &to})
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no video files around the incident")
+	}
+
+	report.Samples = reportSamples(files, incident, opts.Window)
+	if report.Latitude == 0 && report.Longitude == 0 {
+		for _, s := range report.Samples {
+			if s.Latitude != 0 || s.Longitude != 0 {
+				report.Latitude, report.Longitude = s.Latitude, s.Longitude
+				break
+			}
+		}
+	}
+
+	report.Frames = reportFrames(files, incident)
+
+	for _, vf := range files {
+		sum, size, err := hashFile(vf.FilePath)
+		if err != nil {
+			continue
+		}
+		report.Files = append(report.Files, ReportFile{
+			Name:   filepath.Base(vf.FilePath),
+			Camera: NormalizeCameraName(vf.Camera),
+			Size:   size,
+			SHA256: sum,
+		})
+	}
+
+	base := strings.TrimRight(opts.BaseURL, "/")
+	report.Links = append(report.Links, ReportLink{
+		Label: "Original footage archive (ZIP)",
+		URL: fmt.Sprintf("%s/api/clips/%d/archive?from=%s&to=%s", base, clip.ID,
+			from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339)),
+	})
+	if database.DB != nil {
+		var jobs []models.ExportJob
+		database.DB.Where("clip_id = ? AND status = ?", clip.ID, "completed").Order("created_at asc").Find(&jobs)
+		for _, job := range jobs {
+			report.Links = append(report.Links, ReportLink{
+				Label: fmt.Sprintf("%s export %s", job.Kind, job.FileName),
+				URL:   fmt.Sprintf("%s/api/exports/%s/download", base, job.JobID),
+			})
+		}
+	}
+
+	return report, nil
+}
+
+// readEventData flattens event.json into sorted key/value pairs
+func readEventData(path string) [][2]string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil
+	}
+
+	var pairs [][2]string
+	for k, v := range raw {
+		pairs = append(pairs, [2]string{k, fmt.Sprint(v)})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+	return pairs
+}
+
+// reportSamples maps the Front camera's SEI samples onto wall-clock time and keeps those in the window.
+// Samples are spread evenly across each file, as in movingWindows.
+func reportSamples(files []models.VideoFile, incident time.Time, window float64) []ReportSample {
+	var fronts []models.VideoFile
+	for _, vf := range files {
+		if NormalizeCameraName(vf.Camera) == "Front" {
+			fronts = append(fronts, vf)
+		}
+	}
+
+	var samples []ReportSample
+	for i, vf := range fronts {
+		meta, err := seiExtractor(vf.FilePath)
+		if err != nil || len(meta) == 0 {
+			continue
+		}
+
+		duration := defaultSegmentDuration
+		if i+1 < len(fronts) {
+			if gap := fronts[i+1].Timestamp.Sub(vf.Timestamp).Seconds(); gap > 0 && gap < duration {
+				duration = gap
+			}
+		}
+		step := duration / float64(len(meta))
+		start := vf.Timestamp.Sub(incident).Seconds()
+
+		for j, m := range meta {
+			offset := start + float64(j)*step
+			if offset < -window || offset > window {
+				continue
+			}
+			samples = append(samples, ReportSample{
+				Offset:    offset,
+				SpeedKmh:  float64(m.VehicleSpeedMps) * 3.6,
+				Brake:     m.BrakeApplied,
+				Steering:  float64(m.SteeringWheelAngle),
+				Throttle:  float64(m.AcceleratorPedalPosition),
+				Latitude:  m.LatitudeDeg,
+				Longitude: m.LongitudeDeg,
+			})
+		}
+	}
+	return samples
+}
+
+// reportFrames grabs one still per camera at the incident time
+func reportFrames(files []models.VideoFile, incident time.Time) []ReportFrame {
+	// Latest file per camera starting at or before the incident
+	byCamera := make(map[string]models.VideoFile)
+	for _, vf := range files {
+		cam := NormalizeCameraName(vf.Camera)
+		if vf.Timestamp.After(incident) {
+			if _, ok := byCamera[cam]; !ok {
+				byCamera[cam] = vf // Incident precedes the footage; use its first frame
+			}
+			continue
+		}
+		if cur, ok := byCamera[cam]; !ok || cur.Timestamp.After(incident) || vf.Timestamp.After(cur.Timestamp) {
+			byCamera[cam] = vf
+		}
+	}
+
+	var frames []ReportFrame
+	for _, cam := range cameraOrder {
+		vf, ok := byCamera[cam]
+		if !ok {
+			continue
+		}
+		offset := math.Max(incident.Sub(vf.Timestamp).Seconds(), 0)
+		jpeg, err := frameGrabber(vf.FilePath, offset, reportFrameWidth)
+		if err != nil || len(jpeg) == 0 {
+			continue
+		}
+		frames = append(frames, ReportFrame{Camera: cam, Offset: offset, JPEG: jpeg})
+	}
+	return frames
+}
+
+// cameraOrder is the display order of cameras in reports
+var cameraOrder = []string{"Front", "Back", "Left Repeater", "Right Repeater", "Left Pillar", "Right Pillar", "Cabin"}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// reportChart is one telemetry series plotted against the incident offset
+type reportChart struct {
+	Title string
+	Unit  string
+	Step  bool // Boolean series (brake) are drawn as steps between 0 and 1
+	X     []float64
+	Y     []float64
+}
+
+func (r *IncidentReport) charts() []reportChart {
+	speed := reportChart{Title: "Speed", Unit: "km/h"}
+	brake := reportChart{Title: "Brake", Unit: "on/off", Step: true}
+	steering := reportChart{Title: "Steering wheel angle", Unit: "deg"}
+	for _, s := range r.Samples {
+		speed.X, speed.Y = append(speed.X, s.Offset), append(speed.Y, s.SpeedKmh)
+		b := 0.0
+		if s.Brake {
+			b = 1
+		}
+		brake.X, brake.Y = append(brake.X, s.Offset), append(brake.Y, b)
+		steering.X, steering.Y = append(steering.X, s.Offset), append(steering.Y, s.Steering)
+	}
+	return []reportChart{speed, brake, steering}
+}
+
+// plot maps the series into a w x h box (origin top-left) spanning [-window, window] on x.
+// Returns the points and the y range used for the axis labels.
+func (ch reportChart) plot(window, w, h float64) ([][2]float64, float64, float64) {
+	yMin, yMax := 0.0, 1.0
+	if !ch.Step {
+		for _, y := range ch.Y {
+			yMin, yMax = math.Min(yMin, y), math.Max(yMax, y)
+		}
+		if yMax-yMin < 1 {
+			yMax = yMin + 1
+		}
+	}
+
+	scaleX := func(x float64) float64 { return (x + window) / (2 * window) * w }
+	scaleY := func(y float64) float64 { return h - (y-yMin)/(yMax-yMin)*h }
+
+	var pts [][2]float64
+	for i := range ch.X {
+		if ch.Step && i > 0 {
+			pts = append(pts, [2]float64{scaleX(ch.X[i]), scaleY(ch.Y[i-1])})
+		}
+		pts = append(pts, [2]float64{scaleX(ch.X[i]), scaleY(ch.Y[i])})
+	}
+	return pts, yMin, yMax
+}
+
+// routePlot projects the GPS track into a w x h box (origin top-left), preserving aspect.
+// Returns the points, the incident position and a scale bar (pixels, metres).
+func (r *IncidentReport) routePlot(w, h float64) ([][2]float64, *[2]float64, float64, float64) {
+	type ll struct{ lat, lon, offset float64 }
+	var track []ll
+	for _, s := range r.Samples {
+		if s.Latitude != 0 || s.Longitude != 0 {
+			track = append(track, ll{s.Latitude, s.Longitude, s.Offset})
+		}
+	}
+	if len(track) == 0 {
+		return nil, nil, 0, 0
+	}
+
+	const metresPerDegree = 111320.0
+	cosLat := math.Cos(track[0].lat * math.Pi / 180)
+	minX, maxX := math.Inf(1), math.Inf(-1)
+	minY, maxY := math.Inf(1), math.Inf(-1)
+	xy := make([][2]float64, len(track))
+	for i, p := range track {
+		x := p.lon * metresPerDegree * cosLat
+		y := p.lat * metresPerDegree
+		xy[i] = [2]float64{x, y}
+		minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+		minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+	}
+
+	// At least 100 m across so a parked car isn't zoomed to GPS noise
+	span := math.Max(math.Max(maxX-minX, maxY-minY), 100)
+	const pad = 0.1
+	scale := math.Min(w, h) * (1 - 2*pad) / span
+	cx, cy := (minX+maxX)/2, (minY+maxY)/2
+
+	pts := make([][2]float64, len(xy))
+	var incident *[2]float64
+	best := math.Inf(1)
+	for i, p := range xy {
+		pts[i] = [2]float64{w/2 + (p[0]-cx)*scale, h/2 - (p[1]-cy)*scale}
+		if d := math.Abs(track[i].offset); d < best {
+			best = d
+			pt := pts[i]
+			incident = &pt
+		}
+	}
+
+	// Round scale bar to 1/2/5 x 10^n metres, about a fifth of the width
+	target := w / 5 / scale
+	mag := math.Pow(10, math.Floor(math.Log10(target)))
+	metres := mag
+	for _, m := range []float64{2, 5, 10} {
+		if m*mag <= target {
+			metres = m * mag
+		}
+	}
+	return pts, incident, metres * scale, metres
+}
+
+// svgPoints formats points for an SVG polyline
+func svgPoints(pts [][2]float64) string {
+	parts := make([]string, len(pts))
+	for i, p := range pts {
+		parts[i] = fmt.Sprintf("%.1f,%.1f", p[0], p[1])
+	}
+	return strings.Join(parts, " ")
+}
+
+func (r *IncidentReport) routeSVG() template.HTML {
+	const w, h = 640.0, 360.0
+	pts, incident, barPx, barMetres := r.routePlot(w, h)
+	if len(pts) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %.0f %.0f" class="map">`, w, h)
+	fmt.Fprintf(&b, `<rect width="%.0f" height="%.0f" fill="#f4f4f0" stroke="#999"/>`, w, h)
+	fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="#1f6feb" stroke-width="3" stroke-linejoin="round"/>`, svgPoints(pts))
+	fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="5" fill="#2da44e"/>`, pts[0][0], pts[0][1])
+	fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="5" fill="#555"/>`, pts[len(pts)-1][0], pts[len(pts)-1][1])
+	if incident != nil {
+		fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="8" fill="none" stroke="#d1242f" stroke-width="3"/>`, incident[0], incident[1])
+	}
+	fmt.Fprintf(&b, `<line x1="20" y1="%.0f" x2="%.1f" y2="%.0f" stroke="#333" stroke-width="3"/>`, h-20, 20+barPx, h-20)
+	fmt.Fprintf(&b, `<text x="20" y="%.0f" font-size="12">%g m</text>`, h-28, barMetres)
+	fmt.Fprintf(&b, `<text x="%.0f" y="%.0f" font-size="12" text-anchor="end">N &#8593;</text>`, w-10, 20.0)
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+func (r *IncidentReport) chartSVG(ch reportChart) template.HTML {
+	const w, h, left, top = 640.0, 140.0, 50.0, 10.0
+	pw, ph := w-left-10, h-top-25
+	pts, yMin, yMax := ch.plot(r.Window, pw, ph)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %.0f %.0f" class="chart">`, w, h)
+	fmt.Fprintf(&b, `<g transform="translate(%.0f,%.0f)">`, left, top)
+	fmt.Fprintf(&b, `<rect width="%.0f" height="%.0f" fill="none" stroke="#999"/>`, pw, ph)
+	fmt.Fprintf(&b, `<line x1="%.1f" y1="0" x2="%.1f" y2="%.0f" stroke="#d1242f" stroke-dasharray="4 3"/>`, pw/2, pw/2, ph)
+	if len(pts) > 0 {
+		fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="#1f6feb" stroke-width="2"/>`, svgPoints(pts))
+	}
+	fmt.Fprintf(&b, `<text x="-6" y="10" font-size="11" text-anchor="end">%g</text>`, math.Round(yMax))
+	fmt.Fprintf(&b, `<text x="-6" y="%.0f" font-size="11" text-anchor="end">%g</text>`, ph, math.Round(yMin))
+	fmt.Fprintf(&b, `<text x="0" y="%.0f" font-size="11">-%gs</text>`, ph+15, r.Window)
+	fmt.Fprintf(&b, `<text x="%.1f" y="%.0f" font-size="11" text-anchor="middle">incident</text>`, pw/2, ph+15)
+	fmt.Fprintf(&b, `<text x="%.0f" y="%.0f" font-size="11" text-anchor="end">+%gs</text>`, pw, ph+15, r.Window)
+	b.WriteString(`</g></svg>`)
+	return template.HTML(b.String())
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"jpeg": func(data []byte) template.URL {
+		return template.URL("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(data))
+	},
+	"utc": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05 MST") },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Incident report - clip {{.R.ClipID}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; color: #222; max-width: 900px; margin: 2em auto; padding: 0 1em; }
+h1 { margin-bottom: 0.2em; } h2 { border-bottom: 1px solid #ccc; padding-bottom: 0.2em; margin-top: 1.6em; }
+table { border-collapse: collapse; width: 100%; font-size: 0.9em; }
+td, th { text-align: left; padding: 4px 8px; border-bottom: 1px solid #eee; vertical-align: top; }
+.mono { font-family: ui-monospace, Menlo, Consolas, monospace; font-size: 0.85em; word-break: break-all; }
+.map, .chart { width: 100%; height: auto; }
+.frames { display: grid; grid-template-columns: repeat(2, 1fr); gap: 12px; }
+.frames figure { margin: 0; } .frames img { width: 100%; } figcaption { font-size: 0.85em; color: #555; }
+.muted { color: #777; }
+</style>
+</head>
+<body>
+<h1>Incident report</h1>
+<p class="muted">Clip {{.R.ClipID}} &middot; generated {{utc .R.GeneratedAt}}</p>
+
+<h2>Event</h2>
+<table>
+<tr><th>Type</th><td>{{.R.Event}}</td></tr>
+<tr><th>Reason</th><td>{{.R.Reason}}</td></tr>
+<tr><th>Time</th><td>{{utc .R.IncidentTime}}</td></tr>
+<tr><th>Location</th><td>{{.R.City}}{{if or .R.Latitude .R.Longitude}} ({{printf "%.6f" .R.Latitude}}, {{printf "%.6f" .R.Longitude}}){{end}}</td></tr>
+</table>
+{{if .R.EventData}}
+<h3>event.json</h3>
+<table>{{range .R.EventData}}<tr><th>{{index . 0}}</th><td>{{index . 1}}</td></tr>{{end}}</table>
+{{end}}
+
+<h2>Route</h2>
+{{if .Route}}{{.Route}}<p class="muted">Green: start, grey: end, red ring: incident. Map drawn from GPS telemetry; no map tiles.</p>{{else}}<p class="muted">No GPS telemetry in this window.</p>{{end}}
+
+<h2>Telemetry (&plusmn;{{.R.Window}}s)</h2>
+{{if .R.Samples}}{{range .Charts}}<h3>{{.Title}} <span class="muted">({{.Unit}})</span></h3>{{.SVG}}{{end}}{{else}}<p class="muted">No SEI telemetry in this window.</p>{{end}}
+
+<h2>Still frames</h2>
+{{if .R.Frames}}<div class="frames">{{range .R.Frames}}<figure><img src="{{jpeg .JPEG}}" alt="{{.Camera}}"><figcaption>{{.Camera}}</figcaption></figure>{{end}}</div>{{else}}<p class="muted">No frames available.</p>{{end}}
+
+<h2>Source files</h2>
+<table>
+<tr><th>File</th><th>Camera</th><th>Size</th><th>SHA-256</th></tr>
+{{range .R.Files}}<tr><td>{{.Name}}</td><td>{{.Camera}}</td><td>{{.Size}}</td><td class="mono">{{.SHA256}}</td></tr>{{end}}
+</table>
+
+<h2>Downloads</h2>
+<ul>{{range .R.Links}}<li><a href="{{.URL}}">{{.Label}}</a></li>{{end}}</ul>
+</body>
+</html>
+`))
+
+// WriteReportHTML renders a self-contained HTML report (inline SVG and images, no external assets)
+func WriteReportHTML(w io.Writer, r *IncidentReport) error {
+	type chartView struct {
+		Title, Unit string
+		SVG         template.HTML
+	}
+	var charts []chartView
+	for _, ch := range r.charts() {
+		charts = append(charts, chartView{Title: ch.Title, Unit: ch.Unit, SVG: r.chartSVG(ch)})
+	}
+	return reportTemplate.Execute(w, struct {
+		R      *IncidentReport
+		Route  template.HTML
+		Charts []chartView
+	}{r, r.routeSVG(), charts})
+}
@@ -0,0 +1,193 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/jpeg"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pb "teslaxy/proto"
+)
+
+func stubReportSources(t *testing.T) {
+	originalSEI, originalGrabber := seiExtractor, frameGrabber
+
+	// 60 samples per minute: accelerating, braking from sample 30, heading north-east
+	seiExtractor = func(path string) ([]*pb.SeiMetadata, error) {
+		var samples []*pb.SeiMetadata
+		for i := 0; i < 60; i++ {
+			samples = append(samples, &pb.SeiMetadata{
+				FrameSeqNo:         uint64(i),
+				VehicleSpeedMps:    float32(i) / 4,
+				BrakeApplied:       i >= 30,
+				SteeringWheelAngle: float32(i - 30),
+				LatitudeDeg:        -34.9 + float64(i)*0.00001,
+				LongitudeDeg:       138.6 + float64(i)*0.00001,
+			})
+		}
+		return samples, nil
+	}
+
+	var frame bytes.Buffer
+	jpeg.Encode(&frame, image.NewRGBA(image.Rect(0, 0, 64, 48)), nil)
+	frameGrabber = func(path string, offset float64, width int) ([]byte, error) {
+		return frame.Bytes(), nil
+	}
+
+	t.Cleanup(func() { seiExtractor, frameGrabber = originalSEI, originalGrabber })
+}
+
+func reportFixture(t *testing.T) *IncidentReport {
+	stubReportSources(t)
+	clip := archiveFixture(t)
+	incident := clip.Timestamp.Add(30 * time.Second)
+	clip.EventTimestamp = &incident
+
+	report, err := BuildIncidentReport(clip, ReportOptions{Window: 10, BaseURL: "https://teslaxy.lan/"})
+	if err != nil {
+		t.Fatalf("BuildIncidentReport failed: %v", err)
+	}
+	return report
+}
+
+func TestBuildIncidentReport(t *testing.T) {
+	report := reportFixture(t)
+
+	// Front minute one covers offsets -30..+29s; only -10..+10 is kept
+	if len(report.Samples) != 21 {
+		t.Fatalf("Expected 21 samples in the window, got %d", len(report.Samples))
+	}
+	if report.Samples[0].Offset != -10 || !report.Samples[10].Brake || report.Samples[9].Brake {
+		t.Errorf("Unexpected samples: %+v", report.Samples[:11])
+	}
+	if report.Latitude == 0 {
+		t.Error("Expected the location to fall back to SEI GPS")
+	}
+
+	if len(report.EventData) != 2 || report.EventData[0][0] != "reason" {
+		t.Errorf("Unexpected event.json data: %v", report.EventData)
+	}
+
+	// Front and Back at the incident, in display order
+	if len(report.Frames) != 2 || report.Frames[0].Camera != "Front" || report.Frames[1].Camera != "Back" || report.Frames[0].Offset != 30 {
+		t.Errorf("Unexpected frames: %+v", report.Frames)
+	}
+
+	// Minute two starts 30s after the incident, outside the 10s window
+	if len(report.Files) != 2 {
+		t.Errorf("Expected checksums for the 2 files in the window, got %+v", report.Files)
+	}
+	sum := sha256.Sum256([]byte("back minute one"))
+	if report.Files[0].Camera != "Back" || report.Files[0].SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("Unexpected checksum entry %+v", report.Files[0])
+	}
+
+	if len(report.Links) == 0 || !strings.HasPrefix(report.Links[0].URL, "https://teslaxy.lan/api/clips/7/archive?from=2024-06-01T21:00:20Z") {
+		t.Errorf("Unexpected links: %+v", report.Links)
+	}
+}
+
+func TestBuildIncidentReport_NoFootage(t *testing.T) {
+	stubReportSources(t)
+	clip := archiveFixture(t)
+	incident := clip.Timestamp.Add(time.Hour)
+	clip.EventTimestamp = &incident
+
+	if _, err := BuildIncidentReport(clip, ReportOptions{}); err == nil {
+		t.Error("Expected an error when no footage covers the incident")
+	}
+}
+
+func TestWriteReportHTML_SelfContained(t *testing.T) {
+	report := reportFixture(t)
+	report.City = `<script>alert(1)</script>`
+
+	var buf bytes.Buffer
+	if err := WriteReportHTML(&buf, report); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+
+	for _, want := range []string{"<svg", "polyline", "data:image/jpeg;base64,", "sentry_aware_object_detection", report.Files[0].SHA256} {
+		if !strings.Contains(html, want) {
+			t.Errorf("Expected report to contain %q", want)
+		}
+	}
+	if strings.Contains(html, "<script>") {
+		t.Error("Event metadata must be escaped")
+	}
+	// Offline: nothing may be fetched from another origin
+	if regexp.MustCompile(`(src|href)="https?://`).MatchString(strings.ReplaceAll(html, `href="https://teslaxy.lan`, "")) {
+		t.Error("Report references external resources")
+	}
+}
+
+func TestWriteReportPDF_Structure(t *testing.T) {
+	report := reportFixture(t)
+
+	var buf bytes.Buffer
+	if err := WriteReportPDF(&buf, report); err != nil {
+		t.Fatal(err)
+	}
+	pdf := buf.Bytes()
+
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatal("Missing PDF header or trailer")
+	}
+	if !bytes.Contains(pdf, []byte("/Filter /DCTDecode")) || !bytes.Contains(pdf, []byte("/BaseFont /Helvetica")) {
+		t.Error("Expected embedded JPEG stills and built-in fonts")
+	}
+	if bytes.Contains(pdf, []byte("/FontFile")) {
+		t.Error("Fonts must not be embedded")
+	}
+
+	// Every xref entry must point at its object
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(pdf)
+	if startxref == nil {
+		t.Fatal("Missing startxref")
+	}
+	xrefAt, _ := strconv.Atoi(string(startxref[1]))
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(pdf[xrefAt:], -1)
+	if len(entries) < 6 {
+		t.Fatalf("Expected at least 6 objects, got %d", len(entries))
+	}
+	for i, e := range entries {
+		off, _ := strconv.Atoi(string(e[1]))
+		if want := strconv.Itoa(i+1) + " 0 obj"; !bytes.HasPrefix(pdf[off:], []byte(want)) {
+			t.Errorf("xref entry %d points at %q", i+1, pdf[off:off+12])
+		}
+	}
+}
+
+func TestPDFText(t *testing.T) {
+	if got := pdfText(`Café (north) \ ✓`); got != `(Caf\351 \(north\) \\ ?)` {
+		t.Errorf("Unexpected PDF string: %s", got)
+	}
+}
+
+func TestRoutePlotFitsBox(t *testing.T) {
+	report := reportFixture(t)
+	pts, incident, barPx, barMetres := report.routePlot(600, 300)
+
+	if len(pts) != len(report.Samples) || incident == nil {
+		t.Fatalf("Expected one point per GPS sample and an incident marker")
+	}
+	for _, p := range pts {
+		if p[0] < 0 || p[0] > 600 || p[1] < 0 || p[1] > 300 {
+			t.Errorf("Point %v outside the map", p)
+		}
+	}
+	// Moving north-east: the last point is right of and above the first
+	if pts[len(pts)-1][0] <= pts[0][0] || pts[len(pts)-1][1] >= pts[0][1] {
+		t.Errorf("Unexpected orientation: %v -> %v", pts[0], pts[len(pts)-1])
+	}
+	if barPx <= 0 || barMetres <= 0 {
+		t.Errorf("Unexpected scale bar %v px / %v m", barPx, barMetres)
+	}
+}
@@ -28,6 +28,9 @@ type ScannerService struct {
 	DB           *gorm.DB
 	Watcher      *fsnotify.Watcher
 	SEIExtractor SEIExtractor
+	// ClipScanned, if set, is called after a scan added files to a clip (including
+	// a new clip), so rescans don't requeue an unchanged library
+	ClipScanned func(clipID uint)
 
 	// Incremental update state
 	mu           sync.Mutex
@@ -456,10 +459,14 @@ func (s *ScannerService) processEventGroup(dirPath string, filePaths []string) {
 	}
 
 	// Add ALL files in the directory to this single clip
-	s.addFilesToClip(clip, files)
+	added := s.addFilesToClip(clip, files)
 
 	// Aggregate Telemetry (will process all front files sorted by time)
 	s.aggregateTelemetry(&clip, files)
+
+	if added && s.ClipScanned != nil {
+		s.ClipScanned(clip.ID)
+	}
 }
 
 // processRecentGroup groups flat RecentClips into logical multi-minute drives using time heuristics.
@@ -562,26 +569,36 @@ func (s *ScannerService) processRecentGroup(filePaths []string) {
 
 		// Flatten the clip group to get all files for telemetry aggregation
 		var allFiles []fileInfo
+		added := false
 
 		// Add ALL segments in this continuous block to the clip
 		for _, segment := range clipGroup {
-			s.addFilesToClip(clip, segment)
+			if s.addFilesToClip(clip, segment) {
+				added = true
+			}
 			allFiles = append(allFiles, segment...)
 		}
 
 		// Aggregate Telemetry
 		s.aggregateTelemetry(&clip, allFiles)
+
+		if added && s.ClipScanned != nil {
+			s.ClipScanned(clip.ID)
+		}
 	}
 }
 
-func (s *ScannerService) addFilesToClip(clip models.Clip, files []fileInfo) {
+// addFilesToClip records the files clip doesn't have yet and reports whether there
+// were any
+func (s *ScannerService) addFilesToClip(clip models.Clip, files []fileInfo) bool {
+	added := false
 	for _, f := range files {
 		matches := fileRegex.FindStringSubmatch(filepath.Base(f.path))
 		cameraName := "Unknown"
 		if len(matches) == 3 {
 			cameraName = matches[2] // This is group 2 now in the new regex
 		}
-		cameraName = normalizeCameraName(cameraName)
+		cameraName = NormalizeCameraName(cameraName)
 
 		var vf models.VideoFile
 		if err := s.DB.Where("clip_id = ? AND camera = ? AND file_path = ?", clip.ID, cameraName, f.path).First(&vf).Error; gorm.IsRecordNotFoundError(err) {
@@ -591,9 +608,12 @@ func (s *ScannerService) addFilesToClip(clip models.Clip, files []fileInfo) {
 				FilePath:  f.path,
 				Timestamp: f.timestamp,
 			}
-			s.DB.Create(&vf)
+			if s.DB.Create(&vf).Error == nil {
+				added = true
+			}
 		}
 	}
+	return added
 }
 
 // aggregateTelemetry iterates through all 'Front' files in the clip, extracts SEI, and updates the Telemetry record.
@@ -607,7 +627,7 @@ func (s *ScannerService) aggregateTelemetry(clip *models.Clip, files []fileInfo)
 		if len(matches) == 3 {
 			cameraName = matches[2]
 		}
-		if normalizeCameraName(cameraName) == "Front" {
+		if NormalizeCameraName(cameraName) == "Front" {
 			frontFiles = append(frontFiles, f)
 		}
 	}
@@ -700,7 +720,8 @@ func determineTimezone(lat, lon float64) *time.Location {
 	return time.UTC
 }
 
-func normalizeCameraName(raw string) string {
+// NormalizeCameraName maps "left_repeater" and "Left Repeater" to "Left Repeater"
+func NormalizeCameraName(raw string) string {
 	raw = strings.ToLower(raw)
 	switch raw {
 	case "front":
@@ -124,3 +124,49 @@ func TestScanner_CityFallback(t *testing.T) {
 		t.Errorf("expected City '%s', got '%s'", expected, clip.City)
 	}
 }
+
+func TestScanner_ClipScannedOnlyForChangedClips(t *testing.T) {
+	os.Setenv("DEFAULT_TIMEZONE", "UTC")
+	defer os.Unsetenv("DEFAULT_TIMEZONE")
+
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	defer db.Close()
+	db.AutoMigrate(&models.Clip{}, &models.VideoFile{}, &models.Telemetry{})
+
+	tmpDir := t.TempDir()
+	eventDir := filepath.Join(tmpDir, "SentryClips", "2023-10-27_10-00-00")
+	recentDir := filepath.Join(tmpDir, "RecentClips")
+	os.MkdirAll(eventDir, 0755)
+	os.MkdirAll(recentDir, 0755)
+	ioutil.WriteFile(filepath.Join(eventDir, "2023-10-27_10-00-00-front.mp4"), []byte("dummy"), 0644)
+	ioutil.WriteFile(filepath.Join(recentDir, "2023-10-27_12-00-00-front.mp4"), []byte("dummy"), 0644)
+
+	scanner := NewScannerService(tmpDir, db)
+	var scanned []uint
+	scanner.ClipScanned = func(clipID uint) { scanned = append(scanned, clipID) }
+
+	scanner.ScanAll()
+	if len(scanned) != 2 {
+		t.Fatalf("expected both new clips to be reported, got %v", scanned)
+	}
+
+	// Nothing changed
+	scanned = nil
+	scanner.ScanAll()
+	if len(scanned) != 0 {
+		t.Errorf("expected a rescan of unchanged clips to report nothing, got %v", scanned)
+	}
+
+	// The event gains a camera
+	ioutil.WriteFile(filepath.Join(eventDir, "2023-10-27_10-00-00-back.mp4"), []byte("dummy"), 0644)
+	scanned = nil
+	scanner.ScanAll()
+	var event models.Clip
+	db.Where("event = ?", "Sentry").First(&event)
+	if len(scanned) != 1 || scanned[0] != event.ID {
+		t.Errorf("expected only the changed clip %d to be reported, got %v", event.ID, scanned)
+	}
+}
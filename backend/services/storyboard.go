@@ -0,0 +1,152 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+const (
+	// StoryboardInterval is the time between storyboard frames, in seconds
+	StoryboardInterval = 2.0
+
+	storyboardTileWidth = 160
+	storyboardColumns   = 10
+)
+
+// StoryboardDir returns where storyboard sprites are cached, next to the thumbnails
+func StoryboardDir() string {
+	return filepath.Join(ConfigPath(), "thumbnails", "storyboards")
+}
+
+// storyboardLayout is the tile grid of one file's sprite
+type storyboardLayout struct {
+	Frames     int
+	Columns    int
+	Rows       int
+	TileWidth  int
+	TileHeight int
+}
+
+func layoutStoryboard(info VideoInfo) storyboardLayout {
+	l := storyboardLayout{
+		Frames:     int(math.Max(1, math.Ceil(info.Duration/StoryboardInterval))),
+		Columns:    storyboardColumns,
+		TileWidth:  storyboardTileWidth,
+		TileHeight: storyboardTileWidth * 3 / 4, // Tesla cameras are 4:3
+	}
+	if info.Width > 0 && info.Height > 0 {
+		l.TileHeight = int(math.Round(float64(storyboardTileWidth*info.Height)/float64(info.Width)/2)) * 2
+	}
+	if l.Frames < l.Columns {
+		l.Columns = l.Frames
+	}
+	l.Rows = (l.Frames + l.Columns - 1) / l.Columns
+	return l
+}
+
+// storyboardArgs samples one frame every StoryboardInterval and tiles them into a
+// single JPEG
+func storyboardArgs(input string, l storyboardLayout, output string) []string {
+	vf := fmt.Sprintf("fps=1/%g,scale=%d:%d,tile=%dx%d", StoryboardInterval, l.TileWidth, l.TileHeight, l.Columns, l.Rows)
+	return []string{"-hide_banner", "-loglevel", "error", "-i", input, "-an",
+		"-vf", vf, "-frames:v", "1", "-q:v", "5", "-f", "mjpeg", "-y", output}
+}
+
+// StoryboardSprite returns the path of a file's storyboard sprite, generating it on
+// first request. Background requests queue behind viewers and leave them a
+// transcoder slot.
+func StoryboardSprite(ctx context.Context, vf models.VideoFile, background bool) (string, error) {
+	key, err := hlsCacheKey(vf.FilePath)
+	if err != nil {
+		return "", err
+	}
+	info, err := probeVideo(vf.FilePath)
+	if err != nil {
+		return "", err
+	}
+	l := layoutStoryboard(info)
+
+	output := filepath.Join(StoryboardDir(), key+".jpg")
+	job := &transcodeJob{file: filepath.Base(vf.FilePath), quality: "storyboard", background: background}
+	return cachedSegment(ctx, output, job, func(tmp string) []string {
+		return storyboardArgs(vf.FilePath, l, tmp)
+	})
+}
+
+// StoryboardVTT returns a WebVTT thumbnails track for one camera of a clip. Cue times
+// follow the clip stream timeline; each cue points at a tile of the file's sprite
+// (<fileID>.jpg) with a #xywh fragment. Missing footage has no cues.
+func StoryboardVTT(clip models.Clip, camera, uriSuffix string) (string, error) {
+	entries, err := planClipStream(clip, camera)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for _, e := range entries {
+		if e.gap() {
+			continue
+		}
+		info, _ := probeVideo(e.File.FilePath) // Probed while planning
+		l := layoutStoryboard(info)
+		end := e.Offset + e.Duration
+		for i := 0; i < l.Frames; i++ {
+			start := e.Offset + float64(i)*StoryboardInterval
+			fmt.Fprintf(&b, "%s --> %s\nstoryboard/%d.jpg%s#xywh=%d,%d,%d,%d\n\n",
+				vttTimestamp(start), vttTimestamp(math.Min(start+StoryboardInterval, end)),
+				e.File.ID, uriSuffix, (i%l.Columns)*l.TileWidth, (i/l.Columns)*l.TileHeight, l.TileWidth, l.TileHeight)
+		}
+	}
+	return b.String(), nil
+}
+
+// vttTimestamp formats seconds as hh:mm:ss.mmm
+func vttTimestamp(s float64) string {
+	ms := int64(math.Round(s * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+var storyboardWorker = newClipWorker(generateClipStoryboards)
+
+// StartStoryboardWorker pre-generates storyboards for scanned clips unless
+// STORYBOARD_PREGENERATE is false; they are then only made when first viewed.
+func StartStoryboardWorker() {
+	if strings.EqualFold(os.Getenv("STORYBOARD_PREGENERATE"), "false") {
+		return
+	}
+	storyboardWorker.start()
+}
+
+// QueueStoryboards schedules storyboard generation for a clip
+func QueueStoryboards(clipID uint) {
+	storyboardWorker.enqueue(clipID)
+}
+
+func generateClipStoryboards(clipID uint) error {
+	if database.DB == nil {
+		return nil
+	}
+	var clip models.Clip
+	if err := database.DB.Preload("VideoFiles").First(&clip, clipID).Error; err != nil {
+		return err
+	}
+	for _, vf := range clip.VideoFiles {
+		_, err := StoryboardSprite(context.Background(), vf, true)
+		if err == ErrTranscoderBusy {
+			return err
+		}
+		if err != nil {
+			log.Printf("Storyboard for %s failed: %v", vf.FilePath, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"teslaxy/models"
+)
+
+func TestLayoutStoryboard(t *testing.T) {
+	for _, tc := range []struct {
+		info VideoInfo
+		want storyboardLayout
+	}{
+		{VideoInfo{Duration: 60.2, Width: 1280, Height: 960}, storyboardLayout{Frames: 31, Columns: 10, Rows: 4, TileWidth: 160, TileHeight: 120}},
+		{VideoInfo{Duration: 59.9, Width: 1448, Height: 938}, storyboardLayout{Frames: 30, Columns: 10, Rows: 3, TileWidth: 160, TileHeight: 104}},
+		{VideoInfo{Duration: 7}, storyboardLayout{Frames: 4, Columns: 4, Rows: 1, TileWidth: 160, TileHeight: 120}},
+		{VideoInfo{}, storyboardLayout{Frames: 1, Columns: 1, Rows: 1, TileWidth: 160, TileHeight: 120}},
+	} {
+		if got := layoutStoryboard(tc.info); got != tc.want {
+			t.Errorf("%+v: expected %+v, got %+v", tc.info, tc.want, got)
+		}
+	}
+}
+
+func TestStoryboardArgs(t *testing.T) {
+	l := storyboardLayout{Frames: 31, Columns: 10, Rows: 4, TileWidth: 160, TileHeight: 120}
+	args := strings.Join(storyboardArgs("/footage/front.mp4", l, "/config/sprite.jpg.tmp"), " ")
+	for _, want := range []string{"-i /footage/front.mp4", "fps=1/2,scale=160:120,tile=10x4", "-frames:v 1", "-f mjpeg -y /config/sprite.jpg.tmp"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("Expected %q in %s", want, args)
+		}
+	}
+}
+
+func TestStoryboardVTT(t *testing.T) {
+	clip := streamClip(t)
+
+	vtt, err := StoryboardVTT(clip, "front", "?token=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(vtt, "WEBVTT\n\n") {
+		t.Errorf("Expected a WebVTT header:\n%s", vtt)
+	}
+	// Front minute 0 starts 5s into the clip timeline; the last tile of a file is cut
+	// short at its end and minute 2 is missing entirely
+	for _, want := range []string{
+		"00:00:05.000 --> 00:00:07.000\nstoryboard/1.jpg?token=abc#xywh=0,0,160,120\n\n",
+		"00:00:25.000 --> 00:00:27.000\nstoryboard/1.jpg?token=abc#xywh=0,120,160,120\n\n",
+		"00:01:05.000 --> 00:01:05.200\nstoryboard/1.jpg?token=abc#xywh=0,360,160,120\n\n",
+		"00:01:05.200 --> 00:01:07.200\nstoryboard/2.jpg?token=abc#xywh=0,0,160,120\n\n",
+		"00:03:05.000 --> 00:03:07.000\nstoryboard/4.jpg?token=abc#xywh=0,0,160,120\n\n",
+	} {
+		if !strings.Contains(vtt, want) {
+			t.Errorf("Expected cue %q", want)
+		}
+	}
+	if n := strings.Count(vtt, " --> "); n != 31+30+30 {
+		t.Errorf("Expected 91 cues, got %d", n)
+	}
+
+	if _, err := StoryboardVTT(clip, "cabin", ""); err != ErrNoCameraFootage {
+		t.Errorf("Expected ErrNoCameraFootage, got %v", err)
+	}
+}
+
+func TestStoryboardSprite_Cached(t *testing.T) {
+	source, runs := stubHLS(t, VideoInfo{Duration: 60, Width: 1280, Height: 960})
+	vf := models.VideoFile{ID: 1, FilePath: source}
+
+	sprite, err := StoryboardSprite(context.Background(), vf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sprite, StoryboardDir()) || !strings.HasSuffix(sprite, ".jpg") {
+		t.Errorf("Expected the sprite in the storyboard cache, got %s", sprite)
+	}
+	if again, _ := StoryboardSprite(context.Background(), vf, false); again != sprite || atomic.LoadInt32(runs) != 1 {
+		t.Errorf("Expected a cache hit, got %s after %d runs", again, atomic.LoadInt32(runs))
+	}
+}
+
+func TestGenerateClipStoryboards(t *testing.T) {
+	setupExportDB(t)
+	_, runs := stubHLS(t, VideoInfo{Duration: 60, Width: 1280, Height: 960})
+	s := useScheduler(t, 1, 4, 20*time.Millisecond)
+
+	clip := createProxyClip(t, "Recent", time.Now(), "Front", "Back")
+
+	// Pre-generation gives way to viewers
+	viewer := &transcodeJob{file: "viewer.mp4"}
+	s.acquire(context.Background(), viewer)
+	if err := generateClipStoryboards(clip.ID); err != ErrTranscoderBusy {
+		t.Errorf("Expected ErrTranscoderBusy while a viewer holds the slot, got %v", err)
+	}
+	s.release(viewer, 0)
+
+	if err := generateClipStoryboards(clip.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(runs); n != 2 {
+		t.Errorf("Expected a sprite per file, got %d runs", n)
+	}
+}
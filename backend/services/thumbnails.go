@@ -0,0 +1,260 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"teslaxy/database"
+	"teslaxy/models"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Thumbnail cache defaults. Override with THUMBNAIL_CACHE_MB and
+// THUMBNAIL_CACHE_MAX_AGE_DAYS; a value of 0 disables the respective limit.
+const (
+	defaultThumbnailCacheMB         = 512
+	defaultThumbnailCacheMaxAgeDays = 30
+
+	// ClipListThumbnailWidth is the width the clip list asks for, pre-warmed per clip
+	ClipListThumbnailWidth = 160
+)
+
+// ThumbnailFormat is an image format thumbnails can be encoded to
+type ThumbnailFormat struct {
+	Name        string
+	ContentType string
+	Ext         string
+	codec       []string
+}
+
+var (
+	ThumbnailJPEG = ThumbnailFormat{"jpeg", "image/jpeg", ".jpg", []string{"-c:v", "mjpeg", "-q:v", "5", "-f", "mjpeg"}}
+	ThumbnailWebP = ThumbnailFormat{"webp", "image/webp", ".webp", []string{"-c:v", "libwebp", "-quality", "75", "-f", "webp"}}
+	ThumbnailAVIF = ThumbnailFormat{"avif", "image/avif", ".avif", []string{"-c:v", "libaom-av1", "-still-picture", "1", "-crf", "35", "-cpu-used", "8", "-f", "avif"}}
+)
+
+var (
+	// thumbnailTimeout bounds a single ffmpeg run
+	thumbnailTimeout = 20 * time.Second
+
+	// thumbnailFormatSupport reports which optional formats the local ffmpeg can
+	// write; swapped out in tests
+	thumbnailFormatSupport = detectThumbnailFormats
+	thumbnailFormats       map[string]bool
+	thumbnailFormatsOnce   sync.Once
+
+	thumbnailHits, thumbnailMisses, thumbnailFailures, thumbnailTimeouts, thumbnailEvictions int64
+)
+
+// ThumbnailDir returns where generated thumbnails are cached
+func ThumbnailDir() string {
+	return filepath.Join(ConfigPath(), "thumbnails")
+}
+
+func detectThumbnailFormats() map[string]bool {
+	supported := map[string]bool{}
+	encoders, err := exec.Command("ffmpeg", "-hide_banner", "-encoders").CombinedOutput()
+	if err != nil {
+		return supported
+	}
+	muxers, _ := exec.Command("ffmpeg", "-hide_banner", "-muxers").CombinedOutput()
+	supported["webp"] = strings.Contains(string(encoders), "libwebp")
+	supported["avif"] = strings.Contains(string(encoders), "libaom-av1") && strings.Contains(string(muxers), " avif ")
+	return supported
+}
+
+func thumbnailFormatSupported(f ThumbnailFormat) bool {
+	thumbnailFormatsOnce.Do(func() { thumbnailFormats = thumbnailFormatSupport() })
+	return f.Name == ThumbnailJPEG.Name || thumbnailFormats[f.Name]
+}
+
+// NegotiateThumbnailFormat picks the smallest format both the client (per its Accept
+// header) and ffmpeg support: AVIF, then WebP, falling back to JPEG.
+func NegotiateThumbnailFormat(accept string) ThumbnailFormat {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		refused := false
+		for _, param := range fields[1:] {
+			if q, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+					refused = true
+				}
+			}
+		}
+		if !refused {
+			accepted[mediaType] = true
+		}
+	}
+	for _, f := range []ThumbnailFormat{ThumbnailAVIF, ThumbnailWebP} {
+		if accepted[f.ContentType] && thumbnailFormatSupported(f) {
+			return f
+		}
+	}
+	return ThumbnailJPEG
+}
+
+// bestThumbnailFormat is what a current browser negotiates, used for pre-warming
+func bestThumbnailFormat() ThumbnailFormat {
+	return NegotiateThumbnailFormat("image/avif,image/webp,*/*")
+}
+
+func thumbnailArgs(input string, seek float64, width int, format ThumbnailFormat, output string) []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-ss", fmt.Sprintf("%.3f", seek), "-i", input,
+		"-frames:v", "1", "-an", "-vf", fmt.Sprintf("scale=%d:-2", width)}
+	args = append(args, format.codec...)
+	return append(args, "-y", output)
+}
+
+// Thumbnail returns the path of a still of path at seek seconds, generating it on
+// first request. The key covers the file's size and modification time, so replaced
+// footage never serves a stale image. Simultaneous requests share one ffmpeg run,
+// which is stopped once every requester has gone or after thumbnailTimeout.
+func Thumbnail(ctx context.Context, path string, seek float64, width int, format ThumbnailFormat) (string, error) {
+	key, err := hlsCacheKey(path)
+	if err != nil {
+		return "", err
+	}
+	output := filepath.Join(ThumbnailDir(), fmt.Sprintf("%s_%d_%d%s", key, int64(math.Round(seek*1000)), width, format.Ext))
+
+	if fi, err := os.Stat(output); err == nil && fi.Size() > 0 {
+		atomic.AddInt64(&thumbnailHits, 1)
+	} else {
+		atomic.AddInt64(&thumbnailMisses, 1)
+	}
+	thumb, err := cachedFile(ctx, output, nil, cacheOptions{timeout: thumbnailTimeout, abandon: true}, func(tmp string) []string {
+		return thumbnailArgs(path, seek, width, format, tmp)
+	})
+	switch {
+	case err == context.DeadlineExceeded:
+		atomic.AddInt64(&thumbnailTimeouts, 1)
+	case err != nil && err != context.Canceled:
+		atomic.AddInt64(&thumbnailFailures, 1)
+	}
+	return thumb, err
+}
+
+// EvictThumbnailCache removes thumbnails (and storyboard sprites) not viewed within
+// THUMBNAIL_CACHE_MAX_AGE_DAYS, then the least recently viewed ones until the cache
+// fits THUMBNAIL_CACHE_MB.
+func EvictThumbnailCache(now time.Time) {
+	maxAge := time.Duration(envInt("THUMBNAIL_CACHE_MAX_AGE_DAYS", defaultThumbnailCacheMaxAgeDays)) * 24 * time.Hour
+	quota := int64(envInt("THUMBNAIL_CACHE_MB", defaultThumbnailCacheMB)) * 1024 * 1024
+	removed := evictCache(ThumbnailDir(), maxAge, quota, now)
+	atomic.AddInt64(&thumbnailEvictions, int64(removed))
+}
+
+// ThumbnailCacheStats summarises the thumbnail cache for the admin endpoint
+func ThumbnailCacheStats() map[string]interface{} {
+	var files, bytes int64
+	filepath.Walk(ThumbnailDir(), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !strings.HasSuffix(path, ".tmp") {
+			files++
+			bytes += info.Size()
+		}
+		return nil
+	})
+	formats := []string{ThumbnailJPEG.Name}
+	for _, f := range []ThumbnailFormat{ThumbnailWebP, ThumbnailAVIF} {
+		if thumbnailFormatSupported(f) {
+			formats = append(formats, f.Name)
+		}
+	}
+	return map[string]interface{}{
+		"files":           files,
+		"bytes":           bytes,
+		"limit_mb":        envInt("THUMBNAIL_CACHE_MB", defaultThumbnailCacheMB),
+		"max_age_days":    envInt("THUMBNAIL_CACHE_MAX_AGE_DAYS", defaultThumbnailCacheMaxAgeDays),
+		"hits":            atomic.LoadInt64(&thumbnailHits),
+		"misses":          atomic.LoadInt64(&thumbnailMisses),
+		"failures":        atomic.LoadInt64(&thumbnailFailures),
+		"timeouts":        atomic.LoadInt64(&thumbnailTimeouts),
+		"evicted":         atomic.LoadInt64(&thumbnailEvictions),
+		"formats":         formats,
+		"prewarm_pending": thumbnailWorker.pendingCount(),
+	}
+}
+
+// clipListThumbnail mirrors the clip list: the last Front file starting at or before
+// the event (else the first Front file), at the event's offset into it.
+func clipListThumbnail(clip models.Clip) (string, float64, bool) {
+	var target *models.VideoFile
+	if clip.EventTimestamp != nil {
+		for i := len(clip.VideoFiles) - 1; i >= 0; i-- {
+			vf := &clip.VideoFiles[i]
+			if vf.Camera == "Front" && !vf.Timestamp.After(*clip.EventTimestamp) {
+				target = vf
+				break
+			}
+		}
+	}
+	if target == nil {
+		for i := range clip.VideoFiles {
+			if clip.VideoFiles[i].Camera == "Front" {
+				target = &clip.VideoFiles[i]
+				break
+			}
+		}
+	}
+	if target == nil {
+		return "", 0, false
+	}
+
+	seek := 0.0
+	if clip.EventTimestamp != nil {
+		if diff := clip.EventTimestamp.Sub(target.Timestamp).Seconds(); diff >= 0 && diff < 600 {
+			// The clip list asks with one decimal (toFixed rounds halves up)
+			seek = math.Round(diff*10) / 10
+		}
+	}
+	return target.FilePath, seek, true
+}
+
+var thumbnailWorker = newClipWorker(prewarmClipThumbnail)
+
+// StartThumbnailWorker pre-warms the clip-list thumbnail of every scanned clip
+// unless THUMBNAIL_PREWARM is false
+func StartThumbnailWorker() {
+	if strings.EqualFold(os.Getenv("THUMBNAIL_PREWARM"), "false") {
+		return
+	}
+	thumbnailWorker.start()
+}
+
+// QueueThumbnails schedules the clip-list thumbnail of a clip
+func QueueThumbnails(clipID uint) {
+	thumbnailWorker.enqueue(clipID)
+}
+
+func prewarmClipThumbnail(clipID uint) error {
+	if database.DB == nil {
+		return nil
+	}
+	var clip models.Clip
+	err := database.DB.Preload("VideoFiles", func(db *gorm.DB) *gorm.DB {
+		return db.Order("timestamp asc")
+	}).First(&clip, clipID).Error
+	if err != nil {
+		return err
+	}
+	path, seek, ok := clipListThumbnail(clip)
+	if !ok {
+		return nil
+	}
+	if _, err := Thumbnail(context.Background(), path, seek, ClipListThumbnailWidth, bestThumbnailFormat()); err != nil {
+		log.Printf("Thumbnail pre-warm for clip %d failed: %v", clipID, err)
+	}
+	return nil
+}
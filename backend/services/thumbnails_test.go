@@ -0,0 +1,215 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"teslaxy/database"
+	"teslaxy/models"
+)
+
+// stubThumbnailFormats fixes which optional formats ffmpeg "supports"
+func stubThumbnailFormats(t *testing.T, supported map[string]bool) {
+	thumbnailFormatsOnce.Do(func() {})
+	original := thumbnailFormats
+	thumbnailFormats = supported
+	t.Cleanup(func() { thumbnailFormats = original })
+}
+
+func TestNegotiateThumbnailFormat(t *testing.T) {
+	browser := "image/avif,image/webp,image/apng,image/*,*/*;q=0.8"
+	for _, tc := range []struct {
+		name      string
+		supported map[string]bool
+		accept    string
+		want      string
+	}{
+		{"No Accept header", map[string]bool{"avif": true, "webp": true}, "", "jpeg"},
+		{"AVIF preferred", map[string]bool{"avif": true, "webp": true}, browser, "avif"},
+		{"ffmpeg without AVIF", map[string]bool{"webp": true}, browser, "webp"},
+		{"ffmpeg without either", map[string]bool{}, browser, "jpeg"},
+		{"AVIF refused", map[string]bool{"avif": true, "webp": true}, "image/avif;q=0, image/webp", "webp"},
+		{"Only JPEG accepted", map[string]bool{"avif": true, "webp": true}, "image/jpeg", "jpeg"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stubThumbnailFormats(t, tc.supported)
+			if got := NegotiateThumbnailFormat(tc.accept); got.Name != tc.want {
+				t.Errorf("Expected %s, got %s", tc.want, got.Name)
+			}
+		})
+	}
+}
+
+func TestThumbnailArgs(t *testing.T) {
+	args := strings.Join(thumbnailArgs("/footage/front.mp4", 12.3, 160, ThumbnailWebP, "/config/t.webp.tmp"), " ")
+	for _, want := range []string{"-ss 12.300 -i /footage/front.mp4", "-frames:v 1", "scale=160:-2", "-c:v libwebp", "-f webp -y /config/t.webp.tmp"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("Expected %q in %s", want, args)
+		}
+	}
+}
+
+func TestThumbnail_SharedAndCached(t *testing.T) {
+	source, runs := stubHLS(t, VideoInfo{})
+	hitsBefore := atomic.LoadInt64(&thumbnailHits)
+
+	var wg sync.WaitGroup
+	paths := make([]string, 5)
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			paths[i], _ = Thumbnail(context.Background(), source, 12.3, 160, ThumbnailJPEG)
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(runs); n != 1 {
+		t.Errorf("Expected simultaneous requests to share one ffmpeg run, got %d", n)
+	}
+	if paths[0] == "" || paths[0] != paths[4] || !strings.HasPrefix(paths[0], ThumbnailDir()) || !strings.HasSuffix(paths[0], "_12300_160.jpg") {
+		t.Errorf("Unexpected thumbnail paths %v", paths)
+	}
+
+	if _, err := Thumbnail(context.Background(), source, 12.3, 160, ThumbnailJPEG); err != nil || atomic.LoadInt32(runs) != 1 {
+		t.Errorf("Expected a cache hit, err=%v runs=%d", err, atomic.LoadInt32(runs))
+	}
+	if atomic.LoadInt64(&thumbnailHits) != hitsBefore+1 {
+		t.Error("Expected the hit to be counted")
+	}
+	// Each format is cached separately
+	if p, _ := Thumbnail(context.Background(), source, 12.3, 160, ThumbnailWebP); !strings.HasSuffix(p, ".webp") || atomic.LoadInt32(runs) != 2 {
+		t.Errorf("Expected a separate WebP thumbnail, got %s", p)
+	}
+}
+
+// blockingEncoder waits for its context and reports when it was stopped
+func blockingEncoder(t *testing.T) chan error {
+	stopped := make(chan error, 1)
+	original := hlsEncoder
+	hlsEncoder = func(ctx context.Context, args []string, job *transcodeJob) (time.Duration, error) {
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		return 0, ctx.Err()
+	}
+	t.Cleanup(func() { hlsEncoder = original })
+	return stopped
+}
+
+func TestThumbnail_Abandoned(t *testing.T) {
+	source, _ := stubHLS(t, VideoInfo{})
+	stopped := blockingEncoder(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := Thumbnail(ctx, source, 1, 160, ThumbnailJPEG); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	select {
+	case err := <-stopped:
+		if err != context.Canceled {
+			t.Errorf("Expected ffmpeg to be cancelled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected ffmpeg to stop once nobody waits for the thumbnail")
+	}
+}
+
+func TestThumbnail_Timeout(t *testing.T) {
+	source, _ := stubHLS(t, VideoInfo{})
+	blockingEncoder(t)
+	original := thumbnailTimeout
+	thumbnailTimeout = 30 * time.Millisecond
+	t.Cleanup(func() { thumbnailTimeout = original })
+
+	timeouts := atomic.LoadInt64(&thumbnailTimeouts)
+	if _, err := Thumbnail(context.Background(), source, 1, 160, ThumbnailJPEG); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if atomic.LoadInt64(&thumbnailTimeouts) != timeouts+1 {
+		t.Error("Expected the timeout to be counted")
+	}
+}
+
+func TestEvictThumbnailCache(t *testing.T) {
+	stubHLS(t, VideoInfo{})
+	os.Setenv("THUMBNAIL_CACHE_MB", "1")
+	t.Cleanup(func() { os.Unsetenv("THUMBNAIL_CACHE_MB") })
+
+	now := time.Now()
+	write := func(rel string, size int, age time.Duration) string {
+		p := filepath.Join(ThumbnailDir(), rel)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, make([]byte, size), 0644)
+		os.Chtimes(p, now.Add(-age), now.Add(-age))
+		return p
+	}
+	expired := write("aaaa_0_160.jpg", 10, 40*24*time.Hour)
+	oldest := write("storyboards/bbbb.jpg", 600*1024, 3*time.Hour)
+	newest := write("cccc_0_160.webp", 600*1024, time.Hour)
+
+	EvictThumbnailCache(now)
+
+	for _, p := range []string{expired, oldest} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be evicted", p)
+		}
+	}
+	if _, err := os.Stat(newest); err != nil {
+		t.Error("Expected the most recently viewed thumbnail to be kept")
+	}
+	if stats := ThumbnailCacheStats(); stats["files"] != int64(1) || stats["bytes"] != int64(600*1024) {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+}
+
+func TestClipListThumbnail(t *testing.T) {
+	base := time.Date(2024, 7, 1, 3, 0, 0, 0, time.UTC)
+	event := base.Add(75*time.Second + 250*time.Millisecond)
+	clip := models.Clip{EventTimestamp: &event, VideoFiles: []models.VideoFile{
+		{Camera: "Front", FilePath: "/f/0-front.mp4", Timestamp: base},
+		{Camera: "Back", FilePath: "/f/1-back.mp4", Timestamp: base.Add(time.Minute)},
+		{Camera: "Front", FilePath: "/f/1-front.mp4", Timestamp: base.Add(time.Minute)},
+		{Camera: "Front", FilePath: "/f/2-front.mp4", Timestamp: base.Add(2 * time.Minute)},
+	}}
+
+	// The last Front file before the event, at the event's offset to one decimal
+	if path, seek, ok := clipListThumbnail(clip); !ok || path != "/f/1-front.mp4" || seek != 15.3 {
+		t.Errorf("Got %s at %g", path, seek)
+	}
+	// Without an event, the start of the first Front file
+	clip.EventTimestamp = nil
+	if path, seek, _ := clipListThumbnail(clip); path != "/f/0-front.mp4" || seek != 0 {
+		t.Errorf("Got %s at %g", path, seek)
+	}
+	if _, _, ok := clipListThumbnail(models.Clip{VideoFiles: clip.VideoFiles[1:2]}); ok {
+		t.Error("Expected no thumbnail without Front footage")
+	}
+}
+
+func TestPrewarmClipThumbnail(t *testing.T) {
+	setupExportDB(t)
+	_, runs := stubHLS(t, VideoInfo{})
+	stubThumbnailFormats(t, map[string]bool{"webp": true})
+
+	clip := createProxyClip(t, "Sentry", time.Now(), "Front", "Back")
+	event := clip.Timestamp.Add(10 * time.Second)
+	database.DB.Model(&clip).Update("event_timestamp", event)
+
+	if err := prewarmClipThumbnail(clip.ID); err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(ThumbnailDir(), "*_10000_160.webp"))
+	if len(matches) != 1 || atomic.LoadInt32(runs) != 1 {
+		t.Errorf("Expected the clip list thumbnail to be generated once, got %v", matches)
+	}
+}
@@ -0,0 +1,431 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"teslaxy/database"
+	"teslaxy/models"
+	pb "teslaxy/proto"
+)
+
+const (
+	MinTimelapseSpeedUp = 2.0
+	MaxTimelapseSpeedUp = 600.0
+	MaxTimelapseRange   = 24 * time.Hour
+
+	// stationarySpeedMps is the SEI vehicle_speed_mps below which the car is considered parked/stopped
+	stationarySpeedMps = 0.5
+	// minMovingWindow drops moving windows shorter than this (seconds), e.g. creeping in traffic
+	minMovingWindow = 1.0
+	// mergeWindowGap joins moving windows separated by a short stop (seconds)
+	mergeWindowGap = 2.0
+
+	// Tesla writes one file per camera per minute
+	defaultSegmentDuration = 60.0
+
+	// Each camera is scaled/padded to a common tile size so any layout can be stacked
+	timelapseTileWidth  = 960
+	timelapseTileHeight = 720
+	timelapseFPS        = 30
+)
+
+// seiExtractor reads SEI samples outside the scanner; swappable for tests
+var seiExtractor SEIExtractor = ExtractSEI
+
+// timeWindow is an offset range (seconds) within a segment
+type timeWindow struct {
+	Start float64
+	End   float64
+}
+
+// timelapseSegment is one minute-long camera set (all cameras sharing a timestamp)
+type timelapseSegment struct {
+	Start    time.Time
+	Duration float64
+	Files    map[string]string // normalized camera -> path
+	Windows  []timeWindow
+	// SEIFile is the Front file of the minute, which carries the vehicle speed even
+	// when Front isn't one of the exported cameras
+	SEIFile string
+}
+
+// loadTimelapseClips resolves the clips covered by a timelapse request
+func loadTimelapseClips(req ExportRequest) ([]models.Clip, error) {
+	var clips []models.Clip
+	query := database.DB.Preload("VideoFiles", func(db *gorm.DB) *gorm.DB {
+		return db.Order("timestamp asc")
+	})
+
+	if req.ClipID != 0 {
+		var clip models.Clip
+		if err := query.First(&clip, req.ClipID).Error; err != nil {
+			return nil, err
+		}
+		clips = append(clips, clip)
+	} else {
+		// Clips overlapping the range: a clip that started earlier still covers its
+		// beginning when its last file runs past From. planTimelapse trims them.
+		lastStart := req.From.Add(-time.Duration(defaultSegmentDuration) * time.Second)
+		if err := query.Where("timestamp < ? AND id IN (?)", *req.To,
+			database.DB.Table("video_files").Select("clip_id").Where("timestamp >= ?", lastStart).QueryExpr()).
+			Order("timestamp asc").Find(&clips).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	if len(clips) == 0 {
+		return nil, fmt.Errorf("no clips found for the requested range")
+	}
+	return clips, nil
+}
+
+// planTimelapse groups the clips' video files into ordered minute segments and
+// restricts them to the requested window. Segments without any of the requested
+// cameras are dropped.
+func planTimelapse(req ExportRequest, clips []models.Clip) []timelapseSegment {
+	wanted := make(map[string]bool)
+	for _, cam := range req.Cameras {
+		wanted[NormalizeCameraName(cam)] = true
+	}
+
+	byTime := make(map[time.Time]*timelapseSegment)
+	for _, clip := range clips {
+		for _, vf := range clip.VideoFiles {
+			cam := NormalizeCameraName(vf.Camera)
+			seg, ok := byTime[vf.Timestamp]
+			if !ok {
+				seg = &timelapseSegment{Start: vf.Timestamp, Files: make(map[string]string)}
+				byTime[vf.Timestamp] = seg
+			}
+			if cam == "Front" {
+				seg.SEIFile = vf.FilePath
+			}
+			if wanted[cam] {
+				seg.Files[cam] = vf.FilePath
+			}
+		}
+	}
+
+	var segments []timelapseSegment
+	for _, seg := range byTime {
+		if len(seg.Files) > 0 {
+			segments = append(segments, *seg)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Start.Before(segments[j].Start)
+	})
+
+	// Duration: gap to the next segment, capped at a minute
+	for i := range segments {
+		segments[i].Duration = defaultSegmentDuration
+		if i+1 < len(segments) {
+			gap := segments[i+1].Start.Sub(segments[i].Start).Seconds()
+			if gap > 0 && gap < defaultSegmentDuration {
+				segments[i].Duration = gap
+			}
+		}
+		segments[i].Windows = []timeWindow{{Start: 0, End: segments[i].Duration}}
+	}
+
+	// Single clip: honour start_time/duration relative to the first segment.
+	// Date range: keep what lies between From and To.
+	var origin time.Time
+	from, to := 0.0, -1.0
+	switch {
+	case req.ClipID != 0 && len(segments) > 0 && (req.StartTime > 0 || req.Duration > 0):
+		origin = segments[0].Start
+		from = req.StartTime
+		if req.Duration > 0 {
+			to = req.StartTime + req.Duration
+		}
+	case req.ClipID == 0 && req.From != nil && req.To != nil:
+		origin = *req.From
+		to = req.To.Sub(*req.From).Seconds()
+	default:
+		return segments
+	}
+
+	var kept []timelapseSegment
+	for _, seg := range segments {
+		offset := seg.Start.Sub(origin).Seconds()
+		w := timeWindow{Start: from - offset, End: seg.Duration}
+		if to >= 0 {
+			w.End = to - offset
+		}
+		seg.Windows = intersectWindows(seg.Windows, w)
+		if len(seg.Windows) > 0 {
+			kept = append(kept, seg)
+		}
+	}
+	return kept
+}
+
+// movingWindows derives the periods (seconds into the segment) during which the
+// car was moving, assuming SEI samples are evenly spread over the segment.
+// Without SEI data the whole segment is kept since we can't tell.
+func movingWindows(samples []*pb.SeiMetadata, duration float64) []timeWindow {
+	if len(samples) == 0 {
+		return []timeWindow{{Start: 0, End: duration}}
+	}
+
+	step := duration / float64(len(samples))
+	var windows []timeWindow
+	var current *timeWindow
+
+	for i, s := range samples {
+		t := float64(i) * step
+		if s.VehicleSpeedMps >= stationarySpeedMps {
+			if current == nil {
+				current = &timeWindow{Start: t}
+			}
+			current.End = t + step
+			continue
+		}
+		if current != nil {
+			windows = append(windows, *current)
+			current = nil
+		}
+	}
+	if current != nil {
+		windows = append(windows, *current)
+	}
+
+	// Merge short stops, then drop blips
+	var merged []timeWindow
+	for _, w := range windows {
+		if n := len(merged); n > 0 && w.Start-merged[n-1].End <= mergeWindowGap {
+			merged[n-1].End = w.End
+			continue
+		}
+		merged = append(merged, w)
+	}
+
+	var result []timeWindow
+	for _, w := range merged {
+		if w.End-w.Start >= minMovingWindow {
+			result = append(result, w)
+		}
+	}
+	return result
+}
+
+// intersectWindows clips each window to bound, dropping empty results
+func intersectWindows(windows []timeWindow, bound timeWindow) []timeWindow {
+	var result []timeWindow
+	for _, w := range windows {
+		if w.Start < bound.Start {
+			w.Start = bound.Start
+		}
+		if w.End > bound.End {
+			w.End = bound.End
+		}
+		if w.End > w.Start {
+			result = append(result, w)
+		}
+	}
+	return result
+}
+
+// timelapseChunkArgs builds the ffmpeg arguments rendering one window of a segment.
+// Every requested camera becomes a fixed-size tile (black if missing in this segment),
+// masked if it has privacy masks, then the tiles are stacked with the standard layout
+// and sped up by dropping frames.
+func timelapseChunkArgs(seg timelapseSegment, w timeWindow, cameras []string, masks map[string][]MaskRegion, speedUp float64, videoCodec []string, output string) []string {
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	length := w.End - w.Start
+
+	for _, cam := range cameras {
+		if path, ok := seg.Files[cam]; ok {
+			args = append(args, "-ss", fmt.Sprintf("%f", w.Start), "-t", fmt.Sprintf("%f", length), "-i", path)
+		} else {
+			args = append(args, "-f", "lavfi", "-t", fmt.Sprintf("%f", length),
+				"-i", fmt.Sprintf("color=c=black:s=%dx%d:r=%d", timelapseTileWidth, timelapseTileHeight, timelapseFPS))
+		}
+	}
+
+	var parts []string
+	var labels []string
+	for i, cam := range cameras {
+		input := fmt.Sprintf("[%d:v]", i)
+		if _, ok := seg.Files[cam]; ok && len(masks[cam]) > 0 {
+			masked := fmt.Sprintf("[k%d]", i)
+			parts = append(parts, maskFilter(input, masks[cam], masked, fmt.Sprintf("k%d", i)))
+			input = masked
+		}
+		label := fmt.Sprintf("[t%d]", i)
+		parts = append(parts, fmt.Sprintf("%sscale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1%s",
+			input, timelapseTileWidth, timelapseTileHeight, timelapseTileWidth, timelapseTileHeight, label))
+		labels = append(labels, label)
+	}
+	parts = append(parts, layoutFilter(labels, "[grid]"))
+	parts = append(parts, fmt.Sprintf("[grid]setpts=PTS/%g,fps=%d[v]", speedUp, timelapseFPS))
+
+	args = append(args, "-filter_complex", strings.Join(parts, ";"), "-map", "[v]", "-an")
+	args = append(args, videoCodec...)
+	args = append(args, "-y", output)
+	return args
+}
+
+// tiledVideoCodec returns the encoder flags for chunked exports. Every chunk of a job
+// must use the same flags so the concat demuxer can join them without re-encoding.
+func tiledVideoCodec() []string {
+	if CheckForNvidiaGPU() {
+		return []string{"-c:v", "h264_nvenc", "-preset", "fast", "-pix_fmt", "yuv420p"}
+	}
+	return []string{"-c:v", "libx264", "-preset", "fast", "-pix_fmt", "yuv420p"}
+}
+
+// concatChunks joins identically encoded chunks into output without re-encoding
+func concatChunks(listPath string, chunks []string, output string) error {
+	var list strings.Builder
+	for _, chunk := range chunks {
+		list.WriteString(fmt.Sprintf("file '%s'\n", chunk))
+	}
+	if err := os.WriteFile(listPath, []byte(list.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write chunk list: %w", err)
+	}
+
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-loglevel", "error", "-f", "concat", "-safe", "0", "-i", listPath, "-c", "copy", "-movflags", "+faststart", "-y", output)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// dropStationary cuts each segment down to the periods the car was moving.
+// Segments whose SEI can't be read are kept whole.
+func dropStationary(segments []timelapseSegment, cameras []string) []timelapseSegment {
+	var moving []timelapseSegment
+	for _, seg := range segments {
+		if samples := segmentSEI(seg, cameras); samples != nil {
+			var windows []timeWindow
+			for _, w := range seg.Windows {
+				for _, m := range movingWindows(samples, seg.Duration) {
+					windows = append(windows, intersectWindows([]timeWindow{m}, w)...)
+				}
+			}
+			seg.Windows = windows
+		}
+		if len(seg.Windows) > 0 {
+			moving = append(moving, seg)
+		}
+	}
+	return moving
+}
+
+// segmentSEI reads the SEI samples of a segment from its Front file, falling back
+// to the exported cameras for minutes without Front footage
+func segmentSEI(seg timelapseSegment, cameras []string) []*pb.SeiMetadata {
+	sources := []string{seg.SEIFile}
+	for _, cam := range cameras {
+		sources = append(sources, seg.Files[cam])
+	}
+	for _, path := range sources {
+		if path == "" {
+			continue
+		}
+		if samples, err := seiExtractor(path); err == nil && len(samples) > 0 {
+			return samples
+		}
+	}
+	return nil
+}
+
+// processTimelapse renders each moving window as a sped-up chunk and concatenates them.
+// Chunks keep the ffmpeg graphs small for multi-hour drives and give us progress updates.
+func processTimelapse(jobID string, req ExportRequest, clips []models.Clip) {
+	updateStatus(jobID, "processing", 0, "")
+
+	segments := planTimelapse(req, clips)
+	if len(segments) == 0 {
+		updateStatus(jobID, "failed", 0, "No valid camera files found for selection")
+		return
+	}
+
+	// Keep camera order stable and only include cameras that actually have footage
+	var cameras []string
+	seen := make(map[string]bool)
+	for _, cam := range req.Cameras {
+		name := NormalizeCameraName(cam)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		for _, seg := range segments {
+			if _, ok := seg.Files[name]; ok {
+				cameras = append(cameras, name)
+				break
+			}
+		}
+	}
+
+	if req.SkipStationary {
+		segments = dropStationary(segments, cameras)
+		if len(segments) == 0 {
+			updateStatus(jobID, "failed", 0, "No movement found in the selected footage")
+			return
+		}
+	}
+
+	exportDir := ExportDir()
+	workDir := filepath.Join(exportDir, jobID+"_work")
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		updateStatus(jobID, "failed", 0, "Failed to create export directory: "+err.Error())
+		return
+	}
+	defer os.RemoveAll(workDir)
+
+	videoCodec := tiledVideoCodec()
+	masks := make(map[string][]MaskRegion)
+	if !req.IgnoreSavedMasks {
+		masks = savedMasks()
+	}
+
+	total := 0
+	for _, seg := range segments {
+		total += len(seg.Windows)
+	}
+
+	var chunks []string
+	done := 0
+	for _, seg := range segments {
+		for _, w := range seg.Windows {
+			chunk := filepath.Join(workDir, fmt.Sprintf("chunk_%05d.mp4", done))
+			args := timelapseChunkArgs(seg, w, cameras, masks, req.SpeedUp, videoCodec, chunk)
+			if out, err := exec.Command("ffmpeg", args...).CombinedOutput(); err != nil {
+				// A single unreadable minute shouldn't sink a two-hour timelapse
+				log.Printf("Timelapse chunk %d failed: %v, Output: %s", done, err, string(out))
+			} else {
+				chunks = append(chunks, chunk)
+			}
+			done++
+			// Reserve the last 5% for concatenation
+			updateStatus(jobID, "processing", float64(done)/float64(total)*95, "")
+		}
+	}
+
+	if len(chunks) == 0 {
+		updateStatus(jobID, "failed", 0, "Encoding failed for all segments")
+		return
+	}
+
+	outputFilename := fmt.Sprintf("timelapse_%s_%gx_%s.mp4", segments[0].Start.Format("20060102_150405"), req.SpeedUp, jobID)
+	outputPath := filepath.Join(exportDir, outputFilename)
+
+	if err := concatChunks(filepath.Join(workDir, "chunks.txt"), chunks, outputPath); err != nil {
+		log.Printf("Timelapse concat failed: %v", err)
+		updateStatus(jobID, "failed", 0, "Concatenation failed: "+err.Error())
+		return
+	}
+
+	completeExport(jobID, outputFilename)
+}
@@ -0,0 +1,207 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"teslaxy/database"
+	"teslaxy/models"
+	pb "teslaxy/proto"
+)
+
+func speedSamples(speeds ...float32) []*pb.SeiMetadata {
+	var samples []*pb.SeiMetadata
+	for _, s := range speeds {
+		samples = append(samples, &pb.SeiMetadata{VehicleSpeedMps: s})
+	}
+	return samples
+}
+
+func TestMovingWindows(t *testing.T) {
+	t.Run("No SEI keeps whole segment", func(t *testing.T) {
+		windows := movingWindows(nil, 60)
+		if len(windows) != 1 || windows[0].Start != 0 || windows[0].End != 60 {
+			t.Errorf("Expected [0,60], got %v", windows)
+		}
+	})
+
+	t.Run("Parked segment is dropped", func(t *testing.T) {
+		windows := movingWindows(speedSamples(0, 0, 0, 0, 0, 0), 60)
+		if len(windows) != 0 {
+			t.Errorf("Expected no windows, got %v", windows)
+		}
+	})
+
+	t.Run("Stationary tail is trimmed", func(t *testing.T) {
+		// 6 samples over 60s -> 10s each; moving for the first 30s
+		windows := movingWindows(speedSamples(10, 10, 10, 0, 0, 0), 60)
+		if len(windows) != 1 || windows[0].Start != 0 || windows[0].End != 30 {
+			t.Errorf("Expected [0,30], got %v", windows)
+		}
+	})
+
+	t.Run("Short stop is merged", func(t *testing.T) {
+		// 1s per sample: moving, 1s stop, moving
+		windows := movingWindows(speedSamples(5, 5, 0, 5, 5), 5)
+		if len(windows) != 1 || windows[0].Start != 0 || windows[0].End != 5 {
+			t.Errorf("Expected a single merged window, got %v", windows)
+		}
+	})
+}
+
+func TestPlanTimelapse(t *testing.T) {
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	clip := models.Clip{
+		ID: 1,
+		VideoFiles: []models.VideoFile{
+			{Camera: "Front", FilePath: "/f/1-front.mp4", Timestamp: base},
+			{Camera: "Back", FilePath: "/f/1-back.mp4", Timestamp: base},
+			{Camera: "Front", FilePath: "/f/2-front.mp4", Timestamp: base.Add(time.Minute)},
+			{Camera: "Front", FilePath: "/f/3-front.mp4", Timestamp: base.Add(2 * time.Minute)},
+			{Camera: "Left Repeater", FilePath: "/f/3-left.mp4", Timestamp: base.Add(2 * time.Minute)},
+		},
+	}
+
+	t.Run("Groups files by minute", func(t *testing.T) {
+		req := ExportRequest{ClipID: 1, Cameras: []string{"front", "back"}, Mode: ExportModeTimelapse, SpeedUp: 10}
+		segments := planTimelapse(req, []models.Clip{clip})
+		if len(segments) != 3 {
+			t.Fatalf("Expected 3 segments, got %d", len(segments))
+		}
+		if len(segments[0].Files) != 2 {
+			t.Errorf("Expected Front+Back in first segment, got %v", segments[0].Files)
+		}
+		if _, ok := segments[2].Files["Left Repeater"]; ok {
+			t.Error("Unrequested camera should not be planned")
+		}
+	})
+
+	t.Run("Honours clip window", func(t *testing.T) {
+		req := ExportRequest{ClipID: 1, Cameras: []string{"front"}, Mode: ExportModeTimelapse, SpeedUp: 10, StartTime: 90, Duration: 45}
+		segments := planTimelapse(req, []models.Clip{clip})
+		if len(segments) != 2 {
+			t.Fatalf("Expected 2 segments, got %d", len(segments))
+		}
+		if w := segments[0].Windows[0]; w.Start != 30 || w.End != 60 {
+			t.Errorf("Expected [30,60] in second minute, got %v", w)
+		}
+		if w := segments[1].Windows[0]; w.Start != 0 || w.End != 15 {
+			t.Errorf("Expected [0,15] in third minute, got %v", w)
+		}
+	})
+}
+
+func TestTimelapseDateRange(t *testing.T) {
+	setupExportDB(t)
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	// A drive from 10:00 to 10:03, one from 10:10 and one that ended before the range
+	for _, c := range []struct {
+		start   time.Time
+		minutes int
+	}{{base, 3}, {base.Add(10 * time.Minute), 1}, {base.Add(-time.Hour), 2}} {
+		clip := models.Clip{Timestamp: c.start, Event: "Recent"}
+		database.DB.Create(&clip)
+		for i := 0; i < c.minutes; i++ {
+			database.DB.Create(&models.VideoFile{ClipID: clip.ID, Camera: "Front", FilePath: fmt.Sprintf("/f/%d-%d.mp4", clip.ID, i), Timestamp: c.start.Add(time.Duration(i) * time.Minute)})
+		}
+	}
+
+	from, to := base.Add(90*time.Second), base.Add(10*time.Minute+30*time.Second)
+	req := ExportRequest{From: &from, To: &to, Cameras: []string{"front"}, Mode: ExportModeTimelapse, SpeedUp: 10}
+	clips, err := loadTimelapseClips(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clips) != 2 {
+		t.Fatalf("Expected the drive running into the range and the one inside it, got %d clips", len(clips))
+	}
+
+	segments := planTimelapse(req, clips)
+	if len(segments) != 3 {
+		t.Fatalf("Expected minutes 10:01, 10:02 and 10:10, got %d segments", len(segments))
+	}
+	if w := segments[0].Windows[0]; w.Start != 30 || w.End != 60 {
+		t.Errorf("Expected the range to start 30s into 10:01, got %v", w)
+	}
+	if w := segments[2].Windows[0]; w.Start != 0 || w.End != 30 {
+		t.Errorf("Expected the range to end 30s into 10:10, got %v", w)
+	}
+}
+
+func TestDropStationary(t *testing.T) {
+	original := seiExtractor
+	t.Cleanup(func() { seiExtractor = original })
+	var read []string
+	seiExtractor = func(path string) ([]*pb.SeiMetadata, error) {
+		read = append(read, path)
+		if strings.HasSuffix(path, "-front.mp4") {
+			return speedSamples(10, 10, 10, 0, 0, 0), nil
+		}
+		return nil, nil
+	}
+
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	clip := models.Clip{VideoFiles: []models.VideoFile{
+		{Camera: "Front", FilePath: "/f/1-front.mp4", Timestamp: base},
+		{Camera: "Back", FilePath: "/f/1-back.mp4", Timestamp: base},
+		{Camera: "Back", FilePath: "/f/2-back.mp4", Timestamp: base.Add(time.Minute)},
+	}}
+	req := ExportRequest{Cameras: []string{"back"}, Mode: ExportModeTimelapse, SpeedUp: 10, SkipStationary: true}
+	segments := dropStationary(planTimelapse(req, []models.Clip{clip}), []string{"Back"})
+
+	// Speed comes from Front even though only Back is exported
+	if len(segments) != 2 {
+		t.Fatalf("Expected 2 segments, got %d", len(segments))
+	}
+	if w := segments[0].Windows; len(w) != 1 || w[0].Start != 0 || w[0].End != 30 {
+		t.Errorf("Expected the first minute trimmed to [0,30] by the Front speed, got %v", w)
+	}
+	// Without Front footage (or any SEI) the minute is kept whole
+	if w := segments[1].Windows; len(w) != 1 || w[0].End != 60 {
+		t.Errorf("Expected the second minute kept whole, got %v", w)
+	}
+	if strings.Join(read, ",") != "/f/1-front.mp4,/f/2-back.mp4" {
+		t.Errorf("Unexpected SEI sources %v", read)
+	}
+}
+
+func TestTimelapseChunkArgs(t *testing.T) {
+	seg := timelapseSegment{
+		Files: map[string]string{"Front": "/f/front.mp4"},
+	}
+	args := timelapseChunkArgs(seg, timeWindow{Start: 5, End: 35}, []string{"Front", "Back"}, nil, 60, []string{"-c:v", "libx264"}, "/tmp/out.mp4")
+	joined := strings.Join(args, " ")
+
+	if !strings.Contains(joined, "-i /f/front.mp4") {
+		t.Error("Expected front camera input")
+	}
+	if !strings.Contains(joined, "color=c=black") {
+		t.Error("Expected black filler for missing back camera")
+	}
+	if !strings.Contains(joined, "hstack=inputs=2") {
+		t.Error("Expected side-by-side layout for two cameras")
+	}
+	if !strings.Contains(joined, "setpts=PTS/60") {
+		t.Error("Expected 60x speed-up")
+	}
+}
+
+func TestLayoutFilter(t *testing.T) {
+	labels := []string{"[a]", "[b]", "[c]", "[d]", "[e]", "[f]"}
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{1, "[a]null[v]"},
+		{2, "[a][b]hstack=inputs=2[v]"},
+		{4, "[a][b][c][d]xstack=inputs=4:layout=0_0|w0_0|0_h0|w0_h0[v]"},
+		{6, "[a][b][c][d][e][f]xstack=inputs=6:layout=0_0|w0_0|w0+w1_0|0_h0|w0_h0|w0+w1_h0:fill=black[v]"},
+	}
+	for _, tt := range tests {
+		if got := layoutFilter(labels[:tt.n], "[v]"); got != tt.want {
+			t.Errorf("layoutFilter(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scheduler defaults. Override with TRANSCODE_MAX_CONCURRENT, TRANSCODE_QUEUE_LENGTH
+// and TRANSCODE_QUEUE_TIMEOUT (seconds).
+const (
+	defaultTranscodeQueueLength  = 16
+	defaultTranscodeQueueTimeout = 10
+
+	// TranscodeRetryAfter is the Retry-After (seconds) suggested to rejected clients
+	TranscodeRetryAfter = 3
+
+	// clockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat
+	clockTicks = 100
+)
+
+// ErrTranscoderBusy is returned when no transcode slot frees up in time
+var ErrTranscoderBusy = errors.New("transcoder busy, try again shortly")
+
+// TranscodeOptions describes who a transcode is for
+type TranscodeOptions struct {
+	// Session identifies one viewer. A new stream of the same file in the same
+	// session (e.g. after a seek) replaces the previous one instead of running twice.
+	Session string
+	// Focused marks the camera the viewer is looking at; it is served before the rest
+	Focused bool
+}
+
+// transcodeJob is one ffmpeg process, queued or running. Fields other than the
+// identity ones are guarded by the scheduler lock.
+type transcodeJob struct {
+	id      int64
+	file    string
+	quality string
+	opts    TranscodeOptions
+	cancel  context.CancelFunc
+	// background jobs (e.g. proxies) are queued behind viewers and never hold every
+	// slot (see backgroundLimit), but once started they run to the end
+	background bool
+
+	queuedAt  time.Time
+	startedAt time.Time
+	ready     chan struct{}
+	granted   bool
+	rejected  bool
+
+	pid   int
+	fps   float64
+	speed string
+}
+
+// rank orders the queue: focused cameras, other viewers, then background work
+func (j *transcodeJob) rank() int {
+	switch {
+	case j.background:
+		return 0
+	case j.opts.Focused:
+		return 2
+	}
+	return 1
+}
+
+func (j *transcodeJob) sessionKey() string {
+	if j.opts.Session == "" {
+		return ""
+	}
+	return j.opts.Session + "|" + j.file
+}
+
+type transcodeScheduler struct {
+	mu           sync.Mutex
+	limit        int
+	queueLength  int
+	queueTimeout time.Duration
+
+	nextID   int64
+	active   map[int64]*transcodeJob
+	waiting  []*transcodeJob // By rank, then by arrival
+	sessions map[string]*transcodeJob
+
+	completed  int64
+	rejected   int64
+	replaced   int64
+	cpuSeconds float64 // Finished processes only
+}
+
+func newTranscodeScheduler(limit, queueLength int, queueTimeout time.Duration) *transcodeScheduler {
+	if limit < 1 {
+		limit = 1
+	}
+	return &transcodeScheduler{
+		limit:        limit,
+		queueLength:  queueLength,
+		queueTimeout: queueTimeout,
+		active:       make(map[int64]*transcodeJob),
+		sessions:     make(map[string]*transcodeJob),
+	}
+}
+
+var (
+	transcoder     *transcodeScheduler
+	transcoderOnce sync.Once
+)
+
+// scheduler returns the process-wide transcode scheduler, configured from the environment
+func scheduler() *transcodeScheduler {
+	transcoderOnce.Do(func() {
+		if transcoder != nil {
+			return // Installed by a test
+		}
+		defaultLimit := runtime.NumCPU() / 2
+		if defaultLimit < 1 {
+			defaultLimit = 1
+		}
+		transcoder = newTranscodeScheduler(
+			envInt("TRANSCODE_MAX_CONCURRENT", defaultLimit),
+			envInt("TRANSCODE_QUEUE_LENGTH", defaultTranscodeQueueLength),
+			time.Duration(envInt("TRANSCODE_QUEUE_TIMEOUT", defaultTranscodeQueueTimeout))*time.Second,
+		)
+	})
+	return transcoder
+}
+
+// acquire waits for a slot for job. It fails with ErrTranscoderBusy when the queue is
+// full or no slot frees up within the queue timeout, and with ctx's error when the
+// client goes away first.
+func (s *transcodeScheduler) acquire(ctx context.Context, job *transcodeJob) error {
+	s.mu.Lock()
+	s.nextID++
+	job.id = s.nextID
+	job.queuedAt = time.Now()
+	job.ready = make(chan struct{})
+
+	if key := job.sessionKey(); key != "" {
+		if prev, ok := s.sessions[key]; ok && prev.cancel != nil {
+			prev.cancel()
+			s.replaced++
+		}
+		s.sessions[key] = job
+	}
+
+	// Insert after every waiter of equal or higher rank
+	pos := len(s.waiting)
+	for pos > 0 && s.waiting[pos-1].rank() < job.rank() {
+		pos--
+	}
+	s.waiting = append(s.waiting, nil)
+	copy(s.waiting[pos+1:], s.waiting[pos:])
+	s.waiting[pos] = job
+
+	s.dispatch()
+	if len(s.waiting) > s.queueLength {
+		// Turn away the newest, lowest-priority waiter (possibly this job)
+		s.reject(s.waiting[len(s.waiting)-1])
+	}
+	s.mu.Unlock()
+
+	timer := time.NewTimer(s.queueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-job.ready:
+		if job.rejected {
+			return ErrTranscoderBusy
+		}
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = ErrTranscoderBusy
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job.granted {
+		return nil // Granted while we gave up; the caller will release it
+	}
+	if !job.rejected {
+		if err == ErrTranscoderBusy {
+			s.reject(job)
+		} else {
+			s.remove(job)
+		}
+	}
+	if job.rejected {
+		return ErrTranscoderBusy
+	}
+	return err
+}
+
+// backgroundLimit is how many slots background jobs may hold at once: all but one,
+// so a viewer arriving while they run gets a slot straight away. With a single
+// slot, viewers may wait for a background job to finish.
+func (s *transcodeScheduler) backgroundLimit() int {
+	if s.limit > 1 {
+		return s.limit - 1
+	}
+	return 1
+}
+
+// dispatch grants slots to waiters in order, holding background jobs back once
+// they reach backgroundLimit. Callers hold s.mu.
+func (s *transcodeScheduler) dispatch() {
+	background := 0
+	for _, job := range s.active {
+		if job.background {
+			background++
+		}
+	}
+	for i := 0; len(s.active) < s.limit && i < len(s.waiting); {
+		job := s.waiting[i]
+		if job.background && background >= s.backgroundLimit() {
+			i++
+			continue
+		}
+		if job.background {
+			background++
+		}
+		s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+		job.granted = true
+		job.startedAt = time.Now()
+		s.active[job.id] = job
+		close(job.ready)
+	}
+}
+
+// reject drops a waiter with ErrTranscoderBusy. Callers hold s.mu.
+func (s *transcodeScheduler) reject(job *transcodeJob) {
+	s.remove(job)
+	job.rejected = true
+	s.rejected++
+	close(job.ready)
+}
+
+// remove takes a job out of the queue and the session index. Callers hold s.mu.
+func (s *transcodeScheduler) remove(job *transcodeJob) {
+	for i, w := range s.waiting {
+		if w == job {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			break
+		}
+	}
+	if key := job.sessionKey(); key != "" && s.sessions[key] == job {
+		delete(s.sessions, key)
+	}
+}
+
+// release frees the slot of a finished job and hands it to the next waiter
+func (s *transcodeScheduler) release(job *transcodeJob, cpu time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.active[job.id]; !ok {
+		return
+	}
+	delete(s.active, job.id)
+	s.remove(job)
+	s.completed++
+	s.cpuSeconds += cpu.Seconds()
+	s.dispatch()
+}
+
+// progress records a line of ffmpeg -progress output; it reports whether the line
+// was one, so everything else can be logged as an error
+func (s *transcodeScheduler) progress(job *transcodeJob, line string) bool {
+	key, value, ok := strings.Cut(line, "=")
+	if !ok || strings.ContainsAny(key, " \t") {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch key {
+	case "fps":
+		job.fps, _ = strconv.ParseFloat(value, 64)
+	case "speed":
+		job.speed = strings.TrimSpace(value)
+	}
+	return true
+}
+
+func (s *transcodeScheduler) setPID(job *transcodeJob, pid int) {
+	s.mu.Lock()
+	job.pid = pid
+	s.mu.Unlock()
+}
+
+// stats summarises the scheduler for GetTranscoderStatus
+func (s *transcodeScheduler) stats() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cpu := s.cpuSeconds
+	jobs := make([]map[string]interface{}, 0, len(s.active))
+	for _, job := range s.active {
+		jobCPU := processCPUTime(job.pid).Seconds()
+		cpu += jobCPU
+		jobs = append(jobs, map[string]interface{}{
+			"id":          job.id,
+			"file":        job.file,
+			"quality":     job.quality,
+			"focused":     job.opts.Focused,
+			"background":  job.background,
+			"started_at":  job.startedAt,
+			"queued_ms":   job.startedAt.Sub(job.queuedAt).Milliseconds(),
+			"fps":         job.fps,
+			"speed":       job.speed,
+			"cpu_seconds": jobCPU,
+		})
+	}
+
+	return map[string]interface{}{
+		"max_concurrent": s.limit,
+		"active":         len(s.active),
+		"queued":         len(s.waiting),
+		"completed":      s.completed,
+		"rejected":       s.rejected,
+		"replaced":       s.replaced,
+		"cpu_seconds":    cpu,
+		"jobs":           jobs,
+	}
+}
+
+// processCPUTime reads the user+system CPU time of a running process from /proc.
+// It returns 0 where /proc is unavailable.
+func processCPUTime(pid int) time.Duration {
+	if pid == 0 {
+		return 0
+	}
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	// The command name may contain spaces; fields are counted after its closing paren
+	s := string(data)
+	fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+	if len(fields) < 13 {
+		return 0
+	}
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	return time.Duration(utime+stime) * time.Second / clockTicks
+}
+
+// startScheduledFFmpeg starts ffmpeg for a granted job. Progress goes to the job's
+// stats; other stderr output is logged. stderrDone closes once stderr is drained,
+// which must happen before cmd.Wait.
+func startScheduledFFmpeg(ctx context.Context, job *transcodeJob, args []string, stdout io.Writer) (cmd *exec.Cmd, stderrDone chan struct{}, err error) {
+	args = append([]string{"-progress", "pipe:2", "-nostats"}, args...)
+	cmd = exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdout = stdout
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	scheduler().setPID(job, cmd.Process.Pid)
+
+	stderrDone = make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			if line := scanner.Text(); !scheduler().progress(job, line) {
+				log.Printf("FFmpeg Error: %s", line)
+			}
+		}
+	}()
+	return cmd, stderrDone, nil
+}
+
+// cpuTime returns the CPU time of an exited process
+func cpuTime(cmd *exec.Cmd) time.Duration {
+	if cmd == nil || cmd.ProcessState == nil {
+		return 0
+	}
+	return cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+}
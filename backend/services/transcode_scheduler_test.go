@@ -0,0 +1,215 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// useScheduler installs a scheduler for the duration of a test
+func useScheduler(t *testing.T, limit, queueLength int, timeout time.Duration) *transcodeScheduler {
+	scheduler() // Resolve the sync.Once first so it can't overwrite ours
+	original := transcoder
+	transcoder = newTranscodeScheduler(limit, queueLength, timeout)
+	t.Cleanup(func() { transcoder = original })
+	return transcoder
+}
+
+// acquireAsync starts an acquire and returns a channel with its result
+func acquireAsync(s *transcodeScheduler, ctx context.Context, job *transcodeJob) chan error {
+	result := make(chan error, 1)
+	go func() { result <- s.acquire(ctx, job) }()
+	// Let it reach the queue so arrival order is deterministic
+	time.Sleep(20 * time.Millisecond)
+	return result
+}
+
+func TestTranscodeScheduler_BackgroundLeavesASlot(t *testing.T) {
+	s := useScheduler(t, 2, 8, time.Second)
+
+	first := &transcodeJob{file: "a.mp4", background: true}
+	if err := s.acquire(context.Background(), first); err != nil {
+		t.Fatal(err)
+	}
+	second := &transcodeJob{file: "b.mp4", background: true}
+	secondDone := acquireAsync(s, context.Background(), second)
+	if stats := s.stats(); stats["active"] != 1 || stats["queued"] != 1 {
+		t.Fatalf("Expected the second background job to wait, got %v", stats)
+	}
+
+	// A viewer gets the free slot at once
+	viewer := &transcodeJob{file: "c.mp4"}
+	if err := s.acquire(context.Background(), viewer); err != nil {
+		t.Fatal(err)
+	}
+	s.release(viewer, 0)
+	select {
+	case <-secondDone:
+		t.Fatal("Background jobs took every slot")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	s.release(first, 0)
+	if err := <-secondDone; err != nil {
+		t.Fatal(err)
+	}
+	s.release(second, 0)
+}
+
+func TestTranscodeScheduler_LimitAndPriority(t *testing.T) {
+	s := useScheduler(t, 1, 8, time.Second)
+
+	running := &transcodeJob{file: "a.mp4"}
+	if err := s.acquire(context.Background(), running); err != nil {
+		t.Fatal(err)
+	}
+
+	background := &transcodeJob{file: "back.mp4"}
+	focused := &transcodeJob{file: "front.mp4", opts: TranscodeOptions{Focused: true}}
+	bgDone := acquireAsync(s, context.Background(), background)
+	focusDone := acquireAsync(s, context.Background(), focused)
+
+	if stats := s.stats(); stats["active"] != 1 || stats["queued"] != 2 {
+		t.Fatalf("Expected 1 active and 2 queued, got %v", stats)
+	}
+
+	// The focused camera arrived last but is served first
+	s.release(running, 2*time.Second)
+	if err := <-focusDone; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-bgDone:
+		t.Fatal("Background job started while the slot was taken")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	s.release(focused, time.Second)
+	if err := <-bgDone; err != nil {
+		t.Fatal(err)
+	}
+	s.release(background, 0)
+
+	stats := s.stats()
+	if stats["completed"] != int64(3) || stats["cpu_seconds"] != 3.0 || stats["active"] != 0 {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+}
+
+func TestTranscodeScheduler_BusyWhenQueueFull(t *testing.T) {
+	s := useScheduler(t, 1, 1, time.Second)
+	running := &transcodeJob{file: "a.mp4"}
+	s.acquire(context.Background(), running)
+
+	queued := acquireAsync(s, context.Background(), &transcodeJob{file: "b.mp4"})
+
+	// Queue of one is full: an unfocused newcomer is turned away...
+	if err := s.acquire(context.Background(), &transcodeJob{file: "c.mp4"}); err != ErrTranscoderBusy {
+		t.Errorf("Expected ErrTranscoderBusy, got %v", err)
+	}
+	// ...while a focused one bumps the queued background job
+	focused := acquireAsync(s, context.Background(), &transcodeJob{file: "d.mp4", opts: TranscodeOptions{Focused: true}})
+	if err := <-queued; err != ErrTranscoderBusy {
+		t.Errorf("Expected the background job to be bumped, got %v", err)
+	}
+	if s.stats()["rejected"] != int64(2) {
+		t.Errorf("Unexpected stats %v", s.stats())
+	}
+
+	s.release(running, 0)
+	if err := <-focused; err != nil {
+		t.Errorf("Expected the focused job to get the slot, got %v", err)
+	}
+}
+
+func TestTranscodeScheduler_QueueTimeout(t *testing.T) {
+	s := useScheduler(t, 1, 4, 50*time.Millisecond)
+	s.acquire(context.Background(), &transcodeJob{file: "a.mp4"})
+
+	start := time.Now()
+	if err := s.acquire(context.Background(), &transcodeJob{file: "b.mp4"}); err != ErrTranscoderBusy {
+		t.Errorf("Expected ErrTranscoderBusy after the queue timeout, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond || s.stats()["queued"] != 0 {
+		t.Errorf("Expected the job to wait and then leave the queue: %v", s.stats())
+	}
+
+	// A client going away leaves the queue without counting as rejected
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.acquire(ctx, &transcodeJob{file: "c.mp4"}); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if s.stats()["rejected"] != int64(1) || s.stats()["queued"] != 0 {
+		t.Errorf("Unexpected stats %v", s.stats())
+	}
+}
+
+func TestTranscodeScheduler_SessionReplacesStream(t *testing.T) {
+	s := useScheduler(t, 2, 4, time.Second)
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	defer cancel1()
+	first := &transcodeJob{file: "front.mp4", opts: TranscodeOptions{Session: "tab1"}, cancel: cancel1}
+	if err := s.acquire(ctx1, first); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another file in the same session, or the same file in another session, runs alongside
+	other := &transcodeJob{file: "back.mp4", opts: TranscodeOptions{Session: "tab1"}, cancel: func() { t.Error("Unexpected cancel") }}
+	s.acquire(context.Background(), other)
+	s.release(other, 0)
+
+	// Seeking restarts the same file in the same session: the old stream is stopped
+	_, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	second := &transcodeJob{file: "front.mp4", opts: TranscodeOptions{Session: "tab1"}, cancel: cancel2}
+	if err := s.acquire(context.Background(), second); err != nil {
+		t.Fatal(err)
+	}
+	if ctx1.Err() == nil {
+		t.Error("Expected the replaced stream to be cancelled")
+	}
+	if s.stats()["replaced"] != int64(1) {
+		t.Errorf("Unexpected stats %v", s.stats())
+	}
+
+	// The old stream finishing must not drop the new one from the session index
+	s.release(first, 0)
+	if s.sessions["tab1|front.mp4"] != second {
+		t.Error("Expected the new stream to stay registered for its session")
+	}
+}
+
+func TestTranscodeScheduler_Progress(t *testing.T) {
+	s := useScheduler(t, 1, 1, time.Second)
+	job := &transcodeJob{file: "front.mp4", quality: "720p"}
+	s.acquire(context.Background(), job)
+
+	for _, line := range []string{"frame=120", "fps=87.5", "speed=2.9x"} {
+		if !s.progress(job, line) {
+			t.Errorf("Expected %q to be parsed as progress", line)
+		}
+	}
+	if s.progress(job, "Error while decoding stream #0:0: Invalid data found when processing input") {
+		t.Error("Expected errors to be logged, not parsed")
+	}
+
+	jobs := s.stats()["jobs"].([]map[string]interface{})
+	if len(jobs) != 1 || jobs[0]["fps"] != 87.5 || jobs[0]["speed"] != "2.9x" || jobs[0]["file"] != "front.mp4" {
+		t.Errorf("Unexpected job stats %v", jobs)
+	}
+}
+
+func TestHLSSegment_Busy(t *testing.T) {
+	source, runs := stubHLS(t, VideoInfo{Duration: 60, Height: 960})
+	s := useScheduler(t, 1, 0, 20*time.Millisecond)
+	s.acquire(context.Background(), &transcodeJob{file: "other.mp4"})
+
+	if _, err := HLSSegment(context.Background(), source, "480p", 0, TranscodeOptions{}); err != ErrTranscoderBusy {
+		t.Errorf("Expected ErrTranscoderBusy, got %v", err)
+	}
+	if *runs != 0 {
+		t.Error("Expected no transcode without a slot")
+	}
+}
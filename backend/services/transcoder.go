@@ -1,10 +1,7 @@
 package services
 
 import (
-	"bufio"
-	"context"
 	"fmt"
-	"io"
 	"log"
 	"os/exec"
 	"strings"
@@ -54,42 +51,23 @@ func AutoDetectEncoder() string {
 	return encoder
 }
 
-// GetTranscoderStatus returns a user-friendly status string
+// GetTranscoderStatus returns the encoder, the scheduler queues and the stored proxies
 func GetTranscoderStatus() map[string]interface{} {
 	AutoDetectEncoder()
 	return map[string]interface{}{
 		"encoder":   encoder,
 		"hw_accel":  hasNvenc,
 		"supported": true, // Assume ffmpeg is always present
+		"scheduler": scheduler().stats(),
+		"proxies":   proxyStats(),
 	}
 }
 
-// GetTranscodeStream starts an ffmpeg process to transcode the file and returns the command and stdout pipe
-func GetTranscodeStream(ctx context.Context, inputPath string, quality string) (*exec.Cmd, io.ReadCloser, error) {
-	AutoDetectEncoder()
-
-	q, ok := qualityMap[quality]
-	if !ok {
-		// Default to 480p if invalid quality passed
-		q = qualityMap["480p"]
-	}
-
-	// Construct Args
-	args := []string{
-		"-hide_banner",
-		"-loglevel", "error",
-	}
-
-	// HW Accel for decoding (try CUDA if NVENC is available, else auto)
-	if hasNvenc {
-		args = append(args, "-hwaccel", "cuda")
-	}
-
-	args = append(args, "-i", inputPath)
-
+// transcodeVideoArgs returns the scaling and encoder arguments for a rendition
+func transcodeVideoArgs(q TranscodeQuality) []string {
 	// Video Filter (Scaling)
 	// usage: scale=-2:HEIGHT (maintains aspect ratio, keeps width even)
-	args = append(args, "-vf", fmt.Sprintf("scale=-2:%d", q.Height))
+	args := []string{"-vf", fmt.Sprintf("scale=-2:%d", q.Height)}
 
 	// Encoder settings
 	args = append(args, "-c:v", encoder)
@@ -102,29 +80,5 @@ func GetTranscodeStream(ctx context.Context, inputPath string, quality string) (
 		// CPU specific presets
 		args = append(args, "-preset", "ultrafast")
 	}
-
-	// Output format: fragmented MP4 to stdout
-	args = append(args, "-f", "mp4", "-movflags", "frag_keyframe+empty_moov", "-")
-
-	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, nil, err
-	}
-
-	// Capture stderr for debugging (in a separate goroutine)
-	stderr, _ := cmd.StderrPipe()
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			log.Printf("FFmpeg Error: %s", scanner.Text())
-		}
-	}()
-
-	if err := cmd.Start(); err != nil {
-		return nil, nil, err
-	}
-
-	return cmd, stdout, nil
+	return args
 }
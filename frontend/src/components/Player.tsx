@@ -8,6 +8,7 @@ import { useClickOutside } from '../hooks/useClickOutside';
 const Scene3D = React.lazy(() => import('./Scene3D'));
 
 interface VideoFile {
+  ID: number;
   camera: string;
   file_path: string;
   timestamp: string;
@@ -23,6 +24,7 @@ interface Clip {
 }
 
 interface CameraSegment {
+    id: number; // VideoFile ID, addresses the HLS playlist
     file_path: string;
     timestamp: number; // Unix timestamp in seconds
     startTime: number; // Offset from event start in seconds
@@ -33,6 +35,14 @@ const normalizeCameraName = (name: string) => {
   return name.toLowerCase().replace(/[^a-z0-9]/g, '');
 };
 
+const fileUrl = (path: string) => `/api/video${path}`;
+const hlsUrl = (seg: CameraSegment) => `/api/hls/${seg.id}/master.m3u8`;
+
+// Whether a player's (decoded, query-less) source is this segment, as the original file or as HLS
+const playsSegment = (src: string, seg: CameraSegment) => {
+  return src.endsWith(seg.file_path) || src.endsWith(hlsUrl(seg));
+};
+
 // Bolt: Extracted CameraView to a separate component to fix Hooks violation.
 // This allows `useCallback` to be used correctly at the top level.
 const CameraView = React.memo(({
@@ -55,7 +65,7 @@ const CameraView = React.memo(({
     duration: number,
     quality: string,
     handlePlayerReady: (cam: string, p: any) => void,
-    getUrl: (path: string) => string,
+    getUrl: (seg: CameraSegment) => string,
     onClick: () => void
 }) => {
     // Bolt: Use useCallback to create a STABLE handler for onReady.
@@ -72,9 +82,10 @@ const CameraView = React.memo(({
             {seg ? (
                 <VideoPlayer
                     key={`${clip.ID}-${camName}-${seg.file_path}-${quality}`} // Key forces remount on segment change OR quality change
-                    src={getUrl(seg.file_path)}
+                    src={getUrl(seg)}
                     className="w-full h-full object-contain pointer-events-none"
                     onReady={onReady}
+                    maxHeight={quality === 'original' ? undefined : parseInt(quality, 10)}
                 />
             ) : (
                 <div className="flex items-center justify-center h-full text-gray-600">No {camName}</div>
@@ -155,6 +166,7 @@ const Player: React.FC<{ clip: Clip | null }> = ({ clip }) => {
           const tsSeconds = tsMs / 1000;
 
           grouped[cam].push({
+              id: f.ID,
               file_path: f.file_path,
               timestamp: tsSeconds,
               startTime: 0,
@@ -297,7 +309,7 @@ const Player: React.FC<{ clip: Clip | null }> = ({ clip }) => {
          src = src.split('?')[0];
 
          // Find which segment this player loaded
-         const seg = camSegments.find(s => src.endsWith(s.file_path));
+         const seg = camSegments.find(s => playsSegment(src, s));
          if (seg) {
              const globalTime = currentTimeRef.current;
              const localTime = globalTime - seg.startTime;
@@ -326,7 +338,7 @@ const Player: React.FC<{ clip: Clip | null }> = ({ clip }) => {
              // Remove query params for matching
              src = src.split('?')[0];
 
-             const idx = camSegments.findIndex(s => src.endsWith(s.file_path));
+             const idx = camSegments.findIndex(s => playsSegment(src, s));
              if (idx !== -1 && idx < camSegments.length - 1) {
                  // Advance to next segment
                  const nextSeg = camSegments[idx+1];
@@ -346,7 +358,7 @@ const Player: React.FC<{ clip: Clip | null }> = ({ clip }) => {
             // Remove query params
             src = src.split('?')[0];
 
-            const seg = camSegments.find(s => src.endsWith(s.file_path));
+            const seg = camSegments.find(s => playsSegment(src, s));
             if (seg) {
                 const global = seg.startTime + player.currentTime();
                 if (Math.abs(global - currentTimeRef.current) > 0.1) {
@@ -431,7 +443,7 @@ const Player: React.FC<{ clip: Clip | null }> = ({ clip }) => {
                    try { src = decodeURIComponent(src); } catch (e) {}
                    src = src.split('?')[0];
 
-                   if (src && src.endsWith(info.segment.file_path)) {
+                   if (src && playsSegment(src, info.segment)) {
                        const localTime = newTime - info.segment.startTime;
                        // Only seek if difference is significant to avoid stutter
                        if (Math.abs(p.currentTime() - localTime) > 0.5) {
@@ -482,12 +494,9 @@ const Player: React.FC<{ clip: Clip | null }> = ({ clip }) => {
     return () => window.removeEventListener('keydown', handleKeyDown);
   }, [togglePlay, handleSeek]);
 
-  const getUrl = useCallback((path: string) => {
-    let url = `/api/video${path}`;
-    if (quality !== 'original') {
-        url += `?quality=${quality}`;
-    }
-    return url;
+  // Lower qualities play the HLS renditions, transcoded per segment on the server
+  const getUrl = useCallback((seg: CameraSegment) => {
+    return quality === 'original' ? fileUrl(seg.file_path) : hlsUrl(seg);
   }, [quality]);
 
   // Helper to get current segment for a camera
@@ -571,12 +580,12 @@ const Player: React.FC<{ clip: Clip | null }> = ({ clip }) => {
              <div className="flex-1 relative">
                  <Suspense fallback={<div className="flex items-center justify-center h-full text-white">Loading 3D...</div>}>
                      <Scene3D
-                        frontSrc={getCurrentSegment('Front')?.file_path ? getUrl(getCurrentSegment('Front')!.file_path) : ''}
-                        leftRepeaterSrc={getCurrentSegment('Left Repeater')?.file_path ? getUrl(getCurrentSegment('Left Repeater')!.file_path) : ''}
-                        rightRepeaterSrc={getCurrentSegment('Right Repeater')?.file_path ? getUrl(getCurrentSegment('Right Repeater')!.file_path) : ''}
-                        backSrc={getCurrentSegment('Back')?.file_path ? getUrl(getCurrentSegment('Back')!.file_path) : ''}
-                        leftPillarSrc={getCurrentSegment('Left Pillar')?.file_path ? getUrl(getCurrentSegment('Left Pillar')!.file_path) : ''}
-                        rightPillarSrc={getCurrentSegment('Right Pillar')?.file_path ? getUrl(getCurrentSegment('Right Pillar')!.file_path) : ''}
+                        frontSrc={getCurrentSegment('Front')?.file_path ? fileUrl(getCurrentSegment('Front')!.file_path) : ''}
+                        leftRepeaterSrc={getCurrentSegment('Left Repeater')?.file_path ? fileUrl(getCurrentSegment('Left Repeater')!.file_path) : ''}
+                        rightRepeaterSrc={getCurrentSegment('Right Repeater')?.file_path ? fileUrl(getCurrentSegment('Right Repeater')!.file_path) : ''}
+                        backSrc={getCurrentSegment('Back')?.file_path ? fileUrl(getCurrentSegment('Back')!.file_path) : ''}
+                        leftPillarSrc={getCurrentSegment('Left Pillar')?.file_path ? fileUrl(getCurrentSegment('Left Pillar')!.file_path) : ''}
+                        rightPillarSrc={getCurrentSegment('Right Pillar')?.file_path ? fileUrl(getCurrentSegment('Right Pillar')!.file_path) : ''}
                         onVideoReady={handlePlayerReady}
                      />
                  </Suspense>
@@ -7,11 +7,15 @@ interface VideoPlayerProps {
   className?: string;
   onReady?: (player: any) => void;
   options?: any;
+  maxHeight?: number; // Highest HLS rendition to play, e.g. 720
 }
 
+// video.js plays HLS playlists through its bundled http-streaming (VHS) in every browser
+const sourceType = (src: string) => src.split('?')[0].endsWith('.m3u8') ? 'application/x-mpegURL' : 'video/mp4';
+
 // Bolt: Memoized to prevent re-renders when parent (Player) updates (e.g. currentTime changes).
 // Since onReady is now stable (from Player), and src/options are stable, this avoids 60Hz re-renders.
-const VideoPlayer: React.FC<VideoPlayerProps> = React.memo(({ src, className, onReady, options }) => {
+const VideoPlayer: React.FC<VideoPlayerProps> = React.memo(({ src, className, onReady, options, maxHeight }) => {
   const videoRef = useRef<HTMLDivElement>(null);
   const playerRef = useRef<any>(null);
   const currentSrcRef = useRef<string | null>(null);
@@ -36,7 +40,7 @@ const VideoPlayer: React.FC<VideoPlayerProps> = React.memo(({ src, className, on
         preload: 'auto',
         sources: [{
           src: src,
-          type: 'video/mp4'
+          type: sourceType(src)
         }]
       }, () => {
         onReady && onReady(player);
@@ -51,7 +55,7 @@ const VideoPlayer: React.FC<VideoPlayerProps> = React.memo(({ src, className, on
       const player = playerRef.current;
       // Only update src if it has actually changed
       if (currentSrcRef.current !== src) {
-        player.src({ src: src, type: 'video/mp4' });
+        player.src({ src: src, type: sourceType(src) });
         currentSrcRef.current = src;
       }
     }
@@ -59,6 +63,21 @@ const VideoPlayer: React.FC<VideoPlayerProps> = React.memo(({ src, className, on
     // Updating it has no effect on an existing player, so we shouldn't trigger the effect.
   }, [src, options]);
 
+  // Keep adaptive streaming to renditions at or below the chosen quality
+  useEffect(() => {
+    const player = playerRef.current;
+    if (!player || !maxHeight) return;
+    const limit = () => {
+      const vhs = player.tech({ IWillNotUseThisInPlugins: true })?.vhs;
+      const reps = vhs?.representations?.() || [];
+      const allowed = reps.filter((r: any) => r.height <= maxHeight);
+      // If none fits, leave every rendition to the adaptive logic
+      reps.forEach((r: any) => r.enabled(allowed.length === 0 || allowed.includes(r)));
+    };
+    player.on('loadedmetadata', limit);
+    return () => { player.off('loadedmetadata', limit); };
+  }, [maxHeight]);
+
   useEffect(() => {
     return () => {
       if (playerRef.current && !playerRef.current.isDisposed()) {